@@ -0,0 +1,30 @@
+// Package buffer reuses the buffers that connections read into, so that one
+// isn't allocated for every connection. Both gq-client and gq-server use it
+package buffer
+
+import "sync"
+
+// The pools of buffers of each size that has been asked for. There are only ever
+// a few, as they come from the config
+var pools sync.Map
+
+// Get returns a buffer of size bytes, reusing one given back with Put if there
+// is one. Its content is whatever was left in it
+func Get(size int) []byte {
+	p, ok := pools.Load(size)
+	if !ok {
+		p, _ = pools.LoadOrStore(size, &sync.Pool{New: func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		}})
+	}
+	return *p.(*sync.Pool).Get().(*[]byte)
+}
+
+// Put gives back a buffer from Get once nothing refers to it anymore
+func Put(buf []byte) {
+	buf = buf[:cap(buf)]
+	if p, ok := pools.Load(len(buf)); ok {
+		p.(*sync.Pool).Put(&buf)
+	}
+}
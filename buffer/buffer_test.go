@@ -0,0 +1,34 @@
+package buffer
+
+import "testing"
+
+func TestPool(t *testing.T) {
+	buf := Get(1234)
+	if len(buf) != 1234 {
+		t.Error("For", "Get(1234)", "expected", 1234, "got", len(buf))
+	}
+	Put(buf[:10])
+	if buf = Get(1234); len(buf) != 1234 {
+		t.Error("For", "a buffer given back cut short", "expected", 1234, "got", len(buf))
+	}
+	// One that didn't come from a pool is dropped
+	Put(make([]byte, 4321))
+}
+
+// Keeps the buffers of the benchmarks on the heap, like those of a connection
+var benchmarkBuffer []byte
+
+func BenchmarkMake(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		benchmarkBuffer = make([]byte, 20480)
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		benchmarkBuffer = Get(20480)
+		Put(benchmarkBuffer)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+	// Number of failed Accepts in a row at maxAcceptBackoff before the listener
+	// is thought to be broken and is made again
+	maxAcceptFailures = 10
+)
+
+// acceptLoop accepts connections from listener and hands them to handle.
+// Temporary errors, like running out of file descriptors, are retried with an
+// increasing delay instead of spinning. The listener is closed and made again
+// with listen if Accept returns a permanent error or keeps failing. It returns
+// once upgrade has handed the listener over
+func acceptLoop(listener net.Listener, listen func() (net.Listener, error), handle func(net.Conn)) {
+	setSSListener(listener)
+	backoff := time.Duration(0)
+	failures := 0
+	for {
+		conn, err := listener.Accept()
+		if err == nil {
+			backoff = 0
+			failures = 0
+			handle(conn)
+			continue
+		}
+		if atomic.LoadInt32(&upgraded) == 1 {
+			// The listener has been handed to a new gq-client
+			return
+		}
+
+		if ne, ok := err.(net.Error); ok && ne.Temporary() && failures < maxAcceptFailures {
+			if backoff == 0 {
+				backoff = minAcceptBackoff
+			} else if backoff *= 2; backoff >= maxAcceptBackoff {
+				backoff = maxAcceptBackoff
+				failures++
+			}
+			log.Printf("Accepting connection: %v, retrying in %v\n", err, backoff)
+			time.Sleep(backoff)
+			continue
+		}
+
+		log.Printf("Accepting connection: %v, listening again\n", err)
+		listener.Close()
+		backoff = minAcceptBackoff
+		for {
+			listener, err = listen()
+			if err == nil {
+				break
+			}
+			log.Printf("Listening again: %v, retrying in %v\n", err, backoff)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxAcceptBackoff {
+				backoff = maxAcceptBackoff
+			}
+		}
+		setSSListener(listener)
+		backoff = 0
+		failures = 0
+	}
+}
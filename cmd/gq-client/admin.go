@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+)
+
+// 1 while draining, when connections from SS are closed as soon as they're accepted.
+// Accessed atomically
+var draining int32
+
+// serveAdmin listens for admin commands on the UNIX socket at path. Any file
+// already at path is removed first, e.g. one left behind by a crash
+func serveAdmin(path string, config string) {
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		log.Fatalf("Listening on AdminSocket: %v\n", err)
+	}
+	// Only the user running gq-client can connect
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		log.Fatalf("Listening on AdminSocket: %v\n", err)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Accepting admin connection: %v\n", err)
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				fmt.Fprintln(conn, adminCommand(scanner.Text(), config))
+			}
+		}()
+	}
+}
+
+// adminCommand runs one line from the admin socket and returns the response
+func adminCommand(line string, config string) string {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return "error: empty command"
+	}
+	switch args[0] {
+	case "stats":
+		stats := []string{
+			fmt.Sprintf("active_connections %v", tracker.Len()),
+			fmt.Sprintf("draining %v", atomic.LoadInt32(&draining) == 1),
+			fmt.Sprintf("goroutines %v", runtime.NumGoroutine()),
+		}
+		if fds, ok := gqclient.OpenFDs(); ok {
+			stats = append(stats, fmt.Sprintf("open_fds %v", fds))
+		}
+		failures := metrics.HandshakeFailures()
+		var stages []string
+		for stage := range failures {
+			stages = append(stages, stage)
+		}
+		sort.Strings(stages)
+		for _, stage := range stages {
+			stats = append(stats, fmt.Sprintf("handshake_failures %v %v", stage, failures[stage]))
+		}
+		return strings.Join(stats, "\n")
+	case "drain":
+		atomic.StoreInt32(&draining, 1)
+		log.Println("Draining, new connections are refused")
+		return "ok"
+	case "undrain":
+		atomic.StoreInt32(&draining, 0)
+		log.Println("No longer draining")
+		return "ok"
+	case "reload":
+		err := reload(config)
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return "ok"
+	case "upgrade":
+		err := upgrade()
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return "ok"
+	case "set-log-level":
+		if len(args) != 2 || (args[1] != "info" && args[1] != "debug") {
+			return "error: usage: set-log-level info|debug"
+		}
+		setLogLevel(args[1])
+		return "ok"
+	default:
+		return "error: unknown command " + args[0]
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+)
+
+// The sink of audit records, nil if AuditFile isn't set
+var auditLog *auditWriter
+
+type auditWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func openAuditLog(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	auditLog = &auditWriter{w: f}
+	return nil
+}
+
+// auditEntry is one line of the audit log
+type auditEntry struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Source    string    `json:"source"`
+	Remote    string    `json:"remote"`
+	Label     string    `json:"label,omitempty"`
+	Browser   string    `json:"browser"`
+	Handshake string    `json:"handshake"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+	Reason    string    `json:"close_reason"`
+	// The histogram of record sizes from the remote, if LogRecordSizes is set
+	RecordSizes string `json:"record_sizes,omitempty"`
+}
+
+// auditRecord is what happened to one connection from SS. It's filled in as the
+// connection goes and written to the audit log once it's closed. All methods do
+// nothing on a nil *auditRecord so that callers don't need to check whether
+// auditing is on
+type auditRecord struct {
+	mu    sync.Mutex
+	entry auditEntry
+	once  sync.Once
+}
+
+func newAuditRecord(ss net.Conn, label string) *auditRecord {
+	if auditLog == nil {
+		return nil
+	}
+	return &auditRecord{entry: auditEntry{
+		Start:  time.Now(),
+		Source: ss.RemoteAddr().String(),
+		Label:  label,
+	}}
+}
+
+func (r *auditRecord) setRemote(addr string, browser string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.entry.Remote = addr
+	r.entry.Browser = browser
+	r.mu.Unlock()
+}
+
+// closing records why the connection is being closed. Only the first reason is kept
+func (r *auditRecord) closing(reason string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	if r.entry.Reason == "" {
+		r.entry.Reason = reason
+	}
+	r.mu.Unlock()
+}
+
+func (r *auditRecord) setRecordSizes(sizes string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.entry.RecordSizes = sizes
+	r.mu.Unlock()
+}
+
+// handshakeFailed finishes the record of a connection whose handshake failed at stage
+func (r *auditRecord) handshakeFailed(stage string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.entry.Handshake = stage
+	r.mu.Unlock()
+	r.closing("handshake failed")
+	r.finish(gqclient.ConnStats{})
+}
+
+// finish writes the record to the audit log with the byte counts in stats. Only
+// the first call does anything
+func (r *auditRecord) finish(stats gqclient.ConnStats) {
+	if r == nil {
+		return
+	}
+	r.once.Do(func() {
+		r.mu.Lock()
+		e := r.entry
+		r.mu.Unlock()
+		e.End = time.Now()
+		e.BytesUp = stats.BytesUp
+		e.BytesDown = stats.BytesDown
+		if e.Handshake == "" {
+			e.Handshake = "ok"
+		}
+		line, _ := json.Marshal(e)
+		auditLog.mu.Lock()
+		auditLog.w.Write(append(line, '\n'))
+		auditLog.mu.Unlock()
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The sizes of record AutoMTU searches between. Records of autoMTUMin bytes are
+// taken to get through anywhere
+const (
+	autoMTUMin = 256
+	autoMTUMax = 16384
+)
+
+// The search stops once the largest record that gets through is known to within
+// this many bytes
+const autoMTUStep = 64
+
+// How long a size found for a remote is used for, after which it's searched for
+// again in case the network has changed
+const autoMTUCacheTTL = 10 * time.Minute
+
+// mtuSearch is AutoMTU's binary search, over the records of one connection, for
+// the largest record that gets to the remote without stalling
+type mtuSearch struct {
+	mu     sync.Mutex
+	remote string
+	// Records of lo bytes get through, and ones of more than hi stall
+	lo, hi int
+	// The size being tried
+	try  int
+	done bool
+}
+
+// newMTUSearch starts a search for records to remote of at most max bytes, from
+// the size last found for it if there is one
+func newMTUSearch(remote string, max int) *mtuSearch {
+	s := &mtuSearch{remote: remote, lo: autoMTUMin, hi: max}
+	if size, ok := autoMTUCache.get(remote); ok && size < max {
+		s.hi = size
+	}
+	if s.hi < s.lo {
+		s.lo = s.hi
+	}
+	s.try = s.hi
+	s.done = s.hi-s.lo < autoMTUStep
+	return s
+}
+
+// size returns the most to put in a record for now
+func (s *mtuSearch) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return s.lo
+	}
+	return s.try
+}
+
+// untested reports whether a record of size bytes would tell the search anything
+func (s *mtuSearch) untested(size int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.done && size > s.lo
+}
+
+// result narrows the search with a record of size bytes that stalled or got
+// through, and returns the size to try next and whether the search is over
+func (s *mtuSearch) result(size int, stalled bool) (next int, done bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return s.lo, true
+	}
+	if stalled && size-1 < s.hi {
+		s.hi = size - 1
+	} else if !stalled && size > s.lo {
+		s.lo = size
+	}
+	if s.hi < s.lo {
+		// Even the smallest records stall, nothing smaller would be better
+		s.hi = s.lo
+	}
+	if s.hi-s.lo < autoMTUStep {
+		s.done = true
+		autoMTUCache.put(s.remote, s.lo)
+		return s.lo, true
+	}
+	if s.try <= s.lo || s.try > s.hi {
+		s.try = (s.lo + s.hi + 1) / 2
+	}
+	return s.try, false
+}
+
+type cachedMTU struct {
+	size  int
+	found time.Time
+}
+
+// mtuCache keeps the sizes AutoMTU has found for each remote
+type mtuCache struct {
+	sync.Mutex
+	sizes map[string]cachedMTU
+}
+
+var autoMTUCache = &mtuCache{sizes: make(map[string]cachedMTU)}
+
+func (c *mtuCache) get(remote string) (int, bool) {
+	c.Lock()
+	defer c.Unlock()
+	cached, ok := c.sizes[remote]
+	if !ok || time.Since(cached.found) > autoMTUCacheTTL {
+		delete(c.sizes, remote)
+		return 0, false
+	}
+	return cached.size, true
+}
+
+func (c *mtuCache) put(remote string, size int) {
+	c.Lock()
+	c.sizes[remote] = cachedMTU{size, time.Now()}
+	c.Unlock()
+}
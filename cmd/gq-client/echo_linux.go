@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// disableEcho stops the terminal f from showing what's typed, and returns what
+// turns it back on. It does nothing if f isn't a terminal
+func disableEcho(f *os.File) (restore func()) {
+	var old syscall.Termios
+	fd := f.Fd()
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&old))); errno != 0 {
+		return func() {}
+	}
+	noEcho := old
+	noEcho.Lflag &^= syscall.ECHO
+	syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&noEcho)))
+	return func() {
+		syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&old)))
+	}
+}
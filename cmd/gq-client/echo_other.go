@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+// disableEcho would stop the terminal f from showing what's typed. It's only done
+// on Linux, elsewhere the passphrase shows as it's typed
+func disableEcho(f *os.File) (restore func()) {
+	return func() {}
+}
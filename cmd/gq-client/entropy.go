@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+)
+
+// waitForEntropy waits until cryptographically secure random bytes can be read,
+// because Opaque and every handshake are made from them. Routers can take a while
+// to gather enough entropy after boot
+func waitForEntropy() {
+	backoff := time.Second
+	for {
+		done := make(chan error, 1)
+		go func() {
+			done <- gqclient.CheckEntropy()
+		}()
+		var err error
+		select {
+		case err = <-done:
+		case <-time.After(time.Second):
+			log.Println("Waiting for the system to gather entropy")
+			err = <-done
+		}
+		if err == nil {
+			return
+		}
+		log.Printf("Reading random bytes: %v. Waiting for entropy, retrying in %v\n", err, backoff)
+		time.Sleep(backoff)
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
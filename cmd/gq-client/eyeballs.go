@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+)
+
+// How long the IPv6 connection is given before an IPv4 one is raced against it,
+// the Connection Attempt Delay recommended by RFC 8305
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// dialHappyEyeballs connects to addr like RFC 8305: if its host has both IPv6 and
+// IPv4 addresses, the first IPv6 one is dialed, and the first IPv4 one too if that
+// hasn't connected after happyEyeballsDelay or has failed. Whichever connects first
+// is used and the other is closed. Only one address of each family is tried.
+//
+// If addr is an IP and one of RemoteServers, the nearest of those of the other
+// family is raced against it the same way, so a server whose IPv6 or IPv4 is
+// blocked doesn't hold things up. Which one was connected to is in the RemoteAddr
+// of the connection
+func dialHappyEyeballs(sta *gqclient.State, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		other, ok := "", false
+		if sta.ServerPool != nil && sta.Dialer == nil {
+			other, ok = sta.ServerPool.BestOfOtherFamily(addr)
+		}
+		switch {
+		case !ok:
+			return dialWith(sta, addr, false, nil)
+		case ip.To4() == nil:
+			return raceFamilies(sta, addr, other)
+		}
+		return raceFamilies(sta, other, addr)
+	}
+	ips, err := lookupHost(sta, host)
+	if err != nil {
+		return nil, err
+	}
+	var v6, v4 net.IP
+	for _, ip := range ips {
+		if ip.To4() == nil && v6 == nil {
+			v6 = ip
+		} else if ip.To4() != nil && v4 == nil {
+			v4 = ip
+		}
+	}
+	switch {
+	case v6 == nil && v4 == nil:
+		return nil, errors.New("No address found for " + host)
+	case v4 == nil:
+		return dialWith(sta, net.JoinHostPort(v6.String(), port), false, nil)
+	case v6 == nil:
+		return dialWith(sta, net.JoinHostPort(v4.String(), port), false, nil)
+	}
+	return raceFamilies(sta, net.JoinHostPort(v6.String(), port), net.JoinHostPort(v4.String(), port))
+}
+
+// raceFamilies dials v6, and v4 too once v6 hasn't connected after
+// happyEyeballsDelay or has failed, returning whichever connects first
+func raceFamilies(sta *gqclient.State, v6 string, v4 string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 2)
+	start := func(addr string) {
+		go func() {
+			conn, err := dialWith(sta, addr, false, nil)
+			results <- result{conn, err}
+		}()
+	}
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+
+	start(v6)
+	started, pending := 1, 1
+	startV4 := func() {
+		if started == 1 {
+			debugf("IPv6 connection to %v not made yet, trying IPv4 to %v\n", v6, v4)
+			start(v4)
+			started++
+			pending++
+		}
+	}
+	var r result
+	for {
+		select {
+		case <-timer.C:
+			startV4()
+			continue
+		case r = <-results:
+			pending--
+		}
+		if r.err == nil {
+			if pending != 0 {
+				go func() {
+					if other := <-results; other.err == nil {
+						other.conn.Close()
+					}
+				}()
+			}
+			return r.conn, nil
+		}
+		if started == 1 {
+			startV4()
+		} else if pending == 0 {
+			return nil, r.err
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+)
+
+// writeNew writes content into a new file at path. It fails rather than
+// overwrite an existing config
+func writeNew(path string, content []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(content, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// genConfig writes a gqclient.json and a matching gqserver.json into the current directory
+func genConfig(serverName string, webServerAddr string) error {
+	client, server, err := gqclient.GenerateConfigs(serverName, webServerAddr)
+	if err != nil {
+		return err
+	}
+	err = writeNew("gqclient.json", client)
+	if err != nil {
+		return err
+	}
+	err = writeNew("gqserver.json", server)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Written gqclient.json and gqserver.json. Copy gqserver.json to your server")
+	return nil
+}
@@ -1,25 +1,57 @@
-// +build go1.8,!go1.10
-
 package main
 
 import (
+	"crypto/md5"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/cbeuw/GoQuiet/buffer"
+	"github.com/cbeuw/GoQuiet/deflate"
 	"github.com/cbeuw/GoQuiet/gqclient"
 	"github.com/cbeuw/GoQuiet/gqclient/TLS"
-	"github.com/cbeuw/gotfo"
+	"github.com/cbeuw/GoQuiet/idle"
+	"github.com/cbeuw/GoQuiet/tfo"
 )
 
 var version string
 
 // ss refers to the ss-client, remote refers to the proxy server
 
+// dialRemote connects to the proxy server, sending data in the SYN if fastOpen
+// is true. It's a variable so that tests can replace the network with a fake server
+var dialRemote = func(addr string, fastOpen bool, data []byte) (net.Conn, error) {
+	return tfo.Dial(addr, fastOpen, data)
+}
+
+// dialWith connects to the proxy server at addr with the Dialer of sta, or through
+// dialRemote if it has none. A Dialer resolves addr itself, can't send data in the
+// SYN and the sockets it makes don't get the fd callbacks
+func dialWith(sta *gqclient.State, addr string, fastOpen bool, data []byte) (net.Conn, error) {
+	if sta.Dialer == nil {
+		addr, err := resolveAddr(sta, addr)
+		if err != nil {
+			return nil, err
+		}
+		return dialRemote(addr, fastOpen, data)
+	}
+	return sta.Dialer("tcp", addr)
+}
+
+// The connections relaying data
+var tracker = gqclient.NewConnTracker()
+
+var metrics = &gqclient.Metrics{Tracker: tracker}
+
 type pipe interface {
 	remoteToSS()
 	ssToRemote()
@@ -27,119 +59,1013 @@ type pipe interface {
 }
 
 type pair struct {
-	ss     net.Conn
-	remote net.Conn
+	// Bytes of SS data relayed in both directions. Accessed atomically,
+	// and first in the struct so that it's 64-bit aligned on 32-bit platforms
+	relayed  int64
+	maxBytes int64
+	ss       net.Conn
+	remote   net.Conn
+	lifetime *time.Timer
+	compress bool
+	linger   time.Duration
+	// Set to 1 atomically once SS has closed and the remote is lingering
+	lingering int32
+	// Set to 1 atomically by closePipe
+	closed int32
+	// The directions that have ended with EOF. Accessed atomically
+	halfClosed int32
+	audit      *auditRecord
+	trace      *connTrace
+	autoTune   bool
+	strict     bool
+	// MaxRecordSize, if set
+	maxRecord int
+	// RecordSizing, and with it browser the sizes of the first records
+	sizing       string
+	firstRecords []int
+	// UpBufferSize and DownBufferSize, 0 for the defaults
+	upBuf   int
+	downBuf int
+	// Sizes of the records from the remote, nil unless LogRecordSizes is set
+	recordSizes *gqclient.RecordSizes
+	tracked     *gqclient.TrackedConn
+	// BlackHoleTimeout and BlackHoleRecordSize
+	blackHole       time.Duration
+	blackHoleRecord int
+	// Set to 1 atomically while a stall check is waiting, and to 2 once a stall
+	// has been found, after which there are no more checks
+	stallCheck int32
+	// The most data put in a record once a stall has been found or while AutoMTU
+	// is searching. Accessed atomically
+	shrunk int32
+	// AutoMTU's search, nil unless it's set
+	mtu *mtuSearch
+	// The Label of the listener it was accepted on
+	label string
+	// Closes the pair once IdleTimeout has passed without data, nil without it
+	idle *idle.Timer
+	// Called once the pair is closed, so that it no longer counts towards
+	// MaxConnections
+	release func()
+}
+
+// labelled puts label, if there is one, in front of the log format of a
+// connection, so that the logs of each label can be told apart
+func labelled(label string, format string) string {
+	if label == "" {
+		return format
+	}
+	return "[" + label + "] " + format
 }
 
 func (p *pair) closePipe() {
-	go p.ss.Close()
-	go p.remote.Close()
+	if atomic.SwapInt32(&p.closed, 1) == 0 {
+		if p.recordSizes != nil {
+			sizes := p.recordSizes.String()
+			log.Printf(labelled(p.label, "Sizes of records from %v: %v\n"), p.remote.RemoteAddr(), sizes)
+			p.audit.setRecordSizes(sizes)
+		}
+		if p.release != nil {
+			p.release()
+		}
+	}
+	p.tracked.Remove()
+	if p.lifetime != nil {
+		p.lifetime.Stop()
+	}
+	p.idle.Stop()
+	p.audit.finish(p.tracked.Stats())
+	p.trace.finish(p.tracked.Stats().ID)
+	// Close doesn't block since SO_LINGER is never set, so there's no need for
+	// goroutines that would pile up when many connections close at once
+	p.ss.Close()
+	p.remote.Close()
+}
+
+// closeFor closes the pair and records the reason in the audit log
+func (p *pair) closeFor(reason string) {
+	p.audit.closing(reason)
+	p.closePipe()
+}
+
+// halfClose is called when a direction of the pair has ended with EOF: to, the
+// connection it was writing to, is half-closed so that the other direction carries
+// on, e.g. with the response to a request that has been sent. The pair is closed
+// once both directions have ended, or straight away if to can't be half-closed
+func (p *pair) halfClose(to net.Conn) {
+	if !gqclient.CloseWrite(to) || atomic.AddInt32(&p.halfClosed, 1) == 2 {
+		p.closePipe()
+	}
 }
 
+// lingerClose is called when SS closes the connection. Browsers keep idle connections
+// open for a while after the last request, so the remote connection is closed
+// after a random time between half of LingerAfterClose and LingerAfterClose
+func (p *pair) lingerClose() {
+	p.audit.closing("ss closed")
+	if p.linger == 0 {
+		// ss-local may only have closed its writing side
+		p.halfClose(p.remote)
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&p.lingering, 0, 1) {
+		return
+	}
+	p.ss.Close()
+	wait := p.linger/2 + time.Duration(rand.Int63n(int64(p.linger/2)+1))
+	time.AfterFunc(wait, p.closePipe)
+}
+
+// connJitter returns how long to wait before connecting to the server, a random time
+// of up to maxMs milliseconds, so that connections SS makes at the same time don't
+// all make their handshakes at the same instant
+func connJitter(maxMs int) time.Duration {
+	return time.Duration(rand.Int63n(int64(time.Duration(maxMs)*time.Millisecond) + 1))
+}
+
+// replyDelay returns how long to wait before sending the reply to the server, a
+// random time between half of maxMs and maxMs milliseconds, like the time a
+// browser takes to process the server's messages before sending its Finished
+func replyDelay(maxMs int) time.Duration {
+	max := time.Duration(maxMs) * time.Millisecond
+	return max/2 + time.Duration(rand.Int63n(int64(max/2)+1))
+}
+
+// Records carrying more data than this may not fit in one packet on a link with a
+// small MTU, so they're the ones a stall is looked for after
+const blackHoleProbeSize = 1200
+
+// sendStalled is a variable so that tests can fake a stalled connection
+var sendStalled = gqclient.SendStalled
+
+// watchesRecord reports whether watchStall should check on a record of size bytes
+func (p *pair) watchesRecord(size int) bool {
+	if p.blackHole == 0 {
+		return false
+	}
+	if p.mtu != nil {
+		return p.mtu.untested(size)
+	}
+	return size > blackHoleProbeSize
+}
+
+// watchStall checks, blackHole after a large record of size bytes was sent to the
+// remote, whether the kernel is still retransmitting it without any ACK. With the
+// handshake done this is most likely a PMTUD black hole dropping the large packets,
+// which makes the connection hang without an error. Only the first stall of a pair
+// is reported. With AutoMTU each check is a step of its search instead
+func (p *pair) watchStall(size int) {
+	if !atomic.CompareAndSwapInt32(&p.stallCheck, 0, 1) {
+		return
+	}
+	time.AfterFunc(p.blackHole, func() {
+		stalled, ok := sendStalled(p.remote)
+		if ok && p.mtu != nil && atomic.LoadInt32(&p.closed) == 0 {
+			p.mtuStep(size, stalled)
+			return
+		}
+		if !ok || !stalled || atomic.LoadInt32(&p.closed) == 1 {
+			atomic.StoreInt32(&p.stallCheck, 0)
+			return
+		}
+		atomic.StoreInt32(&p.stallCheck, 2)
+		throttledf(labelled(p.label, "Data sent to %v hasn't been acknowledged for %v: possible PMTUD black hole, try a smaller MaxRecordSize or MTU\n"), p.remote.RemoteAddr(), p.blackHole)
+		if p.blackHoleRecord != 0 {
+			p.setRecordCap(p.blackHoleRecord)
+		}
+	})
+}
+
+// mtuStep moves AutoMTU's search on with a record of size bytes that stalled or
+// got through, and sizes the records that follow by it
+func (p *pair) mtuStep(size int, stalled bool) {
+	next, done := p.mtu.result(size, stalled)
+	if stalled {
+		debugf(labelled(p.label, "AutoMTU: a record of %v bytes to %v stalled, trying %v\n"), size, p.remote.RemoteAddr(), next)
+	}
+	if done {
+		debugf(labelled(p.label, "AutoMTU: records to %v are of at most %v bytes\n"), p.remote.RemoteAddr(), next)
+	}
+	p.setRecordCap(next)
+	switch {
+	case done:
+		atomic.StoreInt32(&p.stallCheck, 2)
+	case stalled:
+		p.waitUnstalled()
+	default:
+		atomic.StoreInt32(&p.stallCheck, 0)
+	}
+}
+
+// waitUnstalled holds off the next check of AutoMTU until what stalled has got
+// through, as until then any record sent after it would look stalled too
+func (p *pair) waitUnstalled() {
+	time.AfterFunc(p.blackHole, func() {
+		stalled, ok := sendStalled(p.remote)
+		if ok && stalled && atomic.LoadInt32(&p.closed) == 0 {
+			p.waitUnstalled()
+			return
+		}
+		atomic.StoreInt32(&p.stallCheck, 0)
+	})
+}
+
+// setRecordCap makes the records that follow carry at most size bytes
+func (p *pair) setRecordCap(size int) {
+	if p.compress {
+		size--
+	}
+	atomic.StoreInt32(&p.shrunk, int32(size))
+}
+
+// count adds n to the bytes relayed. It returns false if MaxBytesPerConn has been
+// reached, in which case the pair should be closed
+func (p *pair) count(n int) bool {
+	if p.maxBytes == 0 {
+		return true
+	}
+	total := atomic.AddInt64(&p.relayed, int64(n))
+	if total < p.maxBytes {
+		return true
+	}
+	if total-int64(n) < p.maxBytes {
+		log.Printf(labelled(p.label, "Connection reached MaxBytesPerConn of %v bytes, closing\n"), p.maxBytes)
+	}
+	return false
+}
+
+// The default sizes of the buffers reads from SS and records from the remote go into
+const (
+	defaultUpBufferSize   = 10240
+	defaultDownBufferSize = 20480
+)
+
 func (p *pair) remoteToSS() {
-	buf := make([]byte, 20480)
+	size := defaultDownBufferSize
+	if p.downBuf != 0 {
+		size = p.downBuf
+	}
+	buf := buffer.Get(size)
+	defer buffer.Put(buf)
 	for {
 		i, err := gqclient.ReadTillDrain(p.remote, buf)
 		if err != nil {
-			p.closePipe()
+			// Errors from closing it ourselves aren't anomalies
+			if p.strict && err != io.EOF && atomic.LoadInt32(&p.closed) == 0 {
+				throttledf(labelled(p.label, "Strict record validation: reading from remote: %v\n"), err)
+			}
+			p.audit.closing("remote closed")
+			if err == io.EOF && atomic.LoadInt32(&p.lingering) == 0 {
+				p.halfClose(p.ss)
+			} else {
+				p.closePipe()
+			}
 			return
 		}
+		if p.strict {
+			if err = TLS.ValidateRecord(buf[:i]); err != nil {
+				throttledf(labelled(p.label, "Strict record validation: %v, closing\n"), err)
+				p.closeFor("invalid record")
+				return
+			}
+		}
+		p.idle.Active()
+		if p.recordSizes != nil {
+			p.recordSizes.Add(i - 5)
+		}
+		p.trace.add(traceDown, i-5)
 		data := TLS.PeelRecordLayer(buf[:i])
-		_, err = p.ss.Write(data)
+		if p.compress {
+			data, err = deflate.Decompress(data)
+			if err != nil {
+				throttledf(labelled(p.label, "Decompressing data from remote: %v\n"), err)
+				p.closeFor("bad data from remote")
+				return
+			}
+		}
+		if debugEnabled() && TLS.LooksLikeRecord(data) {
+			debugf("Data from remote is still a TLS record after peeling one off, it may have been wrapped twice\n")
+		}
+		if atomic.LoadInt32(&p.lingering) == 1 {
+			// Nobody is left to read it
+			continue
+		}
+		err = gqclient.WriteAll(p.ss, data)
 		if err != nil {
-			p.closePipe()
+			p.closeFor("writing to ss failed")
+			return
+		}
+		p.tracked.AddDown(len(data))
+		if !p.count(len(data)) {
+			p.closeFor("MaxBytesPerConn")
 			return
 		}
 	}
 }
 
+const (
+	// With RecordSizing dynamic, records carry at most about one TCP segment until
+	// this much has been sent, like crypto/tls does
+	dynamicRecordSize  = 1208
+	dynamicRecordBoost = 128 * 1024
+	// How long to wait for more data from SS to fill a record with RecordSizing fixed
+	fixedRecordWait = 5 * time.Millisecond
+)
+
+// fillRecord reads more from SS into b, which has n bytes in it already, until it
+// is full or SS has sent nothing for fixedRecordWait. It returns how many bytes b
+// has. An error is left for the next read to find
+func (p *pair) fillRecord(b []byte, n int) int {
+	p.ss.SetReadDeadline(time.Now().Add(fixedRecordWait))
+	defer p.ss.SetReadDeadline(time.Time{})
+	for n < len(b) {
+		i, err := p.ss.Read(b[n:])
+		n += i
+		if err != nil {
+			break
+		}
+	}
+	return n
+}
+
+// bufSizes returns the smallest and largest sizes of the buffer reads from SS go
+// into. Each read goes into one record, so the buffer can go up to the largest
+// record allowed in TLS, or MaxRecordSize
+func (p *pair) bufSizes() (minBuf, maxBuf int) {
+	minBuf, maxBuf = defaultUpBufferSize, defaultUpBufferSize
+	if p.upBuf != 0 {
+		minBuf, maxBuf = p.upBuf, p.upBuf
+	}
+	if p.autoTune {
+		maxBuf = 16384
+	}
+	if p.maxRecord != 0 {
+		maxBuf = p.maxRecord
+		if p.compress {
+			// Compress adds a byte to data it can't make smaller
+			maxBuf--
+		}
+		if !p.autoTune || minBuf > maxBuf {
+			minBuf = maxBuf
+		}
+	}
+	if p.sizing == "fixed" {
+		minBuf = maxBuf
+	}
+	return minBuf, maxBuf
+}
+
+// firstReadLen returns how much of the first data from SS can go into the record
+// sent along with the handshake, which is as much as ssToRemote would put in its
+// first record. The rest is left for ssToRemote, so nothing is lost or reordered
+func (p *pair) firstReadLen() int {
+	minBuf, _ := p.bufSizes()
+	if p.sizing == "dynamic" && minBuf > dynamicRecordSize {
+		return dynamicRecordSize
+	}
+	if len(p.firstRecords) != 0 && minBuf > p.firstRecords[0] {
+		return p.firstRecords[0]
+	}
+	return minBuf
+}
+
 func (p *pair) ssToRemote() {
-	buf := make([]byte, 10240)
+	minBuf, maxBuf := p.bufSizes()
+	// Records are made in the buffer, with the header in the headroom
+	buf := gqclient.NewAutoBufferWithHeadroom(minBuf, maxBuf, TLS.RecordHeaderLen)
+	defer buf.Release()
+	sent := 0
+	// The first record went with the handshake
+	records := 1
 	for {
-		i, err := io.ReadAtLeast(p.ss, buf, 1)
+		b := buf.Bytes()
+		if p.sizing == "dynamic" && sent < dynamicRecordBoost && len(b) > dynamicRecordSize {
+			b = b[:dynamicRecordSize]
+		}
+		scheduled := records < len(p.firstRecords)
+		if scheduled && len(b) > p.firstRecords[records] {
+			b = b[:p.firstRecords[records]]
+		}
+		if shrunk := int(atomic.LoadInt32(&p.shrunk)); shrunk != 0 && len(b) > shrunk {
+			b = b[:shrunk]
+		}
+		// A read of nothing, as zero-length writes from SS can make, isn't EOF
+		// and mustn't become an empty record on the wire, so wait for a byte
+		i, err := io.ReadAtLeast(p.ss, b, 1)
 		if err != nil {
-			p.closePipe()
+			p.lingerClose()
 			return
 		}
-		data := buf[:i]
-		data = TLS.AddRecordLayer(data, []byte{0x17}, []byte{0x03, 0x03})
-		_, err = p.remote.Write(data)
+		p.idle.Active()
+		if (p.sizing == "fixed" || scheduled) && i < len(b) {
+			i = p.fillRecord(b, i)
+		}
+		sent += i
+		var data []byte
+		if p.compress {
+			data = TLS.AddRecordLayer(deflate.Compress(b[:i]), []byte{0x17}, []byte{0x03, 0x03})
+		} else {
+			data = buf.Framed(i)
+			TLS.PutRecordHeader(data, []byte{0x17}, []byte{0x03, 0x03})
+		}
+		err = gqclient.WriteAll(p.remote, data)
 		if err != nil {
-			p.closePipe()
+			p.closeFor("writing to remote failed")
 			return
 		}
+		if p.watchesRecord(len(data) - 5) {
+			p.watchStall(len(data) - 5)
+		}
+		p.trace.add(traceUp, len(data)-5)
+		p.tracked.AddUp(i)
+		if !p.count(i) {
+			p.closeFor("MaxBytesPerConn")
+			return
+		}
+		buf.Used(i)
+		if scheduled {
+			records++
+		}
 	}
 }
 
+// remoteHandshake connects to the server and goes through the handshake up to and
+// including our reply, after which the connection is ready for SS data. A failure
+// is counted, and recorded in rec and tr, before it's returned
+func remoteHandshake(sta *gqclient.State, rec *auditRecord, tr *connTrace) (remoteAddr string, remoteConn net.Conn, err error) {
+	// The whole attempt, retries included, has to be done within RetryBudget
+	var deadline time.Time
+	if sta.RetryBudget != 0 {
+		deadline = time.Now().Add(time.Duration(sta.RetryBudget) * time.Second)
+	}
+	if sta.ConnJitterMaxMs != 0 {
+		time.Sleep(connJitter(sta.ConnJitterMaxMs))
+	}
+
+	remoteAddr = sta.RemoteAddr()
+	if sta.ServerPool != nil {
+		remoteAddr = sta.ServerPool.Best()
+	}
+
+	failed := func(stage string) {
+		metrics.HandshakeFailedFor(sta.Label, stage)
+		recordHandshake(remoteAddr, stage)
+		rec.handshakeFailed(stage)
+		tr.handshakeFailed(stage)
+	}
+
+	var reply []byte
+	var stage string
+	if sta.HedgeConnections {
+		second := remoteAddr
+		if sta.ServerPool != nil {
+			second = sta.ServerPool.BestExcept(remoteAddr)
+		}
+		remoteAddr, remoteConn, reply, stage, err = hedgedHandshake(sta, remoteAddr, second, deadline)
+	} else {
+		remoteConn, reply, stage, err = handshake(sta, remoteAddr, deadline)
+	}
+	rec.setRemote(remoteAddr, sta.Browser)
+	if stage == "serverread" && sta.RetryWithNewFingerprint && !budgetLeft(deadline) {
+		debugf("No RetryBudget left to try another fingerprint\n")
+	} else if stage == "serverread" && sta.RetryWithNewFingerprint {
+		// The server closing on us may be down to the fingerprint, so try once more
+		// with another one. Only the last attempt goes into the audit log
+		metrics.HandshakeFailedFor(sta.Label, stage)
+		recordHandshake(remoteAddr, stage)
+		retry := *sta
+		retry.Browser = otherBrowser(sta)
+		throttledf(labelled(sta.Label, "Handshake as %v failed, trying again as %v\n"), sta.Browser, retry.Browser)
+		sta = &retry
+		rec.setRemote(remoteAddr, sta.Browser)
+		remoteConn, reply, stage, err = handshake(sta, remoteAddr, deadline)
+	}
+	if err != nil && sta.ServerPool != nil && unreachable(stage, err) {
+		// Another server may well be reachable, so one blocked IP doesn't take
+		// everything down. The failed one is left alone once it's failed enough
+		sta.ServerPool.Failed(remoteAddr)
+		if next := sta.ServerPool.BestExcept(remoteAddr); next != remoteAddr && budgetLeft(deadline) {
+			metrics.HandshakeFailedFor(sta.Label, stage)
+			recordHandshake(remoteAddr, stage)
+			throttledf(labelled(sta.Label, "Couldn't reach %v, failing over to %v\n"), remoteAddr, next)
+			remoteAddr = next
+			rec.setRemote(remoteAddr, sta.Browser)
+			remoteConn, reply, stage, err = handshake(sta, remoteAddr, deadline)
+			if err != nil && unreachable(stage, err) {
+				sta.ServerPool.Failed(remoteAddr)
+			}
+		}
+	}
+	if err != nil {
+		failed(stage)
+		return remoteAddr, nil, err
+	}
+	if sta.ServerPool != nil {
+		if sta.HappyEyeballs && sta.ServerPool.Has(remoteConn.RemoteAddr().String()) {
+			// It may have been another of RemoteServers that connected first
+			remoteAddr = remoteConn.RemoteAddr().String()
+			rec.setRemote(remoteAddr, sta.Browser)
+		}
+		sta.ServerPool.Worked(remoteAddr)
+	}
+	tr.add(traceHandshake, 0)
+
+	if sta.ReplyDelayMaxMs != 0 {
+		time.Sleep(replyDelay(sta.ReplyDelayMaxMs))
+	}
+	err = gqclient.WriteAll(remoteConn, reply)
+	if err != nil {
+		throttledf(labelled(sta.Label, "Sending reply to remote: %v\n"), err)
+		failed("reply")
+		go remoteConn.Close()
+		return remoteAddr, nil, err
+	}
+	remoteConn.SetDeadline(time.Time{})
+	tr.add(traceReply, 0)
+	return remoteAddr, remoteConn, nil
+}
+
+// The connections from SS that are being relayed or are getting there, for
+// MaxConnections. Accessed atomically
+var openConns int32
+
+// openConn counts a connection from SS, unless there are MaxConnections already
+// in which case it reports false
+func openConn(sta *gqclient.State) bool {
+	n := atomic.AddInt32(&openConns, 1)
+	if sta.MaxConnections != 0 && int(n) > sta.MaxConnections {
+		atomic.AddInt32(&openConns, -1)
+		return false
+	}
+	return true
+}
+
+// closeConn stops counting a connection counted by openConn
+func closeConn() {
+	atomic.AddInt32(&openConns, -1)
+}
+
 func initSequence(ssConn net.Conn, sta *gqclient.State) {
+	if !openConn(sta) {
+		throttledf(labelled(sta.Label, "MaxConnections of %v reached, closing connection from %v\n"), sta.MaxConnections, ssConn.RemoteAddr())
+		ssConn.Close()
+		return
+	}
 	// SS likes to make TCP connections and then immediately close it
 	// without sending anything. This is apperently a feature.
 	// But we don't want this because it may be significant to the GFW
 	// and we don't want to make meaningless handshakes.
 	// So we filter these empty connections
+	p := &pair{
+		maxBytes:        int64(sta.MaxBytesPerConn),
+		ss:              ssConn,
+		compress:        sta.Compress,
+		linger:          time.Duration(sta.LingerAfterClose) * time.Second,
+		autoTune:        sta.BufferAutoTune,
+		strict:          sta.StrictRecordValidation,
+		maxRecord:       sta.MaxRecordSize,
+		sizing:          sta.RecordSizing,
+		upBuf:           sta.UpBufferSize,
+		downBuf:         sta.DownBufferSize,
+		blackHole:       time.Duration(sta.BlackHoleTimeout) * time.Second,
+		blackHoleRecord: sta.BlackHoleRecordSize,
+		label:           sta.Label,
+		release:         closeConn,
+	}
+	if sta.RecordSizing == "browser" {
+		p.firstRecords = TLS.FirstRecordSizes(sta)
+	}
+	tr := newConnTrace()
 	var err error
-	data := make([]byte, 1024)
+	data := make([]byte, p.firstReadLen())
+	if sta.IdleTimeout != 0 {
+		ssConn.SetReadDeadline(time.Now().Add(time.Duration(sta.IdleTimeout) * time.Second))
+	}
 	i, err := io.ReadAtLeast(ssConn, data, 1)
 	if err != nil {
 		go ssConn.Close()
+		closeConn()
+		return
+	}
+	ssConn.SetReadDeadline(time.Time{})
+	if p.sizing == "browser" && i < len(data) {
+		i = p.fillRecord(data, i)
 	}
 	data = data[:i]
+	setNoDelay(ssConn, sta)
 
+	rec := newAuditRecord(ssConn, sta.Label)
+	var remoteAddr string
 	var remoteConn net.Conn
-	clientHello := TLS.ComposeInitHandshake(sta)
-	if sta.FastOpen {
-		remoteConn, err = gotfo.Dial(sta.SS_REMOTE_HOST+":"+sta.SS_REMOTE_PORT, true, clientHello)
+	if sta.MuxSessions != 0 && !sta.Connect {
+		remoteAddr, remoteConn, err = muxes.open(sta, rec, tr)
 		if err != nil {
-			log.Printf("Connecting and sending ClientHello to remote: %v\n", err)
+			go ssConn.Close()
+			closeConn()
 			return
 		}
+		rec.setRemote(remoteAddr, sta.Browser)
+	} else if w := warm.get(sta); w != nil && !sta.Connect {
+		remoteAddr, remoteConn = w.addr, w.conn
+		rec.setRemote(w.addr, w.browser)
 	} else {
-		remoteConn, err = gotfo.Dial(sta.SS_REMOTE_HOST+":"+sta.SS_REMOTE_PORT, false, nil)
+		remoteAddr, remoteConn, err = remoteHandshake(sta, rec, tr)
 		if err != nil {
-			log.Printf("Connecting to remote: %v\n", err)
-			return
-		}
-		_, err = remoteConn.Write(clientHello)
-		if err != nil {
-			log.Printf("Sending ClientHello: %v\n", err)
+			go ssConn.Close()
+			closeConn()
 			return
 		}
 	}
-
-	// Three discarded messages: ServerHello, ChangeCipherSpec and Finished
-	discardBuf := make([]byte, 1024)
-	for c := 0; c < 3; c++ {
-		_, err = gqclient.ReadTillDrain(remoteConn, discardBuf)
-		if err != nil {
-			log.Printf("Reading discarded message %v: %v\n", c, err)
-			return
+	p.remote = remoteConn
+	p.audit = rec
+	p.trace = tr
+	if sta.LogRecordSizes {
+		p.recordSizes = &gqclient.RecordSizes{}
+	}
+	if sta.AutoMTU {
+		max := autoMTUMax
+		if sta.MaxRecordSize != 0 {
+			max = sta.MaxRecordSize
 		}
+		p.mtu = newMTUSearch(remoteAddr, max)
+		p.setRecordCap(p.mtu.size())
 	}
-
-	reply := TLS.ComposeReply()
-	_, err = remoteConn.Write(reply)
-	if err != nil {
-		log.Printf("Sending reply to remote: %v\n", err)
-		return
+	p.tracked = tracker.AddLabelled(ssConn.RemoteAddr().String(), remoteAddr, sta.Label)
+	if sta.MaxConnLifetime != 0 {
+		// Browsers don't keep a single TLS connection open for hours. SS will
+		// make a new connection once this one is closed
+		p.lifetime = time.AfterFunc(time.Duration(sta.MaxConnLifetime)*time.Second, func() {
+			log.Printf(labelled(sta.Label, "Connection exceeded MaxConnLifetime of %vs, closing\n"), sta.MaxConnLifetime)
+			p.closeFor("MaxConnLifetime")
+		})
 	}
-	p := pair{
-		ssConn,
-		remoteConn,
+	if sta.IdleTimeout != 0 {
+		// Neither end is told, as a peer that has gone quiet may never answer
+		p.idle = idle.NewTimer(time.Duration(sta.IdleTimeout)*time.Second, func() {
+			debugf(labelled(sta.Label, "Connection idle for IdleTimeout of %vs, closing\n"), sta.IdleTimeout)
+			p.closeFor("IdleTimeout")
+		})
 	}
 
 	// Send the data we got from SS in the beginning
+	firstLen := len(data)
+	if p.compress {
+		data = deflate.Compress(data)
+	}
 	data = TLS.AddRecordLayer(data, []byte{0x17}, []byte{0x03, 0x03})
-	_, err = p.remote.Write(data)
+	err = gqclient.WriteAll(p.remote, data)
 	if err != nil {
-		log.Printf("Sending first SS data to remote: %v\n", err)
+		throttledf(labelled(sta.Label, "Sending first SS data to remote: %v\n"), err)
+		metrics.HandshakeFailedFor(sta.Label, "firstdata")
+		recordHandshake(remoteAddr, "firstdata")
+		rec.handshakeFailed("firstdata")
+		tr.handshakeFailed("firstdata")
 		p.closePipe()
 		return
 	}
+	tr.add(traceUp, len(data)-5)
+	recordHandshake(remoteAddr, "")
+	if p.watchesRecord(len(data) - 5) {
+		p.watchStall(len(data) - 5)
+	}
+	p.tracked.AddUp(firstLen)
+	if !p.count(firstLen) {
+		p.closeFor("MaxBytesPerConn")
+		return
+	}
 	go p.remoteToSS()
 	go p.ssToRemote()
 
 }
 
+// Default FailureWindow in seconds
+const defaultFailureWindow = 300
+
+// recordHandshake counts a handshake with remote that failed at stage, or succeeded
+// if it's empty, in the FailureWindow and logs when the share of them failing goes
+// over FailureAlertPercent or back under
+func recordHandshake(remote string, stage string) {
+	status.handshakeDone(remote, stage)
+	if metrics.Failures == nil {
+		return
+	}
+	stats, changed := metrics.Failures.Add(remote, stage != "")
+	if !changed {
+		return
+	}
+	if stats.Alerting {
+		log.Printf("Warning: %v of the last %v handshakes with %v failed, the server may be down or blocked\n", stats.Failures, stats.Attempts, remote)
+	} else {
+		log.Printf("Handshakes with %v are succeeding again, %v of the last %v failed\n", remote, stats.Failures, stats.Attempts)
+	}
+}
+
+var errBudgetUsedUp = errors.New("Handshake took longer than RetryBudget or HandshakeTimeout")
+
+// dialBefore dials with dial, giving up at deadline unless it's zero. A connection
+// made after that is closed
+func dialBefore(deadline time.Time, dial func() (net.Conn, error)) (net.Conn, error) {
+	if deadline.IsZero() {
+		return dial()
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		conn, err := dial()
+		results <- result{conn, err}
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		return r.conn, r.err
+	case <-timer.C:
+		go func() {
+			if r := <-results; r.err == nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, errBudgetUsedUp
+	}
+}
+
+// budgetLeft reports whether there's time left before deadline for another attempt
+func budgetLeft(deadline time.Time) bool {
+	return deadline.IsZero() || time.Now().Before(deadline)
+}
+
+// Set once a connection made with TCP fast open has been reset and the same one
+// without it succeeded, so that fast open isn't used again until gq-client restarts
+var tfoBlocked int32
+
+// handshake connects to the server at remoteAddr, sends it a ClientHello and reads
+// its handshake, giving up at deadline unless it's zero, and returns our reply to
+// it. The deadline is left set on remoteConn for the reply. If it fails, the stage
+// it failed at is returned with the error. Some middleboxes reset connections
+// whose SYN carries data, so if one made with FastOpen is refused or reset before
+// the server has answered, it's made again without it, with a new ClientHello as
+// the server may have seen the first one
+func handshake(sta *gqclient.State, remoteAddr string, deadline time.Time) (remoteConn net.Conn, reply []byte, stage string, err error) {
+	// The ClientHello can't go in the SYN when the WebSocket has to be opened first
+	fastOpen := sta.FastOpen && sta.Dialer == nil && atomic.LoadInt32(&tfoBlocked) == 0 && sta.Transport != "websocket"
+	remoteConn, reply, stage, err = handshakeOnce(sta, remoteAddr, deadline, fastOpen)
+	if !fastOpen || !resetByTFO(stage, err) || !budgetLeft(deadline) {
+		return
+	}
+	remoteConn, reply, stage, err = handshakeOnce(sta, remoteAddr, deadline, false)
+	if err == nil && atomic.CompareAndSwapInt32(&tfoBlocked, 0, 1) {
+		log.Printf("TFO may be blocked on this network - retried without it, and it's off until gq-client restarts\n")
+	}
+	return
+}
+
+// resetByTFO reports whether a handshake that failed at stage with err was refused
+// or reset before anything came from the server
+func resetByTFO(stage string, err error) bool {
+	if noAnswer, ok := err.(*TLS.NoAnswerError); ok && stage == "serverread" {
+		err = noAnswer.Err
+	} else if stage != "dial" {
+		return false
+	}
+	return gqclient.IsResetOrRefused(err)
+}
+
+// unreachable reports whether a handshake that failed at stage with err couldn't
+// reach the server, by not connecting or by timing out
+func unreachable(stage string, err error) bool {
+	if noAnswer, ok := err.(*TLS.NoAnswerError); ok {
+		err = noAnswer.Err
+	}
+	netErr, ok := err.(net.Error)
+	return stage == "dial" || ok && netErr.Timeout()
+}
+
+// handshakeOnce is handshake without falling back when fastOpen fails
+func handshakeOnce(sta *gqclient.State, remoteAddr string, deadline time.Time, fastOpen bool) (remoteConn net.Conn, reply []byte, stage string, err error) {
+	if sta.HandshakeTimeout != 0 {
+		timeout := time.Now().Add(time.Duration(sta.HandshakeTimeout) * time.Second)
+		if deadline.IsZero() || timeout.Before(deadline) {
+			deadline = timeout
+		}
+	}
+	sta = sta.WithNextServerName()
+	clientHello := TLS.ComposeInitHandshake(sta)
+	if debugEnabled() {
+		ja3, _ := TLS.JA3(clientHello)
+		debugf("Connecting to %v as %v, JA3 %v\n", remoteAddr, sta.Browser, ja3)
+		if edge := gqclient.AuthWindowEdge(sta.Now(), int(sta.AuthWindowLength()/time.Second)); edge < authEdgeWarning {
+			debugf("The ClientHello is made %v from the edge of its %v window, a server whose clock is off by more turns it down unless its ClockSkewTolerance covers it\n", edge, sta.AuthWindowLength())
+		}
+	}
+	flight := TLS.ClientHelloFlight(clientHello)
+	remoteConn, err = dialBefore(deadline, func() (net.Conn, error) {
+		switch {
+		case fastOpen:
+			return dialWith(sta, remoteAddr, true, flight)
+		case sta.HappyEyeballs:
+			return dialHappyEyeballs(sta, remoteAddr)
+		}
+		return dialWith(sta, remoteAddr, false, nil)
+	})
+	if err != nil {
+		if fastOpen {
+			throttledf(labelled(sta.Label, "Connecting and sending ClientHello to remote: %v\n"), err)
+		} else {
+			throttledf(labelled(sta.Label, "Connecting to remote: %v\n"), err)
+		}
+		return nil, nil, "dial", err
+	}
+	remoteConn.SetDeadline(deadline)
+	if sta.Transport == "websocket" {
+		ws, err := openWebSocket(remoteConn, sta)
+		if err != nil {
+			throttledf(labelled(sta.Label, "Opening WebSocket %v: %v\n"), sta.WebSocketURL, err)
+			go remoteConn.Close()
+			return nil, nil, "websocket", err
+		}
+		remoteConn = ws
+	}
+	if !fastOpen {
+		err = writeSplit(remoteConn, flight, sta.ClientHelloSplit)
+		if err != nil {
+			throttledf(labelled(sta.Label, "Sending ClientHello: %v\n"), err)
+			go remoteConn.Close()
+			return nil, nil, "clienthello", err
+		}
+	}
+
+	setNoDelay(remoteConn, sta)
+
+	serverHello, err := TLS.ReadServerHandshake(sta, remoteConn, clientHello, deadline)
+	if err != nil {
+		throttledf(labelled(sta.Label, "Reading the server's handshake: %v\n"), err)
+		go remoteConn.Close()
+		return nil, nil, "serverread", err
+	}
+	reply, err = TLS.ComposeReply(sta, clientHello, serverHello)
+	if err != nil {
+		throttledf(labelled(sta.Label, "Composing reply: %v\n"), err)
+		go remoteConn.Close()
+		return nil, nil, "reply", err
+	}
+
+	if fastOpen {
+		// The ServerHello has arrived so the SYN must have been acknowledged by now
+		acked, ok := gqclient.SynDataAcked(remoteConn)
+		if ok {
+			debugf("TCP fast open used for connection to %v: %v\n", remoteAddr, acked)
+		}
+	}
+	return remoteConn, reply, "", nil
+}
+
+// How close to the edge of its window a ClientHello's time is logged at
+const authEdgeWarning = 5 * time.Minute
+
+// writeSplit writes b to conn in two writes, the first of the bytes before offset
+// at, or in one if at isn't inside b. TCP_NODELAY is still on while the ClientHello
+// is sent, so each write goes out in segments of its own
+func writeSplit(conn net.Conn, b []byte, at int) error {
+	if at <= 0 || at >= len(b) {
+		return gqclient.WriteAll(conn, b)
+	}
+	err := gqclient.WriteAll(conn, b[:at])
+	if err != nil {
+		return err
+	}
+	return gqclient.WriteAll(conn, b[at:])
+}
+
+// Default HedgeDelay in milliseconds
+const defaultHedgeDelay = 200
+
+// hedgedHandshake makes a handshake with first, and another one with second if
+// the first hasn't finished after HedgeDelay or has failed. Whichever succeeds
+// first is used and the other is closed. The address of the one used is returned,
+// or if both failed, that of the last one to fail with its stage. The second isn't
+// started once deadline has passed
+func hedgedHandshake(sta *gqclient.State, first, second string, deadline time.Time) (addr string, remoteConn net.Conn, reply []byte, stage string, err error) {
+	type result struct {
+		addr  string
+		conn  net.Conn
+		reply []byte
+		stage string
+		err   error
+	}
+	results := make(chan result, 2)
+	start := func(addr string) {
+		go func() {
+			conn, reply, stage, err := handshake(sta, addr, deadline)
+			results <- result{addr, conn, reply, stage, err}
+		}()
+	}
+	delay := time.Duration(sta.HedgeDelay) * time.Millisecond
+	if sta.HedgeDelay == 0 {
+		delay = defaultHedgeDelay * time.Millisecond
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	start(first)
+	started, pending := 1, 1
+	startSecond := func() {
+		if started == 1 && budgetLeft(deadline) {
+			debugf("Handshake with %v not done, starting another with %v\n", first, second)
+			start(second)
+			started++
+			pending++
+		}
+	}
+	var r result
+	for {
+		select {
+		case <-timer.C:
+			startSecond()
+			continue
+		case r = <-results:
+			pending--
+		}
+		if r.err == nil {
+			if pending != 0 {
+				go func() {
+					if other := <-results; other.err == nil {
+						other.conn.Close()
+					}
+				}()
+			}
+			break
+		}
+		if started == 1 {
+			startSecond()
+		}
+		if pending == 0 {
+			break
+		}
+	}
+	return r.addr, r.conn, r.reply, r.stage, r.err
+}
+
+// otherBrowser picks a Browser at random other than the one in sta
+func otherBrowser(sta *gqclient.State) string {
+	// chrome is just another name for chrome-64
+	same := func(a, b string) bool {
+		if a == "chrome" {
+			a = "chrome-64"
+		}
+		if b == "chrome" {
+			b = "chrome-64"
+		}
+		return a == b
+	}
+	var others []string
+	for _, b := range gqclient.Browsers {
+		if b != "chrome" && !same(b, sta.Browser) {
+			others = append(others, b)
+		}
+	}
+	return others[int(sta.RandBytes(1)[0])%len(others)]
+}
+
+// probeServers periodically measures the latency to each remote server
+// so that initSequence can pick the nearest one. Each probe is a smoke test
+// ping, a handshake and some random bytes echoed, of a size that differs
+// from one to the next
+func probeServers() {
+	for {
+		sta := currentState.Load()
+		ping := func(addr string) error {
+			return smokeTestOne(sta, addr, 256+int(sta.RandBytes(1)[0])*4)
+		}
+		if sta.ServerPool != nil {
+			sta.ServerPool.Probe(ping)
+		}
+		interval := 60 * time.Second
+		if sta.ProbeInterval != 0 {
+			interval = time.Duration(sta.ProbeInterval) * time.Second
+		}
+		time.Sleep(interval)
+	}
+}
+
+// serveMetrics serves the metrics at /metrics on listener, and pprof as well if
+// PprofAddr is the same as MetricsAddr
+func serveMetrics(listener net.Listener, withPprof bool) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	if withPprof {
+		addPprof(mux)
+	}
+	log.Printf("Serving metrics on %v\n", listener.Addr())
+	err := http.Serve(listener, mux)
+	if atomic.LoadInt32(&upgraded) == 1 {
+		return
+	}
+	log.Fatal(err)
+}
+
 func main() {
 	// Should be 127.0.0.1 to listen to ss-local on this machine
 	var localHost string
@@ -150,6 +1076,13 @@ func main() {
 	// The proxy port,should be 443
 	var remotePort string
 	var pluginOpts string
+	var verifyFingerprint string
+	var printConfig bool
+	var showJA3 bool
+	var probeTargets string
+	var runSmokeTest bool
+	var smokeTestSize int
+	var socksMode bool
 
 	// These two functions do nothing for non-android
 	log_init()
@@ -169,6 +1102,19 @@ func main() {
 		flag.StringVar(&pluginOpts, "c", "gqclient.json", "configPath: path to gqclient.json")
 		askVersion := flag.Bool("v", false, "Print the version number")
 		printUsage := flag.Bool("h", false, "Print this message")
+		genConf := flag.Bool("genconfig", false, "Generate gqclient.json and a matching gqserver.json in the current directory")
+		genServerName := flag.String("genconfig-servername", "www.bing.com", "ServerName for -genconfig")
+		genWebServerAddr := flag.String("genconfig-webserver", "204.79.197.200:443", "WebServerAddr for -genconfig, should be the address of ServerName")
+		flag.BoolVar(&printConfig, "print-config", false, "Print the config as parsed, with the Key redacted, then exit")
+		flag.StringVar(&verifyFingerprint, "verify-fingerprint", "", "Check that the ClientHello made with the config has this JA3 string, JA3 hash or JA4 fingerprint, then exit")
+		flag.BoolVar(&showJA3, "show-ja3", false, "Print the JA3 and JA4 fingerprints of a ClientHello made with the config, then exit")
+		flag.BoolVar(&runSmokeTest, "smoke-test", false, "Send data through the server with the config and check that it's echoed back, then exit. Exits with 1 if it fails")
+		flag.IntVar(&smokeTestSize, "smoke-test-size", 1024, "Bytes of data to send in -smoke-test, up to 16384")
+		importHello := flag.String("import-hello", "", "Make a HelloTemplate for Browser template from the ClientHello in this pcap file, or hex file or string, print it and exit")
+		printTrace := flag.String("print-trace", "", "Print the connection traces in this TraceFile as text, then exit")
+		encryptConf := flag.String("encrypt-config", "", "Print this config file encrypted with the passphrase in "+gqclient.PassphraseEnv+" or typed in, then exit")
+		flag.BoolVar(&socksMode, "socks", false, "Take SOCKS5 and HTTP CONNECT on localPort and have the server make the connections itself, in place of ss. Needs AllowConnect on the server")
+		flag.StringVar(&probeTargets, "probe-real", "", "Send a ClientHello made with the config to these real TLS servers, comma separated host[:port], and print how they answer, then exit")
 		flag.Parse()
 
 		if *askVersion {
@@ -181,48 +1127,278 @@ func main() {
 			return
 		}
 
-		log.Printf("Starting standalone mode. Listening for ss on %v:%v\n", localHost, localPort)
+		if *importHello != "" {
+			err := printHelloTemplate(*importHello)
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		if *printTrace != "" {
+			err := printTraces(*printTrace, os.Stdout)
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		if *encryptConf != "" {
+			err := encryptConfig(*encryptConf)
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		if *genConf {
+			err := genConfig(*genServerName, *genWebServerAddr)
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		if socketActivated() || localPort == "" {
+			log.Println("Starting standalone mode")
+		} else {
+			log.Printf("Starting standalone mode. Listening for ss on %v\n", gqclient.JoinHostPort(localHost, localPort))
+		}
 	}
 
-	opaque := gqclient.BtoInt(gqclient.CryptoRandBytes(32))
+	gqclient.ConfigPassphrase = configPassphrase
+	waitForEntropy()
 	sta := &gqclient.State{
 		SS_LOCAL_HOST:  localHost,
 		SS_LOCAL_PORT:  localPort,
 		SS_REMOTE_HOST: remoteHost,
 		SS_REMOTE_PORT: remotePort,
 		Now:            time.Now,
-		Opaque:         opaque,
 	}
+	sta.SetOpaque()
 	err := sta.ParseConfig(pluginOpts)
 	if err != nil {
 		log.Fatal(err)
 	}
+	for _, warning := range sta.Warnings {
+		log.Printf("Warning: %v\n", warning)
+	}
+	if state := os.Getenv(stateEnv); state != "" {
+		// Started by upgrade, so carry on with the config of the old gq-client
+		os.Unsetenv(stateEnv)
+		err = sta.RestoreNonSecret([]byte(state))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if printConfig {
+		fmt.Println(string(sta.Redacted()))
+		return
+	}
+	if showJA3 {
+		sta.SetAESKey()
+		clientHello := TLS.ComposeInitHandshake(sta)
+		ja3, err := TLS.JA3(clientHello)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ja4, _ := TLS.JA4(clientHello)
+		fmt.Printf("JA3: %v\nJA3 hash: %x\nJA4: %v\n", ja3, md5.Sum([]byte(ja3)), ja4)
+		return
+	}
+	if runSmokeTest {
+		if smokeTestSize < 1 || smokeTestSize > 16384 {
+			log.Fatal("-smoke-test-size must be between 1 and 16384")
+		}
+		sta.SetAESKey()
+		if !smokeTest(sta, smokeTestSize) {
+			os.Exit(1)
+		}
+		return
+	}
+	if probeTargets != "" {
+		sta.SetAESKey()
+		if !probeReal(sta, probeTargets) {
+			os.Exit(1)
+		}
+		return
+	}
+	log.Printf("Effective config: %s\n", sta.Redacted())
+	log.Printf("Features: %v\n", strings.Join(sta.Features(), ", "))
+
+	if verifyFingerprint != "" {
+		sta.SetAESKey()
+		err = TLS.VerifyFingerprint(TLS.ComposeInitHandshake(sta), verifyFingerprint)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Fingerprint matches")
+		return
+	}
 
-	if sta.SS_LOCAL_PORT == "" {
-		log.Fatal("Must specify localPort")
+	setLogLevel(sta.LogLevel)
+	setLogThrottle(sta.ThrottleLogs)
+	if sta.FastOpen {
+		client, _, ok := gqclient.TFOSupported()
+		if ok && client {
+			log.Println("TCP fast open active")
+		} else if ok {
+			log.Println("TCP fast open requested but not enabled for outgoing connections by the kernel (net.ipv4.tcp_fastopen)")
+		}
+	}
+	if sta.AuditFile != "" {
+		err = openAuditLog(sta.AuditFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if sta.TraceFile != "" {
+		err = openTraceLog(sta.TraceFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if sta.LogFile != "" {
+		logFile, err := gqclient.OpenRotatingFile(sta.LogFile, int64(sta.LogMaxSizeMB)*1024*1024, sta.LogMaxFiles)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// stderr may be swallowed by SS in plugin mode
+		log.SetOutput(io.MultiWriter(os.Stderr, logFile))
+	}
+
+	if sta.CheckForUpdates {
+		updateURL := sta.UpdateURL
+		if updateURL == "" {
+			updateURL = defaultUpdateURL
+		}
+		go checkForUpdates(updateURL)
+	}
+
+	if sta.SS_LOCAL_PORT == "" && sta.LocalPortRange == "" && !socketActivated() {
+		log.Fatal("Must specify localPort or LocalPortRange")
 	}
 	if sta.SS_REMOTE_HOST == "" {
 		log.Fatal("Must specify remoteHost")
 	}
-	if sta.Key == "" {
-		log.Fatal("Key cannot be empty")
-	}
-	if sta.TicketTimeHint == 0 {
-		log.Fatal("TicketTimeHint cannot be empty or 0")
+	if !sta.AllowNon443 {
+		for _, addr := range sta.Non443Servers() {
+			log.Printf("Warning: %v isn't on port 443. Nearly all HTTPS is on 443, so TLS to another port stands out and gives the disguise away. Set AllowNon443 if this is intended\n", addr)
+		}
 	}
 
 	sta.SetAESKey()
-	listener, err := gotfo.Listen(sta.SS_LOCAL_HOST+":"+sta.SS_LOCAL_PORT, sta.FastOpen)
+	makeServerPool(sta, nil)
+	currentState.Store(sta)
+	window := sta.FailureWindow
+	if window == 0 {
+		window = defaultFailureWindow
+	}
+	metrics.Failures = gqclient.NewFailureWindow(time.Duration(window)*time.Second, sta.FailureAlertPercent)
+	addFdCallback(setDSCP)
+	addFdCallback(bindInterface)
+	go probeServers()
+	for i := 0; i < sta.WarmPoolSize; i++ {
+		go warm.fill()
+	}
+	go reloadOnSIGHUP(pluginOpts)
+	if sta.MetricsAddr != "" {
+		metricsListener, err := inheritedListener(metricsFdEnv)
+		if metricsListener == nil && err == nil {
+			metricsListener, err = net.Listen("tcp", sta.MetricsAddr)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners.metrics = metricsListener
+		go serveMetrics(metricsListener, sta.PprofAddr == sta.MetricsAddr)
+	}
+	if sta.PprofAddr != "" && sta.PprofAddr != sta.MetricsAddr {
+		go servePprof(sta.PprofListenAddr())
+	}
+	if sta.StatusAddr != "" {
+		go serveStatus(sta.StatusListenAddr())
+	}
+	if sta.AdminSocket != "" {
+		go serveAdmin(sta.AdminSocket, pluginOpts)
+	}
+
+	localAddr := sta.LocalAddr()
+	listenOpts := gqclient.ListenOptions{
+		FastOpen:  sta.FastOpen,
+		ReusePort: sta.ReusePort,
+		Backlog:   sta.ListenBacklog,
+	}
+	listen := func() (net.Listener, error) {
+		return gqclient.Listen(localAddr, listenOpts)
+	}
+	if sta.SS_LOCAL_PORT == "" && sta.LocalPortRange != "" {
+		// SS picks the port in plugin mode and there's no way to tell it another,
+		// so this is only for standalone mode. Listening again after an error goes
+		// back to the port found the first time
+		listenOnPicked := listen
+		picked := false
+		listen = func() (net.Listener, error) {
+			if picked {
+				return listenOnPicked()
+			}
+			first, last, _ := sta.LocalPorts()
+			l, err := gqclient.ListenInRange(sta.SS_LOCAL_HOST, first, last, listenOpts)
+			if err == nil {
+				localAddr, picked = l.Addr().String(), true
+				log.Printf("Listening for ss on %v, the first free port in LocalPortRange\n", localAddr)
+			}
+			return l, err
+		}
+	}
+	listener, err := inheritedListener(listenFdEnv)
+	if listener == nil && err == nil {
+		listener, err = systemdListener()
+	}
+	if listener == nil && err == nil {
+		listener, err = listen()
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	for {
-		conn, err := listener.Accept()
+	if sta.UDPRelay && socksMode {
+		log.Println("UDPRelay is for ss and isn't used with -socks")
+	} else if sta.UDPRelay {
+		// On the same port as TCP, which is where SS sends UDP to its plugin
+		pc, err := net.ListenPacket("udp", listener.Addr().String())
 		if err != nil {
-			log.Println(err)
-			continue
+			log.Printf("Listening for UDP from ss: %v, only TCP will be relayed\n", err)
+		} else {
+			log.Printf("Relaying UDP from ss on %v\n", pc.LocalAddr())
+			go serveUDP(pc)
 		}
-		go initSequence(conn, sta)
 	}
+	var limiter *gqclient.RateLimiter
+	if sta.ConnRateLimit != 0 {
+		burst := sta.ConnBurst
+		if burst == 0 {
+			burst = sta.ConnRateLimit
+		}
+		limiter = gqclient.NewRateLimiter(sta.ConnRateLimit, burst)
+	}
+	acceptLoop(listener, listen, func(conn net.Conn) {
+		if atomic.LoadInt32(&draining) == 1 {
+			conn.Close()
+			return
+		}
+		if limiter != nil && !limiter.Allow(conn.RemoteAddr().String()) {
+			debugf("Rate limiting connection from %v\n", conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+		if socksMode {
+			go serveSocks(conn, currentState.Load())
+			return
+		}
+		go initSequence(conn, currentState.Load())
+	})
+	waitForConnections()
+	log.Println("All connections closed, exiting")
 
 }
@@ -0,0 +1,2314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+	"github.com/cbeuw/GoQuiet/gqclient/TLS"
+	"github.com/cbeuw/GoQuiet/gqserver"
+	"github.com/cbeuw/GoQuiet/mux"
+	"github.com/cbeuw/GoQuiet/websocket"
+)
+
+// Stages at which fakeServer stops cooperating
+const (
+	failNever = iota
+	failOnClientHello
+	failAfterServerHello
+	failOnReply
+)
+
+// fakeServer behaves like gq-server on conn using the gqserver package, except that
+// it echoes the data back instead of relaying it to ss-server. gq-server itself is
+// tested with every Browser in its own tests
+func fakeServer(conn net.Conn, key string, failAt int) {
+	defer conn.Close()
+	sta := &gqserver.State{
+		Key:        key,
+		Now:        time.Now,
+		UsedRandom: map[[32]byte]int{},
+	}
+	sta.SetAESKey()
+
+	buf := make([]byte, 20480)
+	i, err := gqserver.ReadFirstRecord(conn, buf)
+	if err != nil || failAt == failOnClientHello {
+		return
+	}
+	ch, err := gqserver.ParseClientHello(buf[:i])
+	if err != nil || !gqserver.IsSS(ch, sta) {
+		return
+	}
+	reply := gqserver.ComposeReply(ch)
+	if failAt == failAfterServerHello {
+		// ServerHello on its own, without ChangeCipherSpec and Finished
+		conn.Write(reply[:5+gqserver.BtoInt(reply[3:5])])
+		return
+	}
+	conn.Write(reply)
+
+	for c := 0; c < 2; c++ {
+		i, err = gqserver.ReadTillDrain(conn, buf)
+		if err != nil {
+			return
+		}
+	}
+	finished := gqserver.PeelRecordLayer(buf[:i])
+	if failAt == failOnReply || !gqserver.IsBound(ch, reply, finished, sta) {
+		return
+	}
+	if gqserver.IsConnect(ch, reply, finished, sta) {
+		// Answers with the address it was asked to connect to in place of dialling
+		i, err = gqserver.ReadTillDrain(conn, buf)
+		if err != nil {
+			return
+		}
+		first := gqserver.PeelRecordLayer(buf[:i])
+		addr, n, err := gqserver.ParseAddr(first)
+		if err != nil {
+			return
+		}
+		answer := append([]byte(addr), first[n:]...)
+		conn.Write(gqserver.AddRecordLayer(answer, []byte{0x17}, []byte{0x03, 0x03}))
+	}
+	if _, ok := gqserver.MuxRouteOf(ch, reply, finished, sta); ok {
+		session := mux.NewServer(conn)
+		for {
+			stream, err := session.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				echoRecords(stream)
+			}()
+		}
+	}
+	echoRecords(conn)
+}
+
+// echoRecords sends each record from conn back until it fails
+func echoRecords(conn net.Conn) {
+	buf := make([]byte, 20480)
+	for {
+		i, err := gqserver.ReadTillDrain(conn, buf)
+		if err != nil {
+			return
+		}
+		data := gqserver.PeelRecordLayer(buf[:i])
+		_, err = conn.Write(gqserver.AddRecordLayer(data, []byte{0x17}, []byte{0x03, 0x03}))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// stallingServer sends the ServerHello in answer to the ClientHello on conn, or
+// only the start of it if inside is set, and then reads without sending anything
+func stallingServer(conn net.Conn, inside bool) {
+	defer conn.Close()
+	buf := make([]byte, 20480)
+	i, err := gqserver.ReadTillDrain(conn, buf)
+	if err != nil {
+		return
+	}
+	ch, err := gqserver.ParseClientHello(buf[:i])
+	if err != nil {
+		return
+	}
+	reply := gqserver.ComposeReply(ch)
+	serverHello := reply[:5+gqserver.BtoInt(reply[3:5])]
+	if inside {
+		serverHello = serverHello[:20]
+	}
+	conn.Write(serverHello)
+	io.Copy(ioutil.Discard, conn)
+}
+
+// useFakeServer makes dialRemote connect to an in-memory fakeServer.
+// The returned pointer is set to true once dialRemote is called
+func useFakeServer(key string, failAt int) *bool {
+	dialed := false
+	dialRemote = func(addr string, fastOpen bool, data []byte) (net.Conn, error) {
+		dialed = true
+		client, server := net.Pipe()
+		go fakeServer(server, key, failAt)
+		if fastOpen {
+			go client.Write(data)
+		}
+		return client, nil
+	}
+	return &dialed
+}
+
+func makeTestState() *gqclient.State {
+	sta := &gqclient.State{
+		SS_REMOTE_HOST: "127.0.0.1",
+		SS_REMOTE_PORT: "443",
+		Now:            time.Now,
+		Opaque:         gqclient.BtoInt(gqclient.CryptoRandBytes(32)),
+		Key:            "testkey",
+		TicketTimeHint: 3600,
+		ServerName:     "www.example.com",
+		Browser:        "chrome",
+	}
+	sta.SetAESKey()
+	return sta
+}
+
+// startSS makes a connection from SS to the plugin and sends first through it.
+// It returns the SS end of the connection
+func startSS(sta *gqclient.State, first []byte) net.Conn {
+	ss, plugin := net.Pipe()
+	go ss.Write(first)
+	initSequence(plugin, sta)
+	return ss
+}
+
+// isClosed checks if the SS end of the connection has been closed by the plugin
+func isClosed(ss net.Conn) bool {
+	ss.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := ss.Read(make([]byte, 1))
+	return err == io.EOF
+}
+
+func TestInitSequence(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	for _, fastOpen := range []bool{false, true} {
+		useFakeServer("testkey", failNever)
+		sta := makeTestState()
+		sta.FastOpen = fastOpen
+		// gq-server's handshake must pass
+		sta.DetectInterception = fastOpen
+		// gq-server must ignore extensions it doesn't know
+		sta.RawExtensions = []string{"eeee000100"}
+		ss := startSS(sta, []byte("first"))
+
+		// The first data goes with the handshake, the second through the relay
+		for i, exp := range [][]byte{[]byte("first"), []byte("second")} {
+			if i != 0 {
+				ss.Write(exp)
+			}
+			got := make([]byte, len(exp))
+			ss.SetReadDeadline(time.Now().Add(time.Second))
+			_, err := io.ReadFull(ss, got)
+			if err != nil || !bytes.Equal(got, exp) {
+				t.Error(
+					"For", "FastOpen", fastOpen,
+					"expected", string(exp),
+					"got", string(got), err,
+				)
+			}
+		}
+		ss.Close()
+	}
+}
+
+func TestEarlyServerData(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	// A server that sends data straight after its handshake, before it has read
+	// our reply, as one that pushes data early would. It's over TCP since a
+	// net.Pipe would block the server until the client read what it wrote
+	dialRemote = func(addr string, fastOpen bool, data []byte) (net.Conn, error) {
+		client, server := tcpPair(t)
+		go func() {
+			defer server.Close()
+			buf := make([]byte, 20480)
+			i, err := gqserver.ReadTillDrain(server, buf)
+			if err != nil {
+				return
+			}
+			ch, err := gqserver.ParseClientHello(buf[:i])
+			if err != nil {
+				return
+			}
+			server.Write(append(gqserver.ComposeReply(ch), gqserver.AddRecordLayer([]byte("early"), []byte{0x17}, []byte{0x03, 0x03})...))
+			for {
+				if _, err = gqserver.ReadTillDrain(server, buf); err != nil {
+					return
+				}
+			}
+		}()
+		return client, nil
+	}
+	sta := makeTestState()
+	ss := startSS(sta, []byte("first"))
+	got := make([]byte, 5)
+	ss.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := io.ReadFull(ss, got)
+	if err != nil || string(got) != "early" {
+		t.Error("For", "data from the server before our reply", "expected", "early", "got", string(got), err)
+	}
+	ss.Close()
+}
+
+func TestServerAlert(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	buf := &logBuffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+	remoteClosed := make(chan bool, 1)
+	dialRemote = func(addr string, fastOpen bool, data []byte) (net.Conn, error) {
+		client, server := tcpPair(t)
+		go func() {
+			defer server.Close()
+			gqserver.ReadTillDrain(server, make([]byte, 20480))
+			// handshake_failure, as a TLS server that doesn't like the ClientHello sends
+			server.Write(gqserver.AddRecordLayer([]byte{0x02, 0x28}, []byte{0x15}, []byte{0x03, 0x03}))
+			_, err := server.Read(make([]byte, 1))
+			remoteClosed <- err == io.EOF
+		}()
+		return client, nil
+	}
+	ss := startSS(makeTestState(), []byte("first"))
+	if !isClosed(ss) {
+		t.Error("For", "SS after an alert", "expected", "closed", "got", "open")
+	}
+	select {
+	case closed := <-remoteClosed:
+		if !closed {
+			t.Error("For", "the remote after an alert", "expected", "closed", "got", "an error")
+		}
+	case <-time.After(time.Second):
+		t.Error("For", "the remote after an alert", "expected", "closed", "got", "open")
+	}
+	if !strings.Contains(buf.String(), "Alert from server: handshake_failure") {
+		t.Error("For", "an alert", "expected", "it logged", "got", buf.String())
+	}
+}
+
+func TestLargeFirstData(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	first := make([]byte, 5000)
+	for i := range first {
+		first[i] = byte(i)
+	}
+	cases := []struct {
+		maxRecord int
+		sizing    string
+		// The sizes of the records, which fakeServer echoes one for one
+		exp string
+	}{
+		{0, "", "[5000]"},
+		{1000, "", "[1000 1000 1000 1000 1000]"},
+		{0, "dynamic", "[1208 1208 1208 1208 168]"},
+	}
+	for _, c := range cases {
+		useFakeServer("testkey", failNever)
+		sta := makeTestState()
+		sta.MaxRecordSize = c.maxRecord
+		sta.RecordSizing = c.sizing
+		ss := startSS(sta, first)
+		var got []byte
+		var sizes []int
+		buf := make([]byte, 20480)
+		for len(got) < len(first) {
+			ss.SetReadDeadline(time.Now().Add(time.Second))
+			i, err := ss.Read(buf)
+			if err != nil {
+				break
+			}
+			got = append(got, buf[:i]...)
+			sizes = append(sizes, i)
+		}
+		if !bytes.Equal(got, first) || fmt.Sprint(sizes) != c.exp {
+			t.Error(
+				"For", "MaxRecordSize", c.maxRecord, "RecordSizing", c.sizing,
+				"expected", "all 5000 bytes in order in", c.exp,
+				"got", len(got), "bytes in", sizes,
+			)
+		}
+		ss.Close()
+	}
+}
+
+func TestHelloTemplate(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	useFakeServer("testkey", failNever)
+	sta := makeTestState()
+	tmpl, err := TLS.MakeHelloTemplate(TLS.ComposeInitHandshake(sta))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sta.Browser = "template"
+	sta.Template = tmpl
+	ss := startSS(sta, []byte("first"))
+	got := make([]byte, 5)
+	ss.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadFull(ss, got)
+	if err != nil || string(got) != "first" {
+		t.Error("For", "Browser template", "expected", "first", "got", string(got), err)
+	}
+	ss.Close()
+}
+
+func TestDialer(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	dialed := useFakeServer("testkey", failNever)
+	sta := makeTestState()
+	// FastOpen can't be used with a Dialer
+	sta.FastOpen = true
+	var dialedAddr string
+	sta.Dialer = func(network, addr string) (net.Conn, error) {
+		dialedAddr = addr
+		client, server := net.Pipe()
+		go fakeServer(server, "testkey", failNever)
+		return client, nil
+	}
+	ss := startSS(sta, []byte("first"))
+	got := make([]byte, 5)
+	ss.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := io.ReadFull(ss, got)
+	if err != nil || string(got) != "first" || dialedAddr != "127.0.0.1:443" || *dialed {
+		t.Error(
+			"For", "Dialer",
+			"expected", "first through Dialer to 127.0.0.1:443",
+			"got", string(got), err, dialedAddr, *dialed,
+		)
+	}
+	ss.Close()
+}
+
+// resetConn is a connection that's reset on its first read, before anything comes
+// from the server
+type resetConn struct {
+	net.Conn
+}
+
+func (c resetConn) Read(b []byte) (int, error) {
+	return 0, &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+}
+
+func TestFastOpenFallback(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	defer atomic.StoreInt32(&tfoBlocked, 0)
+	for _, failure := range []string{"refused", "reset"} {
+		atomic.StoreInt32(&tfoBlocked, 0)
+		var dials []bool
+		dialRemote = func(addr string, fastOpen bool, data []byte) (net.Conn, error) {
+			dials = append(dials, fastOpen)
+			client, server := net.Pipe()
+			switch {
+			case fastOpen && failure == "refused":
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+			case fastOpen:
+				go io.Copy(ioutil.Discard, server)
+				return resetConn{client}, nil
+			}
+			go fakeServer(server, "testkey", failNever)
+			return client, nil
+		}
+		sta := makeTestState()
+		sta.FastOpen = true
+		// The second connection doesn't try fast open again
+		for c := 0; c < 2; c++ {
+			ss := startSS(sta, []byte("first"))
+			got := make([]byte, 5)
+			ss.SetReadDeadline(time.Now().Add(time.Second))
+			_, err := io.ReadFull(ss, got)
+			if err != nil || string(got) != "first" {
+				t.Error("For", "FastOpen", failure, "expected", "first", "got", string(got), err)
+			}
+			ss.Close()
+		}
+		if fmt.Sprint(dials) != "[true false false]" {
+			t.Error("For", "FastOpen", failure, "expected", "dials with fast open", "[true false false]", "got", dials)
+		}
+	}
+
+	// Any other failure isn't retried
+	atomic.StoreInt32(&tfoBlocked, 0)
+	dials := 0
+	dialRemote = func(addr string, fastOpen bool, data []byte) (net.Conn, error) {
+		dials++
+		return nil, errors.New("no route")
+	}
+	sta := makeTestState()
+	sta.FastOpen = true
+	_, _, err := remoteHandshake(sta, nil, nil)
+	if err == nil || dials != 1 || atomic.LoadInt32(&tfoBlocked) != 0 {
+		t.Error("For", "FastOpen", "other failure", "expected", "1 dial", "got", dials, err)
+	}
+}
+
+// writeSizes keeps the size of each write to its net.Conn
+type writeSizes struct {
+	net.Conn
+	sync.Mutex
+	sizes []int
+}
+
+func (w *writeSizes) Write(b []byte) (int, error) {
+	w.Lock()
+	w.sizes = append(w.sizes, len(b))
+	w.Unlock()
+	return w.Conn.Write(b)
+}
+
+func TestClientHelloSplit(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	for _, split := range []int{0, 1, 100, 100000} {
+		var conn *writeSizes
+		dialRemote = func(addr string, fastOpen bool, data []byte) (net.Conn, error) {
+			client, server := net.Pipe()
+			go fakeServer(server, "testkey", failNever)
+			conn = &writeSizes{Conn: client}
+			return conn, nil
+		}
+		sta := makeTestState()
+		sta.ClientHelloSplit = split
+		ss := startSS(sta, []byte("first"))
+		got := make([]byte, 5)
+		ss.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := io.ReadFull(ss, got)
+		conn.Lock()
+		sizes := conn.sizes
+		conn.Unlock()
+		// The first write is the whole ClientHello if it isn't split
+		first := split
+		if split == 0 || split == 100000 {
+			first = 5 + gqclient.BtoInt(TLS.ComposeInitHandshake(sta)[3:5])
+		}
+		if err != nil || string(got) != "first" || len(sizes) == 0 || sizes[0] != first {
+			t.Error(
+				"For", "ClientHelloSplit", split,
+				"expected", "first relayed after a first write of", first,
+				"got", string(got), err, sizes,
+			)
+		}
+		ss.Close()
+	}
+}
+
+func TestRetryWithNewFingerprint(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	for _, retry := range []bool{false, true} {
+		dials := 0
+		dialRemote = func(addr string, fastOpen bool, data []byte) (net.Conn, error) {
+			dials++
+			client, server := net.Pipe()
+			// Only the first handshake is rejected
+			failAt := failNever
+			if dials == 1 {
+				failAt = failOnClientHello
+			}
+			go fakeServer(server, "testkey", failAt)
+			return client, nil
+		}
+		sta := makeTestState()
+		sta.RetryWithNewFingerprint = retry
+		ss := startSS(sta, []byte("first"))
+		got := make([]byte, 5)
+		ss.SetReadDeadline(time.Now().Add(time.Second))
+		io.ReadFull(ss, got)
+		if (string(got) == "first") != retry {
+			t.Error(
+				"For", "RetryWithNewFingerprint", retry,
+				"expected", "first relayed", retry,
+				"got", string(got), dials,
+			)
+		}
+		ss.Close()
+	}
+
+	for _, browser := range gqclient.Browsers {
+		sta := makeTestState()
+		sta.Browser = browser
+		for c := 0; c < 20; c++ {
+			other := otherBrowser(sta)
+			if other == browser || other == "chrome" || (browser == "chrome" && other == "chrome-64") {
+				t.Error(
+					"For", browser,
+					"expected", "another browser",
+					"got", other,
+				)
+			}
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	var dials int32
+	dialRemote = func(addr string, fastOpen bool, data []byte) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		client, server := net.Pipe()
+		// A server that takes the ClientHello and never answers
+		go io.Copy(ioutil.Discard, server)
+		return client, nil
+	}
+	sta := makeTestState()
+	sta.RetryBudget = 1
+	sta.RetryWithNewFingerprint = true
+	sta.HedgeConnections = true
+	sta.HedgeDelay = 1500
+	start := time.Now()
+	_, _, err := remoteHandshake(sta, nil, nil)
+	took := time.Since(start)
+	if err == nil || took > 1500*time.Millisecond || atomic.LoadInt32(&dials) != 1 {
+		t.Error("For", "a server that doesn't answer", "expected", "one attempt failing after 1s", "got", err, took, atomic.LoadInt32(&dials))
+	}
+
+	// So is one that stalls partway through its handshake, even though every read
+	// is of a record the server has started
+	sta.HedgeConnections = false
+	for _, stall := range []string{"after the ServerHello", "inside the ServerHello"} {
+		dialRemote = func(addr string, fastOpen bool, data []byte) (net.Conn, error) {
+			client, server := net.Pipe()
+			go stallingServer(server, stall == "inside the ServerHello")
+			return client, nil
+		}
+		start = time.Now()
+		_, _, err = remoteHandshake(sta, nil, nil)
+		took = time.Since(start)
+		if err == nil || took > 1500*time.Millisecond {
+			t.Error("For", "a server that stalls "+stall, "expected", "failing after 1s", "got", err, took)
+		}
+	}
+
+	// A dial that hangs is given up on too
+	dialed := make(chan struct{})
+	dialRemote = func(addr string, fastOpen bool, data []byte) (net.Conn, error) {
+		defer close(dialed)
+		time.Sleep(1500 * time.Millisecond)
+		return nil, errors.New("too late")
+	}
+	start = time.Now()
+	_, _, err = remoteHandshake(sta, nil, nil)
+	took = time.Since(start)
+	if err != errBudgetUsedUp || took > 1400*time.Millisecond {
+		t.Error("For", "a dial that hangs", "expected", errBudgetUsedUp, "got", err, took)
+	}
+	// The dial has to be done before the next test replaces dialRemote
+	<-dialed
+}
+
+func TestHedgeConnections(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	// The first server either never answers or rejects the ClientHello
+	for _, firstFails := range []bool{false, true} {
+		stuck := make(chan net.Conn, 1)
+		dialRemote = func(addr string, fastOpen bool, data []byte) (net.Conn, error) {
+			client, server := net.Pipe()
+			switch {
+			case addr != "first:443":
+				go fakeServer(server, "testkey", failNever)
+			case firstFails:
+				go fakeServer(server, "testkey", failOnClientHello)
+			default:
+				stuck <- server
+				go io.Copy(ioutil.Discard, server)
+			}
+			return client, nil
+		}
+		sta := makeTestState()
+		sta.ServerPool = gqclient.NewServerPool([]string{"first:443", "second:443"})
+		sta.HedgeConnections = true
+		sta.HedgeDelay = 100
+		if firstFails {
+			// The second one starts as soon as the first fails
+			sta.HedgeDelay = 10000
+		}
+		start := time.Now()
+		ss := startSS(sta, []byte("first"))
+		got := make([]byte, 5)
+		ss.SetReadDeadline(time.Now().Add(2 * time.Second))
+		io.ReadFull(ss, got)
+		if string(got) != "first" || time.Since(start) > 2*time.Second {
+			t.Error(
+				"For", "HedgeConnections with the first server failing", firstFails,
+				"expected", "first relayed through the second server",
+				"got", string(got), time.Since(start),
+			)
+		}
+		ss.Close()
+		if !firstFails {
+			(<-stuck).Close()
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	var dialed []string
+	firstDown := true
+	dialRemote = func(addr string, fastOpen bool, data []byte) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if addr == "first:443" && firstDown {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		go fakeServer(server, "testkey", failNever)
+		return client, nil
+	}
+	sta := makeTestState()
+	sta.ServerPool = gqclient.NewServerPool([]string{"first:443", "second:443"})
+	for i := 0; i < 2; i++ {
+		dialed = nil
+		ss := startSS(sta, []byte("first"))
+		got := make([]byte, 5)
+		ss.SetReadDeadline(time.Now().Add(2 * time.Second))
+		io.ReadFull(ss, got)
+		ss.Close()
+		// Once the second has worked it's kept to
+		exp := "second:443"
+		if i == 0 {
+			exp = "first:443 second:443"
+		}
+		if string(got) != "first" || strings.Join(dialed, " ") != exp {
+			t.Error(
+				"For", "connection", i, "with the first server down",
+				"expected", exp,
+				"got", string(got), dialed,
+			)
+		}
+	}
+
+	// Even once the first is back
+	firstDown = false
+	dialed = nil
+	ss := startSS(sta, []byte("first"))
+	ss.Close()
+	if strings.Join(dialed, " ") != "second:443" {
+		t.Error(
+			"For", "the first server back",
+			"expected", "second:443",
+			"got", dialed,
+		)
+	}
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	lookupIP = func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}, nil
+	}
+	defer func() { lookupIP = net.LookupIP }()
+	for _, v6Works := range []bool{true, false} {
+		dialed := make(chan string, 2)
+		// The IPv6 dial doesn't get anywhere until the test is over
+		unstuck := make(chan struct{})
+		dialRemote = func(addr string, fastOpen bool, data []byte) (net.Conn, error) {
+			dialed <- addr
+			if addr == "[2001:db8::1]:443" && !v6Works {
+				<-unstuck
+				return nil, errors.New("timed out")
+			}
+			client, server := net.Pipe()
+			go fakeServer(server, "testkey", failNever)
+			return client, nil
+		}
+		sta := makeTestState()
+		sta.SS_REMOTE_HOST = "example.com"
+		sta.HappyEyeballs = true
+		ss := startSS(sta, []byte("first"))
+		got := make([]byte, 5)
+		ss.SetReadDeadline(time.Now().Add(2 * time.Second))
+		io.ReadFull(ss, got)
+		exp := []string{"[2001:db8::1]:443"}
+		if !v6Works {
+			exp = append(exp, "192.0.2.1:443")
+		}
+		var addrs []string
+		for len(dialed) != 0 {
+			addrs = append(addrs, <-dialed)
+		}
+		if string(got) != "first" || strings.Join(addrs, " ") != strings.Join(exp, " ") {
+			t.Error(
+				"For", "HappyEyeballs with IPv6 working", v6Works,
+				"expected", exp,
+				"got", string(got), addrs,
+			)
+		}
+		ss.Close()
+		close(unstuck)
+	}
+}
+
+func TestDNSRetries(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	defer func() { lookupIP = net.LookupIP }()
+	for _, retries := range []int{1, 2} {
+		// The first lookup fails straight away and the second never finishes
+		unstuck := make(chan struct{})
+		var lookups int32
+		lookupIP = func(host string) ([]net.IP, error) {
+			switch atomic.AddInt32(&lookups, 1) {
+			case 1:
+				return nil, errors.New("server misbehaving")
+			case 2:
+				<-unstuck
+				return nil, errors.New("too late")
+			}
+			return []net.IP{net.ParseIP("192.0.2.1")}, nil
+		}
+		var dialedAddr string
+		dialRemote = func(addr string, fastOpen bool, data []byte) (net.Conn, error) {
+			dialedAddr = addr
+			client, server := net.Pipe()
+			go fakeServer(server, "testkey", failNever)
+			return client, nil
+		}
+		sta := makeTestState()
+		sta.SS_REMOTE_HOST = "example.com"
+		sta.DNSRetries = retries
+		sta.DNSTimeoutMs = 100
+		_, conn, err := remoteHandshake(sta, nil, nil)
+		if retries == 2 && (err != nil || dialedAddr != "192.0.2.1:443") {
+			t.Error("For", "DNSRetries", retries, "expected", "192.0.2.1:443", "got", dialedAddr, err)
+		} else if retries == 1 && (err == nil || dialedAddr != "") {
+			t.Error("For", "DNSRetries", retries, "expected", "DNS failure", "got", dialedAddr, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		close(unstuck)
+	}
+}
+
+func TestSmokeTest(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	useFakeServer("testkey", failNever)
+	sta := makeTestState()
+	if err := smokeTestOne(sta, "127.0.0.1:443", 1000); err != nil {
+		t.Error("For", "working server", "expected", nil, "got", err)
+	}
+	sta.Compress = true
+	if err := smokeTestOne(sta, "127.0.0.1:443", 1000); err != nil {
+		t.Error("For", "Compress", "expected", nil, "got", err)
+	}
+
+	useFakeServer("testkey", failOnClientHello)
+	err := smokeTestOne(makeTestState(), "127.0.0.1:443", 1000)
+	if err == nil || !strings.Contains(err.Error(), "serverread") {
+		t.Error("For", "ClientHello rejected", "expected", "failure at serverread", "got", err)
+	}
+	useFakeServer("otherkey", failNever)
+	if err := smokeTestOne(makeTestState(), "127.0.0.1:443", 1000); err == nil {
+		t.Error("For", "wrong key", "expected", "failure", "got", nil)
+	}
+}
+
+func TestInitSequenceFailure(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	stages := map[string]int{
+		"ClientHello rejected":    failOnClientHello,
+		"ServerHello only":        failAfterServerHello,
+		"reply rejected":          failOnReply,
+		"server with another key": failNever,
+	}
+	for name, stage := range stages {
+		key := "testkey"
+		if name == "server with another key" {
+			key = "anotherkey"
+		}
+		useFakeServer(key, stage)
+		ss := startSS(makeTestState(), []byte("first"))
+		if !isClosed(ss) {
+			t.Error(
+				"For", name,
+				"expected", "SS connection closed",
+				"got", "still open",
+			)
+		}
+	}
+
+	dialRemote = func(addr string, fastOpen bool, data []byte) (net.Conn, error) {
+		return nil, errors.New("unreachable")
+	}
+	ss := startSS(makeTestState(), []byte("first"))
+	if !isClosed(ss) {
+		t.Error(
+			"For", "remote unreachable",
+			"expected", "SS connection closed",
+			"got", "still open",
+		)
+	}
+}
+
+func TestInitSequenceEmptyConnection(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	dialed := useFakeServer("testkey", failNever)
+	ss, plugin := net.Pipe()
+	ss.Close()
+	initSequence(plugin, makeTestState())
+	if *dialed {
+		t.Error(
+			"For", "SS closing without sending anything",
+			"expected", "no connection to remote",
+			"got", "connected",
+		)
+	}
+}
+
+func TestMaxBytesPerConn(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	useFakeServer("testkey", failNever)
+	sta := makeTestState()
+	// "first" sent and echoed back
+	sta.MaxBytesPerConn = 10
+	ss := startSS(sta, []byte("first"))
+	got := make([]byte, 5)
+	ss.SetReadDeadline(time.Now().Add(time.Second))
+	io.ReadFull(ss, got)
+	if !isClosed(ss) {
+		t.Error(
+			"For", "10 bytes relayed",
+			"expected", "SS connection closed",
+			"got", "still open",
+		)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	useFakeServer("testkey", failNever)
+	sta := makeTestState()
+	sta.IdleTimeout = 1
+	ss := startSS(sta, []byte("first"))
+	got := make([]byte, 5)
+	ss.SetReadDeadline(time.Now().Add(time.Second))
+	io.ReadFull(ss, got)
+	// Still open while there's data
+	time.Sleep(600 * time.Millisecond)
+	ss.Write([]byte("more"))
+	io.ReadFull(ss, got[:4])
+	time.Sleep(600 * time.Millisecond)
+	ss.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := ss.Read(got); err == io.EOF {
+		t.Error("For", "a connection with data", "expected", "still open", "got", "closed")
+	}
+	ss.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := ss.Read(got); err != io.EOF {
+		t.Error("For", "IdleTimeout 1", "expected", "SS connection closed", "got", err)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	servers := map[string]func(net.Conn){
+		// A server that takes the ClientHello and never answers
+		"no answer": func(server net.Conn) { io.Copy(ioutil.Discard, server) },
+		// One that stops once the ServerHello has been read
+		"a ServerHello alone": func(server net.Conn) { stallingServer(server, false) },
+	}
+	for name, serve := range servers {
+		dialRemote = func(addr string, fastOpen bool, data []byte) (net.Conn, error) {
+			client, server := net.Pipe()
+			go serve(server)
+			return client, nil
+		}
+		sta := makeTestState()
+		sta.HandshakeTimeout = 1
+		start := time.Now()
+		ss := startSS(sta, []byte("first"))
+		if !isClosed(ss) || time.Since(start) > 1500*time.Millisecond {
+			t.Error("For", "HandshakeTimeout 1 with "+name, "expected", "SS connection closed within it", "got", time.Since(start))
+		}
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	useFakeServer("testkey", failNever)
+	sta := makeTestState()
+	// However many other tests have left open, this is over the limit
+	atomic.AddInt32(&openConns, 1000)
+	defer atomic.AddInt32(&openConns, -1000)
+	sta.MaxConnections = 1
+	ss := startSS(sta, []byte("first"))
+	if !isClosed(ss) {
+		t.Error("For", "MaxConnections reached", "expected", "SS connection closed", "got", "still open")
+	}
+
+	sta.MaxConnections = 100000
+	before := atomic.LoadInt32(&openConns)
+	ss = startSS(sta, []byte("first"))
+	got := make([]byte, 5)
+	ss.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(ss, got); err != nil {
+		t.Error("For", "MaxConnections not reached", "expected", "first", "got", err)
+	}
+	ss.Close()
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&openConns); n > before {
+		t.Error("For", "a closed connection", "expected", "no longer counted", "got", n, "from", before)
+	}
+}
+
+func TestReplyDelay(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	for i := 0; i < 100; i++ {
+		if d := replyDelay(40); d < 20*time.Millisecond || d > 40*time.Millisecond {
+			t.Error("For", "ReplyDelayMaxMs 40", "expected", "between 20ms and 40ms", "got", d)
+			break
+		}
+	}
+
+	useFakeServer("testkey", failNever)
+	sta := makeTestState()
+	sta.ReplyDelayMaxMs = 100
+	start := time.Now()
+	ss := startSS(sta, []byte("first"))
+	got := make([]byte, 5)
+	ss.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := io.ReadFull(ss, got)
+	if err != nil || string(got) != "first" {
+		t.Error("For", "ReplyDelayMaxMs 100", "expected", "first", "got", string(got), err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Error("For", "ReplyDelayMaxMs 100", "expected", "at least 50ms", "got", elapsed)
+	}
+	ss.Close()
+}
+
+func TestConnJitter(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	var longest time.Duration
+	for i := 0; i < 100; i++ {
+		d := connJitter(40)
+		if d < 0 || d > 40*time.Millisecond {
+			t.Error("For", "ConnJitterMaxMs 40", "expected", "up to 40ms", "got", d)
+			break
+		}
+		if d > longest {
+			longest = d
+		}
+	}
+	if longest == 0 {
+		t.Error("For", "ConnJitterMaxMs 40", "expected", "some delay", "got", longest)
+	}
+
+	useFakeServer("testkey", failNever)
+	sta := makeTestState()
+	sta.ConnJitterMaxMs = 50
+	ss := startSS(sta, []byte("first"))
+	got := make([]byte, 5)
+	ss.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := io.ReadFull(ss, got)
+	if err != nil || string(got) != "first" {
+		t.Error("For", "ConnJitterMaxMs 50", "expected", "first", "got", string(got), err)
+	}
+	ss.Close()
+}
+
+func TestWarmPool(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	useFakeServer("testkey", failNever)
+	sta := makeTestState()
+	sta.WarmPoolSize = 2
+	var servers []net.Conn
+	var mu sync.Mutex
+	sta.Dialer = func(network, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go fakeServer(server, "testkey", failNever)
+		mu.Lock()
+		servers = append(servers, server)
+		mu.Unlock()
+		return client, nil
+	}
+	dialed := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(servers)
+	}
+	pooled := func() int {
+		warm.mu.Lock()
+		defer warm.mu.Unlock()
+		return len(warm.conns)
+	}
+	waitFor := func(cond func() bool) bool {
+		for i := 0; i < 100 && !cond(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return cond()
+	}
+	currentState.Store(sta)
+	defer func() {
+		// A copy, as handshakes for the pool may still be reading sta
+		stopped := *sta
+		stopped.WarmPoolSize = 0
+		currentState.Store(&stopped)
+		warm.flush()
+	}()
+	go warm.fill()
+	if !waitFor(func() bool { return pooled() == 2 }) {
+		t.Error("For", "WarmPoolSize 2", "expected", 2, "got", pooled())
+	}
+
+	// The first data goes through a connection from the pool, which is replaced
+	ss := startSS(sta, []byte("first"))
+	got := make([]byte, 5)
+	ss.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := io.ReadFull(ss, got)
+	if err != nil || string(got) != "first" {
+		t.Error("For", "a connection from the pool", "expected", "first", "got", string(got), err)
+	}
+	ss.Close()
+	if !waitFor(func() bool { return dialed() == 3 && pooled() == 2 }) {
+		t.Error("For", "a connection taken from the pool", "expected", "3 dialed, 2 pooled", "got", dialed(), pooled())
+	}
+
+	// One closed by the server is replaced
+	mu.Lock()
+	servers[1].Close()
+	mu.Unlock()
+	if !waitFor(func() bool { return dialed() == 4 && pooled() == 2 }) {
+		t.Error("For", "a pooled connection closed by the server", "expected", "4 dialed, 2 pooled", "got", dialed(), pooled())
+	}
+
+	// A reload replaces all of them
+	warm.flush()
+	if !waitFor(func() bool { return dialed() == 6 && pooled() == 2 }) {
+		t.Error("For", "flush", "expected", "6 dialed, 2 pooled", "got", dialed(), pooled())
+	}
+
+	// Data from SS right after the server closes the pooled connections still gets
+	// through, on a new one
+	mu.Lock()
+	servers[4].Close()
+	servers[5].Close()
+	mu.Unlock()
+	ss = startSS(sta, []byte("again"))
+	ss.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadFull(ss, got)
+	if err != nil || string(got) != "again" {
+		t.Error("For", "pooled connections closed by the server", "expected", "again", "got", string(got), err)
+	}
+	ss.Close()
+}
+
+func TestTicketPeriodLeft(t *testing.T) {
+	sta := makeTestState()
+	cases := map[int64]time.Duration{
+		7200:        time.Hour,
+		7200 + 1800: 30 * time.Minute,
+		7200 + 3599: time.Second,
+	}
+	for unix, exp := range cases {
+		now := time.Unix(unix, 0)
+		sta.Now = func() time.Time { return now }
+		if got := ticketPeriodLeft(sta); got != exp {
+			t.Error("For", now, "expected", exp, "got", got)
+		}
+	}
+}
+
+func TestBlackHole(t *testing.T) {
+	var stalled int32
+	sendStalled = func(conn net.Conn) (bool, bool) {
+		return atomic.LoadInt32(&stalled) == 1, true
+	}
+	defer func() { sendStalled = gqclient.SendStalled }()
+	ss, pluginSS := net.Pipe()
+	remote, pluginRemote := net.Pipe()
+	p := &pair{
+		ss:              pluginSS,
+		remote:          pluginRemote,
+		tracked:         tracker.Add("ss", "remote"),
+		blackHole:       20 * time.Millisecond,
+		blackHoleRecord: 1000,
+	}
+	go p.ssToRemote()
+	defer p.closePipe()
+	readRecord := func() int {
+		remote.SetReadDeadline(time.Now().Add(time.Second))
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(remote, header); err != nil {
+			return -1
+		}
+		length := gqclient.BtoInt(header[3:5])
+		io.ReadFull(remote, make([]byte, length))
+		return length
+	}
+	send := func() {
+		go ss.Write(make([]byte, 5000))
+	}
+
+	// Not stalled, so records stay large
+	send()
+	got := readRecord()
+	time.Sleep(50 * time.Millisecond)
+	if got != 5000 || atomic.LoadInt32(&p.shrunk) != 0 {
+		t.Error("For", "no stall", "expected", 5000, "got", got, atomic.LoadInt32(&p.shrunk))
+	}
+
+	atomic.StoreInt32(&stalled, 1)
+	send()
+	readRecord()
+	time.Sleep(50 * time.Millisecond)
+	// The read already waiting for SS has the old size
+	send()
+	readRecord()
+	send()
+	var sizes []int
+	for n := 0; n < 5000; {
+		size := readRecord()
+		if size <= 0 {
+			break
+		}
+		sizes = append(sizes, size)
+		n += size
+	}
+	if fmt.Sprint(sizes) != "[1000 1000 1000 1000 1000]" {
+		t.Error("For", "a stalled connection", "expected", "[1000 1000 1000 1000 1000]", "got", sizes)
+	}
+}
+
+func TestMTUSearch(t *testing.T) {
+	remote := "search.test:443"
+	s := newMTUSearch(remote, autoMTUMax)
+	for steps := 0; steps < 20; steps++ {
+		size := s.size()
+		if _, done := s.result(size, size > 1400); done {
+			break
+		}
+	}
+	if got := s.size(); got > 1400 || got <= 1400-autoMTUStep {
+		t.Error("For", "a path that stalls over 1400 bytes", "expected", "just under 1400", "got", got)
+	}
+	if got := newMTUSearch(remote, autoMTUMax); got.size() != s.size() {
+		t.Error("For", "a cached size", "expected", s.size(), "got", got.size())
+	}
+	if got := newMTUSearch("other.test:443", 1000).size(); got != 1000 {
+		t.Error("For", "a MaxRecordSize of 1000", "expected", 1000, "got", got)
+	}
+
+	s = newMTUSearch("small.test:443", autoMTUMax)
+	s.result(s.size(), true)
+	if next, done := s.result(autoMTUMin, true); !done || next != autoMTUMin {
+		t.Error("For", "everything stalling", "expected", autoMTUMin, "got", next, done)
+	}
+}
+
+func TestAutoMTU(t *testing.T) {
+	// Records of over 3000 bytes stall until the next check
+	ws := &writeSizes{}
+	checked := 0
+	sendStalled = func(conn net.Conn) (bool, bool) {
+		ws.Lock()
+		defer ws.Unlock()
+		stalled := false
+		for _, size := range ws.sizes[checked:] {
+			stalled = stalled || size-5 > 3000
+		}
+		checked = len(ws.sizes)
+		return stalled, true
+	}
+	defer func() { sendStalled = gqclient.SendStalled }()
+	ss, pluginSS := net.Pipe()
+	remote, pluginRemote := net.Pipe()
+	ws.Conn = pluginRemote
+	p := &pair{
+		ss:        pluginSS,
+		remote:    ws,
+		tracked:   tracker.Add("ss", "remote"),
+		blackHole: 10 * time.Millisecond,
+		mtu:       newMTUSearch("automtu.test:443", autoMTUMax),
+	}
+	p.setRecordCap(p.mtu.size())
+	go p.ssToRemote()
+	defer p.closePipe()
+	go io.Copy(ioutil.Discard, remote)
+
+	for c := 0; c < 100 && atomic.LoadInt32(&p.stallCheck) != 2; c++ {
+		ss.Write(make([]byte, 5000))
+		time.Sleep(30 * time.Millisecond)
+	}
+	if size := int(atomic.LoadInt32(&p.shrunk)); atomic.LoadInt32(&p.stallCheck) != 2 || size > 3000 || size <= 3000-autoMTUStep {
+		t.Error("For", "a path that stalls over 3000 bytes", "expected", "just under 3000", "got", size)
+	}
+	ws.Lock()
+	last := ws.sizes[len(ws.sizes)-1] - 5
+	ws.Unlock()
+	if last > 3000 {
+		t.Error("For", "records once the search is done", "expected", "at most 3000", "got", last)
+	}
+}
+
+// tcpPair makes a loopback TCP connection and returns both ends
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	a, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+func TestSSHalfClose(t *testing.T) {
+	ss, pluginSS := tcpPair(t)
+	remote, pluginRemote := tcpPair(t)
+	defer ss.Close()
+	defer remote.Close()
+	p := &pair{
+		ss:      pluginSS,
+		remote:  pluginRemote,
+		tracked: tracker.Add("ss", "remote"),
+	}
+	go p.ssToRemote()
+	go p.remoteToSS()
+	ss.Write([]byte("request"))
+	ss.(*net.TCPConn).CloseWrite()
+
+	// The remote gets the request and then EOF, and can still reply
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	got, err := ioutil.ReadAll(remote)
+	if err != nil || !bytes.Equal(got, TLS.AddRecordLayer([]byte("request"), []byte{0x17}, []byte{0x03, 0x03})) {
+		t.Error("For", "SS half-closing", "expected", "the request then EOF", "got", got, err)
+	}
+	remote.Write(TLS.AddRecordLayer([]byte("response"), []byte{0x17}, []byte{0x03, 0x03}))
+	remote.Close()
+	ss.SetReadDeadline(time.Now().Add(time.Second))
+	got, err = ioutil.ReadAll(ss)
+	if err != nil || string(got) != "response" {
+		t.Error("For", "the remote replying after the half-close", "expected", "response then EOF", "got", string(got), err)
+	}
+}
+
+func TestRemoteHalfClose(t *testing.T) {
+	ss, pluginSS := tcpPair(t)
+	remote, pluginRemote := tcpPair(t)
+	defer ss.Close()
+	defer remote.Close()
+	p := &pair{
+		ss:      pluginSS,
+		remote:  pluginRemote,
+		tracked: tracker.Add("ss", "remote"),
+	}
+	go p.ssToRemote()
+	go p.remoteToSS()
+	remote.Write(TLS.AddRecordLayer([]byte("pushed"), []byte{0x17}, []byte{0x03, 0x03}))
+	remote.(*net.TCPConn).CloseWrite()
+
+	// SS gets the data and then EOF, and can still send
+	ss.SetReadDeadline(time.Now().Add(time.Second))
+	got, err := ioutil.ReadAll(ss)
+	if err != nil || string(got) != "pushed" {
+		t.Error("For", "the remote half-closing", "expected", "pushed then EOF", "got", string(got), err)
+	}
+	ss.Write([]byte("more"))
+	ss.Close()
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	got, err = ioutil.ReadAll(remote)
+	if err != nil || !bytes.Equal(got, TLS.AddRecordLayer([]byte("more"), []byte{0x17}, []byte{0x03, 0x03})) {
+		t.Error("For", "SS sending after the half-close", "expected", "more then EOF", "got", got, err)
+	}
+	if atomic.LoadInt32(&p.closed) != 1 {
+		t.Error("For", "both directions ended", "expected", "pair closed", "got", "open")
+	}
+}
+
+func TestCoalescedRecords(t *testing.T) {
+	ss, pluginSS := tcpPair(t)
+	remote, pluginRemote := tcpPair(t)
+	p := &pair{
+		ss:      pluginSS,
+		remote:  pluginRemote,
+		tracked: tracker.Add("ss", "remote"),
+	}
+	go p.remoteToSS()
+	defer p.closePipe()
+
+	// Two records in one write and a third split across two
+	records := append(TLS.AddRecordLayer([]byte("hello"), []byte{0x17}, []byte{0x03, 0x03}),
+		TLS.AddRecordLayer([]byte("world"), []byte{0x17}, []byte{0x03, 0x03})...)
+	third := TLS.AddRecordLayer([]byte("again"), []byte{0x17}, []byte{0x03, 0x03})
+	remote.Write(append(records, third[:7]...))
+	time.Sleep(20 * time.Millisecond)
+	remote.Write(third[7:])
+
+	got := make([]byte, 15)
+	ss.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := io.ReadFull(ss, got)
+	if err != nil || string(got) != "helloworldagain" {
+		t.Error("For", "coalesced and split records", "expected", "helloworldagain", "got", string(got), err)
+	}
+}
+
+func TestLingerAfterClose(t *testing.T) {
+	ss, pluginSS := net.Pipe()
+	remote, pluginRemote := net.Pipe()
+	p := &pair{
+		ss:      pluginSS,
+		remote:  pluginRemote,
+		linger:  time.Second,
+		tracked: tracker.Add("ss", "remote"),
+	}
+	go p.ssToRemote()
+	go p.remoteToSS()
+	ss.Close()
+
+	// Closed after between 0.5s and 1s
+	remote.SetReadDeadline(time.Now().Add(400 * time.Millisecond))
+	_, err := remote.Read(make([]byte, 1))
+	if err == io.EOF {
+		t.Error(
+			"For", "remote right after SS closed",
+			"expected", "still open",
+			"got", "closed",
+		)
+	}
+	// Data from the remote is thrown away rather than closing the connection
+	go remote.Write(TLS.AddRecordLayer([]byte("late"), []byte{0x17}, []byte{0x03, 0x03}))
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = remote.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Error(
+			"For", "remote after LingerAfterClose",
+			"expected", "closed",
+			"got", err,
+		)
+	}
+}
+
+func TestMaxRecordSize(t *testing.T) {
+	ss, pluginSS := net.Pipe()
+	remote, pluginRemote := net.Pipe()
+	p := &pair{
+		ss:        pluginSS,
+		remote:    pluginRemote,
+		maxRecord: 100,
+		tracked:   tracker.Add("ss", "remote"),
+	}
+	go p.ssToRemote()
+	go ss.Write(make([]byte, 1000))
+	buf := make([]byte, 20480)
+	for got := 0; got < 1000; {
+		remote.SetReadDeadline(time.Now().Add(time.Second))
+		i, err := gqclient.ReadTillDrain(remote, buf)
+		if err != nil || i-5 > 100 {
+			t.Error(
+				"For", "MaxRecordSize 100",
+				"expected", "records of up to 100 bytes",
+				"got", i-5, err,
+			)
+			break
+		}
+		got += i - 5
+	}
+	p.closePipe()
+	ss.Close()
+	remote.Close()
+}
+
+func TestZeroLengthWrite(t *testing.T) {
+	ss, pluginSS := net.Pipe()
+	remote, pluginRemote := net.Pipe()
+	p := &pair{
+		ss:      pluginSS,
+		remote:  pluginRemote,
+		tracked: tracker.Add("ss", "remote"),
+	}
+	go p.ssToRemote()
+	go func() {
+		ss.Write([]byte{})
+		ss.Write([]byte("a"))
+	}()
+	buf := make([]byte, 20480)
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	i, err := gqclient.ReadTillDrain(remote, buf)
+	if err != nil || string(TLS.PeelRecordLayer(buf[:i])) != "a" {
+		t.Error(
+			"For", "a zero-length write from SS",
+			"expected", "no record before the one with a",
+			"got", buf[:i], err,
+		)
+	}
+	p.closePipe()
+	ss.Close()
+	remote.Close()
+}
+
+func TestBufferSizes(t *testing.T) {
+	ss, pluginSS := net.Pipe()
+	remote, pluginRemote := net.Pipe()
+	p := &pair{
+		ss:      pluginSS,
+		remote:  pluginRemote,
+		upBuf:   2048,
+		downBuf: 1024,
+		tracked: tracker.Add("ss", "remote"),
+	}
+	go p.ssToRemote()
+	go p.remoteToSS()
+	go ss.Write(make([]byte, 5000))
+	buf := make([]byte, 20480)
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	i, err := gqclient.ReadTillDrain(remote, buf)
+	if err != nil || i-5 != 2048 {
+		t.Error(
+			"For", "UpBufferSize 2048",
+			"expected", "a record of 2048 bytes",
+			"got", i-5, err,
+		)
+	}
+	// A record that fits is relayed, one that doesn't closes the connection
+	go remote.Write(TLS.AddRecordLayer(make([]byte, 1000), []byte{0x17}, []byte{0x03, 0x03}))
+	ss.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadFull(ss, buf[:1000])
+	if err != nil {
+		t.Error("For", "DownBufferSize 1024", "expected", "a record of 1000 bytes relayed", "got", err)
+	}
+	go remote.Write(TLS.AddRecordLayer(make([]byte, 2000), []byte{0x17}, []byte{0x03, 0x03}))
+	if !isClosed(ss) {
+		t.Error("For", "DownBufferSize 1024", "expected", "closed on a record of 2000 bytes", "got", "open")
+	}
+	p.closePipe()
+	ss.Close()
+	remote.Close()
+}
+
+func TestRecordSizing(t *testing.T) {
+	// recordSizes relays writes from SS through a pair with sizing and returns the
+	// sizes of the records sent to the remote
+	recordSizes := func(sizing string, maxRecord int, firstRecords []int, writes []int) []int {
+		ss, pluginSS := net.Pipe()
+		remote, pluginRemote := net.Pipe()
+		p := &pair{
+			ss:           pluginSS,
+			remote:       pluginRemote,
+			maxRecord:    maxRecord,
+			sizing:       sizing,
+			firstRecords: firstRecords,
+			tracked:      tracker.Add("ss", "remote"),
+		}
+		go p.ssToRemote()
+		total := 0
+		go func() {
+			for _, n := range writes {
+				ss.Write(make([]byte, n))
+			}
+		}()
+		for _, n := range writes {
+			total += n
+		}
+		var sizes []int
+		buf := make([]byte, 20480)
+		for got := 0; got < total; {
+			remote.SetReadDeadline(time.Now().Add(time.Second))
+			i, err := gqclient.ReadTillDrain(remote, buf)
+			if err != nil {
+				break
+			}
+			sizes = append(sizes, i-5)
+			got += i - 5
+		}
+		p.closePipe()
+		ss.Close()
+		remote.Close()
+		return sizes
+	}
+
+	got := fmt.Sprint(recordSizes("fixed", 250, nil, []int{100, 100, 100}))
+	if got != "[250 50]" {
+		t.Error("For", "RecordSizing fixed", "expected", "[250 50]", "got", got)
+	}
+	got = fmt.Sprint(recordSizes("dynamic", 0, nil, []int{3000}))
+	if got != "[1208 1208 584]" {
+		t.Error("For", "RecordSizing dynamic", "expected", "[1208 1208 584]", "got", got)
+	}
+	got = fmt.Sprint(recordSizes("", 0, nil, []int{3000}))
+	if got != "[3000]" {
+		t.Error("For", "no RecordSizing", "expected", "[3000]", "got", got)
+	}
+	// The first went with the handshake
+	got = fmt.Sprint(recordSizes("browser", 0, []int{70, 250, 400}, []int{10, 20, 3000}))
+	if got != "[250 400 2380]" {
+		t.Error("For", "RecordSizing browser", "expected", "[250 400 2380]", "got", got)
+	}
+	p := &pair{sizing: "browser", firstRecords: []int{70, 250, 400}}
+	if p.firstReadLen() != 70 {
+		t.Error("For", "RecordSizing browser", "expected", "a first read of 70", "got", p.firstReadLen())
+	}
+}
+
+func TestStrictRecordValidation(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		ss, pluginSS := net.Pipe()
+		remote, pluginRemote := net.Pipe()
+		p := &pair{
+			ss:      pluginSS,
+			remote:  pluginRemote,
+			strict:  strict,
+			tracked: tracker.Add("ss", "remote"),
+		}
+		go p.remoteToSS()
+		// A handshake record in the middle of application data
+		go func() {
+			remote.Write(TLS.AddRecordLayer([]byte("injected"), []byte{0x16}, []byte{0x03, 0x03}))
+			remote.Write(TLS.AddRecordLayer([]byte("data"), []byte{0x17}, []byte{0x03, 0x03}))
+		}()
+		ss.SetReadDeadline(time.Now().Add(time.Second))
+		got := make([]byte, 8)
+		_, err := io.ReadFull(ss, got)
+		if strict && err == nil || !strict && string(got) != "injected" {
+			t.Error(
+				"For", "StrictRecordValidation", strict,
+				"expected", "forwarded only if not strict",
+				"got", string(got), err,
+			)
+		}
+		p.closePipe()
+		ss.Close()
+		remote.Close()
+	}
+}
+
+func TestThrottledf(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+	logThrottleInterval = 50 * time.Millisecond
+	setLogThrottle(true)
+	defer setLogThrottle(false)
+
+	for i := 0; i < 100; i++ {
+		throttledf("Connecting to remote: %v\n", "refused")
+	}
+	throttledf("Sending ClientHello: %v\n", "reset")
+	time.Sleep(100 * time.Millisecond)
+	throttledf("Connecting to remote: %v\n", "refused")
+	got := buf.String()
+	exp := []string{
+		"Connecting to remote: refused\n",
+		"Sending ClientHello: reset\n",
+		"Connecting to remote: refused (repeated 99 times in the last 50ms)\n",
+		"Connecting to remote: refused\n",
+	}
+	for _, e := range exp {
+		i := strings.Index(got, e)
+		if i == -1 {
+			t.Error("For", "100 identical messages", "expected", exp, "got", buf.String())
+			break
+		}
+		got = got[i+len(e):]
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	buf := &bytes.Buffer{}
+	auditLog = &auditWriter{w: buf}
+	defer func() { auditLog = nil }()
+	// waitEntry waits for the next line in the audit log
+	waitEntry := func() (e auditEntry) {
+		for c := 0; c < 100; c++ {
+			auditLog.mu.Lock()
+			line, err := buf.ReadBytes('\n')
+			auditLog.mu.Unlock()
+			if err == nil {
+				json.Unmarshal(line, &e)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return
+	}
+
+	useFakeServer("testkey", failNever)
+	ss := startSS(makeTestState(), []byte("first"))
+	io.ReadFull(ss, make([]byte, 5))
+	// Let remoteToSS count what it has just written
+	time.Sleep(50 * time.Millisecond)
+	ss.Close()
+	e := waitEntry()
+	if e.Handshake != "ok" || e.BytesUp != 5 || e.BytesDown != 5 || e.Reason != "ss closed" || e.Remote != "127.0.0.1:443" || e.Browser != "chrome" {
+		t.Error(
+			"For", "connection closed by SS",
+			"expected", "ok, 5 bytes each way, ss closed",
+			"got", e,
+		)
+	}
+
+	useFakeServer("testkey", failNever)
+	sta := makeTestState()
+	sta.LogRecordSizes = true
+	ss = startSS(sta, []byte("first"))
+	io.ReadFull(ss, make([]byte, 5))
+	time.Sleep(50 * time.Millisecond)
+	ss.Close()
+	e = waitEntry()
+	if e.RecordSizes != "<=64:1" {
+		t.Error("For", "LogRecordSizes", "expected", "<=64:1", "got", e.RecordSizes)
+	}
+
+	useFakeServer("testkey", failOnClientHello)
+	startSS(makeTestState(), []byte("first"))
+	e = waitEntry()
+	if e.Handshake != "serverread" || e.Reason != "handshake failed" {
+		t.Error(
+			"For", "ClientHello rejected",
+			"expected", "serverread, handshake failed",
+			"got", e,
+		)
+	}
+
+	useFakeServer("testkey", failOnClientHello)
+	sta = makeTestState()
+	sta.Label = "tenant-a"
+	startSS(sta, []byte("first"))
+	e = waitEntry()
+	if e.Label != "tenant-a" {
+		t.Error("For", "Label", "expected", "tenant-a", "got", e.Label)
+	}
+}
+
+// logBuffer is a bytes.Buffer that the log can be written to while it's read
+type logBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func TestLabel(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	buf := &logBuffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	useFakeServer("testkey", failNever)
+	sta := makeTestState()
+	sta.Label = "tenant-a"
+	ss := startSS(sta, []byte("first"))
+	io.ReadFull(ss, make([]byte, 5))
+	found := false
+	for _, c := range tracker.Snapshot() {
+		found = found || c.Label == "tenant-a"
+	}
+	if !found {
+		t.Error("For", "tracked connections", "expected", "one labelled tenant-a", "got", tracker.Snapshot())
+	}
+	ss.Close()
+
+	useFakeServer("testkey", failOnClientHello)
+	sta = makeTestState()
+	sta.Label = "tenant-b"
+	startSS(sta, []byte("first"))
+	var got string
+	for c := 0; c < 100; c++ {
+		got = buf.String()
+		if strings.Contains(got, "[tenant-b] Reading the server's handshake") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(got, "[tenant-b] Reading the server's handshake") {
+		t.Error("For", "failed handshake", "expected", "[tenant-b] in the log", "got", got)
+	}
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	exp := `labelled_handshake_failures_total{label="tenant-b",stage="serverread"} 1`
+	if !strings.Contains(rec.Body.String(), exp) {
+		t.Error("For", "/metrics", "expected", exp, "got", rec.Body.String())
+	}
+}
+
+func TestTrace(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	buf := bytes.NewBuffer(append([]byte{}, traceMagic...))
+	traceLog = &traceWriter{w: buf}
+	defer func() { traceLog = nil }()
+	// waitTraces waits for the nth trace in the trace file and returns them as text
+	waitTraces := func(n int) string {
+		dir, _ := ioutil.TempDir("", "gqtrace")
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "trace")
+		out := &bytes.Buffer{}
+		for c := 0; c < 100; c++ {
+			traceLog.mu.Lock()
+			ioutil.WriteFile(path, buf.Bytes(), 0600)
+			traceLog.mu.Unlock()
+			out.Reset()
+			err := printTraces(path, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Count(out.String(), "Connection") == n {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return out.String()
+	}
+
+	useFakeServer("testkey", failNever)
+	ss := startSS(makeTestState(), []byte("first"))
+	io.ReadFull(ss, make([]byte, 5))
+	time.Sleep(50 * time.Millisecond)
+	ss.Close()
+	got := waitTraces(1)
+	// The ID of the connection isn't known, as other tests have made some
+	exp := regexp.MustCompile(`^Connection [1-9]\d* at .*\n\t\+.* handshake\n\t\+.* reply\n\t\+.* up 5\n\t\+.* down 5\n\t\+.* closed\n$`)
+	if !exp.MatchString(got) {
+		t.Error("For", "a connection relayed", "expected", exp, "got", got)
+	}
+
+	useFakeServer("testkey", failOnClientHello)
+	startSS(makeTestState(), []byte("first"))
+	got = waitTraces(2)
+	if !regexp.MustCompile(`\nConnection 0 at .*\n\t\+.* failed at serverread\n\t\+.* closed\n$`).MatchString(got) {
+		t.Error("For", "ClientHello rejected", "expected", "failed at serverread", "got", got)
+	}
+
+	for path, exp := range map[string]string{"gq-client.go": "Not a trace file", "missing": "open"} {
+		err := printTraces(path, ioutil.Discard)
+		if err == nil || !strings.HasPrefix(err.Error(), exp) {
+			t.Error("For", path, "expected", exp, "got", err)
+		}
+	}
+}
+
+func TestAdminCommand(t *testing.T) {
+	currentState.Store(makeTestState())
+	cases := []struct {
+		line string
+		exp  string
+	}{
+		{"drain", "ok"},
+		{"stats", "draining true"},
+		{"undrain", "ok"},
+		{"stats", "draining false"},
+		{"stats", "goroutines "},
+		{"stats", "handshake_failures dial"},
+		{"set-log-level debug", "ok"},
+		{"set-log-level verbose", "error"},
+		{"set-log-level info", "ok"},
+		{"reload", "error"},
+		{"shutdown", "error"},
+		{"", "error"},
+	}
+	for _, c := range cases {
+		// Reloading a config that doesn't exist fails
+		got := adminCommand(c.line, "/nonexistent/gqclient.json")
+		if !strings.Contains(got, c.exp) {
+			t.Error(
+				"For", c.line,
+				"expected", c.exp,
+				"got", got,
+			)
+		}
+	}
+}
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "too many open files" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+// failingListener returns the errors in errs in turn from Accept, then a connection
+type failingListener struct {
+	net.Listener
+	errs   []error
+	closed bool
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if len(l.errs) != 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		return nil, err
+	}
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func (l *failingListener) Close() error {
+	l.closed = true
+	return nil
+}
+
+func TestAcceptLoop(t *testing.T) {
+	cases := map[string]struct {
+		errs     []error
+		relisten bool
+	}{
+		"temporary errors": {[]error{tempError{}, tempError{}}, false},
+		"permanent error":  {[]error{errors.New("use of closed network connection")}, true},
+	}
+	for name, c := range cases {
+		first := &failingListener{errs: c.errs}
+		relistened := false
+		listen := func() (net.Listener, error) {
+			relistened = true
+			return &failingListener{}, nil
+		}
+		done := errors.New("done")
+		func() {
+			// Stop at the first connection
+			defer func() { recover() }()
+			acceptLoop(first, listen, func(net.Conn) { panic(done) })
+		}()
+		if relistened != c.relisten || first.closed != c.relisten {
+			t.Error(
+				"For", name,
+				"expected", "listening again", c.relisten,
+				"got", relistened, first.closed,
+			)
+		}
+	}
+}
+
+func TestInheritedListener(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	f, _ := listenerFile(l)
+	os.Setenv("GQ_TEST_FD", strconv.Itoa(int(f.Fd())))
+	inherited, err := inheritedListener("GQ_TEST_FD")
+	if err != nil || inherited == nil || inherited.Addr().String() != l.Addr().String() {
+		t.Error(
+			"For", "listener passed by fd",
+			"expected", l.Addr(),
+			"got", inherited, err,
+		)
+		return
+	}
+	defer inherited.Close()
+	if os.Getenv("GQ_TEST_FD") != "" {
+		t.Error(
+			"For", "GQ_TEST_FD",
+			"expected", "unset",
+			"got", os.Getenv("GQ_TEST_FD"),
+		)
+	}
+	// Connections to the old listener's port are accepted by the inherited one
+	go net.Dial("tcp", l.Addr().String())
+	inherited.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second))
+	conn, err := inherited.Accept()
+	if err != nil {
+		t.Error(
+			"For", "Accept on the inherited listener",
+			"expected", "a connection",
+			"got", err,
+		)
+		return
+	}
+	conn.Close()
+
+	inherited, err = inheritedListener("GQ_TEST_FD")
+	if inherited != nil || err != nil {
+		t.Error(
+			"For", "no GQ_TEST_FD",
+			"expected", "no listener",
+			"got", inherited, err,
+		)
+	}
+}
+
+func TestSystemdListener(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	f, _ := listenerFile(l)
+	defer func(start int) { sdListenFdsStart = start }(sdListenFdsStart)
+	sdListenFdsStart = int(f.Fd())
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	if got, err := systemdListener(); got != nil || err != nil {
+		t.Error("For", "LISTEN_PID of another process", "expected", "no listener", "got", got, err)
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	got, err := systemdListener()
+	if err != nil || got == nil || got.Addr().String() != l.Addr().String() {
+		t.Error("For", "socket activation", "expected", l.Addr(), "got", got, err)
+		return
+	}
+	defer got.Close()
+	if socketActivated() || os.Getenv("LISTEN_FDS") != "" {
+		t.Error("For", "LISTEN_FDS", "expected", "unset", "got", os.Getenv("LISTEN_FDS"))
+	}
+	go net.Dial("tcp", l.Addr().String())
+	got.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second))
+	conn, err := got.Accept()
+	if err != nil {
+		t.Error("For", "Accept on the systemd listener", "expected", "a connection", "got", err)
+		return
+	}
+	conn.Close()
+}
+
+// BenchmarkClosePipe closes pairs from many goroutines at once, as when connections
+// churn, and logs the most goroutines there were right after a closePipe
+func BenchmarkClosePipe(b *testing.B) {
+	var most int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			ss, _ := net.Pipe()
+			remote, _ := net.Pipe()
+			p := &pair{ss: ss, remote: remote, tracked: tracker.Add("ss", "remote")}
+			p.closePipe()
+			n := int64(runtime.NumGoroutine())
+			for m := atomic.LoadInt64(&most); n > m && !atomic.CompareAndSwapInt64(&most, m, n); {
+				m = atomic.LoadInt64(&most)
+			}
+		}
+	})
+	b.Logf("Most goroutines after closePipe: %v\n", atomic.LoadInt64(&most))
+}
+
+func TestNewerVersion(t *testing.T) {
+	cases := []struct {
+		a, b string
+		exp  bool
+	}{
+		{"v1.2.3", "v1.2.2", true},
+		{"v1.10.0", "v1.9.9", true},
+		{"v1.2.3", "v1.2.3", false},
+		{"v1.2", "v1.2.0", false},
+		{"v1.2.1", "v1.2", true},
+		{"v1.2.2", "v1.3.0", false},
+		{"v2.0.0", "master(abc1234)", false},
+		{"", "v1.0.0", false},
+	}
+	for _, c := range cases {
+		if got := newerVersion(c.a, c.b); got != c.exp {
+			t.Error("For", c.a, c.b, "expected", c.exp, "got", got)
+		}
+	}
+}
+
+func TestPprof(t *testing.T) {
+	mux := http.NewServeMux()
+	addPprof(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "goroutine profile") {
+		t.Error("For", "/debug/pprof/goroutine", "expected", "a goroutine profile", "got", resp.StatusCode, string(body))
+	}
+}
+
+func TestStatusPage(t *testing.T) {
+	status.Lock()
+	status.handshakeRemote, status.errors = "", nil
+	status.Unlock()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	server := httptest.NewServer(http.HandlerFunc(serveStatusPage))
+	defer server.Close()
+	page := func() string {
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(body)
+	}
+
+	if got := page(); !strings.Contains(got, "Waiting for the first connection") {
+		t.Error("For", "no handshakes", "expected", "waiting", "got", got)
+	}
+	for i := 0; i < maxStatusErrors+5; i++ {
+		throttledf("Connecting to remote: %v\n", i)
+	}
+	throttledf("Reading the server's handshake: %v\n", "<EOF>")
+	recordHandshake("1.2.3.4:443", "serverread")
+	got := page()
+	for _, exp := range []string{"Not working", "1.2.3.4:443", "failed at serverread", "&lt;EOF&gt;"} {
+		if !strings.Contains(got, exp) {
+			t.Error("For", "a failed handshake", "expected", exp, "got", got)
+		}
+	}
+	if strings.Count(got, "<li>") != maxStatusErrors || strings.Contains(got, "remote: 5<") {
+		t.Error("For", "recent errors", "expected", "the last", maxStatusErrors, "got", got)
+	}
+	recordHandshake("1.2.3.4:443", "")
+	if got := page(); !strings.Contains(got, "Working") || !strings.Contains(got, "succeeded") {
+		t.Error("For", "a handshake", "expected", "working", "got", got)
+	}
+}
+
+func TestLatestVersion(t *testing.T) {
+	var userAgent, query string
+	answers := map[string]string{
+		"/release": `{"tag_name":"v1.3.0","name":"GoQuiet v1.3.0"}`,
+		"/plain":   "v1.3.1\n",
+		"/garbage": "<html></html>",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent, query = r.UserAgent(), r.URL.RawQuery
+		answer, ok := answers[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(answer))
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		path string
+		exp  string
+		ok   bool
+	}{
+		{"/release", "v1.3.0", true},
+		{"/plain", "v1.3.1", true},
+		{"/garbage", "", false},
+		{"/missing", "", false},
+	}
+	for _, c := range cases {
+		got, err := latestVersion(server.URL + c.path)
+		if got != c.exp || (err == nil) != c.ok {
+			t.Error("For", c.path, "expected", c.exp, "got", got, err)
+		}
+		if userAgent != "gq-client" || query != "" {
+			t.Error("For", c.path, "expected", "a request that says nothing about us", "got", userAgent, query)
+		}
+	}
+
+	// Nothing listening
+	server.Close()
+	if _, err := latestVersion(server.URL + "/plain"); err == nil {
+		t.Error("For", "a closed server", "expected", "an error", "got", nil)
+	}
+}
+
+func TestUDPRelay(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	useFakeServer("testkey", failNever)
+	currentState.Store(makeTestState())
+	udpSessionTimeout = 200 * time.Millisecond
+	defer func() { udpSessionTimeout = 60 * time.Second }()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go serveUDP(pc)
+	ss, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+
+	// The fake server echoes the records back, so each datagram should come back
+	// whole, even one that takes more than a record
+	buf := make([]byte, 65535)
+	for _, size := range []int{5, 1200, 20000} {
+		datagram := gqclient.PsudoRandBytes(size, int64(size))
+		ss.WriteTo(datagram, pc.LocalAddr())
+		ss.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := ss.ReadFrom(buf)
+		if err != nil || !bytes.Equal(buf[:n], datagram) {
+			t.Error("For", "a datagram of", size, "bytes", "expected", "it echoed", "got", n, "bytes", err)
+		}
+	}
+	sessions := func() int {
+		n := 0
+		for _, c := range tracker.Snapshot() {
+			if c.Source == "udp "+ss.LocalAddr().String() {
+				n++
+			}
+		}
+		return n
+	}
+	if n := sessions(); n != 1 {
+		t.Error("For", "datagrams from one address", "expected", 1, "session", "got", n)
+	}
+
+	// The session ends once it's idle
+	time.Sleep(400 * time.Millisecond)
+	if n := sessions(); n != 0 {
+		t.Error("For", "an idle session", "expected", 0, "sessions", "got", n)
+	}
+}
+
+func TestMux(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	var dialed int32
+	dialRemote = func(addr string, fastOpen bool, data []byte) (net.Conn, error) {
+		atomic.AddInt32(&dialed, 1)
+		client, server := net.Pipe()
+		go fakeServer(server, "testkey", failNever)
+		return client, nil
+	}
+	defer useFakeServer("testkey", failNever)
+	sta := makeTestState()
+	sta.MuxSessions = 1
+	currentState.Store(sta)
+	defer func() {
+		muxes.mu.Lock()
+		for _, m := range muxes.sessions {
+			m.Close()
+		}
+		muxes.sessions = nil
+		muxes.mu.Unlock()
+	}()
+
+	// Both connections from SS go through the one connection to the server
+	for _, first := range []string{"first", "again"} {
+		ss := startSS(sta, []byte(first))
+		got := make([]byte, 5)
+		ss.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := io.ReadFull(ss, got)
+		if err != nil || string(got) != first {
+			t.Error("For", "a stream", "expected", first, "got", string(got), err)
+		}
+		ss.Close()
+	}
+	if n := atomic.LoadInt32(&dialed); n != 1 {
+		t.Error("For", "MuxSessions 1", "expected", 1, "dial", "got", n)
+	}
+
+	// Once it fails another one is made
+	muxes.mu.Lock()
+	muxes.sessions[0].Close()
+	muxes.mu.Unlock()
+	ss := startSS(sta, []byte("third"))
+	got := make([]byte, 5)
+	ss.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := io.ReadFull(ss, got)
+	if err != nil || string(got) != "third" {
+		t.Error("For", "a stream after the session failed", "expected", "third", "got", string(got), err)
+	}
+	ss.Close()
+	if n := atomic.LoadInt32(&dialed); n != 2 {
+		t.Error("For", "a failed session", "expected", 2, "dials", "got", n)
+	}
+}
+
+func TestSocks(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	useFakeServer("testkey", failNever)
+	sta := makeTestState()
+	cases := []struct {
+		name      string
+		handshake []byte
+		answer    []byte
+		addr      string
+	}{
+		{
+			"SOCKS5",
+			append([]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x03, 11}, "example.com\x00\x50"...),
+			[]byte{0x05, 0x00, 0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+			"example.com:80",
+		},
+		{
+			"HTTP CONNECT",
+			[]byte("CONNECT [::1]:443 HTTP/1.1\r\nHost: [::1]:443\r\n\r\n"),
+			[]byte("HTTP/1.1 200 Connection established\r\n\r\n"),
+			"[::1]:443",
+		},
+	}
+	for _, c := range cases {
+		client, plugin := net.Pipe()
+		go serveSocks(plugin, sta)
+		client.SetDeadline(time.Now().Add(2 * time.Second))
+		go client.Write(c.handshake)
+		got := make([]byte, len(c.answer)+len(c.addr))
+		_, err := io.ReadFull(client, got)
+		if err != nil || !bytes.Equal(got, append(c.answer, c.addr...)) {
+			t.Error("For", c.name, "expected", string(c.answer)+c.addr, "got", string(got), err)
+		}
+		client.Write([]byte("hello"))
+		got = make([]byte, 5)
+		_, err = io.ReadFull(client, got)
+		if err != nil || string(got) != "hello" {
+			t.Error("For", c.name, "relayed data", "expected", "hello", "got", string(got), err)
+		}
+		client.Close()
+	}
+
+	// Anything else is turned down
+	client, plugin := net.Pipe()
+	go serveSocks(plugin, sta)
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	go client.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	got, _ := ioutil.ReadAll(client)
+	if !strings.HasPrefix(string(got), "HTTP/1.1 405") {
+		t.Error("For", "a GET", "expected", "405", "got", string(got))
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	defer func(old func(string, bool, []byte) (net.Conn, error)) { dialRemote = old }(dialRemote)
+	paths := make(chan error, 1)
+	dialRemote = func(addr string, fastOpen bool, data []byte) (net.Conn, error) {
+		if fastOpen {
+			t.Error("For", "Transport websocket", "expected", "no FastOpen", "got", fastOpen)
+		}
+		client, server := net.Pipe()
+		go func() {
+			ws, _, err := websocket.Server(server, "/gq")
+			paths <- err
+			if err != nil {
+				server.Close()
+				return
+			}
+			fakeServer(ws, "testkey", failNever)
+		}()
+		return client, nil
+	}
+	sta := makeTestState()
+	sta.FastOpen = true
+	sta.Transport = "websocket"
+	sta.WebSocketURL = "ws://cdn.example.com/gq"
+	ss := startSS(sta, []byte("first"))
+	defer ss.Close()
+	if err := <-paths; err != nil {
+		t.Fatal("For", "opening the WebSocket", "expected", nil, "got", err)
+	}
+	got := make([]byte, 5)
+	ss.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(ss, got); err != nil || string(got) != "first" {
+		t.Error("For", "data through the WebSocket", "expected", "first", "got", string(got), err)
+	}
+
+	// A WebSocket at another path isn't opened
+	sta.WebSocketURL = "ws://cdn.example.com/other"
+	ss = startSS(sta, []byte("first"))
+	if err := <-paths; err != websocket.ErrNotWebSocket {
+		t.Error("For", "another path", "expected", websocket.ErrNotWebSocket, "got", err)
+	}
+	if !isClosed(ss) {
+		t.Error("For", "another path", "expected", "the connection closed", "got", "open")
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/cbeuw/GoQuiet/gqclient/TLS"
+)
+
+// printHelloTemplate prints the HelloTemplate made from the ClientHello in source,
+// a pcap or hex file, or hex itself if there's no such file
+func printHelloTemplate(source string) error {
+	capture, err := ioutil.ReadFile(source)
+	if os.IsNotExist(err) {
+		capture, err = []byte(source), nil
+	}
+	if err != nil {
+		return err
+	}
+	hello, err := TLS.ExtractClientHello(capture)
+	if err != nil {
+		return err
+	}
+	t, err := TLS.MakeHelloTemplate(hello)
+	if err != nil {
+		return err
+	}
+	ja3, _ := TLS.JA3(hello)
+	fmt.Fprintf(os.Stderr, "ClientHello with JA3 %v\n", ja3)
+	out, _ := json.MarshalIndent(t, "", "\t")
+	fmt.Println(string(out))
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// 1 if debug messages are logged. Accessed atomically so that it can be changed
+// while connections are being handled
+var debugLevel int32
+
+// setLogLevel sets the log level to one of the values accepted by LogLevel
+func setLogLevel(level string) {
+	if level == "debug" {
+		atomic.StoreInt32(&debugLevel, 1)
+	} else {
+		atomic.StoreInt32(&debugLevel, 0)
+	}
+}
+
+// debugEnabled reports whether LogLevel is debug, for debug messages that are
+// expensive to make
+func debugEnabled() bool {
+	return atomic.LoadInt32(&debugLevel) == 1
+}
+
+// debugf logs only if LogLevel is debug
+func debugf(format string, v ...interface{}) {
+	if debugEnabled() {
+		log.Printf(format, v...)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long repeats of a message are held back before they're counted in one line.
+// A variable so that tests don't have to wait a minute
+var logThrottleInterval = time.Minute
+
+// The most different messages held back at once. Past it messages are logged as
+// they come, so that a flood of different ones can't use up memory
+const maxThrottledMessages = 1024
+
+// 1 if ThrottleLogs is set. Accessed atomically like debugLevel
+var throttleLogs int32
+
+// The messages logged by throttledf in the current interval, with how many times
+// each has been repeated since
+var throttled = struct {
+	sync.Mutex
+	repeats map[string]int
+}{repeats: make(map[string]int)}
+
+// setLogThrottle turns ThrottleLogs on or off
+func setLogThrottle(on bool) {
+	if on {
+		atomic.StoreInt32(&throttleLogs, 1)
+	} else {
+		atomic.StoreInt32(&throttleLogs, 0)
+	}
+}
+
+// throttledf logs like log.Printf, but if ThrottleLogs is set a message that has
+// already been logged in the last logThrottleInterval is only counted. The count
+// is logged once the interval is over. It's for the errors of each connection,
+// which come by the thousand when something is wrong with the server. Each is also
+// kept for the status page
+func throttledf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	status.addError(msg)
+	if atomic.LoadInt32(&throttleLogs) == 0 {
+		log.Print(msg)
+		return
+	}
+	throttled.Lock()
+	if n, ok := throttled.repeats[msg]; ok {
+		throttled.repeats[msg] = n + 1
+		throttled.Unlock()
+		return
+	}
+	full := len(throttled.repeats) >= maxThrottledMessages
+	if !full {
+		throttled.repeats[msg] = 0
+	}
+	throttled.Unlock()
+	log.Print(msg)
+	if !full {
+		time.AfterFunc(logThrottleInterval, func() { flushThrottled(msg) })
+	}
+}
+
+// flushThrottled logs how many times msg was repeated in its interval and lets it
+// be logged again
+func flushThrottled(msg string) {
+	throttled.Lock()
+	n := throttled.repeats[msg]
+	delete(throttled.repeats, msg)
+	throttled.Unlock()
+	if n != 0 {
+		log.Printf("%v (repeated %v times in the last %v)\n", strings.TrimSuffix(msg, "\n"), n, logThrottleInterval)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+	"github.com/cbeuw/GoQuiet/mux"
+)
+
+// How often a session made with a State from before a reload is checked for
+// whether its last stream has closed, after which it's closed too
+const muxRetireInterval = time.Second
+
+// muxSession is a connection to the server that the connections from SS are
+// carried over as streams
+type muxSession struct {
+	*mux.Session
+	addr string
+	// The State it was made with
+	sta *gqclient.State
+}
+
+// muxPool keeps the MuxSessions connections to the server that streams are
+// opened on, making them as they're needed and again once they fail
+type muxPool struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	sessions []*muxSession
+	// Handshakes being made for the pool
+	making int
+}
+
+var muxes = newMuxPool()
+
+func newMuxPool() *muxPool {
+	p := &muxPool{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// open opens a stream to the server on the session with the fewest streams, or on
+// a new session if there are fewer than MuxSessions
+func (p *muxPool) open(sta *gqclient.State, rec *auditRecord, tr *connTrace) (remoteAddr string, stream net.Conn, err error) {
+	m, err := p.session(sta, rec, tr)
+	if err != nil {
+		return "", nil, err
+	}
+	s, err := m.Open()
+	if err != nil {
+		throttledf(labelled(sta.Label, "Opening a stream to %v: %v\n"), m.addr, err)
+		return m.addr, nil, err
+	}
+	return m.addr, s, nil
+}
+
+func (p *muxPool) session(sta *gqclient.State, rec *auditRecord, tr *connTrace) (*muxSession, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		p.prune(sta)
+		if len(p.sessions)+p.making < sta.MuxSessions {
+			p.making++
+			p.mu.Unlock()
+			m, err := p.dial(sta, rec, tr)
+			p.mu.Lock()
+			p.making--
+			p.cond.Broadcast()
+			if err != nil {
+				return nil, err
+			}
+			p.sessions = append(p.sessions, m)
+			return m, nil
+		}
+		if len(p.sessions) != 0 {
+			least := p.sessions[0]
+			for _, m := range p.sessions[1:] {
+				if m.NumStreams() < least.NumStreams() {
+					least = m
+				}
+			}
+			return least, nil
+		}
+		// Wait for the sessions being made, or for one of them to fail so that
+		// this can make one
+		p.cond.Wait()
+	}
+}
+
+// prune drops the sessions that have failed, and retires those made with a State
+// other than sta for when their streams are done
+func (p *muxPool) prune(sta *gqclient.State) {
+	live := p.sessions[:0]
+	for _, m := range p.sessions {
+		select {
+		case <-m.Done():
+			continue
+		default:
+		}
+		if m.sta != sta {
+			go m.retire()
+			continue
+		}
+		live = append(live, m)
+	}
+	p.sessions = live
+}
+
+func (p *muxPool) dial(sta *gqclient.State, rec *auditRecord, tr *connTrace) (*muxSession, error) {
+	muxed := *sta
+	muxed.Mux = true
+	addr, conn, err := remoteHandshake(&muxed, rec, tr)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf(labelled(sta.Label, "Made a mux session to %v\n"), addr)
+	m := &muxSession{Session: mux.NewClient(conn), addr: addr, sta: sta}
+	go func() {
+		<-m.Done()
+		debugf(labelled(sta.Label, "Mux session to %v ended: %v\n"), addr, m.Err())
+	}()
+	return m, nil
+}
+
+// retire closes m once its last stream has closed
+func (m *muxSession) retire() {
+	for m.NumStreams() != 0 {
+		select {
+		case <-m.Done():
+			return
+		case <-time.After(muxRetireInterval):
+		}
+	}
+	m.Close()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+)
+
+// isTerminal reports whether f is a terminal someone can type into
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// readPassphrase asks for a passphrase on stderr and reads it from stdin, without
+// showing it where the platform allows
+func readPassphrase(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	restore := disableEcho(os.Stdin)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	restore()
+	fmt.Fprintln(os.Stderr)
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+var passphraseOnce sync.Once
+var passphrase string
+var passphraseErr error
+
+// configPassphrase is gqclient.ConfigPassphrase for gq-client: the environment
+// variable, or asked for once on the terminal if it isn't set, so that a reload
+// doesn't ask again
+func configPassphrase() (string, error) {
+	if env := os.Getenv(gqclient.PassphraseEnv); env != "" {
+		return env, nil
+	}
+	passphraseOnce.Do(func() {
+		if !isTerminal(os.Stdin) {
+			passphraseErr = errors.New("The config is encrypted and " + gqclient.PassphraseEnv + " isn't set")
+			return
+		}
+		passphrase, passphraseErr = readPassphrase("Passphrase of the config: ")
+	})
+	return passphrase, passphraseErr
+}
+
+// encryptConfig prints path, a config, encrypted with the passphrase in the
+// environment variable or asked for twice on the terminal
+func encryptConfig(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if gqclient.IsEncryptedConfig(content) {
+		return errors.New(path + " is already encrypted")
+	}
+	pass := os.Getenv(gqclient.PassphraseEnv)
+	if pass == "" {
+		if !isTerminal(os.Stdin) {
+			return errors.New("Set " + gqclient.PassphraseEnv + " or run on a terminal to be asked for the passphrase")
+		}
+		pass, err = readPassphrase("Passphrase: ")
+		if err != nil {
+			return err
+		}
+		again, err := readPassphrase("Passphrase again: ")
+		if err != nil {
+			return err
+		}
+		if again != pass {
+			return errors.New("The passphrases don't match")
+		}
+	}
+	encrypted, err := gqclient.EncryptConfig(content, pass)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(encrypted))
+	return nil
+}
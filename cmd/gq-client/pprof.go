@@ -0,0 +1,28 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/pprof"
+)
+
+// addPprof adds the handlers of net/http/pprof to mux under /debug/pprof/. Importing
+// the package only for them would also add them to http.DefaultServeMux
+func addPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// servePprof serves pprof on addr. It's only for debugging, so failing to listen,
+// e.g. while the gq-client this one was upgraded from still has the port, is logged
+// rather than fatal
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	addPprof(mux)
+	log.Printf("Serving pprof on %v\n", addr)
+	err := http.ListenAndServe(addr, mux)
+	log.Printf("Serving pprof: %v\n", err)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+	"github.com/cbeuw/GoQuiet/gqclient/TLS"
+)
+
+const probeTimeout = 5 * time.Second
+
+// probeReal sends a ClientHello made with sta to each of targets, a comma separated
+// list of real TLS servers as host or host:port, with the host as ServerName. How
+// each one answered is printed. It returns false if any of them didn't accept it
+func probeReal(sta *gqclient.State, targets string) bool {
+	allAccepted := true
+	for _, target := range strings.Split(targets, ",") {
+		host, port, err := net.SplitHostPort(target)
+		if err != nil {
+			host, port = target, "443"
+		}
+		accepted, description := probeOne(sta, host, port)
+		fmt.Printf("%v: %v\n", target, description)
+		allAccepted = allAccepted && accepted
+	}
+	return allAccepted
+}
+
+func probeOne(sta *gqclient.State, host, port string) (accepted bool, description string) {
+	probe := *sta
+	probe.ServerName = host
+	clientHello := TLS.ComposeInitHandshake(&probe)
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), probeTimeout)
+	if err != nil {
+		return false, err.Error()
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(probeTimeout))
+	err = gqclient.WriteAll(conn, clientHello)
+	if err != nil {
+		return false, "Sending ClientHello: " + err.Error()
+	}
+	buf := make([]byte, 5+16384+2048)
+	i, err := gqclient.ReadTillDrain(conn, buf)
+	if err != nil {
+		return false, "Reading the response: " + err.Error()
+	}
+	return TLS.DescribeServerResponse(buf[:i])
+}
@@ -1,4 +1,6 @@
+//go:build android
 // +build android
+
 package main
 
 /*
@@ -65,7 +67,6 @@ set_timeout(int sock)
 import "C"
 
 import (
-	"github.com/cbeuw/gotfo"
 	"log"
 	"syscall"
 )
@@ -86,11 +87,9 @@ func protect() {
 
 	path := "protect_path"
 
-	// There is no exported method to fetch the socket's system file descriptor in either
-	// standard lib "net" or "gotfo" package. This callback function is used to get the socket's
-	// file descriptor.
-	//
-	// Note that the callback function is not supported in the standard lib "net".
+	// There is no exported method to fetch the socket's system file descriptor in the
+	// standard lib "net" package. The "tfo" package calls this callback with it from the
+	// Control hook of the net.Dialer it dials with.
 	callback := func(fd int) {
 		socket, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
 		if err != nil {
@@ -121,5 +120,5 @@ func protect() {
 		}
 	}
 
-	gotfo.SetFdCallback(callback)
+	addFdCallback(callback)
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+)
+
+// atomicState holds a *gqclient.State that can be swapped while it's being read
+type atomicState struct {
+	v atomic.Value
+}
+
+func (a *atomicState) Load() *gqclient.State {
+	return a.v.Load().(*gqclient.State)
+}
+
+func (a *atomicState) Store(sta *gqclient.State) {
+	a.v.Store(sta)
+}
+
+// The State used for new connections. A State is never modified once stored,
+// a reload stores a new one instead, so that handshakes in progress don't see
+// a half updated State
+var currentState atomicState
+
+// makeServerPool makes the ServerPool of sta if it has RemoteServers. The pool of
+// old is kept if the servers haven't changed so that the latency estimates stay
+func makeServerPool(sta *gqclient.State, old *gqclient.State) {
+	if len(sta.RemoteServers) == 0 {
+		return
+	}
+	if old != nil && old.ServerPool != nil && equalStrings(old.RemoteServers, sta.RemoteServers) {
+		sta.ServerPool = old.ServerPool
+		return
+	}
+	servers := append([]string{sta.RemoteAddr()}, sta.RemoteServers...)
+	sta.ServerPool = gqclient.NewServerPool(servers)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// reload parses the config again and uses it for new connections. Existing
+// connections are not affected. Options that only take effect at startup
+// keep their old values
+func reload(config string) error {
+	old := currentState.Load()
+	sta := &gqclient.State{
+		SS_LOCAL_HOST:  old.SS_LOCAL_HOST,
+		SS_LOCAL_PORT:  old.SS_LOCAL_PORT,
+		SS_REMOTE_HOST: old.SS_REMOTE_HOST,
+		SS_REMOTE_PORT: old.SS_REMOTE_PORT,
+		Now:            old.Now,
+		Opaque:         old.Opaque,
+	}
+	err := sta.ParseConfig(config)
+	if err != nil {
+		log.Printf("Reloading config: %v. Keeping the current config\n", err)
+		return err
+	}
+	for _, warning := range sta.Warnings {
+		log.Printf("Reloading config: %v\n", warning)
+	}
+
+	requiresRestart := func(name string, changed bool) {
+		if changed {
+			log.Printf("Reloading config: %v requires restart, ignored\n", name)
+		}
+	}
+	requiresRestart("ReusePort", sta.ReusePort != old.ReusePort)
+	sta.ReusePort = old.ReusePort
+	requiresRestart("ListenBacklog", sta.ListenBacklog != old.ListenBacklog)
+	sta.ListenBacklog = old.ListenBacklog
+	requiresRestart("LocalPortRange", sta.LocalPortRange != old.LocalPortRange)
+	sta.LocalPortRange = old.LocalPortRange
+	requiresRestart("MetricsAddr", sta.MetricsAddr != old.MetricsAddr)
+	sta.MetricsAddr = old.MetricsAddr
+	requiresRestart("PprofAddr", sta.PprofAddr != old.PprofAddr)
+	sta.PprofAddr = old.PprofAddr
+	requiresRestart("StatusAddr", sta.StatusAddr != old.StatusAddr)
+	sta.StatusAddr = old.StatusAddr
+	requiresRestart("ConnRateLimit", sta.ConnRateLimit != old.ConnRateLimit || sta.ConnBurst != old.ConnBurst)
+	sta.ConnRateLimit, sta.ConnBurst = old.ConnRateLimit, old.ConnBurst
+	requiresRestart("FailureWindow", sta.FailureWindow != old.FailureWindow || sta.FailureAlertPercent != old.FailureAlertPercent)
+	sta.FailureWindow, sta.FailureAlertPercent = old.FailureWindow, old.FailureAlertPercent
+	requiresRestart("AuditFile", sta.AuditFile != old.AuditFile)
+	sta.AuditFile = old.AuditFile
+	requiresRestart("TraceFile", sta.TraceFile != old.TraceFile)
+	sta.TraceFile = old.TraceFile
+	requiresRestart("AdminSocket", sta.AdminSocket != old.AdminSocket)
+	sta.AdminSocket = old.AdminSocket
+	requiresRestart("UDPRelay", sta.UDPRelay != old.UDPRelay)
+	sta.UDPRelay = old.UDPRelay
+	requiresRestart("MuxSessions", sta.MuxSessions != old.MuxSessions)
+	sta.MuxSessions = old.MuxSessions
+	requiresRestart("CheckForUpdates", sta.CheckForUpdates != old.CheckForUpdates || sta.UpdateURL != old.UpdateURL)
+	sta.CheckForUpdates, sta.UpdateURL = old.CheckForUpdates, old.UpdateURL
+	requiresRestart("LogFile", sta.LogFile != old.LogFile ||
+		sta.LogMaxSizeMB != old.LogMaxSizeMB || sta.LogMaxFiles != old.LogMaxFiles)
+	sta.LogFile, sta.LogMaxSizeMB, sta.LogMaxFiles = old.LogFile, old.LogMaxSizeMB, old.LogMaxFiles
+
+	// Dialer and AuthPayloadFunc are set in code rather than in the config
+	sta.Dialer = old.Dialer
+	sta.AuthPayloadFunc = old.AuthPayloadFunc
+
+	sta.SetAESKey()
+	makeServerPool(sta, old)
+	setLogLevel(sta.LogLevel)
+	setLogThrottle(sta.ThrottleLogs)
+	currentState.Store(sta)
+	// The connections in the pool were made with the old config
+	warm.flush()
+	log.Println("Config reloaded")
+	return nil
+}
+
+// reloadOnSIGHUP reloads the config every time SIGHUP is received
+func reloadOnSIGHUP(config string) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		reload(config)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+)
+
+// lookupIP resolves the host names of servers. It's a variable so that tests can
+// do without DNS
+var lookupIP = net.LookupIP
+
+// DNSTimeoutMs if only DNSRetries is set
+const defaultDNSTimeout = 5000 * time.Millisecond
+
+// How long to wait before resolving again after a lookup that failed straight away
+const dnsRetryDelay = 250 * time.Millisecond
+
+var errDNSTimeout = errors.New("DNS lookup timed out")
+
+// lookupOnce resolves host with lookupIP, giving up after timeout
+func lookupOnce(host string, timeout time.Duration) ([]net.IP, error) {
+	type result struct {
+		ips []net.IP
+		err error
+	}
+	// Buffered so that a lookup that finishes late doesn't block forever
+	results := make(chan result, 1)
+	lookup := lookupIP
+	go func() {
+		ips, err := lookup(host)
+		results <- result{ips, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		return r.ips, r.err
+	case <-timer.C:
+		return nil, errDNSTimeout
+	}
+}
+
+// lookupHost resolves host, trying again up to DNSRetries times, each lookup given
+// up on after DNSTimeoutMs. Without either it's a single lookup of its own length
+func lookupHost(sta *gqclient.State, host string) (ips []net.IP, err error) {
+	if sta.DNSRetries == 0 && sta.DNSTimeoutMs == 0 {
+		return lookupIP(host)
+	}
+	timeout := time.Duration(sta.DNSTimeoutMs) * time.Millisecond
+	if sta.DNSTimeoutMs == 0 {
+		timeout = defaultDNSTimeout
+	}
+	for attempt := 0; attempt <= sta.DNSRetries; attempt++ {
+		if attempt != 0 {
+			debugf("Resolving %v: %v, trying again\n", host, err)
+		}
+		start := time.Now()
+		ips, err = lookupOnce(host, timeout)
+		if err == nil {
+			return ips, nil
+		}
+		if attempt < sta.DNSRetries && time.Since(start) < dnsRetryDelay {
+			time.Sleep(dnsRetryDelay - time.Since(start))
+		}
+	}
+	return nil, err
+}
+
+// resolveAddr resolves the host of addr with lookupHost if DNSRetries or
+// DNSTimeoutMs is set, so that the dial is made to an address. Otherwise addr is
+// left for the dial to resolve. This is where a cache or DNS over HTTPS would go
+func resolveAddr(sta *gqclient.State, addr string) (string, error) {
+	if sta.DNSRetries == 0 && sta.DNSTimeoutMs == 0 {
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	ips, err := lookupHost(sta, host)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", errors.New("No address found for " + host)
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+	"github.com/cbeuw/GoQuiet/gqclient/TLS"
+)
+
+const smokeTestTimeout = 10 * time.Second
+
+// smokeTest connects to each server with sta like a connection from SS would, sends
+// size random bytes through and checks that they come back. The Finished message
+// asks gq-server to echo them rather than relay them to ss-server. It returns false
+// if any server failed, after printing the stage it failed at
+func smokeTest(sta *gqclient.State, size int) bool {
+	remotes := sta.RemoteServers
+	if len(remotes) == 0 {
+		remotes = []string{sta.RemoteAddr()}
+	}
+	allPassed := true
+	for _, remote := range remotes {
+		start := time.Now()
+		err := smokeTestOne(sta, remote, size)
+		if err != nil {
+			fmt.Printf("%v: %v\n", remote, err)
+			allPassed = false
+			continue
+		}
+		fmt.Printf("%v: OK, %v bytes echoed in %v\n", remote, size, time.Since(start))
+	}
+	return allPassed
+}
+
+func smokeTestOne(sta *gqclient.State, remoteAddr string, size int) error {
+	ping := *sta
+	ping.Ping = true
+	remoteConn, reply, stage, err := handshake(&ping, remoteAddr, time.Now().Add(smokeTestTimeout))
+	if err != nil {
+		return fmt.Errorf("Handshake failed at %v: %v", stage, err)
+	}
+	defer remoteConn.Close()
+	remoteConn.SetDeadline(time.Now().Add(smokeTestTimeout))
+
+	_, err = TLS.CheckEcho(&ping, remoteConn, reply, gqclient.CryptoRandBytes(size))
+	return err
+}
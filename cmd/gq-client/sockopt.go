@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+	"github.com/cbeuw/GoQuiet/tfo"
+)
+
+// tfo only keeps one callback for the file descriptors of the sockets it dials,
+// so everything that wants one is called from here
+var fdCallbacks []func(fd int)
+
+// addFdCallback makes f be called with the file descriptor of every outgoing
+// socket before it connects. It must not be called after the first connection
+func addFdCallback(f func(fd int)) {
+	fdCallbacks = append(fdCallbacks, f)
+	callbacks := fdCallbacks
+	tfo.SetFdCallback(func(fd int) {
+		for _, cb := range callbacks {
+			cb(fd)
+		}
+	})
+}
+
+// setDSCP sets DSCP on the outgoing socket fd according to the current config
+func setDSCP(fd int) {
+	dscp := currentState.Load().DSCP
+	if dscp == 0 {
+		return
+	}
+	err := gqclient.SetDSCP(fd, dscp)
+	if err != nil {
+		throttledf("Setting DSCP: %v\n", err)
+	}
+}
+
+// bindInterface binds the outgoing socket fd to BindInterface in the current config
+func bindInterface(fd int) {
+	iface := currentState.Load().BindInterface
+	if iface == "" {
+		return
+	}
+	err := gqclient.BindToInterface(fd, iface)
+	if err != nil {
+		throttledf("Binding to interface %v: %v\n", iface, err)
+	}
+}
+
+// setNoDelay turns TCP_NODELAY, which Go sets on every TCP connection, off on
+// conn if NoDelay is false in sta, so that the OS can put small writes together
+func setNoDelay(conn net.Conn, sta *gqclient.State) {
+	if sta.NoDelay == nil || *sta.NoDelay {
+		return
+	}
+	tcpConn, ok := conn.(interface {
+		SetNoDelay(bool) error
+	})
+	if !ok {
+		return
+	}
+	err := tcpConn.SetNoDelay(false)
+	if err != nil {
+		throttledf("Turning off TCP_NODELAY: %v\n", err)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+)
+
+// How long a client of -socks has to say where it's going
+const socksHandshakeTimeout = 10 * time.Second
+
+// SOCKS5 address types, which are also how the address is sent to the server
+const (
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+)
+
+// serveSocks speaks SOCKS5 or HTTP CONNECT with conn, for -socks, then relays it
+// like a connection from SS. The address it asked for goes first, for the server
+// to dial itself. Success is answered before that dial's made, which is only
+// known on the server, so a failed dial is seen as the connection closing
+func serveSocks(conn net.Conn, sta *gqclient.State) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	addr, buffered, err := socksHandshake(conn)
+	if err != nil {
+		debugf(labelled(sta.Label, "Proxy handshake with %v: %v\n"), conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	// initSequence can't get to it through prefixedConn
+	setNoDelay(conn, sta)
+	connect := *sta
+	connect.Connect = true
+	initSequence(&prefixedConn{Conn: conn, prefix: append(addr, buffered...)}, &connect)
+}
+
+// socksHandshake tells SOCKS5 from HTTP CONNECT by the first byte and answers
+// either. It returns the address asked for as a SOCKS5 address, and what was
+// read from conn after the request
+func socksHandshake(conn net.Conn) (addr []byte, buffered []byte, err error) {
+	r := bufio.NewReader(conn)
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if first[0] == 0x05 {
+		addr, err = socks5Handshake(r, conn)
+	} else {
+		addr, err = httpConnectHandshake(r, conn)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	buffered, _ = r.Peek(r.Buffered())
+	return addr, buffered, nil
+}
+
+// socks5Handshake takes a CONNECT without auth, see
+// https://tools.ietf.org/html/rfc1928
+func socks5Handshake(r *bufio.Reader, w io.Writer) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, err
+	}
+	noAuth := false
+	for _, m := range methods {
+		noAuth = noAuth || m == 0x00
+	}
+	if !noAuth {
+		w.Write([]byte{0x05, 0xff})
+		return nil, errors.New("SOCKS5 client needs auth")
+	}
+	if _, err := w.Write([]byte{0x05, 0x00}); err != nil {
+		return nil, err
+	}
+
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(r, request); err != nil {
+		return nil, err
+	}
+	addr, err := readSocksAddr(r)
+	if err != nil {
+		return nil, err
+	}
+	if request[0] != 0x05 || request[1] != 0x01 {
+		// Command not supported
+		w.Write([]byte{0x05, 0x07, 0x00, socksIPv4, 0, 0, 0, 0, 0, 0})
+		return nil, errors.New("SOCKS5 command isn't CONNECT")
+	}
+	if _, err = w.Write([]byte{0x05, 0x00, 0x00, socksIPv4, 0, 0, 0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
+
+// readSocksAddr reads a SOCKS5 address, the type, the address and the port
+func readSocksAddr(r io.Reader) ([]byte, error) {
+	typ := make([]byte, 1)
+	if _, err := io.ReadFull(r, typ); err != nil {
+		return nil, err
+	}
+	var length int
+	switch typ[0] {
+	case socksIPv4:
+		length = net.IPv4len
+	case socksIPv6:
+		length = net.IPv6len
+	case socksDomain:
+		domainLen := make([]byte, 1)
+		if _, err := io.ReadFull(r, domainLen); err != nil {
+			return nil, err
+		}
+		typ = append(typ, domainLen[0])
+		length = int(domainLen[0])
+	default:
+		return nil, errors.New("Unknown SOCKS5 address type")
+	}
+	addr := make([]byte, length+2)
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return nil, err
+	}
+	return append(typ, addr...), nil
+}
+
+// httpConnectHandshake takes a CONNECT request. Other requests are turned down,
+// as they'd have to be made by us
+func httpConnectHandshake(r *bufio.Reader, w io.Writer) ([]byte, error) {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if req.Method != http.MethodConnect {
+		io.WriteString(w, "HTTP/1.1 405 Method Not Allowed\r\nConnection: close\r\n\r\n")
+		return nil, errors.New("HTTP request isn't CONNECT")
+	}
+	addr, err := socksAddr(req.Host)
+	if err != nil {
+		io.WriteString(w, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+		return nil, err
+	}
+	if _, err = io.WriteString(w, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
+
+// socksAddr makes a SOCKS5 address of host:port
+func socksAddr(hostPort string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.New("Bad port " + port)
+	}
+	var addr []byte
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		addr = append([]byte{socksIPv4}, ip.To4()...)
+	} else if ip != nil {
+		addr = append([]byte{socksIPv6}, ip...)
+	} else if len(host) > 0 && len(host) <= 255 {
+		addr = append([]byte{socksDomain, byte(len(host))}, host...)
+	} else {
+		return nil, errors.New("Bad host " + host)
+	}
+	return append(addr, byte(portNum>>8), byte(portNum)), nil
+}
+
+// prefixedConn is a connection whose reads start with prefix before carrying on
+// with what's read from it
+type prefixedConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixedConn) Read(b []byte) (int, error) {
+	if len(c.prefix) != 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// CloseWrite half-closes the connection underneath, which embedding net.Conn hides
+func (c *prefixedConn) CloseWrite() error {
+	cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	})
+	if !ok {
+		return errors.New("Connection can't be half-closed")
+	}
+	return cw.CloseWrite()
+}
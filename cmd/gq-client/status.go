@@ -0,0 +1,142 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+)
+
+// The most recent errors shown on the status page
+const maxStatusErrors = 10
+
+// statusError is an error shown on the status page
+type statusError struct {
+	Time    time.Time
+	Message string
+}
+
+// What the status page shows that the ConnTracker doesn't know. The zero value is
+// ready to use
+type statusLog struct {
+	sync.Mutex
+	handshakeTime   time.Time
+	handshakeRemote string
+	// The stage the last handshake failed at, or empty if it succeeded
+	handshakeStage string
+	// Oldest first
+	errors []statusError
+}
+
+var status = &statusLog{}
+
+// When gq-client started, for the status page
+var startTime = time.Now()
+
+// handshakeDone records the result of a handshake with remote, failed at stage
+// unless it's empty
+func (s *statusLog) handshakeDone(remote, stage string) {
+	s.Lock()
+	s.handshakeTime, s.handshakeRemote, s.handshakeStage = time.Now(), remote, stage
+	s.Unlock()
+}
+
+// addError records msg, dropping the oldest error once there are maxStatusErrors
+func (s *statusLog) addError(msg string) {
+	s.Lock()
+	s.errors = append(s.errors, statusError{time.Now(), strings.TrimSuffix(msg, "\n")})
+	if len(s.errors) > maxStatusErrors {
+		s.errors = s.errors[len(s.errors)-maxStatusErrors:]
+	}
+	s.Unlock()
+}
+
+// seconds formats d in whole seconds
+func seconds(d time.Duration) string {
+	return d.Truncate(time.Second).String()
+}
+
+// The status page, made for people who just want to know if it's working
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"ago": func(t time.Time) string { return seconds(time.Since(t)) + " ago" },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>GoQuiet: {{.State}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+.ok { color: #080; } .bad { color: #c00; } .waiting { color: #860; }
+table { border-collapse: collapse; } td, th { padding: 0.2em 1em; text-align: left; }
+</style>
+</head>
+<body>
+<h1 class="{{.Class}}">{{.State}}</h1>
+<p>gq-client {{.Version}}, running for {{.Uptime}}.</p>
+{{if .HandshakeRemote}}<p>Last connection to the server {{.HandshakeRemote}}: {{if .HandshakeStage}}<span class="bad">failed at {{.HandshakeStage}}</span>{{else}}<span class="ok">succeeded</span>{{end}}, {{ago .HandshakeTime}}.</p>{{end}}
+<h2>Active connections: {{len .Conns}}</h2>
+{{if .Conns}}<table>
+<tr><th>From</th><th>To</th><th>Opened</th><th>Sent</th><th>Received</th></tr>
+{{range .Conns}}<tr><td>{{.Source}}</td><td>{{.Remote}}</td><td>{{ago .Start}}</td><td>{{.BytesUp}} bytes</td><td>{{.BytesDown}} bytes</td></tr>
+{{end}}</table>{{end}}
+<h2>Recent errors</h2>
+{{if .Errors}}<ul>
+{{range .Errors}}<li>{{ago .Time}}: {{.Message}}</li>
+{{end}}</ul>{{else}}<p>None.</p>{{end}}
+</body>
+</html>
+`))
+
+// serveStatusPage writes the status page
+func serveStatusPage(w http.ResponseWriter, r *http.Request) {
+	status.Lock()
+	page := struct {
+		State, Class, Version, Uptime string
+		HandshakeTime                 time.Time
+		HandshakeRemote               string
+		HandshakeStage                string
+		Conns                         []gqclient.ConnStats
+		Errors                        []statusError
+	}{
+		Version:         version,
+		Uptime:          seconds(time.Since(startTime)),
+		HandshakeTime:   status.handshakeTime,
+		HandshakeRemote: status.handshakeRemote,
+		HandshakeStage:  status.handshakeStage,
+		Conns:           tracker.Snapshot(),
+		Errors:          append([]statusError{}, status.errors...),
+	}
+	status.Unlock()
+	switch {
+	case page.HandshakeRemote == "":
+		page.State, page.Class = "Waiting for the first connection", "waiting"
+	case page.HandshakeStage != "":
+		page.State, page.Class = "Not working: can't get through to the server", "bad"
+	default:
+		page.State, page.Class = "Working", "ok"
+	}
+	if page.Version == "" {
+		page.Version = "(unknown version)"
+	}
+	// Newest first
+	for i, j := 0, len(page.Errors)-1; i < j; i, j = i+1, j-1 {
+		page.Errors[i], page.Errors[j] = page.Errors[j], page.Errors[i]
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	statusTemplate.Execute(w, page)
+}
+
+// serveStatus serves the status page on addr. Like pprof it's only a convenience,
+// so failing to listen is logged rather than fatal
+func serveStatus(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", serveStatusPage)
+	log.Printf("Serving the status page on http://%v/\n", addr)
+	err := http.ListenAndServe(addr, mux)
+	log.Printf("Serving the status page: %v\n", err)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+)
+
+// The first file descriptor passed by systemd socket activation, SD_LISTEN_FDS_START.
+// A variable so that tests can pass one of their own
+var sdListenFdsStart = 3
+
+// socketActivated reports whether systemd has passed us listening sockets, see
+// sd_listen_fds(3). LISTEN_PID is checked so that a child we start doesn't take
+// the variables meant for us as its own
+func socketActivated() bool {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return false
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	return err == nil && n > 0
+}
+
+// systemdListener returns the listener passed by systemd socket activation to listen
+// for SS on, or nil if we weren't socket activated. Only the first socket is used
+func systemdListener() (net.Listener, error) {
+	if !socketActivated() {
+		return nil, nil
+	}
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(env)
+	}
+	if n > 1 {
+		log.Printf("systemd passed %v sockets, only the first is used\n", n)
+	}
+	f := os.NewFile(uintptr(sdListenFdsStart), "systemd")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Listening for ss on %v passed by systemd\n", l.Addr())
+	return l, nil
+}
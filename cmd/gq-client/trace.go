@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// The sink of connection traces, nil if TraceFile isn't set
+var traceLog *traceWriter
+
+type traceWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// A trace file starts with this, followed by one trace for each connection, which
+// is its length as a uvarint and then, as uvarints unless said otherwise:
+//
+//	the ID of the connection, 0 if its handshake failed
+//	its start in microseconds since the Unix epoch, as a varint
+//	events, each a byte of its kind, the microseconds since the last event and a
+//	value, which for records is their length without the header
+var traceMagic = []byte("GQTRACE\x01")
+
+// The kinds of trace events
+const (
+	traceUp        = 1 // A record sent to the remote
+	traceDown      = 2 // A record received from the remote
+	traceHandshake = 3 // The server's handshake has been read
+	traceReply     = 4 // Our reply has been sent
+	traceFailed    = 5 // The handshake failed, at the stage in traceStages of the value
+	traceClosed    = 6
+	traceDropped   = 7 // The value is the number of events left out past maxTraceEvents
+)
+
+var traceKinds = map[byte]string{
+	traceUp:        "up",
+	traceDown:      "down",
+	traceHandshake: "handshake",
+	traceReply:     "reply",
+	traceFailed:    "failed",
+	traceClosed:    "closed",
+	traceDropped:   "dropped",
+}
+
+// New stages go at the end, as they're written to TraceFile by their index
+var traceStages = []string{"dial", "clienthello", "serverread", "reply", "firstdata", "websocket"}
+
+// The most events kept for a connection, so that a long one can't use up memory
+const maxTraceEvents = 4096
+
+func openTraceLog(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if info, err := f.Stat(); err == nil && info.Size() == 0 {
+		f.Write(traceMagic)
+	}
+	traceLog = &traceWriter{w: f}
+	return nil
+}
+
+// connTrace is the trace of one connection from SS, written to the trace file once
+// it's closed. Like auditRecord, all methods do nothing on a nil *connTrace, so
+// there's only a nil check on each record when tracing is off
+type connTrace struct {
+	mu      sync.Mutex
+	start   time.Time
+	last    time.Time
+	events  []byte
+	count   int
+	dropped int
+	once    sync.Once
+}
+
+func newConnTrace() *connTrace {
+	if traceLog == nil {
+		return nil
+	}
+	now := time.Now()
+	return &connTrace{start: now, last: now}
+}
+
+func (tr *connTrace) add(kind byte, value int) {
+	if tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	if tr.count < maxTraceEvents {
+		tr.appendEvent(kind, value)
+		tr.count++
+	} else {
+		tr.dropped++
+	}
+	tr.mu.Unlock()
+}
+
+// appendEvent adds an event to events. tr.mu must be held
+func (tr *connTrace) appendEvent(kind byte, value int) {
+	now := time.Now()
+	var buf [1 + 2*binary.MaxVarintLen64]byte
+	buf[0] = kind
+	n := 1 + binary.PutUvarint(buf[1:], uint64(now.Sub(tr.last)/time.Microsecond))
+	n += binary.PutUvarint(buf[n:], uint64(value))
+	tr.events = append(tr.events, buf[:n]...)
+	tr.last = now
+}
+
+// handshakeFailed finishes the trace of a connection whose handshake failed at stage
+func (tr *connTrace) handshakeFailed(stage string) {
+	if tr == nil {
+		return
+	}
+	for i, s := range traceStages {
+		if s == stage {
+			tr.add(traceFailed, i)
+		}
+	}
+	tr.finish(0)
+}
+
+// finish writes the trace of the connection with id to the trace file. Only the
+// first call does anything
+func (tr *connTrace) finish(id uint64) {
+	if tr == nil {
+		return
+	}
+	tr.once.Do(func() {
+		tr.mu.Lock()
+		if tr.dropped != 0 {
+			tr.appendEvent(traceDropped, tr.dropped)
+		}
+		tr.appendEvent(traceClosed, 0)
+		var head [2 * binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(head[:], id)
+		n += binary.PutVarint(head[n:], tr.start.UnixNano()/int64(time.Microsecond))
+		body := append(head[:n], tr.events...)
+		tr.mu.Unlock()
+		var length [binary.MaxVarintLen64]byte
+		trace := append(length[:binary.PutUvarint(length[:], uint64(len(body)))], body...)
+		traceLog.mu.Lock()
+		traceLog.w.Write(trace)
+		traceLog.mu.Unlock()
+	})
+}
+
+// printTraces writes the traces in the trace file at path as text, a line for each
+// connection followed by one for each of its events
+func printTraces(path string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(traceMagic))
+	if _, err = io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, traceMagic) {
+		return errors.New("Not a trace file")
+	}
+	for {
+		length, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil || length > 1<<20 {
+			return errors.New("Malformed trace file")
+		}
+		body := make([]byte, length)
+		if _, err = io.ReadFull(r, body); err != nil {
+			return errors.New("Truncated trace file")
+		}
+		if err = printTrace(bytes.NewReader(body), w); err != nil {
+			return err
+		}
+	}
+}
+
+func printTrace(r *bytes.Reader, w io.Writer) error {
+	id, err := binary.ReadUvarint(r)
+	if err != nil {
+		return errors.New("Malformed trace")
+	}
+	start, err := binary.ReadVarint(r)
+	if err != nil {
+		return errors.New("Malformed trace")
+	}
+	at := time.Unix(0, start*int64(time.Microsecond))
+	fmt.Fprintf(w, "Connection %v at %v\n", id, at.UTC().Format(time.RFC3339Nano))
+	var since time.Duration
+	for r.Len() != 0 {
+		kind, _ := r.ReadByte()
+		delta, err := binary.ReadUvarint(r)
+		if err != nil {
+			return errors.New("Malformed trace")
+		}
+		value, err := binary.ReadUvarint(r)
+		if err != nil {
+			return errors.New("Malformed trace")
+		}
+		since += time.Duration(delta) * time.Microsecond
+		name, ok := traceKinds[kind]
+		if !ok {
+			name = fmt.Sprintf("kind %v", kind)
+		}
+		switch {
+		case kind == traceFailed && value < uint64(len(traceStages)):
+			fmt.Fprintf(w, "\t+%v %v at %v\n", since, name, traceStages[value])
+		case kind == traceUp || kind == traceDown || kind == traceDropped:
+			fmt.Fprintf(w, "\t+%v %v %v\n", since, name, value)
+		default:
+			fmt.Fprintf(w, "\t+%v %v\n", since, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/url"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+	"github.com/cbeuw/GoQuiet/websocket"
+)
+
+// openWebSocket opens the WebSocket at WebSocketURL on conn, a connection to the
+// server or to the CDN in front of it, for the fake TLS to go through. Over wss://
+// it's inside real TLS, with the certificate checked against the system's roots
+func openWebSocket(conn net.Conn, sta *gqclient.State) (net.Conn, error) {
+	u, err := url.Parse(sta.WebSocketURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err = tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return websocket.Client(conn, u.Host, u.RequestURI())
+}
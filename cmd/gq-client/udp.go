@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+	"github.com/cbeuw/GoQuiet/gqclient/TLS"
+)
+
+// How long a UDP session is kept without a datagram either way, which is what
+// ss-local and ss-server time UDP out after by default
+var udpSessionTimeout = 60 * time.Second
+
+// The datagrams from SS a session keeps while its handshake is being made. Any
+// more are dropped, as a full socket buffer would
+const udpQueueLen = 64
+
+// udpSession is the connection to the server that the datagrams from one address
+// of SS go through, each way
+type udpSession struct {
+	from  net.Addr
+	queue chan []byte
+	// Closed once the connection to the server has ended
+	done chan struct{}
+
+	mu   sync.Mutex
+	idle *time.Timer
+}
+
+// udpRelay relays the datagrams SS sends to the port it connects to for TCP, as
+// SIP003u, with a session for each address they're from
+type udpRelay struct {
+	pc       net.PacketConn
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+}
+
+// serveUDP relays the datagrams from SS on pc until it's closed
+func serveUDP(pc net.PacketConn) {
+	r := &udpRelay{pc: pc, sessions: make(map[string]*udpSession)}
+	buf := make([]byte, TLS.MaxDatagramSize)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			log.Printf("Reading UDP from ss: %v\n", err)
+			return
+		}
+		s := r.session(from)
+		select {
+		case s.queue <- append([]byte{}, buf[:n]...):
+		default:
+			debugf("Dropping a datagram from %v while its session is busy\n", from)
+		}
+	}
+}
+
+// session returns the session of datagrams from from, starting one if there's none
+func (r *udpRelay) session(from net.Addr) *udpSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[from.String()]
+	if !ok {
+		s = &udpSession{
+			from:  from,
+			queue: make(chan []byte, udpQueueLen),
+			done:  make(chan struct{}),
+		}
+		r.sessions[from.String()] = s
+		go r.run(s, currentState.Load())
+	}
+	return s
+}
+
+func (r *udpRelay) remove(s *udpSession) {
+	r.mu.Lock()
+	if r.sessions[s.from.String()] == s {
+		delete(r.sessions, s.from.String())
+	}
+	r.mu.Unlock()
+}
+
+// active pushes back the end of an idle session
+func (s *udpSession) active() {
+	s.mu.Lock()
+	s.idle.Reset(udpSessionTimeout)
+	s.mu.Unlock()
+}
+
+// run makes the handshake of s, then relays its datagrams until either the server
+// closes the connection or there has been none for udpSessionTimeout
+func (r *udpRelay) run(s *udpSession, sta *gqclient.State) {
+	session := *sta
+	session.Datagrams = true
+	remoteAddr, remote, err := remoteHandshake(&session, nil, nil)
+	if err != nil {
+		r.remove(s)
+		return
+	}
+	debugf(labelled(sta.Label, "UDP session from %v to %v\n"), s.from, remoteAddr)
+	tracked := tracker.AddLabelled("udp "+s.from.String(), remoteAddr, sta.Label)
+	s.mu.Lock()
+	s.idle = time.AfterFunc(udpSessionTimeout, func() { remote.Close() })
+	s.mu.Unlock()
+
+	go func() {
+		defer close(s.done)
+		defer r.remove(s)
+		defer tracked.Remove()
+		defer remote.Close()
+		var datagrams TLS.DatagramReader
+		buf := make([]byte, 20480)
+		for {
+			i, err := gqclient.ReadTillDrain(remote, buf)
+			if err != nil {
+				return
+			}
+			datagrams.Feed(TLS.PeelRecordLayer(buf[:i]))
+			for {
+				datagram, ok := datagrams.Next()
+				if !ok {
+					break
+				}
+				s.active()
+				tracked.AddDown(len(datagram))
+				r.pc.WriteTo(datagram, s.from)
+			}
+		}
+	}()
+
+	for {
+		select {
+		case datagram := <-s.queue:
+			s.active()
+			if gqclient.WriteAll(remote, TLS.DatagramRecords(datagram)) != nil {
+				remote.Close()
+				return
+			}
+			tracked.AddUp(len(datagram))
+		case <-s.done:
+			return
+		}
+	}
+}
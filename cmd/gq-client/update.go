@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Where CheckForUpdates asks for the latest release if UpdateURL isn't set
+const defaultUpdateURL = "https://api.github.com/repos/cbeuw/GoQuiet/releases/latest"
+
+const updateCheckTimeout = 10 * time.Second
+
+// checkForUpdates asks url for the latest version of gq-client and logs a notice if
+// it's newer than this one. Nothing is installed. It's meant to run in the
+// background, and a failure is only logged at debug level so that it never gets
+// in the way of gq-client starting
+func checkForUpdates(url string) {
+	latest, err := latestVersion(url)
+	if err != nil {
+		debugf("Checking for updates: %v\n", err)
+		return
+	}
+	if newerVersion(latest, version) {
+		log.Printf("gq-client %v is available, this is %v. Updating keeps the browser fingerprints current\n", latest, version)
+	}
+}
+
+// latestVersion gets the latest version from url, which answers with either a
+// GitHub release or the version on its own. The request is a plain GET with no
+// query and a generic User-Agent, so that it says nothing about us or this version
+func latestVersion(url string) (string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "gq-client")
+	client := &http.Client{Timeout: updateCheckTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%v answered %v", url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return "", err
+	}
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	latest := strings.TrimSpace(string(body))
+	if json.Unmarshal(body, &release) == nil {
+		latest = release.TagName
+	}
+	if _, ok := parseVersion(latest); !ok {
+		return "", fmt.Errorf("No version in the answer from %v", url)
+	}
+	return latest, nil
+}
+
+// parseVersion parses a release version like v1.2.3 into its numbers
+func parseVersion(v string) ([]int, bool) {
+	if !strings.HasPrefix(v, "v") {
+		return nil, false
+	}
+	var ret []int
+	for _, part := range strings.Split(v[1:], ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		ret = append(ret, n)
+	}
+	return ret, true
+}
+
+// newerVersion reports whether version a is newer than b. It's false if either
+// isn't a release version, as with a build from master
+func newerVersion(a, b string) bool {
+	va, okA := parseVersion(a)
+	vb, okB := parseVersion(b)
+	if !okA || !okB {
+		return false
+	}
+	for i := 0; i < len(va) || i < len(vb); i++ {
+		var x, y int
+		if i < len(va) {
+			x = va[i]
+		}
+		if i < len(vb) {
+			y = vb[i]
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The environment variables through which a new gq-client started by upgrade
+// gets the listeners and the config of the old one
+const (
+	listenFdEnv  = "GQ_LISTEN_FD"
+	metricsFdEnv = "GQ_METRICS_FD"
+	stateEnv     = "GQ_STATE"
+)
+
+// 1 once a new gq-client has taken over the listeners. Accessed atomically
+var upgraded int32
+
+// The listeners handed to a new gq-client by upgrade
+var listeners struct {
+	sync.Mutex
+	ss      net.Listener
+	metrics net.Listener
+}
+
+func setSSListener(l net.Listener) {
+	listeners.Lock()
+	listeners.ss = l
+	listeners.Unlock()
+}
+
+// inheritedListener returns the listener whose file descriptor is in the
+// environment variable env, or nil if there's none
+func inheritedListener(env string) (net.Listener, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return nil, nil
+	}
+	os.Unsetenv(env)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, errors.New("Bad " + env + ": " + value)
+	}
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// listenerFile returns a duplicate of the file descriptor of l
+func listenerFile(l net.Listener) (*os.File, error) {
+	filer, ok := l.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, errors.New("Listener has no file descriptor")
+	}
+	return filer.File()
+}
+
+// upgrade starts the gq-client executable again, with the same arguments, on
+// the listeners of this one and with the config currently in use, apart from Key
+// which it reads from the config again. This gq-client then stops accepting
+// connections and exits once the connections it has are closed
+func upgrade() error {
+	if atomic.LoadInt32(&upgraded) == 1 {
+		return errors.New("Already upgraded")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	listeners.Lock()
+	defer listeners.Unlock()
+	ssFile, err := listenerFile(listeners.ss)
+	if err != nil {
+		return err
+	}
+	defer ssFile.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// ExtraFiles start at file descriptor 3
+	cmd.ExtraFiles = []*os.File{ssFile}
+	cmd.Env = append(os.Environ(),
+		listenFdEnv+"=3",
+		stateEnv+"="+string(currentState.Load().NonSecret()),
+	)
+	if listeners.metrics != nil {
+		metricsFile, err := listenerFile(listeners.metrics)
+		if err != nil {
+			return err
+		}
+		defer metricsFile.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, metricsFile)
+		cmd.Env = append(cmd.Env, metricsFdEnv+"=4")
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	log.Printf("Started new gq-client with pid %v, no longer accepting connections\n", cmd.Process.Pid)
+	atomic.StoreInt32(&upgraded, 1)
+	listeners.ss.Close()
+	if listeners.metrics != nil {
+		listeners.metrics.Close()
+	}
+	return nil
+}
+
+// waitForConnections waits until no connections are being relayed. It waits at
+// least a second, for the handshakes in progress, which aren't tracked yet
+func waitForConnections() {
+	for {
+		time.Sleep(time.Second)
+		if tracker.Len() == 0 {
+			return
+		}
+	}
+}
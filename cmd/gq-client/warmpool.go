@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+)
+
+// How long to wait before making another handshake for the pool after one failed,
+// so that a server that's down isn't hammered
+const warmRetryDelay = 5 * time.Second
+
+// The default WarmPoolMaxIdle in seconds, well within the idle timeout of 60 seconds
+// ss-server has by default, since gq-server connects to it once the handshake is done
+const defaultWarmPoolMaxIdle = 30
+
+// warmConn is a connection to the server that has been through the handshake and
+// waits in the pool for a connection from SS
+type warmConn struct {
+	conn    net.Conn
+	addr    string
+	browser string
+	// The State it was made with
+	sta *gqclient.State
+	// Set to 1 atomically if the server closed it or sent something while idle
+	dead int32
+	// Closed once watch has returned
+	watched chan struct{}
+	idle    *time.Timer
+}
+
+// warmPool keeps WarmPoolSize connections that have been through the handshake,
+// so that a connection from SS doesn't have to wait for one. The State used is
+// always currentState, so the pool follows reloads
+type warmPool struct {
+	mu    sync.Mutex
+	conns []*warmConn
+	// Handshakes being made for the pool
+	filling int
+}
+
+var warm = &warmPool{}
+
+// get takes a connection made with sta out of the pool and starts a handshake to
+// replace it. It returns nil if the pool has none
+func (p *warmPool) get(sta *gqclient.State) *warmConn {
+	for {
+		p.mu.Lock()
+		if len(p.conns) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		w := p.conns[0]
+		p.conns = p.conns[1:]
+		p.mu.Unlock()
+		go p.fill()
+
+		w.idle.Stop()
+		// Stop watch reading from it
+		w.conn.SetReadDeadline(time.Now())
+		<-w.watched
+		if atomic.LoadInt32(&w.dead) == 0 && w.sta == sta {
+			w.conn.SetReadDeadline(time.Time{})
+			return w
+		}
+		w.conn.Close()
+	}
+}
+
+// remove takes w out of the pool and reports whether it was there
+func (p *warmPool) remove(w *warmConn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, c := range p.conns {
+		if c == w {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// fill makes a handshake for the pool if it has fewer than WarmPoolSize connections,
+// counting the handshakes already being made
+func (p *warmPool) fill() {
+	sta := currentState.Load()
+	p.mu.Lock()
+	// A new gq-client has taken over, so no more connections will come from SS
+	if len(p.conns)+p.filling >= sta.WarmPoolSize || atomic.LoadInt32(&upgraded) == 1 {
+		p.mu.Unlock()
+		return
+	}
+	p.filling++
+	p.mu.Unlock()
+
+	addr, conn, err := remoteHandshake(sta, nil, nil)
+	if err != nil {
+		p.mu.Lock()
+		p.filling--
+		p.mu.Unlock()
+		time.AfterFunc(warmRetryDelay, p.fill)
+		return
+	}
+	w := &warmConn{
+		conn:    conn,
+		addr:    addr,
+		browser: sta.Browser,
+		sta:     sta,
+		watched: make(chan struct{}),
+	}
+	maxIdle := sta.WarmPoolMaxIdle
+	if maxIdle == 0 {
+		maxIdle = defaultWarmPoolMaxIdle
+	}
+	idle := time.Duration(maxIdle) * time.Second
+	if left := ticketPeriodLeft(sta); left < idle {
+		idle = left
+	}
+	// Replaced before the server side gives up on it
+	w.idle = time.AfterFunc(idle, func() {
+		if p.remove(w) {
+			w.conn.Close()
+			p.fill()
+		}
+	})
+	p.mu.Lock()
+	p.filling--
+	p.conns = append(p.conns, w)
+	p.mu.Unlock()
+	go p.watch(w)
+	// In case there's more room
+	go p.fill()
+}
+
+// ticketPeriodLeft returns how long is left of the TicketTimeHint period the
+// session ticket of a handshake made now is from. A connection isn't kept in the
+// pool past it, so that SS isn't handed one whose ticket has since been replaced
+func ticketPeriodLeft(sta *gqclient.State) time.Duration {
+	now := sta.Now()
+	period := int64(sta.TicketTimeHint)
+	end := time.Unix((now.Unix()/period+1)*period, 0)
+	return end.Sub(now)
+}
+
+// watch reads from w while it's in the pool. The server sends nothing until it
+// gets data, so the read only returns early if the connection is broken, in which
+// case it's replaced. get stops it with a read deadline
+func (p *warmPool) watch(w *warmConn) {
+	defer close(w.watched)
+	_, err := w.conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return
+	}
+	atomic.StoreInt32(&w.dead, 1)
+	if p.remove(w) {
+		w.idle.Stop()
+		w.conn.Close()
+		p.fill()
+	}
+}
+
+// flush closes the connections in the pool and makes new ones, after a reload
+func (p *warmPool) flush() {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = nil
+	p.mu.Unlock()
+	for _, w := range conns {
+		w.idle.Stop()
+		w.conn.Close()
+	}
+	for i := 0; i < currentState.Load().WarmPoolSize; i++ {
+		go p.fill()
+	}
+}
@@ -1,20 +1,28 @@
-// +build go1.8,!go1.10
-
 package main
 
 import (
+	"crypto/md5"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/cbeuw/GoQuiet/buffer"
+	"github.com/cbeuw/GoQuiet/deflate"
 	"github.com/cbeuw/GoQuiet/gqserver"
-	"github.com/cbeuw/gotfo"
+	"github.com/cbeuw/GoQuiet/idle"
+	"github.com/cbeuw/GoQuiet/mux"
+	"github.com/cbeuw/GoQuiet/tfo"
+	"github.com/cbeuw/GoQuiet/websocket"
 )
 
 var version string
@@ -26,105 +34,306 @@ type pipe interface {
 }
 
 type ssPair struct {
-	ss     net.Conn
-	remote net.Conn
+	ss       net.Conn
+	remote   net.Conn
+	compress bool
+	// The most plaintext in a record to the remote, from the record_size_limit
+	// in its ClientHello. 0 if it didn't send one
+	maxRecord int
+	// The size of the buffer reads from ss-server go into, DownBufferSize
+	bufSize int
+	// Closes the pair once IdleTimeout has passed without data, nil without it
+	idle *idle.Timer
+	// The user of Users the client is, nil for the Key
+	user *gqserver.User
+	// The directions that have ended with EOF. Accessed atomically
+	halfClosed int32
 }
 
 type webPair struct {
-	webServer net.Conn
-	remote    net.Conn
+	webServer  net.Conn
+	remote     net.Conn
+	halfClosed int32
+}
+
+// halfClose is called when a direction of the pair has ended with EOF: to, the
+// connection it was writing to, is half-closed so that the other direction carries
+// on, e.g. with the response to a request that has been sent. The pair is closed
+// once both directions have ended, or straight away if to can't be half-closed
+func halfClose(p pipe, halfClosed *int32, to net.Conn) {
+	if !gqserver.CloseWrite(to) || atomic.AddInt32(halfClosed, 1) == 2 {
+		p.closePipe()
+	}
 }
 
+// Close doesn't block since SO_LINGER is never set, so the connections are closed
+// without goroutines of their own
 func (pair *webPair) closePipe() {
-	go pair.webServer.Close()
-	go pair.remote.Close()
+	pair.webServer.Close()
+	pair.remote.Close()
 }
 
 func (pair *ssPair) closePipe() {
-	go pair.ss.Close()
-	go pair.remote.Close()
+	pair.idle.Stop()
+	pair.ss.Close()
+	pair.remote.Close()
 }
 
 func (pair *webPair) serverToRemote() {
-	for {
-		length, err := io.Copy(pair.remote, pair.webServer)
-		if err != nil || length == 0 {
-			pair.closePipe()
-			return
-		}
+	// io.Copy returns a nil error once it has read EOF
+	_, err := io.Copy(pair.remote, pair.webServer)
+	if err != nil {
+		pair.closePipe()
+		return
 	}
+	halfClose(pair, &pair.halfClosed, pair.remote)
 }
 
 func (pair *webPair) remoteToServer() {
-	for {
-		length, err := io.Copy(pair.webServer, pair.remote)
-		if err != nil || length == 0 {
-			pair.closePipe()
-			return
-		}
+	_, err := io.Copy(pair.webServer, pair.remote)
+	if err != nil {
+		pair.closePipe()
+		return
+	}
+	halfClose(pair, &pair.halfClosed, pair.webServer)
+}
+
+// The connections from clients being dealt with, for MaxConnections. Accessed
+// atomically
+var openConns int32
+
+// openConn counts a connection, unless there are MaxConnections already in which
+// case it reports false
+func openConn(sta *gqserver.State) bool {
+	n := atomic.AddInt32(&openConns, 1)
+	if sta.MaxConnections != 0 && int(n) > sta.MaxConnections {
+		atomic.AddInt32(&openConns, -1)
+		return false
 	}
+	return true
+}
+
+// What has happened to the connections from clients, served on MetricsAddr
+var metrics = &gqserver.Metrics{
+	Active: func() int { return int(atomic.LoadInt32(&openConns)) },
+}
+
+// countedConn is a connection counted by openConn, which stops being counted once
+// it's closed. Every way a connection is dealt with ends in closing it
+type countedConn struct {
+	net.Conn
+	opened time.Time
+	once   sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt32(&openConns, -1)
+		metrics.ConnClosed(time.Since(c.opened))
+	})
+	return c.Conn.Close()
 }
 
+// CloseWrite half-closes the connection underneath, which embedding net.Conn hides
+func (c *countedConn) CloseWrite() error {
+	cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	})
+	if !ok {
+		return errors.New("Connection can't be half-closed")
+	}
+	return cw.CloseWrite()
+}
+
+// expiringConn is a connection from a user with an Expiry, which is closed then
+// so that a connection made before it doesn't carry on for good
+type expiringConn struct {
+	net.Conn
+	timer *time.Timer
+}
+
+// expireAt returns conn, closed once user expires if it ever does
+func expireAt(conn net.Conn, user *gqserver.User, sta *gqserver.State) net.Conn {
+	if user == nil || user.Expiry.IsZero() {
+		return conn
+	}
+	c := &expiringConn{Conn: conn}
+	c.timer = time.AfterFunc(user.Expiry.Sub(sta.Now()), func() {
+		log.Printf("User %v has expired, closing its connection from %v\n", user.ID, conn.RemoteAddr())
+		conn.Close()
+	})
+	return c
+}
+
+func (c *expiringConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
+
+// CloseWrite half-closes the connection underneath, which embedding net.Conn hides
+func (c *expiringConn) CloseWrite() error {
+	cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	})
+	if !ok {
+		return errors.New("Connection can't be half-closed")
+	}
+	return cw.CloseWrite()
+}
+
+// The default size of the buffer reads from ss-server go into
+const defaultDownBufferSize = 10240
+
 func (pair *ssPair) remoteToServer() {
-	buf := make([]byte, 20480)
+	buf := buffer.Get(20480)
+	defer buffer.Put(buf)
 	for {
 		i, err := gqserver.ReadTillDrain(pair.remote, buf)
+		if err == io.EOF {
+			halfClose(pair, &pair.halfClosed, pair.ss)
+			return
+		}
 		if err != nil {
 			pair.closePipe()
 			return
 		}
+		pair.idle.Active()
 		data := gqserver.PeelRecordLayer(buf[:i])
-		_, err = pair.ss.Write(data)
+		if pair.compress {
+			data, err = deflate.Decompress(data)
+			if err != nil {
+				log.Printf("Decompressing data from remote: %v\n", err)
+				pair.closePipe()
+				return
+			}
+		}
+		pair.user.Wait(len(data))
+		err = gqserver.WriteAll(pair.ss, data)
 		if err != nil {
 			pair.closePipe()
 			return
 		}
+		metrics.AddUp(pair.user.Name(), len(data))
 	}
 }
 
 func (pair *ssPair) serverToRemote() {
-	buf := make([]byte, 10240)
+	size := defaultDownBufferSize
+	if pair.bufSize != 0 {
+		size = pair.bufSize
+	}
+	if pair.maxRecord != 0 && pair.maxRecord < size {
+		size = pair.maxRecord
+		if pair.compress {
+			// Compress adds a byte to data it can't make smaller
+			size--
+		}
+	}
+	// Records are made in the buffer, with the header in front of what's read
+	buf := buffer.Get(gqserver.RecordHeaderLen + size)
+	defer buffer.Put(buf)
 	for {
-		i, err := io.ReadAtLeast(pair.ss, buf, 1)
+		i, err := io.ReadAtLeast(pair.ss, buf[gqserver.RecordHeaderLen:], 1)
+		if err == io.EOF {
+			halfClose(pair, &pair.halfClosed, pair.remote)
+			return
+		}
 		if err != nil {
 			pair.closePipe()
 			return
 		}
-		data := buf[:i]
-		data = gqserver.AddRecordLayer(data, []byte{0x17}, []byte{0x03, 0x03})
-		_, err = pair.remote.Write(data)
+		pair.idle.Active()
+		pair.user.Wait(i)
+		var data []byte
+		if pair.compress {
+			data = gqserver.AddRecordLayer(deflate.Compress(buf[gqserver.RecordHeaderLen:gqserver.RecordHeaderLen+i]), []byte{0x17}, []byte{0x03, 0x03})
+		} else {
+			data = buf[:gqserver.RecordHeaderLen+i]
+			gqserver.PutRecordHeader(data, []byte{0x17}, []byte{0x03, 0x03})
+		}
+		err = gqserver.WriteAll(pair.remote, data)
 		if err != nil {
 			pair.closePipe()
 			return
 		}
+		metrics.AddDown(pair.user.Name(), i)
 	}
 }
 
-func dispatchConnection(conn net.Conn, sta *gqserver.State) {
-	goWeb := func(data []byte) {
-		pair, err := makeWebPipe(conn, sta)
-		if err != nil {
-			log.Printf("Making connection to redirection server: %v\n", err)
+// How long a connection has to open its WebSocket with Transport websocket
+const webSocketTimeout = 10 * time.Second
+
+// serveWebSocket opens the WebSocket conn asks for, inside TLS if tlsConfig isn't
+// nil, and deals with the fake TLS in it like that of a connection over TCP.
+// Any other request is relayed to WebServerAddr, inside the TLS, like a
+// ClientHello that isn't from gq-client
+func serveWebSocket(conn net.Conn, sta *gqserver.State, tlsConfig *tls.Config) {
+	raw := conn
+	raw.SetDeadline(time.Now().Add(webSocketTimeout))
+	if tlsConfig != nil {
+		tlsConn := tls.Server(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("TLS handshake with %v: %v\n", raw.RemoteAddr(), err)
 			go conn.Close()
 			return
 		}
-		pair.webServer.Write(data)
-		go pair.remoteToServer()
-		go pair.serverToRemote()
+		conn = tlsConn
 	}
-	goSS := func(data []byte) {
-		pair, err := makeSSPipe(conn, sta, data)
-		if err != nil {
-			log.Fatalf("Making connection to ss-server: %v\n", err)
-		}
-		go pair.remoteToServer()
-		go pair.serverToRemote()
+	path := sta.WebSocketPath
+	if path == "" {
+		path = "/"
+	}
+	ws, read, err := websocket.Server(conn, path)
+	raw.SetDeadline(time.Time{})
+	if err != nil {
+		// Even one that timed out, as a web server would wait longer than us
+		log.Printf("+1 non WebSocket request from %v: %v\n", raw.RemoteAddr(), err)
+		metrics.Rejected("notwebsocket")
+		goWeb(conn, read, sta)
+		return
+	}
+	dispatchConnection(ws, sta)
+}
+
+// goWeb relays conn to WebServerAddr, starting with data that was read from it
+func goWeb(conn net.Conn, data []byte, sta *gqserver.State) {
+	pair, err := makeWebPipe(conn, sta)
+	if err != nil {
+		log.Printf("Making connection to redirection server: %v\n", err)
+		go conn.Close()
+		return
+	}
+	err = gqserver.WriteAll(pair.webServer, data)
+	if err != nil {
+		log.Printf("Sending first data to redirection server: %v\n", err)
+		pair.closePipe()
+		return
 	}
+	go pair.remoteToServer()
+	go pair.serverToRemote()
+}
 
-	buf := make([]byte, 1500)
+func dispatchConnection(conn net.Conn, sta *gqserver.State) {
+	// Large enough for any record, so a ClientHello with long RawExtensions fits
+	buf := make([]byte, 5+16384)
 
 	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
-	i, err := io.ReadAtLeast(conn, buf, 1)
+	// Only the ClientHello, the ChangeCipherSpec that gq-client sends straight
+	// after one offering early data is read as the first record of its reply
+	i, err := gqserver.ReadFirstRecord(conn, buf)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		// A web server would wait longer than us for a request, and a probe
+		// that says nothing, or stops halfway, would see us hang up early.
+		// Let it decide
+		conn.SetReadDeadline(time.Time{})
+		if i == 0 {
+			metrics.Rejected("silent")
+		} else {
+			metrics.Rejected("notclienthello")
+		}
+		goWeb(conn, buf[:i], sta)
+		return
+	}
 	if err != nil {
 		go conn.Close()
 		return
@@ -133,44 +342,293 @@ func dispatchConnection(conn net.Conn, sta *gqserver.State) {
 	data := buf[:i]
 	ch, err := gqserver.ParseClientHello(data)
 	if err != nil {
-		goWeb(data)
+		metrics.Rejected("notclienthello")
+		goWeb(conn, data, sta)
 		return
 	}
 
-	isSS := gqserver.IsSS(ch, sta)
-	if !isSS {
+	err = gqserver.VerifyClientHello(ch, sta)
+	if err != nil {
 		log.Printf("+1 non SS traffic from %v\n", conn.RemoteAddr())
-		goWeb(data)
+		switch err {
+		case gqserver.ErrReplay:
+			metrics.Rejected("replay")
+		case gqserver.ErrExpired:
+			log.Printf("ClientHello from %v is from a user that has expired\n", conn.RemoteAddr())
+			metrics.Rejected("expired")
+		default:
+			metrics.Rejected("auth")
+		}
+		goWeb(conn, data, sta)
 		return
 	}
 
+	if sta.LogFingerprints {
+		ja3 := ch.JA3()
+		from := conn.RemoteAddr().String()
+		if ch.User() != nil {
+			from += " of user " + ch.User().ID
+		}
+		log.Printf("ClientHello from %v has JA3 %x (%v) and JA4 %v\n", from, md5.Sum([]byte(ja3)), ja3, ch.JA4())
+	}
+
 	reply := gqserver.ComposeReply(ch)
-	_, err = conn.Write(reply)
+	err = gqserver.WriteAll(conn, reply)
 	if err != nil {
 		log.Printf("Sending reply to remote: %v\n", err)
+		metrics.HandshakeFailed("reply")
 		go conn.Close()
 		return
 	}
 
-	// Two discarded messages: ChangeCipherSpec and Finished
+	// Two messages: ChangeCipherSpec, which may have come with the ClientHello,
+	// and Finished. Finished must be bound to the ServerHello we've just sent
+	var handshakeDeadline time.Time
+	if sta.HandshakeTimeout != 0 {
+		handshakeDeadline = time.Now().Add(time.Duration(sta.HandshakeTimeout) * time.Second)
+	}
 	discardBuf := make([]byte, 1024)
 	for c := 0; c < 2; c++ {
-		_, err = gqserver.ReadTillDrain(conn, discardBuf)
+		// ReadTillDrain clears it once it has read a record
+		conn.SetReadDeadline(handshakeDeadline)
+		i, err = gqserver.ReadTillDrain(conn, discardBuf)
+		if c == 0 && err == io.EOF {
+			// gq-client always answers our ServerHello. Replays are caught by IsSS,
+			// but only of the ClientHellos seen since gq-server started
+			log.Printf("%v closed the connection after our ServerHello, it's likely a probe replaying a ClientHello from before gq-server started\n", conn.RemoteAddr())
+			metrics.HandshakeFailed("finished")
+			go conn.Close()
+			return
+		}
 		if err != nil {
 			log.Printf("Reading discarded message %v: %v\n", c, err)
+			metrics.HandshakeFailed("finished")
+			go conn.Close()
+			return
+		}
+	}
+	finished := gqserver.PeelRecordLayer(discardBuf[:i])
+	if !gqserver.IsBound(ch, reply, finished, sta) {
+		log.Printf("Finished from %v is not bound to our ServerHello\n", conn.RemoteAddr())
+		metrics.HandshakeFailed("unbound")
+		go conn.Close()
+		return
+	}
+	if gqserver.IsPing(ch, reply, finished, sta) {
+		log.Printf("Smoke test ping from %v\n", conn.RemoteAddr())
+		go echoPing(conn)
+		return
+	}
+	// It's only checked for in the handshake otherwise
+	conn = expireAt(conn, ch.User(), sta)
+	if gqserver.IsConnect(ch, reply, finished, sta) {
+		if !sta.AllowConnect {
+			log.Printf("%v asked for a connection to be dialled by us, which needs AllowConnect\n", conn.RemoteAddr())
 			go conn.Close()
 			return
 		}
+		go serveConnect(conn, sta, ch.RecordSizeLimit(), ch.User())
+		return
+	}
+	if udpAddr, ok := gqserver.DatagramRouteOf(ch, reply, finished, sta); ok {
+		go relayDatagrams(conn, udpAddr, ch.User())
+		return
+	}
+	if muxAddr, ok := gqserver.MuxRouteOf(ch, reply, finished, sta); ok {
+		go serveMux(conn, muxAddr, sta, ch.RecordSizeLimit(), ch.User())
+		return
 	}
+	serveSS(conn, gqserver.RouteOf(ch, reply, finished, sta), sta, ch.RecordSizeLimit(), ch.User())
+}
 
+// serveSS relays conn, a connection that has been through the handshake or a
+// stream on one, to the ss-server at addr. maxRecord is the record_size_limit
+// of the client, or 0, and user is the user of Users it's from, or nil
+func serveSS(conn net.Conn, addr string, sta *gqserver.State, maxRecord int, user *gqserver.User) {
 	// If FastOpen is enabled, we need some data ready to send to ss-server
+	var data []byte
 	if sta.FastOpen {
 		tempBuf := make([]byte, 20480)
-		i, _ = gqserver.ReadTillDrain(conn, tempBuf)
+		i, _ := gqserver.ReadTillDrain(conn, tempBuf)
 		data = gqserver.PeelRecordLayer(tempBuf[:i])
-		goSS(data)
-	} else {
-		goSS(nil)
+		if sta.Compress {
+			var err error
+			data, err = deflate.Decompress(data)
+			if err != nil {
+				log.Printf("Decompressing first data from remote: %v\n", err)
+				go conn.Close()
+				return
+			}
+		}
+	}
+	pair, err := makeSSPipe(conn, addr, sta.FastOpen, data)
+	if err != nil {
+		// Only this connection, or stream, is lost, not everyone's
+		log.Printf("Making connection to ss-server: %v\n", err)
+		go conn.Close()
+		return
+	}
+	relaySS(pair, sta, maxRecord, user)
+}
+
+// How long a connection from gq-client -socks has to send the address it's for
+const connectAddrTimeout = 10 * time.Second
+
+// serveConnect relays conn, a connection from gq-client -socks, to the address
+// it starts with, and what comes after it
+func serveConnect(conn net.Conn, sta *gqserver.State, maxRecord int, user *gqserver.User) {
+	var first []byte
+	buf := make([]byte, 20480)
+	for {
+		// ReadTillDrain clears it once it has read a record
+		conn.SetReadDeadline(time.Now().Add(connectAddrTimeout))
+		i, err := gqserver.ReadTillDrain(conn, buf)
+		if err != nil {
+			log.Printf("Reading the address to connect to from %v: %v\n", conn.RemoteAddr(), err)
+			go conn.Close()
+			return
+		}
+		data := gqserver.PeelRecordLayer(buf[:i])
+		if sta.Compress {
+			data, err = deflate.Decompress(data)
+			if err != nil {
+				log.Printf("Decompressing first data from remote: %v\n", err)
+				go conn.Close()
+				return
+			}
+		}
+		first = append(first, data...)
+		addr, n, err := gqserver.ParseAddr(first)
+		if err == gqserver.ErrShortAddr {
+			continue
+		}
+		if err != nil {
+			log.Printf("Bad address to connect to from %v: %v\n", conn.RemoteAddr(), err)
+			go conn.Close()
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		target, err := sta.ResolveConnect(addr)
+		if err != nil {
+			log.Printf("Not connecting to %v for %v: %v\n", addr, conn.RemoteAddr(), err)
+			go conn.Close()
+			return
+		}
+		pair, err := makeSSPipe(conn, target, sta.FastOpen, first[n:])
+		if err != nil {
+			log.Printf("Connecting to %v for %v: %v\n", addr, conn.RemoteAddr(), err)
+			go conn.Close()
+			return
+		}
+		relaySS(pair, sta, maxRecord, user)
+		return
+	}
+}
+
+// relaySS starts relaying pair, made to ss-server or to where -socks asked
+func relaySS(pair *ssPair, sta *gqserver.State, maxRecord int, user *gqserver.User) {
+	pair.compress = sta.Compress
+	pair.maxRecord = maxRecord
+	pair.bufSize = sta.DownBufferSize
+	pair.user = user
+	if sta.IdleTimeout != 0 {
+		pair.idle = idle.NewTimer(time.Duration(sta.IdleTimeout)*time.Second, pair.closePipe)
+	}
+	go pair.remoteToServer()
+	go pair.serverToRemote()
+}
+
+// serveMux relays each of the streams the client opens on conn to the ss-server
+// at addr, until conn is closed
+func serveMux(conn net.Conn, addr string, sta *gqserver.State, maxRecord int, user *gqserver.User) {
+	session := mux.NewServer(conn)
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+		if user.Expired(sta.Now()) {
+			log.Printf("User %v has expired, closing its mux session from %v\n", user.ID, conn.RemoteAddr())
+			stream.Close()
+			session.Close()
+			return
+		}
+		go serveSS(stream, addr, sta, maxRecord, user)
+	}
+}
+
+// How long a smoke test ping has to send its record
+const pingTimeout = 10 * time.Second
+
+// echoPing sends the first record from the client straight back and closes conn
+func echoPing(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(pingTimeout))
+	buf := make([]byte, 20480)
+	i, err := gqserver.ReadTillDrain(conn, buf)
+	if err != nil {
+		log.Printf("Reading smoke test ping: %v\n", err)
+		return
+	}
+	gqserver.WriteAll(conn, buf[:i])
+}
+
+// How long a UDP session is kept without a datagram from ss-server. gq-client
+// ends sessions idle for a minute, this is in case it's gone without a word
+const udpSessionTimeout = 2 * time.Minute
+
+// relayDatagrams relays the datagrams of a UDP session, framed in the records
+// from conn, to the ss-server at addr over UDP, and those it answers with back
+func relayDatagrams(conn net.Conn, addr string, user *gqserver.User) {
+	ss, err := net.Dial("udp", addr)
+	if err != nil {
+		log.Printf("Connecting to ss-server over UDP: %v\n", err)
+		go conn.Close()
+		return
+	}
+	var closed int32
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, gqserver.MaxDatagramSize)
+		for {
+			ss.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+			n, err := ss.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() || atomic.LoadInt32(&closed) == 1 {
+					return
+				}
+				// e.g. refused, when ss-server isn't taking UDP
+				continue
+			}
+			user.Wait(n)
+			if gqserver.WriteAll(conn, gqserver.DatagramRecords(buf[:n])) != nil {
+				return
+			}
+			metrics.AddDown(user.Name(), n)
+		}
+	}()
+
+	defer func() {
+		atomic.StoreInt32(&closed, 1)
+		ss.Close()
+	}()
+	var datagrams gqserver.DatagramReader
+	buf := make([]byte, 20480)
+	for {
+		i, err := gqserver.ReadTillDrain(conn, buf)
+		if err != nil {
+			return
+		}
+		datagrams.Feed(gqserver.PeelRecordLayer(buf[:i]))
+		for {
+			datagram, ok := datagrams.Next()
+			if !ok {
+				break
+			}
+			user.Wait(len(datagram))
+			ss.Write(datagram)
+			metrics.AddUp(user.Name(), len(datagram))
+		}
 	}
 }
 
@@ -180,33 +638,37 @@ func makeWebPipe(remote net.Conn, sta *gqserver.State) (*webPair, error) {
 		return &webPair{}, errors.New("Connection to web server failed")
 	}
 	pair := &webPair{
-		conn,
-		remote,
+		webServer: conn,
+		remote:    remote,
 	}
 	return pair, nil
 }
 
-func makeSSPipe(remote net.Conn, sta *gqserver.State, data []byte) (*ssPair, error) {
-	conn, err := gotfo.Dial(sta.SS_LOCAL_HOST+":"+sta.SS_LOCAL_PORT, sta.FastOpen, data)
+func makeSSPipe(remote net.Conn, addr string, fastOpen bool, data []byte) (*ssPair, error) {
+	conn, err := tfo.Dial(addr, fastOpen, data)
 	if err != nil {
 		return &ssPair{}, errors.New("Connection to SS server failed")
 	}
 	pair := &ssPair{
-		conn,
-		remote,
+		ss:     conn,
+		remote: remote,
 	}
 	return pair, nil
 }
 
+// serveMetrics serves /metrics on addr for Prometheus to scrape
+func serveMetrics(addr string) {
+	handlers := http.NewServeMux()
+	handlers.Handle("/metrics", metrics)
+	log.Printf("Serving metrics on %v\n", addr)
+	log.Fatal(http.ListenAndServe(addr, handlers))
+}
+
 func usedRandomCleaner(sta *gqserver.State) {
 	for {
-		time.Sleep(12 * time.Hour)
-		now := int(sta.Now().Unix())
-		for key, t := range sta.UsedRandom {
-			if now-t > 12*3600 {
-				sta.DelUsedRandom(key)
-			}
-		}
+		time.Sleep(time.Hour)
+		sta.CleanUsedRandom()
+		log.Printf("%v ClientHello randoms remembered against replays\n", sta.UsedRandomCount())
 	}
 }
 
@@ -248,9 +710,12 @@ func main() {
 		if *localAddr == "" {
 			log.Fatal("Must specify localAddr")
 		}
-		localHost = strings.Split(*localAddr, ":")[0]
-		localPort = strings.Split(*localAddr, ":")[1]
-		log.Printf("Starting standalone mode, listening on %v:%v to ss at %v:%v\n", remoteHost, remotePort, localHost, localPort)
+		var err error
+		localHost, localPort, err = net.SplitHostPort(*localAddr)
+		if err != nil {
+			log.Fatalf("Bad localAddr: %v", err)
+		}
+		log.Printf("Starting standalone mode, listening on %v to ss at %v\n", net.JoinHostPort(remoteHost, remotePort), *localAddr)
 	}
 	sta := &gqserver.State{
 		SS_LOCAL_HOST:  localHost,
@@ -265,16 +730,24 @@ func main() {
 		log.Fatalf("Configuration file error: %v", err)
 	}
 
-	if sta.Key == "" {
-		log.Fatal("Key cannot be empty")
-	}
-
 	sta.SetAESKey()
 	go usedRandomCleaner(sta)
+	if sta.MetricsAddr != "" {
+		go serveMetrics(sta.MetricsListenAddr())
+	}
+
+	var tlsConfig *tls.Config
+	if sta.WebSocketCert != "" {
+		cert, err := tls.LoadX509KeyPair(sta.WebSocketCert, sta.WebSocketKey)
+		if err != nil {
+			log.Fatalf("Loading WebSocketCert: %v", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
 
-	listen := func(addr, port string) {
-		listener, err := gotfo.Listen(addr+":"+port, sta.FastOpen)
-		log.Println("Listening on " + addr + ":" + port)
+	listen := func(addr string) {
+		listener, err := tfo.Listen(addr, sta.FastOpen)
+		log.Println("Listening on " + addr)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -284,23 +757,31 @@ func main() {
 				log.Printf("%v", err)
 				continue
 			}
-			go dispatchConnection(conn, sta)
+			if !openConn(sta) {
+				log.Printf("MaxConnections of %v reached, closing connection from %v\n", sta.MaxConnections, conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
+			counted := &countedConn{Conn: conn, opened: time.Now()}
+			if sta.Transport == "websocket" {
+				go serveWebSocket(counted, sta, tlsConfig)
+				continue
+			}
+			go dispatchConnection(counted, sta)
 		}
 	}
 
 	// When listening on an IPv6 and IPv4, SS gives REMOTE_HOST as e.g. ::|0.0.0.0
 	listeningIP := strings.Split(sta.SS_REMOTE_HOST, "|")
 	for i, ip := range listeningIP {
-		if net.ParseIP(ip).To4() == nil {
-			// IPv6 needs square brackets
-			ip = "[" + ip + "]"
-		}
+		// IPv6 gets its square brackets here
+		addr := net.JoinHostPort(ip, sta.SS_REMOTE_PORT)
 
 		// The last listener must block main() because the program exits on main return.
 		if i == len(listeningIP)-1 {
-			listen(ip, sta.SS_REMOTE_PORT)
+			listen(addr)
 		} else {
-			go listen(ip, sta.SS_REMOTE_PORT)
+			go listen(addr)
 		}
 	}
 
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+	"github.com/cbeuw/GoQuiet/gqclient/TLS"
+	"github.com/cbeuw/GoQuiet/gqserver"
+)
+
+// startSSServer listens on loopback like ss-server, echoing what it's sent, and
+// returns its address
+func startSSServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// startWebServer listens on loopback like the web server of WebServerAddr. What
+// each connection to it sends in its first 200ms is sent on the returned channel
+func startWebServer(t *testing.T) (string, chan []byte) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	received := make(chan []byte, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+				data, _ := ioutil.ReadAll(conn)
+				received <- data
+			}()
+		}
+	}()
+	return l.Addr().String(), received
+}
+
+func makeServerState(t *testing.T, key string) (*gqserver.State, chan []byte) {
+	ssHost, ssPort, _ := net.SplitHostPort(startSSServer(t))
+	webAddr, received := startWebServer(t)
+	sta := &gqserver.State{
+		WebServerAddr: webAddr,
+		Key:           key,
+		Now:           time.Now,
+		SS_LOCAL_HOST: ssHost,
+		SS_LOCAL_PORT: ssPort,
+		UsedRandom:    map[[32]byte]int{},
+	}
+	sta.SetAESKey()
+	return sta, received
+}
+
+// clientState is the State of a gq-client with options in the form of
+// SS_PLUGIN_OPTIONS, which can set another Browser than chrome
+func clientState(options string) (*gqclient.State, error) {
+	sta := &gqclient.State{
+		SS_REMOTE_HOST: "127.0.0.1",
+		SS_REMOTE_PORT: "443",
+		Now:            time.Now,
+		Opaque:         gqclient.BtoInt(gqclient.CryptoRandBytes(32)),
+		ServerName:     "www.example.com",
+		Browser:        "chrome",
+	}
+	err := sta.ParseConfig("Key=testkey;TicketTimeHint=3600;" + options)
+	if err != nil {
+		return nil, err
+	}
+	sta.SetAESKey()
+	return sta, nil
+}
+
+func makeClientState(t *testing.T, options string) *gqclient.State {
+	sta, err := clientState(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sta
+}
+
+// dialServer returns the client end of a connection over loopback whose other
+// end is dealt with by dispatchConnection
+func dialServer(t *testing.T, sta *gqserver.State) net.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go dispatchConnection(server, sta)
+	return client
+}
+
+// clientHandshake goes through the handshake of gq-client with sta on conn, and
+// sends first in a record after it. It returns what's echoed back
+func clientHandshake(sta *gqclient.State, conn net.Conn, first []byte) ([]byte, error) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	clientHello := TLS.ComposeInitHandshake(sta)
+	flight := TLS.ClientHelloFlight(clientHello)
+	at := sta.ClientHelloSplit
+	if at <= 0 || at >= len(flight) {
+		at = len(flight)
+	}
+	err := gqclient.WriteAll(conn, flight[:at])
+	if err != nil {
+		return nil, err
+	}
+	if at < len(flight) {
+		// Long enough apart for gq-server to read the first part on its own
+		time.Sleep(50 * time.Millisecond)
+		err = gqclient.WriteAll(conn, flight[at:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	serverHello, err := TLS.ReadServerHandshake(sta, conn, clientHello, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	reply, err := TLS.ComposeReply(sta, clientHello, serverHello)
+	if err != nil {
+		return nil, err
+	}
+	err = gqclient.WriteAll(conn, append(reply, TLS.AddRecordLayer(first, []byte{0x17}, []byte{0x03, 0x03})...))
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 20480)
+	i, err := gqclient.ReadTillDrain(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	return TLS.PeelRecordLayer(buf[:i]), nil
+}
+
+func TestLongClientHello(t *testing.T) {
+	sta, _ := makeServerState(t, "testkey")
+	// The longest RawExtensions takes the ClientHello far past a packet
+	long := "eeee1ffc" + strings.Repeat("00", 0x1ffc)
+	csta := makeClientState(t, "RawExtensions="+long+";")
+	got, err := clientHandshake(csta, dialServer(t, sta), []byte("first"))
+	if err != nil || string(got) != "first" {
+		t.Error("For", "RawExtensions of 8192 bytes", "expected", "first", "got", string(got), err)
+	}
+}
+
+func TestNotClientHello(t *testing.T) {
+	sta, received := makeServerState(t, "testkey")
+	for _, data := range [][]byte{
+		[]byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"),
+		// A handshake record header that's too long for a ClientHello
+		{0x16, 0x03, 0x01, 0xff, 0xff},
+	} {
+		conn := dialServer(t, sta)
+		conn.Write(data)
+		select {
+		case got := <-received:
+			if !bytes.Equal(got, data) {
+				t.Error("For", data, "expected", data, "got", got)
+			}
+		case <-time.After(time.Second):
+			// Waiting for the rest of a record as if it were a ClientHello
+			t.Error("For", data, "expected", "it relayed to the web server straight away", "got", "nothing")
+		}
+	}
+}
+
+func TestSplitClientHello(t *testing.T) {
+	sta, _ := makeServerState(t, "testkey")
+	last := len(TLS.ComposeInitHandshake(makeClientState(t, ""))) - 1
+	// In the record header, just after it, in the middle and a byte before the end
+	for _, split := range []int{1, 3, 6, 100, last} {
+		csta := makeClientState(t, "ClientHelloSplit="+strconv.Itoa(split)+";")
+		got, err := clientHandshake(csta, dialServer(t, sta), []byte("first"))
+		if err != nil || string(got) != "first" {
+			t.Error("For", "ClientHelloSplit", split, "expected", "first", "got", string(got), err)
+		}
+	}
+}
+
+// TestInterop makes connections with every Browser and the options that change the
+// handshake to dispatchConnection, which must relay them to ss-server unless the
+// two can't work together, in which case they go to the web server
+func TestInterop(t *testing.T) {
+	cases := []struct {
+		options   string
+		serverKey string
+		works     bool
+	}{
+		{"", "testkey", true},
+		{"", "otherkey", false},
+		{"ExtensionSet=minimal;", "testkey", true},
+		{"DelegatedCredentials=default;CertCompression=brotli,zlib;", "testkey", true},
+		{"MaxRecordSize=1000;RecordSizeLimit=true;", "testkey", true},
+		{"SignatureAlgorithms=ed25519,rsa_pkcs1_sha256;", "testkey", true},
+		{"RawExtensions=eeee000100;", "testkey", true},
+		{"ClientHelloSplit=100;", "testkey", true},
+		{"SimulateResumption=100;", "testkey", true},
+	}
+	for _, browser := range gqclient.Browsers {
+		for _, c := range cases {
+			csta, err := clientState("Browser=" + browser + ";" + c.options)
+			if err != nil {
+				// SimulateResumption is only for chrome-120
+				continue
+			}
+			sta, received := makeServerState(t, c.serverKey)
+			got, err := clientHandshake(csta, dialServer(t, sta), []byte("first"))
+			if (string(got) == "first") != c.works {
+				t.Error(
+					"For", browser, c.options, "server key", c.serverKey,
+					"expected", "first relayed", c.works,
+					"got", string(got), err,
+				)
+			}
+			if !c.works {
+				select {
+				case <-received:
+				case <-time.After(time.Second):
+					t.Error("For", browser, c.options, "server key", c.serverKey, "expected", "the ClientHello relayed to the web server", "got", "nothing")
+				}
+			}
+		}
+	}
+}
+
+func TestEarlyChangeCipherSpec(t *testing.T) {
+	sta, _ := makeServerState(t, "testkey")
+	csta := makeClientState(t, "Browser=chrome-120;SimulateResumption=100;")
+	if !TLS.EarlyChangeCipherSpec(TLS.ComposeInitHandshake(csta)) {
+		t.Fatal("For", "SimulateResumption=100", "expected", "ChangeCipherSpec with the ClientHello", "got", "none")
+	}
+	// Sent in one write along with the ClientHello, as it is in the SYN with FastOpen
+	got, err := clientHandshake(csta, dialServer(t, sta), []byte("first"))
+	if err != nil || string(got) != "first" {
+		t.Error("For", "a ClientHello followed by ChangeCipherSpec", "expected", "first", "got", string(got), err)
+	}
+}
@@ -0,0 +1,60 @@
+// Package deflate compresses the data of records for Compress. Both gq-client
+// and gq-server use it, so that what one compresses the other can decompress
+package deflate
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// Types of payload made by Compress
+const (
+	stored   = 0x00
+	deflated = 0x01
+)
+
+// Maximum size of a decompressed payload. Nothing larger is ever compressed,
+// so anything that inflates beyond this is corrupted or malicious
+const maxDecompressed = 20480
+
+// Compress compresses the data of one record with DEFLATE. The first byte of the
+// returned payload says whether it's compressed, because data that's already
+// encrypted doesn't get smaller and is stored as it is instead
+func Compress(data []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(deflated)
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	w.Write(data)
+	w.Close()
+	if buf.Len() < 1+len(data) {
+		return buf.Bytes()
+	}
+	return append([]byte{stored}, data...)
+}
+
+// Decompress reverses Compress
+func Decompress(payload []byte) ([]byte, error) {
+	if len(payload) == 0 {
+		return nil, errors.New("Empty compressed payload")
+	}
+	switch payload[0] {
+	case stored:
+		return payload[1:], nil
+	case deflated:
+		r := flate.NewReader(bytes.NewReader(payload[1:]))
+		defer r.Close()
+		data, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressed+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > maxDecompressed {
+			return nil, errors.New("Decompressed payload too large")
+		}
+		return data, nil
+	default:
+		return nil, errors.New("Unknown compressed payload type")
+	}
+}
@@ -0,0 +1,45 @@
+package deflate
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	random := make([]byte, 1000)
+	rand.Read(random)
+	cases := map[string][]byte{
+		"text":   bytes.Repeat([]byte("GET / HTTP/1.1\r\n"), 100),
+		"random": random,
+		"empty":  {},
+	}
+	for name, data := range cases {
+		payload := Compress(data)
+		if len(payload) > len(data)+1 {
+			t.Error(
+				"For", name,
+				"expected", "payload of at most", len(data)+1, "bytes",
+				"got", len(payload),
+			)
+		}
+		got, err := Decompress(payload)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Error(
+				"For", name,
+				"expected", data,
+				"got", got, err,
+			)
+		}
+	}
+
+	bomb := Compress(make([]byte, maxDecompressed*2))
+	_, err := Decompress(bomb)
+	if err == nil {
+		t.Error(
+			"For", "payload inflating beyond the limit",
+			"expected", "err",
+			"got", "no err",
+		)
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/cbeuw/GoQuiet
+
+go 1.18
@@ -1,32 +1,101 @@
 package TLS
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/cbeuw/GoQuiet/gqclient"
+	"math/rand"
+	"net"
 	"time"
 )
 
+// RecordHeaderLen is the length of the record layer, which PutRecordHeader needs
+// in front of the data
+const RecordHeaderLen = 5
+
 // AddRecordLayer adds record layer to data
 func AddRecordLayer(input []byte, typ []byte, ver []byte) []byte {
-	length := make([]byte, 2)
-	binary.BigEndian.PutUint16(length, uint16(len(input)))
-	ret := append(typ, ver...)
-	ret = append(ret, length...)
-	ret = append(ret, input...)
+	ret := make([]byte, RecordHeaderLen+len(input))
+	copy(ret[RecordHeaderLen:], input)
+	PutRecordHeader(ret, typ, ver)
 	return ret
 }
 
-// PeelRecordLayer peels off the record layer
+// PutRecordHeader writes the record layer into the first RecordHeaderLen bytes of
+// record, for the data after them. Unlike AddRecordLayer the data isn't copied
+func PutRecordHeader(record []byte, typ []byte, ver []byte) {
+	copy(record[0:1], typ)
+	copy(record[1:3], ver)
+	binary.BigEndian.PutUint16(record[3:5], uint16(len(record)-RecordHeaderLen))
+}
+
+// PeelRecordLayer peels off the record layer of data, a single record as
+// gqclient.ReadTillDrain reads them. The type, version and length are not checked,
+// so records with any version, e.g. rewritten by a middlebox, are accepted. Data
+// shorter than a record header gives nil
 func PeelRecordLayer(data []byte) []byte {
+	if len(data) < 5 {
+		return nil
+	}
 	ret := data[5:]
 	return ret
 }
 
+// LooksLikeRecord reports whether data starts with a plausible TLS record header,
+// i.e. a known type, a TLS version and a length that fits in data. A payload that
+// does may have been wrapped in a record twice
+func LooksLikeRecord(data []byte) bool {
+	if len(data) < 5 || data[0] < 0x14 || data[0] > 0x17 || data[1] != 0x03 || data[2] > 0x04 {
+		return false
+	}
+	return gqclient.BtoInt(data[3:5]) <= len(data)-5
+}
+
+// maxRecordLen is the largest length a TLS 1.2 record can declare, see
+// https://tools.ietf.org/html/rfc5246#section-6.2.3
+const maxRecordLen = 16384 + 2048
+
+// ValidateRecord checks that record is one whole application data record of
+// TLS 1.2, which is all that gq-server sends after the handshake. The error
+// describes the first thing that isn't
+func ValidateRecord(record []byte) error {
+	if len(record) < 5 {
+		return fmt.Errorf("Record of %v bytes is shorter than its header", len(record))
+	}
+	if record[0] != 0x17 {
+		return fmt.Errorf("Record type is 0x%02x rather than application data", record[0])
+	}
+	if record[1] != 0x03 || record[2] != 0x03 {
+		return fmt.Errorf("Record version is 0x%02x%02x rather than TLS 1.2", record[1], record[2])
+	}
+	length := gqclient.BtoInt(record[3:5])
+	if length != len(record)-5 {
+		return fmt.Errorf("Record declares %v bytes but has %v", length, len(record)-5)
+	}
+	if length > maxRecordLen {
+		return fmt.Errorf("Record of %v bytes is over the maximum of %v", length, maxRecordLen)
+	}
+	return nil
+}
+
 type browser interface {
 	composeExtensions()
 	composeClientHello()
 }
 
+// helloVersions are the versions in a browser's ClientHello: legacy_version in the
+// message itself and the version of the record carrying it. Browsers that speak
+// TLS 1.3 still put TLS 1.2 in legacy_version, and TLS 1.0 in the record for
+// servers that choke on anything newer
+type helloVersions struct {
+	hello  []byte
+	record []byte
+}
+
 func makeServerName(sta *gqclient.State) []byte {
 	serverName := sta.ServerName
 	serverNameLength := make([]byte, 2)
@@ -40,11 +109,105 @@ func makeServerName(sta *gqclient.State) []byte {
 	return append(serverNameListLength, ret...)
 }
 
+// makeStatusRequest makes a status_request extension asking for OCSP stapling, with
+// no responder ids and no request extensions, which is what browsers send
+func makeStatusRequest() []byte {
+	ret := []byte{0x01}            // status type ocsp
+	ret = append(ret, 0x00, 0x00)  // responder id list length
+	return append(ret, 0x00, 0x00) // request extensions length
+}
+
+// The protocols Chrome advertises in application_layer_protocol_negotiation
+var chromeALPN = []string{"h2", "http/1.1"}
+
+// makeALPN makes an application_layer_protocol_negotiation extension advertising
+// protocols, in order
+func makeALPN(protocols []string) []byte {
+	var list []byte
+	for _, p := range protocols {
+		list = append(list, byte(len(p)))
+		list = append(list, p...)
+	}
+	return append(u16(len(list)), list...)
+}
+
+// makeApplicationSettings makes an application_settings (ALPS) extension for the
+// protocols in alpn that Chrome has settings for, which is only h2. It goes with
+// an ALPN extension of alpn, see https://tools.ietf.org/html/draft-vvv-tls-alps
+func makeApplicationSettings(alpn []string) []byte {
+	var protocols []string
+	for _, p := range alpn {
+		if p == "h2" {
+			protocols = append(protocols, p)
+		}
+	}
+	return makeALPN(protocols)
+}
+
+// makeCompressCertificate makes a compress_certificate extension advertising the
+// algorithms in CertCompression, or browserDefault if it's not set. It returns nil
+// if there are no algorithms, in which case the extension shouldn't be sent
+func makeCompressCertificate(sta *gqclient.State, browserDefault []string) []byte {
+	algos := sta.CertCompression
+	if len(algos) == 0 {
+		algos = browserDefault
+	}
+	if len(algos) == 0 {
+		return nil
+	}
+	var list []byte
+	for _, name := range algos {
+		list = append(list, u16(int(gqclient.CertCompressionAlgorithms[name]))...)
+	}
+	return append([]byte{byte(len(list))}, list...)
+}
+
+// makeDelegatedCredentials makes a delegated_credentials extension advertising the
+// signature schemes in DelegatedCredentials, see https://tools.ietf.org/html/rfc9345#section-4.1.1.
+// It returns nil if it isn't set, since none of the browsers send it
+func makeDelegatedCredentials(sta *gqclient.State) []byte {
+	names := sta.DelegatedCredentials
+	if len(names) == 1 && names[0] == "default" {
+		names = gqclient.DefaultDelegatedCredentials
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	var list []byte
+	for _, name := range names {
+		list = append(list, u16(int(gqclient.SignatureSchemes[name]))...)
+	}
+	return append(u16(len(list)), list...)
+}
+
+// makeRecordSizeLimit makes a record_size_limit extension advertising MaxRecordSize,
+// or nil if RecordSizeLimit isn't set. In TLS 1.3 the limit counts the content
+// type byte too, see https://tools.ietf.org/html/rfc8449#section-4
+func makeRecordSizeLimit(sta *gqclient.State, tls13 bool) []byte {
+	if !sta.RecordSizeLimit {
+		return nil
+	}
+	limit := sta.MaxRecordSize
+	if limit == 0 {
+		limit = 16384
+	}
+	if tls13 {
+		limit++
+	}
+	return u16(limit)
+}
+
 func makeSessionTicket(sta *gqclient.State) []byte {
 	seed := int64(sta.Opaque + gqclient.BtoInt(sta.AESKey) + int(sta.Now().Unix())/sta.TicketTimeHint)
 	return gqclient.PsudoRandBytes(192, seed)
 }
 
+// newPRNG makes a pseudorandom generator seeded from sta.RandBytes, for the random
+// choices in a ClientHello that don't need to be cryptographically secure
+func newPRNG(sta *gqclient.State) *rand.Rand {
+	return rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(sta.RandBytes(8)))))
+}
+
 func makeNullBytes(length int) []byte {
 	var ret []byte
 	for i := 0; i < length; i++ {
@@ -53,6 +216,88 @@ func makeNullBytes(length int) []byte {
 	return ret
 }
 
+// makeSigAlgos makes the signature_algorithms extension from SignatureAlgorithms, or
+// uses browserDefault (the extension in hex) if it isn't set
+func makeSigAlgos(sta *gqclient.State, browserDefault string) []byte {
+	if len(sta.SignatureAlgorithms) == 0 {
+		ret, _ := hex.DecodeString(browserDefault)
+		return ret
+	}
+	var list []byte
+	for _, name := range sta.SignatureAlgorithms {
+		list = append(list, u16(int(gqclient.SignatureSchemes[name]))...)
+	}
+	return append(u16(len(list)), list...)
+}
+
+// makeSessionId makes the session id field. mode is one of the values accepted
+// by SessionID in the config. An empty mode means using the browser's default
+func makeSessionId(sta *gqclient.State, mode string) []byte {
+	if sta.SessionID != "" {
+		mode = sta.SessionID
+	}
+	switch mode {
+	case "empty":
+		return nil
+	case "resumption":
+		// Stays the same as long as the session ticket does, like the id of a
+		// session being resumed. It must not be derived the same way as the
+		// ticket or they would match each other
+		h := sha256.New()
+		h.Write([]byte(fmt.Sprintf("%v %v", sta.Opaque, int(sta.Now().Unix())/sta.TicketTimeHint)))
+		h.Write(sta.AESKey)
+		return h.Sum(nil)
+	default:
+		return gqclient.PsudoRandBytes(32, sta.Now().UnixNano())
+	}
+}
+
+// makePadding makes the padding extension like BoringSSL and NSS do. A ClientHello
+// (with its handshake header) between 256 and 511 bytes long is padded to 512 bytes
+// to work around buggy servers. unpaddedLen is the length of the ClientHello
+// including the handshake header but without the padding extension
+func makePadding(unpaddedLen int) []byte {
+	if unpaddedLen <= 0xff || unpaddedLen >= 0x200 {
+		return nil
+	}
+	paddingLen := 0x200 - unpaddedLen
+	if paddingLen >= 4+1 {
+		paddingLen -= 4
+	} else {
+		paddingLen = 1
+	}
+	return addExtRec([]byte{0x00, 0x15}, makeNullBytes(paddingLen))
+}
+
+// assembleClientHello puts the fields of a ClientHello together and calculates
+// the length fields. If pad is true, the padding extension is appended to extensions
+func assembleClientHello(version, random, sessionId, cipherSuites, extensions []byte, pad bool) []byte {
+	var body []byte
+	body = append(body, version...)                // legacy_version
+	body = append(body, random...)                 // random
+	body = append(body, byte(len(sessionId)))      // session id length
+	body = append(body, sessionId...)              // session id
+	body = append(body, u16(len(cipherSuites))...) // cipher suites length
+	body = append(body, cipherSuites...)           // cipher suites
+	body = append(body, 0x01, 0x00)                // compression methods length 1, null
+	if pad {
+		// 4 bytes of handshake header and 2 bytes of extensions length
+		extensions = append(extensions, makePadding(4+len(body)+2+len(extensions))...)
+	}
+	body = append(body, u16(len(extensions))...) // extensions length
+	body = append(body, extensions...)           // extensions
+
+	ret := []byte{0x01} // handshake type
+	ret = append(ret, byte(len(body)>>16), byte(len(body)>>8), byte(len(body)))
+	return append(ret, body...)
+}
+
+func u16(i int) []byte {
+	ret := make([]byte, 2)
+	binary.BigEndian.PutUint16(ret, uint16(i))
+	return ret
+}
+
 // addExtensionRecord, add type, length to extension data
 func addExtRec(typ []byte, data []byte) []byte {
 	length := make([]byte, 2)
@@ -62,25 +307,420 @@ func addExtRec(typ []byte, data []byte) []byte {
 	return append(ret, data...)
 }
 
+// extensionName returns the name in gqclient.ExtensionTypes of the extension typ
+func extensionName(typ uint16) string {
+	if isGREASE(typ) {
+		return "grease"
+	}
+	for name, t := range gqclient.ExtensionTypes {
+		if t == typ {
+			return name
+		}
+	}
+	return ""
+}
+
+// filterExtensions leaves out of the extension records in ext the ones not in
+// the ExtensionSet of sta
+func filterExtensions(sta *gqclient.State, ext []byte) []byte {
+	if sta.ExtensionSet == "" || sta.ExtensionSet == "full" {
+		return ext
+	}
+	var ret []byte
+	for len(ext) >= 4 {
+		recLen := 4 + gqclient.BtoInt(ext[2:4])
+		if sta.KeepsExtension(extensionName(binary.BigEndian.Uint16(ext))) {
+			ret = append(ret, ext[:recLen]...)
+		}
+		ext = ext[recLen:]
+	}
+	return ret
+}
+
+// addRawExtensions adds the RawExtensions of sta to ext, the extension records of
+// a ClientHello. One of a type ext already has takes its place, the others go at
+// the end, but before pre_shared_key which has to be the last
+func addRawExtensions(sta *gqclient.State, ext []byte) []byte {
+	if len(sta.RawExtensions) == 0 {
+		return ext
+	}
+	var order []uint16
+	raw := make(map[uint16][]byte)
+	for _, h := range sta.RawExtensions {
+		rec, _ := hex.DecodeString(h)
+		typ := binary.BigEndian.Uint16(rec)
+		order = append(order, typ)
+		raw[typ] = rec
+	}
+	var ret, psk []byte
+	for len(ext) >= 4 {
+		typ := binary.BigEndian.Uint16(ext)
+		recLen := 4 + gqclient.BtoInt(ext[2:4])
+		rec := ext[:recLen]
+		ext = ext[recLen:]
+		if r, ok := raw[typ]; ok {
+			rec = r
+			delete(raw, typ)
+		}
+		if typ == gqclient.ExtensionTypes["pre_shared_key"] {
+			psk = rec
+			continue
+		}
+		ret = append(ret, rec...)
+	}
+	for _, typ := range order {
+		ret = append(ret, raw[typ]...)
+	}
+	return append(ret, psk...)
+}
+
 // ComposeInitHandshake composes ClientHello with record layer
 func ComposeInitHandshake(sta *gqclient.State) []byte {
 	var ch []byte
+	var v helloVersions
 	switch sta.Browser {
-	case "chrome":
-		ch = (&chrome{}).composeClientHello(sta)
+	case "chrome", "chrome-64":
+		ch, v = (&chrome{}).composeClientHello(sta), chromeVersions
+	case "chrome-120":
+		ch, v = (&chrome120{}).composeClientHello(sta), chrome120Versions
 	case "firefox":
-		ch = (&firefox{}).composeClientHello(sta)
+		ch, v = (&firefox{}).composeClientHello(sta), firefoxVersions
+	case "safari":
+		ch, v = (&safari{}).composeClientHello(sta), safariVersions
+	case "template":
+		ch, v = (&fromTemplate{}).composeClientHello(sta), templateVersions(sta.Template)
 	default:
 		panic("Unsupported browser:" + sta.Browser)
 	}
-	return AddRecordLayer(ch, []byte{0x16}, []byte{0x03, 0x01})
+	return AddRecordLayer(ch, []byte{0x16}, v.record)
 }
 
-// ComposeReply composes RL+ChangeCipherSpec+RL+Finished
-func ComposeReply() []byte {
+// FirstRecordSizes returns the sizes of the data in the first records Browser sends
+// once the handshake is done, which RecordSizing browser makes the first records
+// of SS data follow. For Browser template they're in the HelloTemplate
+func FirstRecordSizes(sta *gqclient.State) []int {
+	switch sta.Browser {
+	case "chrome", "chrome-64":
+		return chromeFirstRecords
+	case "chrome-120":
+		return chrome120FirstRecords
+	case "firefox":
+		return firefoxFirstRecords
+	case "safari":
+		return safariFirstRecords
+	case "template":
+		return sta.Template.FirstRecordSizes
+	}
+	return nil
+}
+
+// The most records ReadServerHandshake reads before giving up on the server
+const maxServerHandshakeRecords = 8
+
+// interceptionPrefix starts the errors of ReadServerHandshake when DetectInterception
+// finds that the server isn't gq-server
+const interceptionPrefix = "TLS interception / wrong server detected: "
+
+// Names of the handshake messages a TLS server may send before ChangeCipherSpec
+var serverHandshakeNames = map[byte]string{
+	0x04: "NewSessionTicket",
+	0x0b: "Certificate",
+	0x0c: "ServerKeyExchange",
+	0x0d: "CertificateRequest",
+	0x0e: "ServerHelloDone",
+	0x16: "CertificateStatus",
+}
+
+// checkServerHello checks that serverHello, with its record layer, is what gq-server
+// answers clientHello with: TLS 1.2, our session id echoed and its cipher suite
+func checkServerHello(clientHello, serverHello []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(interceptionPrefix + "malformed ServerHello")
+		}
+	}()
+	// record layer 5, handshake type 1, length 3, version 2, random 32
+	const sessionIdAt = 5 + 4 + 2 + 32
+	if gqclient.BtoInt(serverHello[9:11]) != 0x0303 {
+		return fmt.Errorf(interceptionPrefix+"ServerHello version is %#04x rather than TLS 1.2", gqclient.BtoInt(serverHello[9:11]))
+	}
+	ourId := clientHello[sessionIdAt+1 : sessionIdAt+1+int(clientHello[sessionIdAt])]
+	theirId := serverHello[sessionIdAt+1 : sessionIdAt+1+int(serverHello[sessionIdAt])]
+	if !bytes.Equal(ourId, theirId) {
+		return errors.New(interceptionPrefix + "ServerHello doesn't echo our session id")
+	}
+	cipherAt := sessionIdAt + 1 + len(theirId)
+	if cipher := gqclient.BtoInt(serverHello[cipherAt : cipherAt+2]); cipher != 0xc030 {
+		return fmt.Errorf(interceptionPrefix+"ServerHello picked cipher suite %#04x", cipher)
+	}
+	return nil
+}
+
+// NoAnswerError is what ReadServerHandshake returns when the connection is closed
+// or reset before anything comes from the server. Err is the error of the read
+type NoAnswerError struct {
+	Err error
+}
+
+func (e *NoAnswerError) Error() string {
+	return fmt.Sprintf("Server closed the connection without answering the ClientHello (%v). "+
+		"gq-server does this to a replayed ClientHello or when it can't reach its WebServerAddr, "+
+		"otherwise something on the way cut it", e.Err)
+}
+
+// The longest handshake message a handshakeReader puts back together unless
+// MaxHandshakeMessageSize says otherwise. The longest a server sends is Certificate,
+// and a chain of a few certificates is far shorter
+const defaultMaxHandshakeMessageLen = 1 << 16
+
+// handshakeReader reads the server's records and puts the handshake messages in them
+// back together, since a message can span several records and a record can hold
+// several messages. Only the plaintext ones before ChangeCipherSpec can be split
+type handshakeReader struct {
+	conn net.Conn
+	// Large enough for any TLS record
+	buf []byte
+	// The records read so far, up to maxServerHandshakeRecords
+	records int
+	// Handshake data read but not yet returned as a message
+	pending []byte
+	// The records the data in pending came in
+	pendingRecords int
+	// The version in the record layer of the last handshake record
+	version []byte
+	// The longest message, and the most records one can span
+	maxMessageLen     int
+	maxMessageRecords int
+	// When the whole handshake has to be in by, zero for no limit
+	deadline time.Time
+}
+
+func newHandshakeReader(sta *gqclient.State, conn net.Conn, deadline time.Time) *handshakeReader {
+	h := &handshakeReader{
+		conn:              conn,
+		deadline:          deadline,
+		buf:               make([]byte, 5+16384+2048),
+		maxMessageLen:     sta.MaxHandshakeMessageSize,
+		maxMessageRecords: sta.MaxHandshakeMessageRecords,
+	}
+	if h.maxMessageLen == 0 {
+		h.maxMessageLen = defaultMaxHandshakeMessageLen
+	}
+	if h.maxMessageRecords == 0 {
+		h.maxMessageRecords = maxServerHandshakeRecords
+	}
+	return h
+}
+
+// readRecord reads a whole record and returns its type and its data, which is only
+// valid until the next read
+func (h *handshakeReader) readRecord() (byte, []byte, error) {
+	if h.records == maxServerHandshakeRecords {
+		return 0, nil, errors.New("Too many records in the server's handshake")
+	}
+	h.records++
+	i, err := gqclient.ReadTillDrainBefore(h.conn, h.buf, h.deadline)
+	if err != nil {
+		return 0, nil, err
+	}
+	return h.buf[0], h.buf[5:i], nil
+}
+
+// readMessage returns the next handshake message with its 4 byte header, reading
+// as many records as it spans. A record of another type is returned whole, with
+// its data valid until the next read
+func (h *handshakeReader) readMessage() (byte, []byte, error) {
+	for {
+		if len(h.pending) >= 4 {
+			length := 4 + int(h.pending[1])<<16 + gqclient.BtoInt(h.pending[2:4])
+			if length > h.maxMessageLen {
+				return 0, nil, fmt.Errorf("Handshake message of %v bytes from the server is too long", length)
+			}
+			if len(h.pending) >= length {
+				msg := h.pending[:length]
+				h.pending = h.pending[length:]
+				// What's left came in the last record
+				h.pendingRecords = 1
+				return 0x16, msg, nil
+			}
+		}
+		typ, data, err := h.readRecord()
+		if err != nil {
+			return 0, nil, err
+		}
+		if typ != 0x16 {
+			if len(h.pending) != 0 {
+				return 0, nil, fmt.Errorf("Record type %#x in the middle of a handshake message from the server", typ)
+			}
+			return typ, data, nil
+		}
+		h.version = []byte{h.buf[1], h.buf[2]}
+		if len(h.pending) == 0 {
+			h.pendingRecords = 0
+		}
+		h.pendingRecords++
+		if h.pendingRecords > h.maxMessageRecords {
+			return 0, nil, fmt.Errorf("Handshake message from the server spans more than %v records", h.maxMessageRecords)
+		}
+		h.pending = append(h.pending, data...)
+	}
+}
+
+// ReadServerHandshake reads the server's messages up to and including its Finished
+// and returns the ServerHello with its record layer. Rather than expecting exactly
+// ServerHello, ChangeCipherSpec and Finished, it goes by the record types, so any
+// other handshake messages before ChangeCipherSpec are skipped too. The messages are
+// put back together from the records they're in, however the server splits them. If
+// DetectInterception is set, they aren't skipped: anything that gq-server wouldn't
+// send in answer to clientHello fails the handshake straight away. Nothing past the
+// Finished is read, so data the server sends after it without waiting for our reply
+// is left in conn for the pair to hand to SS. Unless deadline is zero, the reads
+// give up at it however the server spaces out its records
+func ReadServerHandshake(sta *gqclient.State, conn net.Conn, clientHello []byte, deadline time.Time) ([]byte, error) {
+	if !deadline.IsZero() {
+		conn.SetReadDeadline(deadline)
+	}
+	h := newHandshakeReader(sta, conn, deadline)
+	typ, msg, err := h.readMessage()
+	if gqclient.IsClosedByPeer(err) {
+		return nil, &NoAnswerError{err}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if typ == 0x15 {
+		// A TLS server turning the ClientHello down, or something in the way
+		return nil, alertError(msg)
+	}
+	if typ != 0x16 || msg[0] != 0x02 {
+		return nil, errors.New("First message is not a ServerHello")
+	}
+	serverHello := AddRecordLayer(append([]byte{}, msg...), []byte{0x16}, h.version)
+	if sta.DetectInterception {
+		if err = checkServerHello(clientHello, serverHello); err != nil {
+			return nil, err
+		}
+	}
+
+	certificate := false
+	for {
+		typ, msg, err = h.readMessage()
+		if certificate && err != nil {
+			// gq-server never sends a Certificate, so we've been handed to its web server
+			return nil, fmt.Errorf("Server sent a Certificate and then: %v. "+
+				"That's a web server answering rather than gq-server, which means it didn't accept us: "+
+				"check that Key and the system time match the server's", err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case 0x14:
+			// The record after ChangeCipherSpec is the encrypted Finished, which
+			// can't be split into messages
+			typ, msg, err = h.readRecord()
+			if err != nil {
+				return nil, err
+			}
+			switch typ {
+			case 0x16:
+				return serverHello, nil
+			case 0x15:
+				return nil, alertError(msg)
+			default:
+				return nil, fmt.Errorf("Unexpected record type %#x in the server's handshake", typ)
+			}
+		case 0x16:
+			if sta.DetectInterception {
+				name, ok := serverHandshakeNames[msg[0]]
+				if !ok {
+					name = fmt.Sprintf("handshake message of type %v", msg[0])
+				}
+				return nil, errors.New(interceptionPrefix + "the server sent a " + name + ", which gq-server never does")
+			}
+			certificate = certificate || msg[0] == 0x0b
+		case 0x15:
+			return nil, alertError(msg)
+		default:
+			return nil, fmt.Errorf("Unexpected record type %#x in the server's handshake", typ)
+		}
+	}
+}
+
+// alertError is the error of an alert record from the server with data. Only a
+// plaintext alert can be named, an encrypted one is longer than 2 bytes
+func alertError(data []byte) error {
+	if len(data) != 2 {
+		return errors.New("Alert from server")
+	}
+	name, ok := alertNames[data[1]]
+	if !ok {
+		name = fmt.Sprintf("alert %v", data[1])
+	}
+	return errors.New("Alert from server: " + name)
+}
+
+// The ChangeCipherSpec record, the same in every version
+var changeCipherSpec = AddRecordLayer([]byte{0x01}, []byte{0x14}, []byte{0x03, 0x03})
+
+// EarlyChangeCipherSpec reports whether clientHello, with its record layer, is
+// followed straight away by ChangeCipherSpec rather than it coming before our
+// Finished. A TLS 1.3 client in middlebox compatibility mode sends it right after a
+// ClientHello that offers early data, see https://tools.ietf.org/html/rfc8446#appendix-D.4,
+// which is when Chrome resumes a session. gq-server reads it as the first record of
+// our reply either way
+func EarlyChangeCipherSpec(clientHello []byte) bool {
+	f, err := parseHelloFields(clientHello)
+	if err != nil {
+		return false
+	}
+	for _, e := range f.extensions {
+		if e == 0x002a {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientHelloFlight is what's sent for clientHello before the server answers: the
+// ClientHello, followed by ChangeCipherSpec if EarlyChangeCipherSpec says so
+func ClientHelloFlight(clientHello []byte) []byte {
+	if !EarlyChangeCipherSpec(clientHello) {
+		return clientHello
+	}
+	return append(append([]byte{}, clientHello...), changeCipherSpec...)
+}
+
+// ComposeReply composes RL+ChangeCipherSpec+RL+Finished, or only the Finished if
+// the ChangeCipherSpec went with clientHello. serverHello is the ServerHello
+// message we received, including its record layer. The Finished message is bound
+// to the random field in serverHello so that a recorded reply cannot be replayed
+// into a different handshake. If Ping, Connect, Datagrams, Mux or Route is set,
+// the last 8 bytes of Finished carry it instead of being random
+func ComposeReply(sta *gqclient.State, clientHello []byte, serverHello []byte) ([]byte, error) {
+	// record layer 5 bytes, handshake type 1, length 3, server version 2, random 32
+	if len(serverHello) < 43 {
+		return nil, errors.New("ServerHello too short")
+	}
 	TLS12 := []byte{0x03, 0x03}
-	ccsBytes := AddRecordLayer([]byte{0x01}, []byte{0x14}, TLS12)
-	finished := gqclient.PsudoRandBytes(40, time.Now().UnixNano())
+	var ccsBytes []byte
+	if !EarlyChangeCipherSpec(clientHello) {
+		ccsBytes = changeCipherSpec
+	}
+	finished := gqclient.MakeReplyBinding(sta, serverHello[11:43])
+	if sta.Ping {
+		finished = append(finished, gqclient.MakePingTag(sta, serverHello[11:43])...)
+	} else if sta.Connect {
+		finished = append(finished, gqclient.MakeConnectTag(sta, serverHello[11:43])...)
+	} else if sta.Datagrams {
+		finished = append(finished, gqclient.MakeDatagramTag(sta, serverHello[11:43])...)
+	} else if sta.Mux {
+		finished = append(finished, gqclient.MakeMuxTag(sta, serverHello[11:43])...)
+	} else if sta.Route != "" {
+		finished = append(finished, gqclient.MakeRouteTag(sta, serverHello[11:43])...)
+	} else {
+		finished = append(finished, sta.RandBytes(8)...)
+	}
 	fBytes := AddRecordLayer(finished, []byte{0x16}, TLS12)
-	return append(ccsBytes, fBytes...)
+	return append(append([]byte{}, ccsBytes...), fBytes...), nil
 }
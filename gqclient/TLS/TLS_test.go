@@ -0,0 +1,1486 @@
+package TLS
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	mrand "math/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+	"github.com/cbeuw/GoQuiet/gqserver"
+)
+
+func makeTestState(browser string) *gqclient.State {
+	sta := &gqclient.State{
+		Now:            func() time.Time { return time.Unix(1519319215, 0) },
+		Opaque:         1234,
+		Key:            "testkey",
+		TicketTimeHint: 3600,
+		ServerName:     "www.example.com",
+		Browser:        browser,
+	}
+	sta.SetAESKey()
+	return sta
+}
+
+// sessionIdOf returns the session id field of a ClientHello with record layer
+func sessionIdOf(hello []byte) []byte {
+	// record layer 5, handshake type 1, length 3, client version 2, random 32
+	sidLen := int(hello[43])
+	return hello[44 : 44+sidLen]
+}
+
+func TestComposeInitHandshakeLength(t *testing.T) {
+	for _, browser := range []string{"chrome", "firefox"} {
+		for _, mode := range []string{"random", "empty", "resumption"} {
+			sta := makeTestState(browser)
+			sta.SessionID = mode
+			hello := ComposeInitHandshake(sta)
+			recordLen := gqclient.BtoInt(hello[3:5])
+			helloLen := gqclient.BtoInt(hello[6:9])
+			// Padded to 512 bytes with the handshake header
+			if recordLen != len(hello)-5 || helloLen != len(hello)-9 || recordLen != 512 {
+				t.Error(
+					"For", browser, mode,
+					"expected", "record length 512",
+					"got", recordLen, helloLen, len(hello),
+				)
+			}
+		}
+	}
+}
+
+func TestSessionId(t *testing.T) {
+	for _, browser := range []string{"chrome", "firefox"} {
+		sta := makeTestState(browser)
+
+		sta.SessionID = "empty"
+		hello := ComposeInitHandshake(sta)
+		if hello[43] != 0x00 {
+			t.Error(
+				"For", browser, "empty",
+				"expected", "00",
+				"got", fmt.Sprintf("%x", hello[43]),
+			)
+		}
+
+		sta.SessionID = "random"
+		if sid := sessionIdOf(ComposeInitHandshake(sta)); len(sid) != 32 {
+			t.Error(
+				"For", browser, "random",
+				"expected", "32 bytes",
+				"got", len(sid),
+			)
+		}
+
+		sta.SessionID = "resumption"
+		sid := sessionIdOf(ComposeInitHandshake(sta))
+		if !bytes.Equal(sid, sessionIdOf(ComposeInitHandshake(sta))) {
+			t.Error(
+				"For", browser, "resumption",
+				"expected", "same session id within TicketTimeHint",
+				"got", "different",
+			)
+		}
+		sta.Now = func() time.Time { return time.Unix(1519319215+3600, 0) }
+		if bytes.Equal(sid, sessionIdOf(ComposeInitHandshake(sta))) {
+			t.Error(
+				"For", browser, "resumption",
+				"expected", "new session id after TicketTimeHint",
+				"got", "same",
+			)
+		}
+	}
+}
+
+func TestVerifyFingerprint(t *testing.T) {
+	chromeJA3 := "771,49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53-10," +
+		"65281-0-23-35-13-5-18-16-30032-11-10-21,29-23-24,0"
+	hello := ComposeInitHandshake(makeTestState("chrome"))
+	ja3, err := JA3(hello)
+	if err != nil || ja3 != chromeJA3 {
+		t.Error(
+			"For", "JA3 of chrome",
+			"expected", chromeJA3,
+			"got", ja3, err,
+		)
+	}
+	ja4, _ := JA4(hello)
+
+	// GREASE values differ every time but are left out of the fingerprints
+	for _, fp := range []string{chromeJA3, "", ja4} {
+		if fp == "" {
+			sum := md5.Sum([]byte(chromeJA3))
+			fp = hex.EncodeToString(sum[:])
+		}
+		err = VerifyFingerprint(ComposeInitHandshake(makeTestState("chrome")), fp)
+		if err != nil {
+			t.Error(
+				"For", fp,
+				"expected", "no err",
+				"got", err,
+			)
+		}
+	}
+
+	for _, fp := range []string{strings.Replace(chromeJA3, "-21,", ",", 1), ja4[:len(ja4)-1] + "0"} {
+		err = VerifyFingerprint(ComposeInitHandshake(makeTestState("firefox")), fp)
+		if err == nil {
+			t.Error(
+				"For", "firefox against", fp,
+				"expected", "err",
+				"got", "no err",
+			)
+		}
+	}
+	err = VerifyFingerprint(hello, strings.Replace(chromeJA3, "-21,", ",", 1))
+	if err == nil || !strings.Contains(err.Error(), "extra [21]") {
+		t.Error(
+			"For", "chrome without padding",
+			"expected", "extra [21]",
+			"got", err,
+		)
+	}
+}
+
+func TestSignatureAlgorithms(t *testing.T) {
+	for _, browser := range []string{"chrome", "firefox"} {
+		sta := makeTestState(browser)
+		sta.SignatureAlgorithms = []string{"ecdsa_secp256r1_sha256", "rsa_pss_rsae_sha256", "rsa_pkcs1_sha1"}
+		hello := ComposeInitHandshake(sta)
+		// type, extension length 8, list length 6, the algorithms
+		exp := []byte{0x00, 0x0d, 0x00, 0x08, 0x00, 0x06, 0x04, 0x03, 0x08, 0x04, 0x02, 0x01}
+		if !bytes.Contains(hello, exp) || gqclient.BtoInt(hello[3:5]) != 512 {
+			t.Error(
+				"For", browser,
+				"expected", fmt.Sprintf("%x", exp),
+				"got", fmt.Sprintf("%x", hello),
+			)
+		}
+	}
+}
+
+func TestPeelRecordLayer(t *testing.T) {
+	for _, ver := range [][]byte{{0x03, 0x01}, {0x03, 0x03}, {0x03, 0x04}} {
+		record := append([]byte{0x17}, ver...)
+		record = append(record, 0x00, 0x05)
+		record = append(record, "hello"...)
+		got := PeelRecordLayer(record)
+		if !bytes.Equal(got, []byte("hello")) {
+			t.Error(
+				"For", "version", ver,
+				"expected", "hello",
+				"got", got,
+			)
+		}
+	}
+}
+
+func TestPutRecordHeader(t *testing.T) {
+	record := append(make([]byte, RecordHeaderLen), "hello"...)
+	PutRecordHeader(record, []byte{0x17}, []byte{0x03, 0x03})
+	if !bytes.Equal(record, AddRecordLayer([]byte("hello"), []byte{0x17}, []byte{0x03, 0x03})) {
+		t.Error("For", "hello", "expected", "the same record as AddRecordLayer", "got", record)
+	}
+}
+
+func BenchmarkAddRecordLayer(b *testing.B) {
+	data := make([]byte, 10240)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		AddRecordLayer(data, []byte{0x17}, []byte{0x03, 0x03})
+	}
+}
+
+func BenchmarkPutRecordHeader(b *testing.B) {
+	buf := make([]byte, RecordHeaderLen+10240)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buf) - RecordHeaderLen))
+	for i := 0; i < b.N; i++ {
+		PutRecordHeader(buf, []byte{0x17}, []byte{0x03, 0x03})
+	}
+}
+
+// A real web server behind WebServerAddr must be able to carry on with our
+// ClientHello, so that a visitor sent there by gq-server sees a working website
+func TestClientHelloAcceptedByTLSServer(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "www.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	config := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+
+	for _, browser := range []string{"chrome", "chrome-120", "firefox", "template"} {
+		sta := makeTestState(browser)
+		if browser == "template" {
+			sta, _ = makeTemplateState("chrome-120")
+		}
+		client, server := net.Pipe()
+		go tls.Server(server, config).Handshake()
+		go client.Write(ComposeInitHandshake(sta))
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		reply := make([]byte, 6)
+		_, err := io.ReadFull(client, reply)
+		// A handshake record starting with ServerHello, rather than an alert
+		if err != nil || reply[0] != 0x16 || reply[5] != 0x02 {
+			t.Error(
+				"For", browser,
+				"expected", "ServerHello",
+				"got", reply, err,
+			)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestDatagramRecords(t *testing.T) {
+	sizes := []int{0, 1200, 20000, MaxDatagramSize}
+	var stream []byte
+	for _, size := range sizes {
+		stream = append(stream, DatagramRecords(gqclient.PsudoRandBytes(size, int64(size)))...)
+	}
+	var r DatagramReader
+	var got []int
+	for len(stream) > 0 {
+		length := 5 + gqclient.BtoInt(stream[3:5])
+		if err := ValidateRecord(stream[:length]); err != nil || length-5 > 16384 {
+			t.Fatal("For", "a record", "expected", "application data of at most 16384 bytes", "got", stream[:5], err)
+		}
+		r.Feed(PeelRecordLayer(stream[:length]))
+		for {
+			datagram, ok := r.Next()
+			if !ok {
+				break
+			}
+			if !bytes.Equal(datagram, gqclient.PsudoRandBytes(len(datagram), int64(len(datagram)))) {
+				t.Error("For", "a datagram of", len(datagram), "bytes", "expected", "it unchanged", "got", "other bytes")
+			}
+			got = append(got, len(datagram))
+		}
+		stream = stream[length:]
+	}
+	if fmt.Sprint(got) != fmt.Sprint(sizes) {
+		t.Error("For", "datagrams", "expected", sizes, "got", got)
+	}
+}
+
+func TestLooksLikeRecord(t *testing.T) {
+	cases := map[string]bool{
+		"170303000568656c6c6f":   true,
+		"1703030005":             false, // length beyond the data
+		"16030100020200":         true,
+		"ff030300020000":         false,
+		"17020300020000":         false,
+		"1703":                   false,
+		"170303000268656c6c6f00": true,
+	}
+	for h, exp := range cases {
+		data, _ := hex.DecodeString(h)
+		if LooksLikeRecord(data) != exp {
+			t.Error(
+				"For", h,
+				"expected", exp,
+				"got", !exp,
+			)
+		}
+	}
+}
+
+func TestValidateRecord(t *testing.T) {
+	cases := map[string]bool{
+		"170303000568656c6c6f": true,
+		"1703030000":           true,
+		"170303000668656c6c6f": false, // length beyond the data
+		"170303000468656c6c6f": false, // data beyond the length
+		"160303000568656c6c6f": false,
+		"150303000568656c6c6f": false,
+		"170301000568656c6c6f": false,
+		"17030300":             false,
+	}
+	long := append([]byte{0x17, 0x03, 0x03, 0x48, 0x01}, make([]byte, 0x4801)...)
+	if err := ValidateRecord(long); err == nil {
+		t.Error("For", "a record over the maximum length", "expected", "an error", "got", nil)
+	}
+	for h, exp := range cases {
+		data, _ := hex.DecodeString(h)
+		err := ValidateRecord(data)
+		if (err == nil) != exp {
+			t.Error(
+				"For", h,
+				"expected", exp,
+				"got", err,
+			)
+		}
+	}
+}
+
+func TestReadServerHandshake(t *testing.T) {
+	TLS12 := []byte{0x03, 0x03}
+	serverHello := AddRecordLayer(append([]byte{0x02, 0x00, 0x00, 0x26}, make([]byte, 38)...), []byte{0x16}, TLS12)
+	certificate := AddRecordLayer(append([]byte{0x0b, 0x00, 0x03, 0xe8}, make([]byte, 1000)...), []byte{0x16}, TLS12)
+	ccs := AddRecordLayer([]byte{0x01}, []byte{0x14}, TLS12)
+	finished := AddRecordLayer(make([]byte, 40), []byte{0x16}, TLS12)
+	appData := AddRecordLayer([]byte("data"), []byte{0x17}, TLS12)
+	alert := AddRecordLayer([]byte{0x02, 0x28}, []byte{0x15}, TLS12)
+	// The ServerHello split over two records, and sharing one with the Certificate
+	helloStart := AddRecordLayer(serverHello[5:20], []byte{0x16}, TLS12)
+	helloEnd := AddRecordLayer(serverHello[20:], []byte{0x16}, TLS12)
+	helloAndCertificate := AddRecordLayer(append(append([]byte{}, serverHello[5:]...), certificate[5:]...), []byte{0x16}, TLS12)
+	tooLong := AddRecordLayer([]byte{0x0b, 0x01, 0x00, 0x00}, []byte{0x16}, TLS12)
+	helloDone := AddRecordLayer([]byte{0x0e, 0x00, 0x00, 0x00}, []byte{0x16}, TLS12)
+
+	cases := map[string]struct {
+		records [][]byte
+		ok      bool
+		// part of the error, which says what the likely cause is
+		hint string
+	}{
+		"ServerHello, ChangeCipherSpec, Finished": {[][]byte{serverHello, ccs, finished}, true, ""},
+		"with a Certificate":                      {[][]byte{serverHello, certificate, ccs, finished}, true, ""},
+		"no ServerHello":                          {[][]byte{ccs, finished}, false, "not a ServerHello"},
+		"alert":                                   {[][]byte{serverHello, alert}, false, "Alert from server: handshake_failure"},
+		"alert instead of a ServerHello":          {[][]byte{alert}, false, "Alert from server: handshake_failure"},
+		"all in one write":                        {[][]byte{bytes.Join([][]byte{serverHello, certificate, ccs, finished}, nil)}, true, ""},
+		"application data before Finished":        {[][]byte{serverHello, ccs, appData}, false, "Unexpected record type"},
+		"closed straight away":                    {nil, false, "without answering the ClientHello"},
+		"web server":                              {[][]byte{serverHello, certificate}, false, "check that Key"},
+		"ServerHello over two records":            {[][]byte{helloStart, helloEnd, ccs, finished}, true, ""},
+		"ServerHello and Certificate in a record": {[][]byte{helloAndCertificate, ccs, finished}, true, ""},
+		"ChangeCipherSpec in a message":           {[][]byte{helloStart, ccs, helloEnd, finished}, false, "in the middle of a handshake message"},
+		"message too long":                        {[][]byte{serverHello, tooLong}, false, "too long"},
+		"alert after ChangeCipherSpec":            {[][]byte{serverHello, ccs, alert}, false, "Alert"},
+		"too many records":                        {[][]byte{serverHello, bytes.Repeat(helloDone, 8)}, false, "Too many records"},
+	}
+	for name, c := range cases {
+		client, server := net.Pipe()
+		go func(records [][]byte) {
+			for _, r := range records {
+				server.Write(r)
+			}
+			server.Close()
+		}(c.records)
+		got, err := ReadServerHandshake(makeTestState("chrome"), client, nil, time.Time{})
+		if c.ok && (err != nil || !bytes.Equal(got, serverHello)) {
+			t.Error(
+				"For", name,
+				"expected", "the ServerHello",
+				"got", got, err,
+			)
+		} else if !c.ok && (err == nil || !strings.Contains(err.Error(), c.hint)) {
+			t.Error(
+				"For", name,
+				"expected", c.hint,
+				"got", err,
+			)
+		}
+		client.Close()
+	}
+
+	// Data coalesced with the handshake is left for the pair
+	client, server := net.Pipe()
+	go server.Write(bytes.Join([][]byte{serverHello, ccs, finished, appData}, nil))
+	_, err := ReadServerHandshake(makeTestState("chrome"), client, nil, time.Time{})
+	buf := make([]byte, 100)
+	i, err2 := gqclient.ReadTillDrain(client, buf)
+	if err != nil || err2 != nil || !bytes.Equal(buf[:i], appData) {
+		t.Error("For", "data in the same write as Finished", "expected", appData, "got", buf[:i], err, err2)
+	}
+	client.Close()
+	server.Close()
+}
+
+func TestHandshakeReassemblyLimits(t *testing.T) {
+	TLS12 := []byte{0x03, 0x03}
+	serverHello := AddRecordLayer(append([]byte{0x02, 0x00, 0x00, 0x26}, make([]byte, 38)...), []byte{0x16}, TLS12)
+	ccs := AddRecordLayer([]byte{0x01}, []byte{0x14}, TLS12)
+	finished := AddRecordLayer(make([]byte, 40), []byte{0x16}, TLS12)
+	// fragments cuts msg into records of size bytes
+	fragments := func(msg []byte, size int) (ret [][]byte) {
+		for len(msg) > size {
+			ret = append(ret, AddRecordLayer(msg[:size], []byte{0x16}, TLS12))
+			msg = msg[size:]
+		}
+		return append(ret, AddRecordLayer(msg, []byte{0x16}, TLS12))
+	}
+	certificate := append([]byte{0x0b, 0x00, 0x0f, 0xa0}, make([]byte, 4000)...)
+	handshake := func(middle [][]byte) [][]byte {
+		return append(append([][]byte{serverHello}, middle...), ccs, finished)
+	}
+	// A message claiming to be as long as a message can be, in records of a byte
+	giant := fragments([]byte{0x0b, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, 1)
+	// One claiming less than the limit, which is never finished
+	endless := fragments(append([]byte{0x0b, 0x00, 0xea, 0x60}, make([]byte, 60000)...), 1)
+
+	cases := []struct {
+		name       string
+		records    [][]byte
+		maxSize    int
+		maxRecords int
+		hint       string
+	}{
+		{"Certificate in a record", handshake(fragments(certificate, 16384)), 0, 0, ""},
+		{"Certificate over 4 records", handshake(fragments(certificate, 1001)), 0, 4, ""},
+		{"Certificate over too many records", handshake(fragments(certificate, 1001)), 0, 3, "spans more than 3 records"},
+		{"Certificate too long", handshake(fragments(certificate, 16384)), 2048, 0, "too long"},
+		{"giant message", append([][]byte{serverHello}, giant...), 0, 0, "too long"},
+		{"endless message", append([][]byte{serverHello}, endless...), 0, 0, "records"},
+		{"endless message with a limit", append([][]byte{serverHello}, endless...), 0, 2, "spans more than 2 records"},
+	}
+	for _, c := range cases {
+		sta := makeTestState("chrome")
+		sta.MaxHandshakeMessageSize = c.maxSize
+		sta.MaxHandshakeMessageRecords = c.maxRecords
+		client, server := net.Pipe()
+		go func(records [][]byte) {
+			for _, r := range records {
+				if _, err := server.Write(r); err != nil {
+					return
+				}
+			}
+			server.Close()
+		}(c.records)
+		_, err := ReadServerHandshake(sta, client, nil, time.Time{})
+		if c.hint == "" && err != nil {
+			t.Error("For", c.name, "expected", "the ServerHello", "got", err)
+		} else if c.hint != "" && (err == nil || !strings.Contains(err.Error(), c.hint)) {
+			t.Error("For", c.name, "expected", c.hint, "got", err)
+		}
+		client.Close()
+	}
+}
+
+func TestDetectInterception(t *testing.T) {
+	sta := makeTestState("chrome")
+	sta.DetectInterception = true
+	clientHello := ComposeInitHandshake(sta)
+	TLS12 := []byte{0x03, 0x03}
+	// makeServerHello makes a ServerHello like gq-server's with the session id and cipher suite given
+	makeServerHello := func(sessionId []byte, cipher []byte) []byte {
+		sh := append([]byte{0x03, 0x03}, make([]byte, 32)...)
+		sh = append(sh, byte(len(sessionId)))
+		sh = append(sh, sessionId...)
+		sh = append(sh, cipher...)
+		sh = append(sh, 0x00, 0x00, 0x05, 0xff, 0x01, 0x00, 0x01, 0x00)
+		sh = append([]byte{0x02, 0x00, 0x00, byte(len(sh))}, sh...)
+		return AddRecordLayer(sh, []byte{0x16}, TLS12)
+	}
+	serverHello := makeServerHello(sessionIdOf(clientHello), []byte{0xc0, 0x30})
+	certificate := AddRecordLayer(append([]byte{0x0b, 0x00, 0x03, 0xe8}, make([]byte, 1000)...), []byte{0x16}, TLS12)
+	ccs := AddRecordLayer([]byte{0x01}, []byte{0x14}, TLS12)
+	finished := AddRecordLayer(make([]byte, 40), []byte{0x16}, TLS12)
+
+	cases := map[string]struct {
+		records [][]byte
+		hint    string
+	}{
+		"gq-server":             {[][]byte{serverHello, ccs, finished}, ""},
+		"with a Certificate":    {[][]byte{serverHello, certificate, ccs, finished}, "sent a Certificate"},
+		"another session id":    {[][]byte{makeServerHello(make([]byte, 32), []byte{0xc0, 0x30}), ccs, finished}, "session id"},
+		"another cipher":        {[][]byte{makeServerHello(sessionIdOf(clientHello), []byte{0xc0, 0x2f}), ccs, finished}, "cipher suite"},
+		"truncated ServerHello": {[][]byte{AddRecordLayer([]byte{0x02, 0x00, 0x00, 0x02, 0x03, 0x03}, []byte{0x16}, TLS12)}, "malformed"},
+	}
+	for name, c := range cases {
+		client, server := net.Pipe()
+		go func(records [][]byte) {
+			for _, r := range records {
+				server.Write(r)
+			}
+			server.Close()
+		}(c.records)
+		got, err := ReadServerHandshake(sta, client, clientHello, time.Time{})
+		if c.hint == "" && (err != nil || !bytes.Equal(got, serverHello)) {
+			t.Error(
+				"For", name,
+				"expected", "the ServerHello",
+				"got", got, err,
+			)
+		} else if c.hint != "" && (err == nil || !strings.Contains(err.Error(), "TLS interception") || !strings.Contains(err.Error(), c.hint)) {
+			t.Error(
+				"For", name,
+				"expected", c.hint,
+				"got", err,
+			)
+		}
+		client.Close()
+	}
+}
+
+func TestChrome120(t *testing.T) {
+	// JA4 of Chrome 120, which doesn't change with the order of the extensions
+	exp := "t13d1516h2_8daaf6152771_02713d6af862"
+	for c := 0; c < 10; c++ {
+		hello := ComposeInitHandshake(makeTestState("chrome-120"))
+		ja4, err := JA4(hello)
+		if err != nil || ja4 != exp {
+			t.Error(
+				"For", "chrome-120",
+				"expected", exp,
+				"got", ja4, err,
+			)
+		}
+		if gqclient.BtoInt(hello[3:5]) != len(hello)-5 {
+			t.Error(
+				"For", "chrome-120 record length",
+				"expected", len(hello)-5,
+				"got", gqclient.BtoInt(hello[3:5]),
+			)
+		}
+	}
+}
+
+func TestSafari(t *testing.T) {
+	// The JA3 of Safari 17, with the well known hash 773906b0efdefa24a7f2b8eb6985bf37,
+	// and its JA4
+	expJA3 := "771,4865-4866-4867-49196-49195-52393-49200-49199-52392-49162-49161-49172-49171-157-156-53-47-49160-49170-10," +
+		"0-23-65281-10-11-16-5-13-18-51-45-43-27-21,29-23-24-25,0"
+	expJA4 := "t13d2014h2_a09f3c656075_14788d8d241b"
+	hello := ComposeInitHandshake(makeTestState("safari"))
+	ja3, err := JA3(hello)
+	if err != nil || ja3 != expJA3 {
+		t.Error("For", "JA3 of safari", "expected", expJA3, "got", ja3, err)
+	}
+	ja4, err := JA4(hello)
+	if err != nil || ja4 != expJA4 {
+		t.Error("For", "JA4 of safari", "expected", expJA4, "got", ja4, err)
+	}
+}
+
+// maskHello blanks out what differs between connections in hello, a ClientHello
+// with its record layer: the random field, session id, session ticket and key
+// shares, and makes the GREASE values 0a0a, so that it can be compared with a fixture
+func maskHello(hello []byte) []byte {
+	ret := append([]byte{}, hello...)
+	grease := []byte{0x0a, 0x0a}
+	zero := func(b []byte) {
+		for i := range b {
+			b[i] = 0
+		}
+	}
+	// record layer 5, handshake type 1, length 3, client version 2, random 32
+	zero(ret[11:43])
+	p := 44 + int(ret[43])
+	zero(ret[44:p])
+	cipherLen := 2 + gqclient.BtoInt(ret[p:p+2])
+	copy(ret[p:], regrease(ret[p:p+cipherLen], 2, grease))
+	p += cipherLen
+	p += 1 + int(ret[p]) // compression methods
+	p += 2               // extensions length
+	for p+4 <= len(ret) {
+		typ := binary.BigEndian.Uint16(ret[p:])
+		data := ret[p+4 : p+4+gqclient.BtoInt(ret[p+2:p+4])]
+		if isGREASE(typ) {
+			copy(ret[p:], grease)
+		}
+		switch typ {
+		case 0x000a: // supported groups
+			copy(data, regrease(data, 2, grease))
+		case 0x002b: // supported versions
+			copy(data, regrease(data, 1, grease))
+		case 0x0023: // session ticket
+			zero(data)
+		case 0x0033: // key share
+			for q := 2; q+4 <= len(data); {
+				shareLen := gqclient.BtoInt(data[q+2 : q+4])
+				if isGREASE(binary.BigEndian.Uint16(data[q:])) {
+					copy(data[q:], grease)
+				}
+				zero(data[q+4 : q+4+shareLen])
+				q += 4 + shareLen
+			}
+		}
+		p += 4 + len(data)
+	}
+	return ret
+}
+
+func zeros(n int) string {
+	return strings.Repeat("00", n)
+}
+
+// The ClientHellos of the browsers whose extensions are in a fixed order, for
+// www.example.com as maskHello leaves them: the browser's record and handshake
+// headers, random and session id, cipher suites and compression methods, then
+// each extension in order
+var helloFixtures = map[string][]string{
+	"chrome": {
+		"1603010200", "010001fc", "0303", zeros(32), "20" + zeros(32),
+		"001c0a0ac02bc02fc02cc030cca9cca8c013c014009c009d002f0035000a", "0100",
+		"0197",
+		"0a0a0000",
+		"ff01000100",
+		"00000014001200000f7777772e6578616d706c652e636f6d",
+		"00170000",
+		"002300c0" + zeros(192),
+		"000d00140012040308040401050308050501080606010201",
+		"000500050100000000",
+		"00120000",
+		"0010000e000c02683208687474702f312e31",
+		"75500000",
+		"000b00020100",
+		"000a000a00080a0a001d00170018",
+		"0a0a000100",
+		"00150056" + zeros(0x56),
+	},
+	"firefox": {
+		"1603010200", "010001fc", "0303", zeros(32), "20" + zeros(32),
+		"001ec02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a", "0100",
+		"0195",
+		"00000014001200000f7777772e6578616d706c652e636f6d",
+		"00170000",
+		"ff01000100",
+		"000a000a0008001d001700180019",
+		"000b00020100",
+		"002300c0" + zeros(192),
+		"0010000e000c02683208687474702f312e31",
+		"000500050100000000",
+		"000d0018001604030503060308040805080604010501060102030201",
+		"00150061" + zeros(0x61),
+	},
+	"safari": {
+		"1603010200", "010001fc", "0303", zeros(32), "20" + zeros(32),
+		"002a0a0a130113021303c02cc02bcca9c030c02fcca8c00ac009c014c013009d009c0035002fc008c012000a", "0100",
+		"0189",
+		"0a0a0000",
+		"00000014001200000f7777772e6578616d706c652e636f6d",
+		"00170000",
+		"ff01000100",
+		"000a000c000a0a0a001d001700180019",
+		"000b00020100",
+		"0010000e000c02683208687474702f312e31",
+		"000500050100000000",
+		"000d0018001604030804040105030203080508050501080606010201",
+		"00120000",
+		"0033002b00290a0a000100001d0020" + zeros(32),
+		"002d00020101",
+		"002b000b0a0a0a0304030303020301",
+		"001b0003020001",
+		"0a0a000100",
+		"001500bf" + zeros(0xbf),
+	},
+}
+
+func TestHelloFixtures(t *testing.T) {
+	for browser, fixture := range helloFixtures {
+		exp := strings.Join(fixture, "")
+		got := hex.EncodeToString(maskHello(ComposeInitHandshake(makeTestState(browser))))
+		if got != exp {
+			t.Error("For", browser, "expected", exp, "got", got)
+		}
+	}
+}
+
+func TestGREASEECH(t *testing.T) {
+	sizes := map[int]bool{}
+	for c := 0; c < 50; c++ {
+		hello := ComposeInitHandshake(makeTestState("chrome-120"))
+		tmpl, _ := MakeHelloTemplate(hello)
+		var ech []byte
+		for _, e := range tmpl.Extensions {
+			if e.Type == "encrypted_client_hello" {
+				ech, _ = hex.DecodeString(e.Data)
+			}
+		}
+		// outer, HKDF-SHA256, AES-128-GCM, config id, 32 byte key, payload
+		if len(ech) < 42 || !bytes.Equal(ech[:5], []byte{0x00, 0x00, 0x01, 0x00, 0x01}) || !bytes.Equal(ech[6:8], []byte{0x00, 0x20}) {
+			t.Error("For", "chrome-120", "expected", "a GREASE ECH", "got", fmt.Sprintf("%x", ech))
+			continue
+		}
+		payloadLen := gqclient.BtoInt(ech[40:42])
+		if len(ech) != 42+payloadLen {
+			t.Error("For", "chrome-120 ECH length", "expected", 42+payloadLen, "got", len(ech))
+		}
+		sizes[payloadLen] = true
+	}
+	for size := range sizes {
+		if size < 144 || size > 240 || size%32 != 16 {
+			t.Error("For", "chrome-120 ECH payload", "expected", chrome120ECHPayloadLens, "got", size)
+		}
+	}
+	if len(sizes) < 2 {
+		t.Error("For", "chrome-120 ECH payloads", "expected", "different sizes", "got", sizes)
+	}
+	// Chrome 64 and Firefox 58 came before ECH
+	for _, browser := range []string{"chrome", "firefox"} {
+		for _, e := range extensionOrder(ComposeInitHandshake(makeTestState(browser))) {
+			if e == 0xfe0d {
+				t.Error("For", browser, "expected", "no encrypted_client_hello", "got", e)
+			}
+		}
+	}
+}
+
+func TestApplicationSettings(t *testing.T) {
+	// The ALPN and ALPS extensions in a ClientHello of Chrome 120
+	ref := map[string]string{
+		"application_layer_protocol_negotiation": "0010000e000c02683208687474702f312e31",
+		"application_settings":                   "446900050003026832",
+	}
+	for c := 0; c < 10; c++ {
+		hello := ComposeInitHandshake(makeTestState("chrome-120"))
+		for name, exp := range ref {
+			ext, _ := hex.DecodeString(exp)
+			if !bytes.Contains(hello, ext) {
+				t.Error("For", "chrome-120", name, "expected", exp, "got", fmt.Sprintf("%x", hello))
+			}
+		}
+	}
+	// Chrome 64 and Firefox 58 came before ALPS
+	for _, browser := range []string{"chrome", "firefox"} {
+		for _, e := range extensionOrder(ComposeInitHandshake(makeTestState(browser))) {
+			if e == 0x4469 {
+				t.Error("For", browser, "expected", "no application_settings", "got", e)
+			}
+		}
+	}
+	if got := fmt.Sprintf("%x", makeApplicationSettings([]string{"http/1.1"})); got != "0000" {
+		t.Error("For", "ALPN of only http/1.1", "expected", "0000", "got", got)
+	}
+}
+
+// crypto/tls turns down early data for sessions it didn't issue, so unlike
+// TestClientHelloAcceptedByTLSServer this only looks at the extensions
+func TestSimulateResumption(t *testing.T) {
+	for _, percentage := range []int{0, 100} {
+		sta := makeTestState("chrome-120")
+		sta.SimulateResumption = percentage
+		f, err := parseHelloFields(ComposeInitHandshake(sta))
+		if err != nil {
+			t.Error("For", percentage, "expected", "a ClientHello", "got", err)
+			continue
+		}
+		earlyData := false
+		for _, e := range f.extensions {
+			earlyData = earlyData || e == 0x002a
+		}
+		resumed := f.extensions[len(f.extensions)-1] == 0x0029
+		if earlyData != (percentage == 100) || resumed != (percentage == 100) {
+			t.Error(
+				"For", "SimulateResumption", percentage,
+				"expected", "early_data and pre_shared_key last", percentage == 100,
+				"got", earlyData, resumed,
+			)
+		}
+	}
+}
+
+// RFC 8446 4.2: pre_shared_key must be the last extension and can only be sent
+// with psk_key_exchange_modes
+func TestEarlyChangeCipherSpec(t *testing.T) {
+	serverHello := AddRecordLayer(make([]byte, 38), []byte{0x16}, []byte{0x03, 0x03})
+	ccs := []byte{0x14, 0x03, 0x03, 0x00, 0x01, 0x01}
+	cases := []struct {
+		browser    string
+		resumption int
+		early      bool
+	}{
+		{"chrome", 0, false},
+		{"firefox", 0, false},
+		{"chrome-120", 0, false},
+		{"chrome-120", 100, true},
+	}
+	for _, c := range cases {
+		sta := makeTestState(c.browser)
+		sta.SimulateResumption = c.resumption
+		hello := ComposeInitHandshake(sta)
+		flight := ClientHelloFlight(hello)
+		reply, err := ComposeReply(sta, hello, serverHello)
+		if err != nil {
+			t.Error("For", c.browser, c.resumption, "expected", "a reply", "got", err)
+			continue
+		}
+		// The ChangeCipherSpec is sent once, after the ClientHello or before Finished
+		var exp []byte
+		if c.early {
+			exp = append(append(append([]byte{}, hello...), ccs...), reply...)
+		} else {
+			exp = append(append(append([]byte{}, hello...), ccs...), reply[len(ccs):]...)
+		}
+		got := append(append([]byte{}, flight...), reply...)
+		if EarlyChangeCipherSpec(hello) != c.early || !bytes.Equal(got, exp) || reply[len(reply)-45] != 0x16 {
+			t.Error(
+				"For", c.browser, "SimulateResumption", c.resumption,
+				"expected", "ChangeCipherSpec after the ClientHello", c.early,
+				"got", fmt.Sprintf("%x", got),
+			)
+		}
+	}
+}
+
+func TestPreSharedKey(t *testing.T) {
+	custom := []string{"session_ticket", "supported_versions", "key_share", "psk_key_exchange_modes", "pre_shared_key", "grease"}
+	for _, set := range []string{"full", "custom"} {
+		for c := 0; c < 10; c++ {
+			sta := makeTestState("chrome-120")
+			sta.SimulateResumption = 100
+			sta.ExtensionSet = set
+			if set == "custom" {
+				sta.Extensions = custom
+			}
+			hello := ComposeInitHandshake(sta)
+			// parseHelloFields leaves out GREASE, which mustn't come last either
+			var last uint16
+			p := 5 + 4 + 2 + 32
+			p += 1 + int(hello[p])
+			p += 2 + gqclient.BtoInt(hello[p:p+2])
+			p += 1 + int(hello[p])
+			for p += 2; p < len(hello); p += 4 + gqclient.BtoInt(hello[p+2:p+4]) {
+				last = binary.BigEndian.Uint16(hello[p:])
+			}
+			f, _ := parseHelloFields(hello)
+			modes := false
+			for _, e := range f.extensions {
+				modes = modes || e == 0x002d
+			}
+			if last != 0x0029 || !modes {
+				t.Error(
+					"For", set,
+					"expected", "pre_shared_key last with psk_key_exchange_modes",
+					"got", fmt.Sprintf("%04x", last), modes,
+				)
+			}
+		}
+	}
+}
+
+func TestStatusRequest(t *testing.T) {
+	// type, length, status type ocsp, empty responder ids and request extensions
+	exp, _ := hex.DecodeString("000500050100000000")
+	for _, browser := range []string{"chrome", "chrome-120", "firefox"} {
+		for c := 0; c < 10; c++ {
+			hello := ComposeInitHandshake(makeTestState(browser))
+			if !bytes.Contains(hello, exp) {
+				t.Error(
+					"For", browser,
+					"expected", fmt.Sprintf("%x", exp),
+					"got", fmt.Sprintf("%x", hello),
+				)
+			}
+		}
+	}
+}
+
+func TestServerNames(t *testing.T) {
+	names := []string{"www.example.com", "cdn.example.org", "a.b.example.net"}
+	for _, browser := range []string{"chrome", "chrome-120", "firefox", "safari"} {
+		sta := makeTestState(browser)
+		sta.ServerName, sta.ServerNames = names[0], names
+		for c := 0; c < 6; c++ {
+			conn := sta.WithNextServerName()
+			hello := ComposeInitHandshake(conn)
+			name := []byte(conn.ServerName)
+			// type, length, list length, host_name, name length, then the name
+			exp := []byte{0x00, 0x00, 0x00, byte(len(name) + 5), 0x00, byte(len(name) + 3), 0x00, 0x00, byte(len(name))}
+			exp = append(exp, name...)
+			if !bytes.Contains(hello, exp) {
+				t.Error(
+					"For", browser, conn.ServerName,
+					"expected", fmt.Sprintf("%x", exp),
+					"got", fmt.Sprintf("%x", hello),
+				)
+			}
+		}
+	}
+}
+
+func TestCompressCertificate(t *testing.T) {
+	cases := []struct {
+		browser string
+		algos   []string
+		exp     string
+	}{
+		// type, length, algorithms length, algorithms
+		{"chrome-120", nil, "001b0003020002"},
+		{"chrome-120", []string{"zlib", "brotli"}, "001b00050400010002"},
+		{"chrome", []string{"brotli"}, "001b0003020002"},
+		{"firefox", []string{"zstd", "zlib"}, "001b00050400030001"},
+	}
+	for _, c := range cases {
+		sta := makeTestState(c.browser)
+		sta.CertCompression = c.algos
+		exp, _ := hex.DecodeString(c.exp)
+		hello := ComposeInitHandshake(sta)
+		if !bytes.Contains(hello, exp) {
+			t.Error(
+				"For", c.browser, c.algos,
+				"expected", c.exp,
+				"got", fmt.Sprintf("%x", hello),
+			)
+		}
+	}
+	for _, browser := range []string{"chrome", "firefox"} {
+		f, err := parseHelloFields(ComposeInitHandshake(makeTestState(browser)))
+		if err != nil {
+			t.Error("For", browser, "expected", nil, "got", err)
+			continue
+		}
+		for _, e := range f.extensions {
+			if e == 0x001b {
+				t.Error("For", browser, "expected", "no compress_certificate", "got", f.extensions)
+			}
+		}
+	}
+}
+
+func TestDelegatedCredentials(t *testing.T) {
+	cases := []struct {
+		browser string
+		schemes []string
+		exp     string
+	}{
+		// type, length, schemes length, schemes
+		{"chrome", []string{"default"}, "0022000a00080403050306030203"},
+		{"chrome-120", []string{"ed25519"}, "0022000400020807"},
+		{"firefox", []string{"ecdsa_secp256r1_sha256", "rsa_pss_rsae_sha256"}, "00220006000404030804"},
+	}
+	for _, c := range cases {
+		sta := makeTestState(c.browser)
+		sta.DelegatedCredentials = c.schemes
+		exp, _ := hex.DecodeString(c.exp)
+		hello := ComposeInitHandshake(sta)
+		if !bytes.Contains(hello, exp) {
+			t.Error(
+				"For", c.browser, c.schemes,
+				"expected", c.exp,
+				"got", fmt.Sprintf("%x", hello),
+			)
+		}
+	}
+	for _, browser := range []string{"chrome", "chrome-120", "firefox"} {
+		for _, e := range extensionOrder(ComposeInitHandshake(makeTestState(browser))) {
+			if e == 0x0022 {
+				t.Error("For", browser, "expected", "no delegated_credentials", "got", e)
+			}
+		}
+	}
+
+	// A template keeps the captured contents unless DelegatedCredentials is set
+	captured := makeTestState("firefox")
+	captured.DelegatedCredentials = []string{"default"}
+	sta := makeTestState("template")
+	sta.Template, _ = MakeHelloTemplate(ComposeInitHandshake(captured))
+	for _, c := range []struct {
+		schemes []string
+		exp     string
+	}{
+		{nil, "0022000a00080403050306030203"},
+		{[]string{"ed25519"}, "0022000400020807"},
+	} {
+		sta.DelegatedCredentials = c.schemes
+		exp, _ := hex.DecodeString(c.exp)
+		hello := ComposeInitHandshake(sta)
+		if !bytes.Contains(hello, exp) {
+			t.Error("For", "template", c.schemes, "expected", c.exp, "got", fmt.Sprintf("%x", hello))
+		}
+	}
+}
+
+func TestHelloVersions(t *testing.T) {
+	for _, browser := range []string{"chrome", "chrome-120", "firefox"} {
+		hello := ComposeInitHandshake(makeTestState(browser))
+		// record layer 5, handshake type 1, length 3
+		record, legacy := fmt.Sprintf("%x", hello[1:3]), fmt.Sprintf("%x", hello[9:11])
+		if record != "0301" || legacy != "0303" {
+			t.Error(
+				"For", browser,
+				"expected", "record version 0301, legacy_version 0303",
+				"got", record, legacy,
+			)
+		}
+	}
+}
+
+func TestRawExtensions(t *testing.T) {
+	// An extension the profiles don't send and an ALPN of only h2 replacing theirs
+	raw := []string{"eeee000100", "001000050003026832"}
+	for _, browser := range []string{"chrome", "chrome-120", "firefox"} {
+		sta := makeTestState(browser)
+		sta.RawExtensions = raw
+		sta.SimulateResumption = 100
+		hello := ComposeInitHandshake(sta)
+		for _, h := range raw {
+			exp, _ := hex.DecodeString(h)
+			if !bytes.Contains(hello, exp) {
+				t.Error("For", browser, "expected", h, "got", fmt.Sprintf("%x", hello))
+			}
+		}
+		f, err := parseHelloFields(hello)
+		if err != nil {
+			t.Error("For", browser, "expected", nil, "got", err)
+			continue
+		}
+		alpn := 0
+		for _, e := range f.extensions {
+			if e == 0x0010 {
+				alpn++
+			}
+		}
+		if alpn != 1 {
+			t.Error("For", browser, "expected", "one application_layer_protocol_negotiation", "got", alpn)
+		}
+		// pre_shared_key stays last when resuming
+		if browser == "chrome-120" && f.extensions[len(f.extensions)-1] != 0x0029 {
+			t.Error("For", browser, "expected", "pre_shared_key last", "got", f.extensions)
+		}
+	}
+}
+
+func TestRecordSizeLimit(t *testing.T) {
+	// TLS 1.3 counts the content type byte in the limit
+	exp := map[string]string{
+		"chrome":     "001c00021000",
+		"chrome-120": "001c00021001",
+		"firefox":    "001c00021000",
+	}
+	for browser, e := range exp {
+		sta := makeTestState(browser)
+		sta.MaxRecordSize = 4096
+		f, _ := parseHelloFields(ComposeInitHandshake(sta))
+		for _, typ := range f.extensions {
+			if typ == 0x001c {
+				t.Error("For", browser, "expected", "no record_size_limit", "got", f.extensions)
+			}
+		}
+		sta.RecordSizeLimit = true
+		ext, _ := hex.DecodeString(e)
+		hello := ComposeInitHandshake(sta)
+		if !bytes.Contains(hello, ext) {
+			t.Error(
+				"For", browser,
+				"expected", e,
+				"got", fmt.Sprintf("%x", hello),
+			)
+		}
+	}
+}
+
+func TestExtensionSet(t *testing.T) {
+	cases := map[string][]string{
+		"minimal": gqclient.MinimalExtensions,
+		"custom":  {"session_ticket", "grease", "application_layer_protocol_negotiation"},
+	}
+	for set, exp := range cases {
+		for _, browser := range []string{"chrome", "chrome-120", "firefox"} {
+			sta := makeTestState(browser)
+			sta.ExtensionSet = set
+			if set == "custom" {
+				sta.Extensions = exp
+			}
+			hello := ComposeInitHandshake(sta)
+			f, err := parseHelloFields(hello)
+			if err != nil {
+				t.Error("For", browser, set, "expected", "a ClientHello", "got", err)
+				continue
+			}
+			for _, e := range f.extensions {
+				if !sta.KeepsExtension(extensionName(e)) {
+					t.Error(
+						"For", browser, set,
+						"expected", exp,
+						"got", extensionName(e),
+					)
+				}
+			}
+			if gqclient.BtoInt(hello[3:5]) != len(hello)-5 {
+				t.Error(
+					"For", browser, set, "record length",
+					"expected", len(hello)-5,
+					"got", gqclient.BtoInt(hello[3:5]),
+				)
+			}
+		}
+	}
+}
+
+func TestReproducibleClientHello(t *testing.T) {
+	serverHello := AddRecordLayer(make([]byte, 38), []byte{0x16}, []byte{0x03, 0x03})
+	for _, browser := range []string{"chrome", "chrome-120", "firefox", "safari"} {
+		var hellos [2][]byte
+		for i := range hellos {
+			sta := makeTestState(browser)
+			sta.Rand = mrand.New(mrand.NewSource(1))
+			sta.SetOpaque()
+			hellos[i] = ComposeInitHandshake(sta)
+			reply, _ := ComposeReply(sta, hellos[i], serverHello)
+			hellos[i] = append(hellos[i], reply...)
+		}
+		if !bytes.Equal(hellos[0], hellos[1]) {
+			t.Error(
+				"For", browser,
+				"expected", fmt.Sprintf("%x", hellos[0]),
+				"got", fmt.Sprintf("%x", hellos[1]),
+			)
+		}
+	}
+}
+
+func TestAuthPayloadFunc(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xab}, 32)
+	for _, browser := range []string{"chrome", "chrome-120", "firefox"} {
+		sta := makeTestState(browser)
+		sta.AuthPayloadFunc = func(*gqclient.State) []byte { return payload }
+		// record layer 5, handshake type 1, length 3, version 2
+		random := ComposeInitHandshake(sta)[11:43]
+		if !bytes.Equal(random, payload) {
+			t.Error(
+				"For", browser,
+				"expected", fmt.Sprintf("%x", payload),
+				"got", fmt.Sprintf("%x", random),
+			)
+		}
+	}
+}
+
+func TestDescribeServerResponse(t *testing.T) {
+	TLS12 := []byte{0x03, 0x03}
+	serverHello := func(random []byte, extensions []byte) []byte {
+		sh := append([]byte{0x03, 0x03}, random...)
+		sh = append(sh, 0x00, 0x13, 0x01, 0x00)
+		sh = append(sh, u16(len(extensions))...)
+		sh = append(sh, extensions...)
+		sh = append([]byte{0x02, 0x00, 0x00, byte(len(sh))}, sh...)
+		return AddRecordLayer(sh, []byte{0x16}, TLS12)
+	}
+	tls13, _ := hex.DecodeString("002b00020304")
+	cases := []struct {
+		record   []byte
+		accepted bool
+		exp      string
+	}{
+		{serverHello(make([]byte, 32), nil), true, "ServerHello: TLS 1.2, cipher suite 0x1301"},
+		{serverHello(make([]byte, 32), tls13), true, "ServerHello: TLS 1.3, cipher suite 0x1301"},
+		{serverHello(helloRetryRandom, tls13), true, "HelloRetryRequest: TLS 1.3, cipher suite 0x1301"},
+		{AddRecordLayer([]byte{0x02, 0x28}, []byte{0x15}, TLS12), false, "Alert: handshake_failure"},
+		{AddRecordLayer([]byte{0x02, 0xfe}, []byte{0x15}, TLS12), false, "Alert: alert 254"},
+		{AddRecordLayer([]byte{0x0b, 0x00, 0x00, 0x00}, []byte{0x16}, TLS12), false, "Not a ServerHello"},
+		{AddRecordLayer([]byte{0x02, 0x00, 0x00, 0x02, 0x03, 0x03}, []byte{0x16}, TLS12), false, "Malformed ServerHello"},
+	}
+	for _, c := range cases {
+		accepted, description := DescribeServerResponse(c.record)
+		if accepted != c.accepted || !strings.HasPrefix(description, c.exp) {
+			t.Error(
+				"For", fmt.Sprintf("%x", c.record),
+				"expected", c.accepted, c.exp,
+				"got", accepted, description,
+			)
+		}
+	}
+}
+
+func TestSessionTicketConcurrent(t *testing.T) {
+	// With a fake clock every ClientHello in the same TicketTimeHint has the same ticket,
+	// however many are made at once
+	sta := makeTestState("chrome")
+	exp := makeSessionTicket(sta)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hello := ComposeInitHandshake(sta)
+			if !bytes.Contains(hello, exp) {
+				t.Error(
+					"For", "concurrent ClientHellos",
+					"expected", fmt.Sprintf("%x", exp),
+					"got", fmt.Sprintf("%x", hello),
+				)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// makeTemplateState makes a State with Browser template, from a ClientHello of browser
+func makeTemplateState(browser string) (*gqclient.State, []byte) {
+	hello := ComposeInitHandshake(makeTestState(browser))
+	sta := makeTestState("template")
+	sta.Template, _ = MakeHelloTemplate(hello)
+	return sta, hello
+}
+
+// extensionOrder returns the extension types of hello in order, with GREASE as 0x0a0a
+func extensionOrder(hello []byte) []uint16 {
+	var ret []uint16
+	p := 9 + 2 + 32
+	p += 1 + int(hello[p])
+	p += 2 + gqclient.BtoInt(hello[p:p+2])
+	p += 1 + int(hello[p])
+	for p += 2; p < len(hello); {
+		typ := binary.BigEndian.Uint16(hello[p:])
+		if isGREASE(typ) {
+			typ = 0x0a0a
+		}
+		ret = append(ret, typ)
+		p += 4 + gqclient.BtoInt(hello[p+2:p+4])
+	}
+	return ret
+}
+
+func TestHelloTemplate(t *testing.T) {
+	for _, browser := range []string{"chrome", "chrome-120", "firefox"} {
+		sta, captured := makeTemplateState(browser)
+		if sta.Template == nil {
+			t.Error("For", browser, "expected", "a HelloTemplate", "got", nil)
+			continue
+		}
+		hello := ComposeInitHandshake(sta)
+		expJA3, _ := JA3(captured)
+		gotJA3, _ := JA3(hello)
+		if gotJA3 != expJA3 {
+			t.Error("For", browser, "expected", expJA3, "got", gotJA3)
+		}
+		exp, got := fmt.Sprint(extensionOrder(captured)), fmt.Sprint(extensionOrder(hello))
+		if got != exp {
+			t.Error("For", browser, "extension order", "expected", exp, "got", got)
+		}
+		if !bytes.Equal(hello[1:3], captured[1:3]) || !bytes.Equal(hello[9:11], captured[9:11]) {
+			t.Error("For", browser, "expected", "the captured versions", "got", hello[1:3], hello[9:11])
+		}
+		if !bytes.Contains(hello, makeServerName(sta)) || !bytes.Contains(hello, makeSessionTicket(sta)) {
+			t.Error("For", browser, "expected", "server_name and session_ticket made from the config", "got", fmt.Sprintf("%x", hello))
+		}
+	}
+
+	// Key shares are made afresh
+	sta, captured := makeTemplateState("chrome-120")
+	p := bytes.Index(captured, []byte{0x00, 0x1d, 0x00, 0x20})
+	if share := captured[p+4 : p+36]; bytes.Contains(ComposeInitHandshake(sta), share) {
+		t.Error("For", "key_share", "expected", "a new share", "got", fmt.Sprintf("%x", share))
+	}
+
+	// Sessions of the captured connection aren't carried over
+	resumed := makeTestState("chrome-120")
+	resumed.SimulateResumption = 100
+	tmpl, err := MakeHelloTemplate(ComposeInitHandshake(resumed))
+	if err != nil {
+		t.Error("For", "resumption", "expected", nil, "got", err)
+	} else {
+		for _, e := range tmpl.Extensions {
+			if e.Type == "pre_shared_key" || e.Type == "early_data" {
+				t.Error("For", "resumption", "expected", "no pre_shared_key or early_data", "got", e.Type)
+			}
+		}
+	}
+
+	noTicket := makeTestState("chrome")
+	noTicket.ExtensionSet = "custom"
+	noTicket.Extensions = []string{"server_name", "supported_groups"}
+	if _, err := MakeHelloTemplate(ComposeInitHandshake(noTicket)); err == nil {
+		t.Error("For", "no session_ticket", "expected", "an error", "got", nil)
+	}
+}
+
+// makePcap makes a little endian pcap of Ethernet frames carrying IPv4 TCP segments
+func makePcap(segments []tcpSegment) []byte {
+	ret, _ := hex.DecodeString("d4c3b2a1020004000000000000000000ffff000001000000")
+	for _, s := range segments {
+		tcp := append([]byte(s.flow[4:6]), s.flow[10:12]...)
+		seq := make([]byte, 4)
+		binary.BigEndian.PutUint32(seq, s.seq)
+		tcp = append(tcp, seq...)
+		tcp = append(tcp, 0, 0, 0, 0, 0x50, 0x18, 0xff, 0xff, 0, 0, 0, 0)
+		tcp = append(tcp, s.payload...)
+		ip := []byte{0x45, 0, 0, 0, 0, 0, 0x40, 0, 64, 6, 0, 0}
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		ip = append(ip, s.flow[0:4]...)
+		ip = append(ip, s.flow[6:10]...)
+		frame := append(make([]byte, 12), 0x08, 0x00)
+		frame = append(frame, ip...)
+		frame = append(frame, tcp...)
+		header := make([]byte, 16)
+		binary.LittleEndian.PutUint32(header[8:], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(header[12:], uint32(len(frame)))
+		ret = append(ret, header...)
+		ret = append(ret, frame...)
+	}
+	return ret
+}
+
+func TestExtractClientHello(t *testing.T) {
+	hello := ComposeInitHandshake(makeTestState("chrome-120"))
+	for _, capture := range []string{
+		fmt.Sprintf("%x", hello),
+		fmt.Sprintf("%x\n", hello[5:]),
+	} {
+		got, err := ExtractClientHello([]byte(capture))
+		if err != nil || !bytes.Equal(got, hello) {
+			t.Error("For", "hex", "expected", fmt.Sprintf("%x", hello), "got", fmt.Sprintf("%x", got), err)
+		}
+	}
+
+	// src ip, src port, dst ip, dst port
+	flow := string([]byte{10, 0, 0, 1, 0xc0, 0x00, 10, 0, 0, 2, 0x01, 0xbb})
+	other := string([]byte{10, 0, 0, 1, 0xc0, 0x01, 10, 0, 0, 2, 0x01, 0xbb})
+	half := len(hello) / 2
+	capture := makePcap([]tcpSegment{
+		{other, 1, []byte("GET / HTTP/1.1\r\n")},
+		{flow, 100, hello[:half]},
+		{other, 100 + uint32(half), []byte("not this one")},
+		// A retransmission
+		{flow, 100, hello[:half]},
+		{flow, 100 + uint32(half), hello[half:]},
+	})
+	got, err := ExtractClientHello(capture)
+	if err != nil || !bytes.Equal(got, hello) {
+		t.Error("For", "pcap", "expected", fmt.Sprintf("%x", hello), "got", fmt.Sprintf("%x", got), err)
+	}
+	_, err = ExtractClientHello(makePcap([]tcpSegment{{flow, 100, hello[:half]}}))
+	if err == nil {
+		t.Error("For", "incomplete pcap", "expected", "an error", "got", nil)
+	}
+	if _, err = ExtractClientHello([]byte("GET / HTTP/1.1")); err == nil {
+		t.Error("For", "not a capture", "expected", "an error", "got", nil)
+	}
+}
+
+func TestFirstRecordSizes(t *testing.T) {
+	for _, browser := range gqclient.Browsers {
+		sta := &gqclient.State{Browser: browser}
+		if len(FirstRecordSizes(sta)) == 0 {
+			t.Error("For", browser, "expected", "FirstRecordSizes", "got", "none")
+		}
+	}
+	sta := &gqclient.State{Browser: "template", Template: &gqclient.HelloTemplate{FirstRecordSizes: []int{100}}}
+	if fmt.Sprint(FirstRecordSizes(sta)) != "[100]" {
+		t.Error("For", "template", "expected", "[100]", "got", FirstRecordSizes(sta))
+	}
+}
+
+// echoServer answers like gq-server with key on l, echoing the data sent through
+func echoServer(l net.Listener, key string) {
+	sta := &gqserver.State{Key: key, Now: time.Now, UsedRandom: map[[32]byte]int{}}
+	sta.SetAESKey()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			buf := make([]byte, 20480)
+			i, err := gqserver.ReadTillDrain(conn, buf)
+			if err != nil {
+				return
+			}
+			ch, err := gqserver.ParseClientHello(buf[:i])
+			if err != nil || !gqserver.IsSS(ch, sta) {
+				return
+			}
+			reply := gqserver.ComposeReply(ch)
+			conn.Write(reply)
+			for c := 0; c < 2; c++ {
+				if i, err = gqserver.ReadTillDrain(conn, buf); err != nil {
+					return
+				}
+			}
+			if !gqserver.IsBound(ch, reply, gqserver.PeelRecordLayer(buf[:i]), sta) {
+				return
+			}
+			for {
+				if i, err = gqserver.ReadTillDrain(conn, buf); err != nil {
+					return
+				}
+				conn.Write(gqserver.AddRecordLayer(gqserver.PeelRecordLayer(buf[:i]), []byte{0x17}, []byte{0x03, 0x03}))
+			}
+		}()
+	}
+}
+
+func TestProbeServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go echoServer(l, "testkey")
+	addr := l.Addr().String()
+
+	cases := []struct {
+		name  string
+		sta   *gqclient.State
+		addr  string
+		stage string
+	}{
+		{"working server", NewProbeState("testkey", time.Now()), addr, ""},
+		{"wrong key", NewProbeState("otherkey", time.Now()), addr, "serverread"},
+		{"clock a day off", NewProbeState("testkey", time.Now().Add(24*time.Hour)), addr, "serverread"},
+		{"nothing listening", NewProbeState("testkey", time.Now()), "127.0.0.1:1", "dial"},
+	}
+	for _, c := range cases {
+		result := ProbeServer(c.sta, c.addr, time.Second)
+		if result.OK != (c.stage == "") || result.Stage != c.stage || (result.Err == nil) != result.OK {
+			t.Error("For", c.name, "expected", "failure at", c.stage, "got", result.OK, result.Stage, result.Err)
+		}
+	}
+
+	// Check on a connection of the caller's own
+	p := NewProbe(NewProbeState("testkey", time.Now()))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(ClientHelloFlight(p.ClientHello))
+	if result := p.Check(conn, time.Time{}); !result.OK || result.Elapsed <= 0 {
+		t.Error("For", "Check", "expected", "OK", "got", result.Stage, result.Err, result.Elapsed)
+	}
+}
+
+func TestAuthWindow(t *testing.T) {
+	// 1519319215 is 415 seconds into a window of 600
+	cases := []struct {
+		offset int
+		window int
+		exp    bool
+	}{
+		{0, 600, true},
+		{184, 600, true},
+		{185, 600, false},
+		{-416, 600, false},
+		{0, 0, false},
+	}
+	for _, c := range cases {
+		client := makeTestState("chrome")
+		client.AuthWindow = 600
+		ch, err := gqserver.ParseClientHello(ComposeInitHandshake(client))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sta := &gqserver.State{
+			Key:        "testkey",
+			Now:        func() time.Time { return time.Unix(int64(1519319215+c.offset), 0) },
+			UsedRandom: map[[32]byte]int{},
+			AuthWindow: c.window,
+		}
+		sta.SetAESKey()
+		if gqserver.IsSS(ch, sta) != c.exp {
+			t.Error(
+				"For", "our clock", c.offset, "seconds off with AuthWindow", c.window,
+				"expected", c.exp,
+				"got", !c.exp,
+			)
+		}
+	}
+}
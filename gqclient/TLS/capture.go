@@ -0,0 +1,155 @@
+package TLS
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// ExtractClientHello finds a ClientHello with its record layer in capture, which is
+// either a pcap file or hex. In a pcap it's the first one sent over TCP, put back
+// together if it spans several segments. Hex can be of the ClientHello with or
+// without its record layer, e.g. as copied from Wireshark
+func ExtractClientHello(capture []byte) ([]byte, error) {
+	if len(capture) >= 4 {
+		switch binary.BigEndian.Uint32(capture) {
+		case 0xa1b2c3d4, 0xd4c3b2a1, 0xa1b23c4d, 0x4d3cb2a1:
+			return clientHelloFromPcap(capture)
+		case 0x0a0d0d0a:
+			return nil, errors.New("pcapng isn't supported, save the capture as pcap")
+		}
+	}
+	text := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(" \t\r\n:", r) {
+			return -1
+		}
+		return r
+	}, string(capture))
+	hello, err := hex.DecodeString(text)
+	if err != nil {
+		return nil, errors.New("Neither pcap nor hex")
+	}
+	if len(hello) != 0 && hello[0] == 0x01 {
+		hello = AddRecordLayer(hello, []byte{0x16}, []byte{0x03, 0x01})
+	}
+	if len(hello) < 6 || hello[0] != 0x16 || hello[5] != 0x01 {
+		return nil, errors.New("Not a ClientHello")
+	}
+	return hello, nil
+}
+
+// tcpSegment is the part of a TCP packet in a capture needed to find a ClientHello
+type tcpSegment struct {
+	flow    string
+	seq     uint32
+	payload []byte
+}
+
+// clientHelloFromPcap finds the first ClientHello in a pcap file
+func clientHelloFromPcap(capture []byte) ([]byte, error) {
+	var order binary.ByteOrder = binary.LittleEndian
+	if capture[0] == 0xa1 {
+		order = binary.BigEndian
+	}
+	if len(capture) < 24 {
+		return nil, errors.New("Truncated pcap")
+	}
+	linkType := order.Uint32(capture[20:])
+	var hello []byte
+	var flow string
+	var next uint32
+	for p := 24; p+16 <= len(capture); {
+		length := int(order.Uint32(capture[p+8:]))
+		p += 16
+		if p+length > len(capture) {
+			break
+		}
+		seg, ok := parsePacket(linkType, capture[p:p+length], order)
+		p += length
+		if !ok || len(seg.payload) == 0 {
+			continue
+		}
+		if hello == nil {
+			if len(seg.payload) < 6 || seg.payload[0] != 0x16 || seg.payload[5] != 0x01 {
+				continue
+			}
+			hello, flow = append([]byte{}, seg.payload...), seg.flow
+		} else if seg.flow == flow && seg.seq == next {
+			hello = append(hello, seg.payload...)
+		} else {
+			// Another connection, or a retransmission
+			continue
+		}
+		next = seg.seq + uint32(len(seg.payload))
+		if recLen := 5 + int(binary.BigEndian.Uint16(hello[3:5])); len(hello) >= recLen {
+			return hello[:recLen], nil
+		}
+	}
+	if hello != nil {
+		return nil, errors.New("The ClientHello in the pcap is incomplete")
+	}
+	return nil, errors.New("No ClientHello in the pcap")
+}
+
+// parsePacket finds the TCP segment in packet, a frame of linkType in a pcap. order
+// is the byte order of the pcap, which the loopback link type is in
+func parsePacket(linkType uint32, packet []byte, order binary.ByteOrder) (seg tcpSegment, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			ok = false
+		}
+	}()
+	var ip []byte
+	var ethertype uint16
+	switch linkType {
+	case 1: // Ethernet
+		ethertype, ip = binary.BigEndian.Uint16(packet[12:]), packet[14:]
+		if ethertype == 0x8100 { // VLAN
+			ethertype, ip = binary.BigEndian.Uint16(packet[16:]), packet[18:]
+		}
+	case 113: // Linux cooked
+		ethertype, ip = binary.BigEndian.Uint16(packet[14:]), packet[16:]
+	case 276: // Linux cooked v2
+		ethertype, ip = binary.BigEndian.Uint16(packet[0:]), packet[20:]
+	case 0: // Loopback, with the address family in the byte order of the capture
+		ethertype, ip = 0x0800, packet[4:]
+		if order.Uint32(packet) != 2 {
+			ethertype = 0x86dd
+		}
+	case 101, 228, 229: // Raw IP
+		ethertype, ip = 0x0800, packet
+		if ip[0]>>4 == 6 {
+			ethertype = 0x86dd
+		}
+	default:
+		return seg, false
+	}
+
+	var tcp, src, dst []byte
+	switch ethertype {
+	case 0x0800:
+		if ip[9] != 6 {
+			return seg, false
+		}
+		// Frames can be padded after the IP packet
+		ip = ip[:binary.BigEndian.Uint16(ip[2:4])]
+		src, dst, tcp = ip[12:16], ip[16:20], ip[int(ip[0]&0x0f)*4:]
+	case 0x86dd:
+		// Extension headers aren't followed
+		if ip[6] != 6 {
+			return seg, false
+		}
+		ip = ip[:40+int(binary.BigEndian.Uint16(ip[4:6]))]
+		src, dst, tcp = ip[8:24], ip[24:40], ip[40:]
+	default:
+		return seg, false
+	}
+	flow := bytes.Join([][]byte{src, tcp[0:2], dst, tcp[2:4]}, nil)
+	return tcpSegment{
+		flow:    string(flow),
+		seq:     binary.BigEndian.Uint32(tcp[4:8]),
+		payload: tcp[int(tcp[12]>>4)*4:],
+	}, true
+}
@@ -5,73 +5,75 @@ package TLS
 import (
 	"encoding/hex"
 	"github.com/cbeuw/GoQuiet/gqclient"
-	"math/rand"
-	"time"
 )
 
 type chrome struct {
 	browser
 }
 
+var chromeVersions = helloVersions{hello: []byte{0x03, 0x03}, record: []byte{0x03, 0x01}}
+
+// The first records Chrome sends on an HTTP/2 connection: the connection preface,
+// SETTINGS with four settings and WINDOW_UPDATE, then about the HEADERS of a first
+// request, whose size depends on the request
+var chromeFirstRecords = []int{70, 250}
+
 func (c *chrome) composeExtensions(sta *gqclient.State) []byte {
 	// see https://tools.ietf.org/html/draft-davidben-tls-grease-01
 	// This is exclusive to chrome.
-	makeGREASE := func() []byte {
-		rand.Seed(time.Now().UnixNano())
-		sixteenth := rand.Intn(16)
-		monoGREASE := byte(sixteenth*16 + 0xA)
-		doubleGREASE := []byte{monoGREASE, monoGREASE}
-		return doubleGREASE
-	}
+	r := newPRNG(sta)
+	greaseFirst, greaseLast := makeGREASEPair(r)
+	greaseGroup, _ := makeGREASEPair(r)
 
 	makeSupportedGroups := func() []byte {
 		suppGroupListLen := []byte{0x00, 0x08}
-		suppGroup := append(makeGREASE(), []byte{0x00, 0x1d, 0x00, 0x17, 0x00, 0x18}...)
+		suppGroup := append(greaseGroup, []byte{0x00, 0x1d, 0x00, 0x17, 0x00, 0x18}...)
 		return append(suppGroupListLen, suppGroup...)
 	}
 
-	var ext [14][]byte
-	ext[0] = addExtRec(makeGREASE(), nil)                          // First GREASE
+	var ext [13][]byte
+	ext[0] = addExtRec(greaseFirst, nil)                           // First GREASE
 	ext[1] = addExtRec([]byte{0xff, 0x01}, []byte{0x00})           // renegotiation_info
 	ext[2] = addExtRec([]byte{0x00, 0x00}, makeServerName(sta))    // server name indication
 	ext[3] = addExtRec([]byte{0x00, 0x17}, nil)                    // extended_master_secret
 	ext[4] = addExtRec([]byte{0x00, 0x23}, makeSessionTicket(sta)) // Session tickets
-	sigAlgo, _ := hex.DecodeString("0012040308040401050308050501080606010201")
-	ext[5] = addExtRec([]byte{0x00, 0x0d}, sigAlgo)                              // Signature Algorithms
-	ext[6] = addExtRec([]byte{0x00, 0x05}, []byte{0x01, 0x00, 0x00, 0x00, 0x00}) // status request
-	ext[7] = addExtRec([]byte{0x00, 0x12}, nil)                                  // signed cert timestamp
+	sigAlgo := makeSigAlgos(sta, "0012040308040401050308050501080606010201")
+	ext[5] = addExtRec([]byte{0x00, 0x0d}, sigAlgo)             // Signature Algorithms
+	ext[6] = addExtRec([]byte{0x00, 0x05}, makeStatusRequest()) // status request
+	ext[7] = addExtRec([]byte{0x00, 0x12}, nil)                 // signed cert timestamp
 	APLN, _ := hex.DecodeString("000c02683208687474702f312e31")
-	ext[8] = addExtRec([]byte{0x00, 0x10}, APLN)                            // app layer proto negotiation
-	ext[9] = addExtRec([]byte{0x75, 0x50}, nil)                             // channel id
-	ext[10] = addExtRec([]byte{0x00, 0x0b}, []byte{0x01, 0x00})             // ec point formats
-	ext[11] = addExtRec([]byte{0x00, 0x0a}, makeSupportedGroups())          // supported groups
-	ext[12] = addExtRec(makeGREASE(), []byte{0x00})                         // Last GREASE
-	ext[13] = addExtRec([]byte{0x00, 0x15}, makeNullBytes(110-len(ext[2]))) // padding
+	ext[8] = addExtRec([]byte{0x00, 0x10}, APLN)                   // app layer proto negotiation
+	ext[9] = addExtRec([]byte{0x75, 0x50}, nil)                    // channel id
+	ext[10] = addExtRec([]byte{0x00, 0x0b}, []byte{0x01, 0x00})    // ec point formats
+	ext[11] = addExtRec([]byte{0x00, 0x0a}, makeSupportedGroups()) // supported groups
+	ext[12] = addExtRec(greaseLast, []byte{0x00})                  // Last GREASE
+	// padding is added by assembleClientHello
 	var ret []byte
-	for i := 0; i < 14; i++ {
+	for i := 0; i < 12; i++ {
 		ret = append(ret, ext[i]...)
 	}
-	return ret
+	// Chrome 64 doesn't send compress_certificate, record_size_limit or
+	// delegated_credentials, so they're only there if set in the config
+	if compCert := makeCompressCertificate(sta, nil); compCert != nil {
+		ret = append(ret, addExtRec([]byte{0x00, 0x1b}, compCert)...)
+	}
+	if limit := makeRecordSizeLimit(sta, false); limit != nil {
+		ret = append(ret, addExtRec([]byte{0x00, 0x1c}, limit)...)
+	}
+	if delegated := makeDelegatedCredentials(sta); delegated != nil {
+		ret = append(ret, addExtRec([]byte{0x00, 0x22}, delegated)...)
+	}
+	return append(ret, ext[12]...)
 }
 
 func (c *chrome) composeClientHello(sta *gqclient.State) []byte {
-	var clientHello [12][]byte
-	clientHello[0] = []byte{0x01}                                      // handshake type
-	clientHello[1] = []byte{0x00, 0x01, 0xfc}                          // length 508
-	clientHello[2] = []byte{0x03, 0x03}                                // client version
-	clientHello[3] = gqclient.MakeRandomField(sta)                     // random
-	clientHello[4] = []byte{0x20}                                      // session id length 32
-	clientHello[5] = gqclient.PsudoRandBytes(32, sta.Now().UnixNano()) // session id
-	clientHello[6] = []byte{0x00, 0x1c}                                // cipher suites length 28
 	cipherSuites, _ := hex.DecodeString("2a2ac02bc02fc02cc030cca9cca8c013c014009c009d002f0035000a")
-	clientHello[7] = cipherSuites              // cipher suites
-	clientHello[8] = []byte{0x01}              // compression methods length 1
-	clientHello[9] = []byte{0x00}              // compression methods
-	clientHello[10] = []byte{0x01, 0x97}       // extensions length 407
-	clientHello[11] = c.composeExtensions(sta) // extensions
-	var ret []byte
-	for i := 0; i < 12; i++ {
-		ret = append(ret, clientHello[i]...)
-	}
-	return ret
+	return assembleClientHello(
+		chromeVersions.hello,
+		gqclient.MakeRandomField(sta),
+		makeSessionId(sta, "random"),
+		cipherSuites,
+		addRawExtensions(sta, filterExtensions(sta, c.composeExtensions(sta))),
+		sta.KeepsExtension("padding"),
+	)
 }
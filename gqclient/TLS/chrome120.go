@@ -0,0 +1,147 @@
+// Chrome 120
+
+package TLS
+
+import (
+	"encoding/hex"
+	"math/rand"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+)
+
+type chrome120 struct {
+	browser
+}
+
+var chrome120Versions = helloVersions{hello: []byte{0x03, 0x03}, record: []byte{0x03, 0x01}}
+
+// Like chromeFirstRecords, with the longer headers of a newer Chrome, the client
+// hints among them
+var chrome120FirstRecords = []int{70, 400}
+
+// The sizes of the payload of the GREASE ECH Chrome 120 sends when it has no ECH
+// config for the site, one picked at random for each connection: a multiple of 32
+// from 128 to 224, as BoringSSL would pad the inner ClientHello, plus the AEAD tag
+var chrome120ECHPayloadLens = []int{144, 176, 208, 240}
+
+// makeGREASEECH makes a GREASE encrypted_client_hello: outer, HKDF-SHA256,
+// AES-128-GCM, a random config id and X25519 encapsulated key, and a random payload
+// of one of payloadLens. The server ignores it as it would an unknown extension
+func makeGREASEECH(sta *gqclient.State, r *rand.Rand, payloadLens []int) []byte {
+	ech := []byte{0x00, 0x00, 0x01, 0x00, 0x01}
+	ech = append(ech, sta.RandBytes(1)...)
+	ech = append(ech, 0x00, 0x20)
+	ech = append(ech, sta.RandBytes(32)...)
+	payloadLen := payloadLens[r.Intn(len(payloadLens))]
+	ech = append(ech, u16(payloadLen)...)
+	return append(ech, sta.RandBytes(payloadLen)...)
+}
+
+// makeGREASEPair makes two different GREASE values, for the first and the last
+// GREASE extension, which Chrome never makes the same
+func makeGREASEPair(r *rand.Rand) ([]byte, []byte) {
+	first := r.Intn(16)
+	last := (first + 1 + r.Intn(15)) % 16
+	grease := func(i int) []byte {
+		b := byte(i*16 + 0xA)
+		return []byte{b, b}
+	}
+	return grease(first), grease(last)
+}
+
+// makePreSharedKey makes a pre_shared_key extension with one identity the length
+// of a ticket and one SHA256 binder. They're random as the server never issues
+// tickets and ignores the extension, like any TLS 1.2 server would
+func makePreSharedKey(sta *gqclient.State, r *rand.Rand) []byte {
+	identity := sta.RandBytes(192 + 16*r.Intn(5))
+	identities := append(u16(len(identity)), identity...)
+	identities = append(identities, sta.RandBytes(4)...) // obfuscated ticket age
+	ret := append(u16(len(identities)), identities...)
+	ret = append(ret, 0x00, 0x21, 0x20)
+	return append(ret, sta.RandBytes(32)...)
+}
+
+// composeExtensions composes the extensions of Chrome 120. If resume is true, they
+// are those of resuming a TLS 1.3 session and offering early data
+func (c *chrome120) composeExtensions(sta *gqclient.State, resume bool) []byte {
+	r := newPRNG(sta)
+	greaseFirst, greaseLast := makeGREASEPair(r)
+	greaseGroup, _ := makeGREASEPair(r)
+
+	suppGroups := append([]byte{0x00, 0x08}, greaseGroup...)
+	suppGroups = append(suppGroups, 0x00, 0x1d, 0x00, 0x17, 0x00, 0x18)
+
+	// A GREASE share of 1 byte and an X25519 share
+	keyShare := append([]byte{0x00, 0x29}, greaseGroup...)
+	keyShare = append(keyShare, 0x00, 0x01, 0x00)
+	keyShare = append(keyShare, 0x00, 0x1d, 0x00, 0x20)
+	keyShare = append(keyShare, sta.RandBytes(32)...)
+
+	suppVersions := append([]byte{0x06}, greaseFirst...)
+	suppVersions = append(suppVersions, 0x03, 0x04, 0x03, 0x03)
+
+	APLN := makeALPN(chromeALPN)
+	ext := [][]byte{
+		addExtRec([]byte{0x00, 0x00}, makeServerName(sta)),                                       // server name indication
+		addExtRec([]byte{0x00, 0x17}, nil),                                                       // extended_master_secret
+		addExtRec([]byte{0xff, 0x01}, []byte{0x00}),                                              // renegotiation_info
+		addExtRec([]byte{0x00, 0x0a}, suppGroups),                                                // supported groups
+		addExtRec([]byte{0x00, 0x0b}, []byte{0x01, 0x00}),                                        // ec point formats
+		addExtRec([]byte{0x00, 0x23}, makeSessionTicket(sta)),                                    // Session tickets
+		addExtRec([]byte{0x00, 0x10}, APLN),                                                      // app layer proto negotiation
+		addExtRec([]byte{0x00, 0x05}, makeStatusRequest()),                                       // status request
+		addExtRec([]byte{0x00, 0x0d}, makeSigAlgos(sta, "001004030804040105030805050108060601")), // Signature Algorithms
+		addExtRec([]byte{0x00, 0x12}, nil),                                                       // signed cert timestamp
+		addExtRec([]byte{0x00, 0x33}, keyShare),                                                  // key share
+		addExtRec([]byte{0x00, 0x2d}, []byte{0x01, 0x01}),                                        // psk key exchange modes
+		addExtRec([]byte{0x00, 0x2b}, suppVersions),                                              // supported versions
+		addExtRec([]byte{0x00, 0x1b}, makeCompressCertificate(sta, []string{"brotli"})),          // compress certificate
+		addExtRec([]byte{0x44, 0x69}, makeApplicationSettings(chromeALPN)),                       // application settings
+		addExtRec([]byte{0xfe, 0x0d}, makeGREASEECH(sta, r, chrome120ECHPayloadLens)),            // encrypted client hello
+	}
+	if resume {
+		ext = append(ext, addExtRec([]byte{0x00, 0x2a}, nil)) // early data
+	}
+	// Chrome doesn't send these, so they're only there if set in the config
+	if limit := makeRecordSizeLimit(sta, true); limit != nil {
+		ext = append(ext, addExtRec([]byte{0x00, 0x1c}, limit)) // record size limit
+	}
+	if delegated := makeDelegatedCredentials(sta); delegated != nil {
+		ext = append(ext, addExtRec([]byte{0x00, 0x22}, delegated)) // delegated credentials
+	}
+	// Since Chrome 110 the order of the extensions between the GREASE ones is random
+	for i := len(ext) - 1; i > 0; i-- {
+		j := r.Intn(i + 1)
+		ext[i], ext[j] = ext[j], ext[i]
+	}
+
+	ret := addExtRec(greaseFirst, nil) // First GREASE
+	for _, e := range ext {
+		ret = append(ret, e...)
+	}
+	ret = append(ret, addExtRec(greaseLast, []byte{0x00})...) // Last GREASE
+	if resume {
+		// pre_shared_key must be the last extension
+		ret = append(ret, addExtRec([]byte{0x00, 0x29}, makePreSharedKey(sta, r))...)
+	}
+	// padding is added by assembleClientHello
+	return ret
+}
+
+func (c *chrome120) composeClientHello(sta *gqclient.State) []byte {
+	r := newPRNG(sta)
+	greaseCipher, _ := makeGREASEPair(r)
+	// A share of the connections resume a session, as a browser does with the
+	// sites it has visited before
+	resume := sta.SimulateResumption > 0 && r.Intn(100) < sta.SimulateResumption
+	cipherSuites, _ := hex.DecodeString("130113021303c02bc02fc02cc030cca9cca8c013c014009c009d002f0035")
+	return assembleClientHello(
+		chrome120Versions.hello,
+		gqclient.MakeRandomField(sta),
+		makeSessionId(sta, "random"),
+		append(greaseCipher, cipherSuites...),
+		addRawExtensions(sta, filterExtensions(sta, c.composeExtensions(sta, resume))),
+		// Padding would come after pre_shared_key
+		!resume && sta.KeepsExtension("padding"),
+	)
+}
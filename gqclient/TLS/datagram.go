@@ -0,0 +1,62 @@
+// Framing the datagrams of a UDP session from SS for the stream to gq-server
+
+package TLS
+
+import (
+	"encoding/binary"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+)
+
+// MaxDatagramSize is the largest datagram that can be framed, the most its 2 byte
+// length can say
+const MaxDatagramSize = 65535
+
+// The most data in each of the records a datagram is put in, the most a TLS
+// record can carry
+const maxDatagramRecord = 16384
+
+// DatagramRecords frames datagram for a connection carrying a UDP session: its
+// length in 2 bytes then the datagram, in as many application data records as
+// that needs. The length is what tells the datagrams apart, however the records
+// are cut or coalesced on the way
+func DatagramRecords(datagram []byte) []byte {
+	framed := make([]byte, 2, 2+len(datagram))
+	binary.BigEndian.PutUint16(framed, uint16(len(datagram)))
+	framed = append(framed, datagram...)
+	var ret []byte
+	for len(framed) > 0 {
+		n := len(framed)
+		if n > maxDatagramRecord {
+			n = maxDatagramRecord
+		}
+		ret = append(ret, AddRecordLayer(framed[:n], []byte{0x17}, []byte{0x03, 0x03})...)
+		framed = framed[n:]
+	}
+	return ret
+}
+
+// DatagramReader takes the datagrams framed by DatagramRecords back out of the
+// data of the records they came in
+type DatagramReader struct {
+	buf []byte
+}
+
+// Feed adds the data of a record, with its record layer peeled
+func (r *DatagramReader) Feed(data []byte) {
+	r.buf = append(r.buf, data...)
+}
+
+// Next returns the next whole datagram fed, or false if it hasn't all come yet
+func (r *DatagramReader) Next() ([]byte, bool) {
+	if len(r.buf) < 2 {
+		return nil, false
+	}
+	n := gqclient.BtoInt(r.buf[:2])
+	if len(r.buf) < 2+n {
+		return nil, false
+	}
+	datagram := append([]byte{}, r.buf[2:2+n]...)
+	r.buf = r.buf[2+n:]
+	return datagram, true
+}
@@ -0,0 +1,298 @@
+package TLS
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+)
+
+// helloFields are the fields of a ClientHello that fingerprints are made of
+type helloFields struct {
+	version           uint16
+	cipherSuites      []uint16
+	extensions        []uint16
+	groups            []uint16
+	pointFormats      []uint16
+	sigAlgos          []uint16
+	supportedVersions []uint16
+	sni               bool
+	alpn              string
+}
+
+// see https://tools.ietf.org/html/draft-davidben-tls-grease-01
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// u16List reads a list of uint16 that starts with a length field of lenSize bytes
+func u16List(data []byte, lenSize int) []uint16 {
+	length := gqclient.BtoInt(data[:lenSize])
+	data = data[lenSize : lenSize+length]
+	var ret []uint16
+	for i := 0; i+1 < len(data); i += 2 {
+		ret = append(ret, binary.BigEndian.Uint16(data[i:]))
+	}
+	return ret
+}
+
+// parseHelloFields parses a ClientHello with its record layer
+func parseHelloFields(hello []byte) (ret *helloFields, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New("Malformed ClientHello")
+		}
+	}()
+	if hello[5] != 0x01 {
+		return nil, errors.New("Not a ClientHello")
+	}
+	// record layer 5, handshake type 1, length 3
+	data := hello[9:]
+	ret = &helloFields{version: binary.BigEndian.Uint16(data)}
+	p := 2 + 32
+	p += 1 + int(data[p]) // session id
+	for _, c := range u16List(data[p:], 2) {
+		if !isGREASE(c) {
+			ret.cipherSuites = append(ret.cipherSuites, c)
+		}
+	}
+	p += 2 + gqclient.BtoInt(data[p:p+2])
+	p += 1 + int(data[p]) // compression methods
+	extEnd := p + 2 + gqclient.BtoInt(data[p:p+2])
+	p += 2
+	for p < extEnd {
+		typ := binary.BigEndian.Uint16(data[p:])
+		length := gqclient.BtoInt(data[p+2 : p+4])
+		ext := data[p+4 : p+4+length]
+		p += 4 + length
+		if isGREASE(typ) {
+			continue
+		}
+		ret.extensions = append(ret.extensions, typ)
+		switch typ {
+		case 0x0000:
+			ret.sni = true
+		case 0x000a:
+			for _, g := range u16List(ext, 2) {
+				if !isGREASE(g) {
+					ret.groups = append(ret.groups, g)
+				}
+			}
+		case 0x000b:
+			for _, f := range ext[1 : 1+int(ext[0])] {
+				ret.pointFormats = append(ret.pointFormats, uint16(f))
+			}
+		case 0x000d:
+			ret.sigAlgos = u16List(ext, 2)
+		case 0x0010:
+			// protocol name list length 2, name length 1
+			ret.alpn = string(ext[3 : 3+int(ext[2])])
+		case 0x002b:
+			vers := ext[1 : 1+int(ext[0])]
+			for i := 0; i+1 < len(vers); i += 2 {
+				v := binary.BigEndian.Uint16(vers[i:])
+				if !isGREASE(v) {
+					ret.supportedVersions = append(ret.supportedVersions, v)
+				}
+			}
+		}
+	}
+	return ret, nil
+}
+
+func joinDecimal(list []uint16) string {
+	s := make([]string, len(list))
+	for i, v := range list {
+		s[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(s, "-")
+}
+
+func joinHex(list []uint16) string {
+	s := make([]string, len(list))
+	for i, v := range list {
+		s[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *helloFields) ja3() string {
+	return strings.Join([]string{
+		strconv.Itoa(int(f.version)),
+		joinDecimal(f.cipherSuites),
+		joinDecimal(f.extensions),
+		joinDecimal(f.groups),
+		joinDecimal(f.pointFormats),
+	}, ",")
+}
+
+// ja4Raw returns the three parts of JA4 before the last two are hashed
+func (f *helloFields) ja4Raw() (a, b, c string) {
+	version := f.version
+	for _, v := range f.supportedVersions {
+		if v > version {
+			version = v
+		}
+	}
+	ver := map[uint16]string{0x0304: "13", 0x0303: "12", 0x0302: "11", 0x0301: "10"}[version]
+	if ver == "" {
+		ver = "00"
+	}
+	sni := "i"
+	if f.sni {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(f.alpn) > 0 {
+		alpn = f.alpn[:1] + f.alpn[len(f.alpn)-1:]
+	}
+	count := func(n int) string {
+		if n > 99 {
+			n = 99
+		}
+		return fmt.Sprintf("%02d", n)
+	}
+	a = "t" + ver + sni + count(len(f.cipherSuites)) + count(len(f.extensions)) + alpn
+
+	ciphers := append([]uint16{}, f.cipherSuites...)
+	sort.Slice(ciphers, func(i, j int) bool { return ciphers[i] < ciphers[j] })
+	b = joinHex(ciphers)
+
+	var exts []uint16
+	for _, e := range f.extensions {
+		// SNI and ALPN are already in a
+		if e != 0x0000 && e != 0x0010 {
+			exts = append(exts, e)
+		}
+	}
+	sort.Slice(exts, func(i, j int) bool { return exts[i] < exts[j] })
+	c = joinHex(exts)
+	if len(f.sigAlgos) != 0 {
+		c += "_" + joinHex(f.sigAlgos)
+	}
+	return
+}
+
+func (f *helloFields) ja4() string {
+	hash := func(s string) string {
+		if s == "" {
+			return "000000000000"
+		}
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])[:12]
+	}
+	a, b, c := f.ja4Raw()
+	return a + "_" + hash(b) + "_" + hash(c)
+}
+
+// JA3 returns the JA3 string of a ClientHello with its record layer. GREASE values are left out
+func JA3(hello []byte) (string, error) {
+	f, err := parseHelloFields(hello)
+	if err != nil {
+		return "", err
+	}
+	return f.ja3(), nil
+}
+
+// JA4 returns the JA4 fingerprint of a ClientHello with its record layer
+func JA4(hello []byte) (string, error) {
+	f, err := parseHelloFields(hello)
+	if err != nil {
+		return "", err
+	}
+	return f.ja4(), nil
+}
+
+// VerifyFingerprint checks that the ClientHello hello has the fingerprint expected,
+// which can be a JA3 string, the MD5 hash of it or a JA4 fingerprint. If it doesn't
+// match, the returned error describes how they differ
+func VerifyFingerprint(hello []byte, expected string) error {
+	f, err := parseHelloFields(hello)
+	if err != nil {
+		return err
+	}
+	ja3 := f.ja3()
+	ja3Sum := md5.Sum([]byte(ja3))
+	ja3Hash := hex.EncodeToString(ja3Sum[:])
+	switch {
+	case strings.Contains(expected, ","):
+		if expected == ja3 {
+			return nil
+		}
+		return errors.New("JA3 mismatch:\n" + diffJA3(expected, ja3))
+	case len(expected) == md5.Size*2:
+		if strings.ToLower(expected) == ja3Hash {
+			return nil
+		}
+		return fmt.Errorf("JA3 hash mismatch: expected %v, got %v (%v)", expected, ja3Hash, ja3)
+	default:
+		ja4 := f.ja4()
+		if expected == ja4 {
+			return nil
+		}
+		a, b, c := f.ja4Raw()
+		return fmt.Errorf("JA4 mismatch: expected %v, got %v (%v_%v_%v)", expected, ja4, a, b, c)
+	}
+}
+
+// diffJA3 describes the differences between two JA3 strings field by field
+func diffJA3(expected, got string) string {
+	names := []string{"SSLVersion", "Ciphers", "Extensions", "EllipticCurves", "EllipticCurvePointFormats"}
+	exp := strings.Split(expected, ",")
+	act := strings.Split(got, ",")
+	var ret []string
+	for i, name := range names {
+		var e, a string
+		if i < len(exp) {
+			e = exp[i]
+		}
+		if i < len(act) {
+			a = act[i]
+		}
+		if e == a {
+			continue
+		}
+		line := fmt.Sprintf("%v: expected %v, got %v", name, e, a)
+		if i != 0 {
+			missing, extra := diffLists(strings.Split(e, "-"), strings.Split(a, "-"))
+			switch {
+			case len(missing) == 0 && len(extra) == 0:
+				line += " (same values, different order)"
+			default:
+				line += fmt.Sprintf(" (missing %v, extra %v)", missing, extra)
+			}
+		}
+		ret = append(ret, line)
+	}
+	return strings.Join(ret, "\n")
+}
+
+// diffLists returns the values in exp that aren't in got and the other way round
+func diffLists(exp, got []string) (missing, extra []string) {
+	in := func(v string, list []string) bool {
+		for _, w := range list {
+			if v == w {
+				return true
+			}
+		}
+		return false
+	}
+	for _, v := range exp {
+		if v != "" && !in(v, got) {
+			missing = append(missing, v)
+		}
+	}
+	for _, v := range got {
+		if v != "" && !in(v, exp) {
+			extra = append(extra, v)
+		}
+	}
+	return
+}
@@ -0,0 +1,67 @@
+package TLS
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+)
+
+// The most data gq-client and gq-server put in one record
+const maxFuzzRecord = 16384
+
+func FuzzRecordLayer(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte("data"))
+	f.Add(make([]byte, maxFuzzRecord))
+	f.Add(make([]byte, maxFuzzRecord+1))
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		var stream []byte
+		for rest := payload; ; {
+			n := len(rest)
+			if n > maxFuzzRecord {
+				n = maxFuzzRecord
+			}
+			stream = append(stream, AddRecordLayer(rest[:n], []byte{0x17}, []byte{0x03, 0x03})...)
+			rest = rest[n:]
+			if len(rest) == 0 {
+				break
+			}
+		}
+
+		var got []byte
+		for len(stream) != 0 {
+			if len(stream) < 5 {
+				t.Fatal("For", len(payload), "bytes", "expected", "whole records", "got", len(stream), "bytes left")
+			}
+			record := stream[:5+gqclient.BtoInt(stream[3:5])]
+			if err := ValidateRecord(record); err != nil {
+				t.Fatal("For", len(payload), "bytes", "expected", "valid records", "got", err)
+			}
+			got = append(got, PeelRecordLayer(record)...)
+			stream = stream[len(record):]
+		}
+		if !bytes.Equal(got, payload) {
+			t.Error("For", len(payload), "bytes", "expected", "the same back", "got", len(got), "bytes")
+		}
+	})
+}
+
+func FuzzPeelRecordLayer(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0x17, 0x03, 0x03})
+	f.Add([]byte{0x17, 0x03, 0x03, 0x00, 0x00})
+	f.Add([]byte{0x17, 0x03, 0x03, 0xff, 0xff, 0x00})
+	f.Add([]byte{0x16, 0x03, 0x01, 0x00, 0x01, 0x00})
+	f.Fuzz(func(t *testing.T, record []byte) {
+		data := PeelRecordLayer(record)
+		err := ValidateRecord(record)
+		if err == nil && len(data) != gqclient.BtoInt(record[3:5]) {
+			t.Error("For", record, "expected", "the declared length", "got", len(data))
+		}
+		if len(record) < 5 && (err == nil || data != nil) {
+			t.Error("For", record, "expected", "an error and nothing peeled", "got", err, data)
+		}
+		LooksLikeRecord(record)
+	})
+}
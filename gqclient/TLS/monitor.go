@@ -0,0 +1,139 @@
+// Checking that a server works, for monitoring it from outside gq-client
+
+package TLS
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/cbeuw/GoQuiet/deflate"
+	"github.com/cbeuw/GoQuiet/gqclient"
+)
+
+// The bytes a Probe sends through the server
+const probeSize = 64
+
+// NewProbeState makes a State for a Probe of a server with key as of now, e.g. for
+// a blackbox exporter without a gq-client config. Its other fields can be set before
+// NewProbe, e.g. Browser and ServerName to be like the server's clients
+func NewProbeState(key string, now time.Time) *gqclient.State {
+	sta := &gqclient.State{
+		Now:            func() time.Time { return now },
+		Opaque:         gqclient.BtoInt(gqclient.CryptoRandBytes(32)),
+		Key:            key,
+		TicketTimeHint: 3600,
+		ServerName:     "www.bing.com",
+		Browser:        "chrome",
+	}
+	sta.SetAESKey()
+	return sta
+}
+
+// Probe is a check that a server works: a ClientHello to send to it, and Check
+// for the rest of the connection. Each Probe is for one connection, as the server
+// turns down a ClientHello it has seen before
+type Probe struct {
+	ClientHello []byte
+	sta         *gqclient.State
+	payload     []byte
+}
+
+// ProbeResult is the outcome of a Probe
+type ProbeResult struct {
+	OK bool
+	// The stage that failed, as gq-client logs them: dial, clienthello, serverread,
+	// reply, firstdata or echo
+	Stage string
+	Err   error
+	// From the ClientHello being sent, or Check being called, to the echo
+	Elapsed time.Duration
+}
+
+// NewProbe makes a Probe with sta. Ping is set on a copy of it, so that the server
+// echoes what's sent through rather than relaying it to ss-server
+func NewProbe(sta *gqclient.State) *Probe {
+	ping := *sta
+	ping.Ping = true
+	return &Probe{
+		ClientHello: ComposeInitHandshake(&ping),
+		sta:         &ping,
+		payload:     gqclient.CryptoRandBytes(probeSize),
+	}
+}
+
+// Check reads the server's answer to p.ClientHello on conn, which the caller has
+// sent as ClientHelloFlight(p.ClientHello), then finishes the handshake and checks
+// that data sent through comes back. The server's handshake has to be in by
+// deadline unless it's zero
+func (p *Probe) Check(conn net.Conn, deadline time.Time) ProbeResult {
+	start := time.Now()
+	serverHello, err := ReadServerHandshake(p.sta, conn, p.ClientHello, deadline)
+	if err != nil {
+		return ProbeResult{Stage: "serverread", Err: err, Elapsed: time.Since(start)}
+	}
+	reply, err := ComposeReply(p.sta, p.ClientHello, serverHello)
+	if err != nil {
+		return ProbeResult{Stage: "reply", Err: fmt.Errorf("Composing reply: %v", err), Elapsed: time.Since(start)}
+	}
+	stage, err := CheckEcho(p.sta, conn, reply, p.payload)
+	return ProbeResult{OK: err == nil, Stage: stage, Err: err, Elapsed: time.Since(start)}
+}
+
+// ProbeServer dials the server at addr and checks it with a new Probe made with
+// sta, giving up after timeout
+func ProbeServer(sta *gqclient.State, addr string, timeout time.Duration) ProbeResult {
+	start := time.Now()
+	p := NewProbe(sta)
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return ProbeResult{Stage: "dial", Err: err, Elapsed: time.Since(start)}
+	}
+	defer conn.Close()
+	conn.SetDeadline(start.Add(timeout))
+	if err = gqclient.WriteAll(conn, ClientHelloFlight(p.ClientHello)); err != nil {
+		return ProbeResult{Stage: "clienthello", Err: err, Elapsed: time.Since(start)}
+	}
+	result := p.Check(conn, start.Add(timeout))
+	result.Elapsed = time.Since(start)
+	return result
+}
+
+// CheckEcho finishes a handshake made with sta, which has Ping set, on conn by
+// sending reply, made by ComposeReply, then sends payload and checks that it's
+// echoed back. If it fails, the stage it failed at is returned with the error
+func CheckEcho(sta *gqclient.State, conn net.Conn, reply []byte, payload []byte) (stage string, err error) {
+	err = gqclient.WriteAll(conn, reply)
+	if err != nil {
+		return "reply", fmt.Errorf("Sending reply: %v", err)
+	}
+
+	data := payload
+	if sta.Compress {
+		data = deflate.Compress(data)
+	}
+	err = gqclient.WriteAll(conn, AddRecordLayer(data, []byte{0x17}, []byte{0x03, 0x03}))
+	if err != nil {
+		return "firstdata", fmt.Errorf("Sending data: %v", err)
+	}
+
+	buf := make([]byte, 20480)
+	i, err := gqclient.ReadTillDrain(conn, buf)
+	if err != nil {
+		// gq-server closes connections whose Finished isn't right without a word
+		return "echo", fmt.Errorf("Reading the echo, the server may not know the Key: %v", err)
+	}
+	echo := PeelRecordLayer(buf[:i])
+	if sta.Compress {
+		echo, err = deflate.Decompress(echo)
+		if err != nil {
+			return "echo", fmt.Errorf("Decompressing the echo: %v", err)
+		}
+	}
+	if !bytes.Equal(echo, payload) {
+		return "echo", errors.New("The echo doesn't match the data sent")
+	}
+	return "", nil
+}
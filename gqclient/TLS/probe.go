@@ -0,0 +1,86 @@
+package TLS
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+)
+
+// The random of a ServerHello that is really a HelloRetryRequest, see
+// https://tools.ietf.org/html/rfc8446#section-4.1.3
+var helloRetryRandom, _ = hex.DecodeString("cf21ad74e59a6111be1d8c021e65b891c2a211167abb8c5e079e09e2c8a8339c")
+
+var alertNames = map[byte]string{
+	0:   "close_notify",
+	10:  "unexpected_message",
+	20:  "bad_record_mac",
+	22:  "record_overflow",
+	40:  "handshake_failure",
+	42:  "bad_certificate",
+	47:  "illegal_parameter",
+	50:  "decode_error",
+	51:  "decrypt_error",
+	70:  "protocol_version",
+	71:  "insufficient_security",
+	80:  "internal_error",
+	86:  "inappropriate_fallback",
+	109: "missing_extension",
+	110: "unsupported_extension",
+	112: "unrecognized_name",
+	120: "no_application_protocol",
+}
+
+// DescribeServerResponse tells whether record, the first record a TLS server
+// answered a ClientHello with, accepts the ClientHello, and describes it: the
+// version and cipher suite picked from a ServerHello, or the alert
+func DescribeServerResponse(record []byte) (accepted bool, description string) {
+	defer func() {
+		if r := recover(); r != nil {
+			accepted, description = false, "Malformed ServerHello"
+		}
+	}()
+	if len(record) < 7 {
+		return false, fmt.Sprintf("Response too short: %x", record)
+	}
+	switch {
+	case record[0] == 0x15:
+		name, ok := alertNames[record[6]]
+		if !ok {
+			name = fmt.Sprintf("alert %v", record[6])
+		}
+		return false, "Alert: " + name
+	case record[0] != 0x16 || record[5] != 0x02:
+		return false, fmt.Sprintf("Not a ServerHello: record type %#x, message type %#x", record[0], record[5])
+	}
+	// record layer 5, handshake type 1, length 3
+	data := record[9:]
+	version := binary.BigEndian.Uint16(data)
+	random := data[2:34]
+	p := 34
+	p += 1 + int(data[p]) // session id
+	cipher := binary.BigEndian.Uint16(data[p:])
+	p += 2 + 1 // cipher suite, compression method
+	if p+2 <= len(data) {
+		extEnd := p + 2 + gqclient.BtoInt(data[p:p+2])
+		for p += 2; p < extEnd; {
+			typ := binary.BigEndian.Uint16(data[p:])
+			length := gqclient.BtoInt(data[p+2 : p+4])
+			if typ == 0x002b && length == 2 {
+				version = binary.BigEndian.Uint16(data[p+4:])
+			}
+			p += 4 + length
+		}
+	}
+	versionName := map[uint16]string{0x0304: "TLS 1.3", 0x0303: "TLS 1.2", 0x0302: "TLS 1.1", 0x0301: "TLS 1.0"}[version]
+	if versionName == "" {
+		versionName = fmt.Sprintf("version %#04x", version)
+	}
+	kind := "ServerHello"
+	if bytes.Equal(random, helloRetryRandom) {
+		kind = "HelloRetryRequest"
+	}
+	return true, fmt.Sprintf("%v: %v, cipher suite %#04x", kind, versionName, cipher)
+}
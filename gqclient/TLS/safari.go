@@ -0,0 +1,86 @@
+// Safari 17
+
+package TLS
+
+import (
+	"encoding/hex"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+)
+
+type safari struct {
+	browser
+}
+
+var safariVersions = helloVersions{hello: []byte{0x03, 0x03}, record: []byte{0x03, 0x01}}
+
+// The first records Safari sends on an HTTP/2 connection: the connection preface,
+// SETTINGS with four settings and WINDOW_UPDATE, then about the HEADERS of a first
+// request
+var safariFirstRecords = []int{70, 300}
+
+func (s *safari) composeExtensions(sta *gqclient.State) []byte {
+	r := newPRNG(sta)
+	greaseFirst, greaseLast := makeGREASEPair(r)
+	greaseGroup, _ := makeGREASEPair(r)
+
+	suppGroups := append([]byte{0x00, 0x0a}, greaseGroup...)
+	suppGroups = append(suppGroups, 0x00, 0x1d, 0x00, 0x17, 0x00, 0x18, 0x00, 0x19)
+
+	// A GREASE share of 1 byte and an X25519 share
+	keyShare := append([]byte{0x00, 0x29}, greaseGroup...)
+	keyShare = append(keyShare, 0x00, 0x01, 0x00)
+	keyShare = append(keyShare, 0x00, 0x1d, 0x00, 0x20)
+	keyShare = append(keyShare, sta.RandBytes(32)...)
+
+	// Safari still offers TLS 1.1 and 1.0
+	suppVersions := append([]byte{0x0a}, greaseFirst...)
+	suppVersions = append(suppVersions, 0x03, 0x04, 0x03, 0x03, 0x03, 0x02, 0x03, 0x01)
+
+	// Unlike Chrome, Safari sends no session_ticket, resuming with TLS 1.3 PSKs only,
+	// and keeps its extensions in the same order
+	ext := [][]byte{
+		addExtRec(greaseFirst, nil),                                                                          // First GREASE
+		addExtRec([]byte{0x00, 0x00}, makeServerName(sta)),                                                   // server name indication
+		addExtRec([]byte{0x00, 0x17}, nil),                                                                   // extended_master_secret
+		addExtRec([]byte{0xff, 0x01}, []byte{0x00}),                                                          // renegotiation_info
+		addExtRec([]byte{0x00, 0x0a}, suppGroups),                                                            // supported groups
+		addExtRec([]byte{0x00, 0x0b}, []byte{0x01, 0x00}),                                                    // ec point formats
+		addExtRec([]byte{0x00, 0x10}, makeALPN(chromeALPN)),                                                  // app layer proto negotiation
+		addExtRec([]byte{0x00, 0x05}, makeStatusRequest()),                                                   // status request
+		addExtRec([]byte{0x00, 0x0d}, makeSigAlgos(sta, "001604030804040105030203080508050501080606010201")), // Signature Algorithms
+		addExtRec([]byte{0x00, 0x12}, nil),                                                                   // signed cert timestamp
+		addExtRec([]byte{0x00, 0x33}, keyShare),                                                              // key share
+		addExtRec([]byte{0x00, 0x2d}, []byte{0x01, 0x01}),                                                    // psk key exchange modes
+		addExtRec([]byte{0x00, 0x2b}, suppVersions),                                                          // supported versions
+		addExtRec([]byte{0x00, 0x1b}, makeCompressCertificate(sta, []string{"zlib"})),                        // compress certificate
+	}
+	// Safari doesn't send these, so they're only there if set in the config
+	if limit := makeRecordSizeLimit(sta, true); limit != nil {
+		ext = append(ext, addExtRec([]byte{0x00, 0x1c}, limit)) // record size limit
+	}
+	if delegated := makeDelegatedCredentials(sta); delegated != nil {
+		ext = append(ext, addExtRec([]byte{0x00, 0x22}, delegated)) // delegated credentials
+	}
+	var ret []byte
+	for _, e := range ext {
+		ret = append(ret, e...)
+	}
+	ret = append(ret, addExtRec(greaseLast, []byte{0x00})...) // Last GREASE
+	// padding is added by assembleClientHello
+	return ret
+}
+
+func (s *safari) composeClientHello(sta *gqclient.State) []byte {
+	r := newPRNG(sta)
+	greaseCipher, _ := makeGREASEPair(r)
+	cipherSuites, _ := hex.DecodeString("130113021303c02cc02bcca9c030c02fcca8c00ac009c014c013009d009c0035002fc008c012000a")
+	return assembleClientHello(
+		safariVersions.hello,
+		gqclient.MakeRandomField(sta),
+		makeSessionId(sta, "random"),
+		append(greaseCipher, cipherSuites...),
+		addRawExtensions(sta, filterExtensions(sta, s.composeExtensions(sta))),
+		sta.KeepsExtension("padding"),
+	)
+}
@@ -0,0 +1,203 @@
+// A ClientHello cloned from one captured from a browser
+
+package TLS
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+
+	"github.com/cbeuw/GoQuiet/gqclient"
+)
+
+type fromTemplate struct {
+	browser
+}
+
+func templateVersions(t *gqclient.HelloTemplate) helloVersions {
+	hello, _ := hex.DecodeString(t.Version)
+	record, _ := hex.DecodeString(t.RecordVersion)
+	return helloVersions{hello: hello, record: record}
+}
+
+// regrease replaces the GREASE values in list, 2 byte values after a length of
+// lenSize bytes, with grease
+func regrease(list []byte, lenSize int, grease []byte) []byte {
+	ret := append([]byte{}, list...)
+	for i := lenSize; i+1 < len(ret); i += 2 {
+		if isGREASE(binary.BigEndian.Uint16(ret[i:])) {
+			copy(ret[i:], grease)
+		}
+	}
+	return ret
+}
+
+// refreshKeyShare makes new shares of the same groups and lengths as the ones in
+// keyShare. The GREASE ones are kept as they are, apart from their group
+func refreshKeyShare(sta *gqclient.State, keyShare []byte, grease []byte) []byte {
+	ret := append([]byte{}, keyShare...)
+	for p := 2; p+4 <= len(ret); {
+		length := gqclient.BtoInt(ret[p+2 : p+4])
+		if p+4+length > len(ret) {
+			break
+		}
+		if isGREASE(binary.BigEndian.Uint16(ret[p:])) {
+			copy(ret[p:], grease)
+		} else {
+			copy(ret[p+4:], sta.RandBytes(length))
+		}
+		p += 4 + length
+	}
+	return ret
+}
+
+// refreshECH makes a new GREASE ECH like the one in ech: the same cipher suite, a
+// random config id, and random encapsulated key and payload of the same lengths
+func refreshECH(sta *gqclient.State, ech []byte) []byte {
+	// type 1, KDF 2, AEAD 2, config id 1
+	if len(ech) < 8 {
+		return ech
+	}
+	ret := append([]byte{}, ech[:5]...)
+	ret = append(ret, sta.RandBytes(1)...)
+	rest := ech[6:]
+	for i := 0; i < 2 && len(rest) >= 2; i++ {
+		length := gqclient.BtoInt(rest[:2])
+		if 2+length > len(rest) {
+			break
+		}
+		ret = append(ret, rest[:2]...)
+		ret = append(ret, sta.RandBytes(length)...)
+		rest = rest[2+length:]
+	}
+	return append(ret, rest...)
+}
+
+// composeExtensions composes the extensions in the HelloTemplate of sta, in its
+// order. pad is whether it has padding, which is added by assembleClientHello
+func (f *fromTemplate) composeExtensions(sta *gqclient.State, r *rand.Rand) (ret []byte, pad bool) {
+	greaseFirst, greaseLast := makeGREASEPair(r)
+	greaseGroup, _ := makeGREASEPair(r)
+	seenGREASE := false
+	for _, e := range sta.Template.Extensions {
+		typ, _ := e.TypeValue()
+		data, _ := hex.DecodeString(e.Data)
+		typBytes := u16(int(typ))
+		switch {
+		case e.Type == "grease" || isGREASE(typ):
+			typBytes = greaseFirst
+			if seenGREASE {
+				typBytes = greaseLast
+			}
+			seenGREASE = true
+		case typ == 0x0000:
+			data = makeServerName(sta)
+		case typ == 0x0023:
+			data = makeSessionTicket(sta)
+		case typ == 0x0015:
+			pad = true
+			continue
+		case typ == 0x000a:
+			data = regrease(data, 2, greaseGroup)
+		case typ == 0x002b:
+			data = regrease(data, 1, greaseFirst)
+		case typ == 0x000d:
+			data = makeSigAlgos(sta, e.Data)
+		case typ == 0x0022 && len(sta.DelegatedCredentials) != 0:
+			data = makeDelegatedCredentials(sta)
+		case typ == 0x0033:
+			data = refreshKeyShare(sta, data, greaseGroup)
+		case typ == 0xfe0d:
+			data = refreshECH(sta, data)
+		}
+		ret = append(ret, addExtRec(typBytes, data)...)
+	}
+	return ret, pad
+}
+
+func (f *fromTemplate) composeClientHello(sta *gqclient.State) []byte {
+	t := sta.Template
+	r := newPRNG(sta)
+	greaseCipher, _ := makeGREASEPair(r)
+	var cipherSuites []byte
+	for _, c := range t.CipherSuites {
+		if c == "grease" {
+			cipherSuites = append(cipherSuites, greaseCipher...)
+		} else {
+			b, _ := hex.DecodeString(c)
+			cipherSuites = append(cipherSuites, b...)
+		}
+	}
+	sessionId := "random"
+	if t.SessionIDLength == 0 {
+		sessionId = "empty"
+	}
+	ext, pad := f.composeExtensions(sta, r)
+	return assembleClientHello(
+		templateVersions(t).hello,
+		gqclient.MakeRandomField(sta),
+		makeSessionId(sta, sessionId),
+		cipherSuites,
+		addRawExtensions(sta, filterExtensions(sta, ext)),
+		pad && sta.KeepsExtension("padding"),
+	)
+}
+
+// MakeHelloTemplate makes a HelloTemplate from hello, a ClientHello with its record
+// layer. pre_shared_key and early_data are left out, since they belong to a session
+// with the server it was sent to, and so is the data of the extensions that's made
+// for each connection
+func MakeHelloTemplate(hello []byte) (t *gqclient.HelloTemplate, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			t, err = nil, errors.New("Malformed ClientHello")
+		}
+	}()
+	if hello[0] != 0x16 || hello[5] != 0x01 {
+		return nil, errors.New("Not a ClientHello")
+	}
+	// record layer 5, handshake type 1, length 3
+	data := hello[9:]
+	t = &gqclient.HelloTemplate{
+		Version:       fmt.Sprintf("%x", data[:2]),
+		RecordVersion: fmt.Sprintf("%x", hello[1:3]),
+	}
+	p := 2 + 32
+	t.SessionIDLength = int(data[p])
+	if t.SessionIDLength != 0 {
+		t.SessionIDLength = 32
+	}
+	p += 1 + int(data[p])
+	for _, c := range u16List(data[p:], 2) {
+		if isGREASE(c) {
+			t.CipherSuites = append(t.CipherSuites, "grease")
+		} else {
+			t.CipherSuites = append(t.CipherSuites, fmt.Sprintf("%04x", c))
+		}
+	}
+	p += 2 + gqclient.BtoInt(data[p:p+2])
+	p += 1 + int(data[p]) // compression methods
+	extEnd := p + 2 + gqclient.BtoInt(data[p:p+2])
+	for p += 2; p < extEnd; {
+		typ := binary.BigEndian.Uint16(data[p:])
+		length := gqclient.BtoInt(data[p+2 : p+4])
+		e := gqclient.TemplateExtension{
+			Type: extensionName(typ),
+			Data: fmt.Sprintf("%x", data[p+4:p+4+length]),
+		}
+		p += 4 + length
+		if e.Type == "" {
+			e.Type = fmt.Sprintf("%04x", typ)
+		}
+		switch typ {
+		case 0x0029, 0x002a:
+			continue
+		case 0x0000, 0x0023, 0x0015:
+			e.Data = ""
+		}
+		t.Extensions = append(t.Extensions, e)
+	}
+	return t, t.Validate()
+}
@@ -3,8 +3,10 @@ package gqclient
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/sha256"
 	"fmt"
+	"time"
 )
 
 func encrypt(iv []byte, key []byte, plaintext []byte) []byte {
@@ -15,13 +17,108 @@ func encrypt(iv []byte, key []byte, plaintext []byte) []byte {
 	return ciphertext
 }
 
-// MakeRandomField makes the random value that can pass the check at server side
+// The length in seconds of the windows of time the random field is made for, which
+// the server has to be in as well unless it has ClockSkewTolerance. AuthWindow
+// replaces it, and has to be the same as the server's
+const defaultAuthWindow = 12 * 60 * 60
+
+// AuthWindowLength returns the length of the windows the random field is made for
+func (sta *State) AuthWindowLength() time.Duration {
+	return time.Duration(sta.authWindow()) * time.Second
+}
+
+func (sta *State) authWindow() int {
+	if sta.AuthWindow != 0 {
+		return sta.AuthWindow
+	}
+	return defaultAuthWindow
+}
+
+// AuthWindowEdge returns how far now is from the nearest edge of its window of
+// window seconds, past which a server whose clock is off by more than that is in
+// another one
+func AuthWindowEdge(now time.Time, window int) time.Duration {
+	into := int(now.Unix()) % window
+	if left := window - into; left < into {
+		into = left
+	}
+	return time.Duration(into) * time.Second
+}
+
+// MakeRandomField makes the random value that can pass the check at server side.
+// If AuthPayloadFunc is set it's what it returns, cut or padded to 32 bytes
 func MakeRandomField(sta *State) []byte {
+	if sta.AuthPayloadFunc != nil {
+		ret := make([]byte, 32)
+		copy(ret, sta.AuthPayloadFunc(sta))
+		return ret
+	}
 	h := sha256.New()
-	t := int(sta.Now().Unix()) / (12 * 60 * 60)
+	t := int(sta.Now().Unix()) / sta.authWindow()
 	h.Write([]byte(fmt.Sprintf("%v", t) + sta.Key))
 	goal := h.Sum(nil)[0:16]
-	iv := CryptoRandBytes(16)
+	iv := sta.RandBytes(16)
 	rest := encrypt(iv, sta.AESKey, goal)
 	return append(iv, rest...)
 }
+
+// MakeReplyBinding makes the value put into our Finished message to prove to the
+// server that we have received the ServerHello of this specific handshake
+func MakeReplyBinding(sta *State, serverRandom []byte) []byte {
+	mac := hmac.New(sha256.New, sta.AESKey)
+	mac.Write(serverRandom)
+	return mac.Sum(nil)
+}
+
+// MakeRouteTag makes the value that tells the server which of its Routes this
+// connection is for. It's only meaningful to a server that knows the key, and
+// it differs in every handshake so it can't be used to link connections together
+func MakeRouteTag(sta *State, serverRandom []byte) []byte {
+	mac := hmac.New(sha256.New, sta.AESKey)
+	mac.Write([]byte("route"))
+	mac.Write(serverRandom)
+	mac.Write([]byte(sta.Route))
+	return mac.Sum(nil)[:8]
+}
+
+// MakeDatagramTag makes the value that goes in place of the route tag on a
+// connection carrying a UDP session from SS, so that the server relays its
+// datagrams to the UDP port of the ss-server of Route
+func MakeDatagramTag(sta *State, serverRandom []byte) []byte {
+	return makeRoutedTag(sta, "udp", serverRandom)
+}
+
+// MakeMuxTag makes the value that goes in place of the route tag on a connection
+// carrying streams, for the server to relay each to the ss-server of Route
+func MakeMuxTag(sta *State, serverRandom []byte) []byte {
+	return makeRoutedTag(sta, "mux", serverRandom)
+}
+
+// makeRoutedTag makes a tag that says both what the connection is for and which
+// of the server's Routes it goes to
+func makeRoutedTag(sta *State, purpose string, serverRandom []byte) []byte {
+	mac := hmac.New(sha256.New, sta.AESKey)
+	mac.Write([]byte(purpose))
+	mac.Write(serverRandom)
+	mac.Write([]byte(sta.Route))
+	return mac.Sum(nil)[:8]
+}
+
+// MakeConnectTag makes the value that goes in place of the route tag to ask the
+// server to dial the address at the start of the connection itself, for -socks,
+// rather than relay it to ss-server
+func MakeConnectTag(sta *State, serverRandom []byte) []byte {
+	mac := hmac.New(sha256.New, sta.AESKey)
+	mac.Write([]byte("connect"))
+	mac.Write(serverRandom)
+	return mac.Sum(nil)[:8]
+}
+
+// MakePingTag makes the value that goes in place of the route tag to ask the
+// server to echo the connection back rather than relay it to ss-server
+func MakePingTag(sta *State, serverRandom []byte) []byte {
+	mac := hmac.New(sha256.New, sta.AESKey)
+	mac.Write([]byte("ping"))
+	mac.Write(serverRandom)
+	return mac.Sum(nil)[:8]
+}
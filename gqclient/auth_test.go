@@ -0,0 +1,24 @@
+package gqclient
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthWindowEdge(t *testing.T) {
+	// 1791936000 starts a window
+	cases := map[int64]time.Duration{
+		1791936000:         0,
+		1791936000 + 10:    10 * time.Second,
+		1791936000 - 10:    10 * time.Second,
+		1791936000 + 21600: 6 * time.Hour,
+	}
+	for now, exp := range cases {
+		if got := AuthWindowEdge(time.Unix(now, 0), defaultAuthWindow); got != exp {
+			t.Error("For", now, "expected", exp, "got", got)
+		}
+	}
+	if got := AuthWindowEdge(time.Unix(1791936000+250, 0), 600); got != 250*time.Second {
+		t.Error("For", "a window of 600", "expected", 250*time.Second, "got", got)
+	}
+}
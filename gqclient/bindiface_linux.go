@@ -0,0 +1,19 @@
+package gqclient
+
+import (
+	"os"
+	"syscall"
+)
+
+const bindInterfaceSupported = true
+
+// BindToInterface binds the socket fd to the network interface iface with
+// SO_BINDTODEVICE, so that it goes out through iface whatever its addresses and
+// the routes are. It should be called before connecting
+func BindToInterface(fd int, iface string) error {
+	err := syscall.BindToDevice(fd, iface)
+	if err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	return nil
+}
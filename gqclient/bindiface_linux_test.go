@@ -0,0 +1,34 @@
+package gqclient
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestBindToInterface(t *testing.T) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	err = BindToInterface(fd, "lo")
+	if sysErr, ok := err.(*os.SyscallError); ok && sysErr.Err == syscall.EPERM {
+		t.Skip("SO_BINDTODEVICE needs CAP_NET_RAW")
+	}
+	if err != nil {
+		t.Error(
+			"For", "lo",
+			"expected", "no err",
+			"got", err,
+		)
+	}
+	err = BindToInterface(fd, "nonexistent0")
+	if err == nil {
+		t.Error(
+			"For", "nonexistent0",
+			"expected", "err",
+			"got", "no err",
+		)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package gqclient
+
+import "errors"
+
+const bindInterfaceSupported = false
+
+// BindToInterface is only supported on Linux
+func BindToInterface(fd int, iface string) error {
+	return errors.New("BindInterface is only supported on Linux")
+}
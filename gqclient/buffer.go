@@ -0,0 +1,82 @@
+package gqclient
+
+import "github.com/cbeuw/GoQuiet/buffer"
+
+// AutoBuffer is a read buffer that grows while reads keep filling it, i.e. there's
+// more data waiting than it can hold, and shrinks back once they don't. Its buffers
+// come from the buffer package
+type AutoBuffer struct {
+	buf   []byte
+	min   int
+	max   int
+	small int
+	// Bytes in front of what Bytes returns, for a header
+	headroom int
+}
+
+// Number of reads in a row using less than a quarter of the buffer before it shrinks
+const shrinkAfter = 16
+
+// NewAutoBuffer makes an AutoBuffer that starts at min bytes and never goes beyond max
+func NewAutoBuffer(min, max int) *AutoBuffer {
+	return NewAutoBufferWithHeadroom(min, max, 0)
+}
+
+// NewAutoBufferWithHeadroom makes an AutoBuffer like NewAutoBuffer that keeps
+// headroom bytes in front of what Bytes returns, so that a header can be put in
+// front of the data read into it without copying the data
+func NewAutoBufferWithHeadroom(min, max int, headroom int) *AutoBuffer {
+	return &AutoBuffer{
+		buf:      buffer.Get(headroom + min),
+		min:      min,
+		max:      max,
+		headroom: headroom,
+	}
+}
+
+// Bytes returns the buffer to read into next
+func (b *AutoBuffer) Bytes() []byte {
+	return b.buf[b.headroom:]
+}
+
+// Framed returns the n bytes read into the buffer with the headroom in front
+func (b *AutoBuffer) Framed(n int) []byte {
+	return b.buf[:b.headroom+n]
+}
+
+// Release gives the buffer back to be reused. b can't be used after
+func (b *AutoBuffer) Release() {
+	buffer.Put(b.buf)
+	b.buf = nil
+}
+
+// Used tells the buffer that n bytes were read into it, so that it can be resized
+// for the next read. The content of the buffer is lost if it is resized
+func (b *AutoBuffer) Used(n int) {
+	size := len(b.buf) - b.headroom
+	switch {
+	case n == size && size < b.max:
+		size *= 2
+		if size > b.max {
+			size = b.max
+		}
+		b.small = 0
+	case n < size/4 && size > b.min:
+		b.small++
+		if b.small < shrinkAfter {
+			return
+		}
+		size /= 2
+		if size < b.min {
+			size = b.min
+		}
+		b.small = 0
+	default:
+		b.small = 0
+		return
+	}
+	if size != len(b.buf)-b.headroom {
+		buffer.Put(b.buf)
+		b.buf = buffer.Get(b.headroom + size)
+	}
+}
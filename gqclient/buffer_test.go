@@ -0,0 +1,55 @@
+package gqclient
+
+import "testing"
+
+func TestAutoBuffer(t *testing.T) {
+	b := NewAutoBuffer(1000, 3000)
+	sizes := []int{}
+	// Two full reads grow it to the max, then it stays there
+	for c := 0; c < 3; c++ {
+		b.Used(len(b.Bytes()))
+		sizes = append(sizes, len(b.Bytes()))
+	}
+	if sizes[0] != 2000 || sizes[1] != 3000 || sizes[2] != 3000 {
+		t.Error(
+			"For", "full reads",
+			"expected", []int{2000, 3000, 3000},
+			"got", sizes,
+		)
+	}
+
+	for c := 0; c < shrinkAfter-1; c++ {
+		b.Used(10)
+	}
+	if len(b.Bytes()) != 3000 {
+		t.Error(
+			"For", "a few small reads",
+			"expected", 3000,
+			"got", len(b.Bytes()),
+		)
+	}
+	for c := 0; c < shrinkAfter*4; c++ {
+		b.Used(10)
+	}
+	if len(b.Bytes()) != 1000 {
+		t.Error(
+			"For", "many small reads",
+			"expected", 1000,
+			"got", len(b.Bytes()),
+		)
+	}
+}
+
+func TestAutoBufferHeadroom(t *testing.T) {
+	b := NewAutoBufferWithHeadroom(1000, 3000, 5)
+	defer b.Release()
+	copy(b.Bytes(), "data")
+	if len(b.Bytes()) != 1000 || string(b.Framed(4)[5:]) != "data" {
+		t.Error("For", "headroom 5", "expected", 1000, "data", "got", len(b.Bytes()), string(b.Framed(4)[5:]))
+	}
+	// It grows by what comes after the headroom
+	b.Used(1000)
+	if len(b.Bytes()) != 2000 || len(b.Framed(2000)) != 2005 {
+		t.Error("For", "a full read", "expected", 2000, "got", len(b.Bytes()))
+	}
+}
@@ -0,0 +1,123 @@
+package gqclient
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// What an encrypted config says it is, which is also how it's told apart from a
+// plaintext one
+const configEnvelopeFormat = "gq-config-aes256gcm-pbkdf2sha256"
+
+// The PBKDF2 iterations of new encrypted configs
+const configIterations = 200000
+
+// PassphraseEnv is the environment variable the passphrase of an encrypted config
+// is read from by default
+const PassphraseEnv = "GQ_CONFIG_PASSPHRASE"
+
+// ConfigPassphrase gets the passphrase of an encrypted config for ParseConfig. By
+// default it's PassphraseEnv, gq-client also asks for it on a terminal
+var ConfigPassphrase = func() (string, error) {
+	if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+	return "", errors.New("The config is encrypted and " + PassphraseEnv + " isn't set")
+}
+
+// configEnvelope is an encrypted config. The key is derived from the passphrase
+// with PBKDF2, and Data is the config sealed with AES-256-GCM under it, the nonce
+// first. []byte is base64 in JSON
+type configEnvelope struct {
+	Format     string
+	Iterations int
+	Salt       []byte
+	Data       []byte
+}
+
+// pbkdf2 is PBKDF2 with HMAC-SHA256, see https://tools.ietf.org/html/rfc8018#section-5.2
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+func configAEAD(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2([]byte(passphrase), salt, iterations, 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// IsEncryptedConfig reports whether content is a config encrypted by EncryptConfig
+func IsEncryptedConfig(content []byte) bool {
+	var envelope configEnvelope
+	return json.Unmarshal(content, &envelope) == nil && envelope.Format == configEnvelopeFormat
+}
+
+// EncryptConfig encrypts the config in content with passphrase
+func EncryptConfig(content []byte, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.New("The passphrase cannot be empty")
+	}
+	envelope := configEnvelope{
+		Format:     configEnvelopeFormat,
+		Iterations: configIterations,
+		Salt:       CryptoRandBytes(16),
+	}
+	aead, err := configAEAD(passphrase, envelope.Salt, envelope.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	nonce := CryptoRandBytes(aead.NonceSize())
+	envelope.Data = aead.Seal(nonce, nonce, content, nil)
+	return json.MarshalIndent(envelope, "", "    ")
+}
+
+// DecryptConfig decrypts content, a config encrypted by EncryptConfig, with passphrase
+func DecryptConfig(content []byte, passphrase string) ([]byte, error) {
+	var envelope configEnvelope
+	if err := json.Unmarshal(content, &envelope); err != nil || envelope.Format != configEnvelopeFormat {
+		return nil, errors.New("Not an encrypted config")
+	}
+	// A huge count would hang us, whoever wrote the file
+	if envelope.Iterations < 1 || envelope.Iterations > 10*configIterations {
+		return nil, errors.New("Bad iteration count in encrypted config")
+	}
+	aead, err := configAEAD(passphrase, envelope.Salt, envelope.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(envelope.Data) < aead.NonceSize() {
+		return nil, errors.New("Encrypted config is truncated")
+	}
+	nonce, sealed := envelope.Data[:aead.NonceSize()], envelope.Data[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, errors.New("Can't decrypt the config: wrong passphrase or a damaged file")
+	}
+	return plain, nil
+}
@@ -0,0 +1,74 @@
+package gqclient
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPBKDF2(t *testing.T) {
+	// From https://tools.ietf.org/html/rfc7914#section-11
+	cases := []struct {
+		password, salt string
+		iterations     int
+		exp            string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, c := range cases {
+		got := fmt.Sprintf("%x", pbkdf2([]byte(c.password), []byte(c.salt), c.iterations, 64))
+		if got != c.exp {
+			t.Error("For", c.password, c.salt, c.iterations, "expected", c.exp, "got", got)
+		}
+	}
+}
+
+func TestEncryptedConfig(t *testing.T) {
+	plain, err := ioutil.ReadFile("../config/gqclient.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := EncryptConfig(plain, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncryptedConfig(encrypted) || IsEncryptedConfig(plain) {
+		t.Error("For", "IsEncryptedConfig", "expected", "true and false", "got", IsEncryptedConfig(encrypted), IsEncryptedConfig(plain))
+	}
+	if strings.Contains(string(encrypted), "exampleconftest") {
+		t.Error("For", "encrypted config", "expected", "no plaintext", "got", string(encrypted))
+	}
+	if got, err := DecryptConfig(encrypted, "correct horse"); err != nil || string(got) != string(plain) {
+		t.Error("For", "the right passphrase", "expected", string(plain), "got", string(got), err)
+	}
+	if _, err := DecryptConfig(encrypted, "wrong horse"); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Error("For", "the wrong passphrase", "expected", "wrong passphrase", "got", err)
+	}
+	if _, err := EncryptConfig(plain, ""); err == nil {
+		t.Error("For", "an empty passphrase", "expected", "error", "got", nil)
+	}
+
+	dir, _ := ioutil.TempDir("", "gqclient")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gqclient.json")
+	ioutil.WriteFile(path, encrypted, 0600)
+	defer func(old func() (string, error)) { ConfigPassphrase = old }(ConfigPassphrase)
+	for _, pass := range []string{"correct horse", "wrong horse", ""} {
+		os.Setenv(PassphraseEnv, pass)
+		sta := &State{}
+		err := sta.ParseConfig(path)
+		if (err == nil) != (pass == "correct horse") {
+			t.Error("For", "ParseConfig with passphrase", pass, "expected", pass == "correct horse", "got", err)
+		}
+	}
+	os.Unsetenv(PassphraseEnv)
+	ConfigPassphrase = func() (string, error) { return "correct horse", nil }
+	sta := &State{}
+	if err := sta.ParseConfig(path); err != nil || sta.Key == "" {
+		t.Error("For", "ConfigPassphrase", "expected", "the config", "got", err)
+	}
+}
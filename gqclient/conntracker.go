@@ -0,0 +1,117 @@
+package gqclient
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnTracker keeps track of the connections being relayed, so that their stats
+// can be looked at while they are open. Byte counts are updated atomically, the
+// lock is only taken when a connection is added or removed and by Snapshot
+type ConnTracker struct {
+	mu     sync.Mutex
+	conns  map[uint64]*TrackedConn
+	nextID uint64
+}
+
+// TrackedConn is a connection in a ConnTracker
+type TrackedConn struct {
+	// Accessed atomically, and first in the struct so that they're 64-bit
+	// aligned on 32-bit platforms
+	bytesUp   int64
+	bytesDown int64
+	removed   int32
+	stats     ConnStats
+	tracker   *ConnTracker
+}
+
+// ConnStats are the stats of a connection at the time they are taken
+type ConnStats struct {
+	ID     uint64
+	Start  time.Time
+	Source string
+	Remote string
+	// The Label of the listener it was accepted on, if it has one
+	Label string
+	// SS data sent to the remote and received from it
+	BytesUp   int64
+	BytesDown int64
+}
+
+// NewConnTracker makes an empty ConnTracker
+func NewConnTracker() *ConnTracker {
+	return &ConnTracker{conns: make(map[uint64]*TrackedConn)}
+}
+
+// Add starts tracking a connection from source relayed to remote
+func (t *ConnTracker) Add(source, remote string) *TrackedConn {
+	return t.AddLabelled(source, remote, "")
+}
+
+// AddLabelled is Add for a connection tagged with label
+func (t *ConnTracker) AddLabelled(source, remote, label string) *TrackedConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextID++
+	c := &TrackedConn{
+		stats: ConnStats{
+			ID:     t.nextID,
+			Start:  time.Now(),
+			Source: source,
+			Remote: remote,
+			Label:  label,
+		},
+		tracker: t,
+	}
+	t.conns[c.stats.ID] = c
+	return c
+}
+
+// Len returns the number of connections being tracked
+func (t *ConnTracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// Snapshot returns the stats of every connection being tracked, oldest first
+func (t *ConnTracker) Snapshot() []ConnStats {
+	t.mu.Lock()
+	ret := make([]ConnStats, 0, len(t.conns))
+	for _, c := range t.conns {
+		ret = append(ret, c.Stats())
+	}
+	t.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+// AddUp counts n bytes sent to the remote
+func (c *TrackedConn) AddUp(n int) {
+	atomic.AddInt64(&c.bytesUp, int64(n))
+}
+
+// AddDown counts n bytes received from the remote
+func (c *TrackedConn) AddDown(n int) {
+	atomic.AddInt64(&c.bytesDown, int64(n))
+}
+
+// Stats returns the current stats of the connection
+func (c *TrackedConn) Stats() ConnStats {
+	s := c.stats
+	s.BytesUp = atomic.LoadInt64(&c.bytesUp)
+	s.BytesDown = atomic.LoadInt64(&c.bytesDown)
+	return s
+}
+
+// Remove stops tracking the connection. It can be called more than once
+func (c *TrackedConn) Remove() {
+	if !atomic.CompareAndSwapInt32(&c.removed, 0, 1) {
+		return
+	}
+	c.tracker.mu.Lock()
+	delete(c.tracker.conns, c.stats.ID)
+	c.tracker.mu.Unlock()
+}
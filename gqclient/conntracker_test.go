@@ -0,0 +1,43 @@
+package gqclient
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestConnTracker(t *testing.T) {
+	tracker := NewConnTracker()
+	a := tracker.Add("127.0.0.1:1000", "1.2.3.4:443")
+	b := tracker.Add("127.0.0.1:1001", "5.6.7.8:443")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			a.AddUp(10)
+			a.AddDown(1)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	snap := tracker.Snapshot()
+	if len(snap) != 2 || snap[0].Source != "127.0.0.1:1000" || snap[0].BytesUp != 1000 || snap[0].BytesDown != 100 || snap[1].Remote != "5.6.7.8:443" {
+		t.Error(
+			"For", "two connections",
+			"expected", "both with their byte counts",
+			"got", snap,
+		)
+	}
+
+	b.Remove()
+	b.Remove()
+	snap = tracker.Snapshot()
+	if len(snap) != 1 || snap[0].ID != a.Stats().ID || tracker.Len() != 1 {
+		t.Error(
+			"For", "one removed",
+			"expected", "the other one left",
+			"got", snap,
+		)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package gqclient
+
+import "errors"
+
+// SetDSCP is only supported on Linux, macOS and FreeBSD
+func SetDSCP(fd int, dscp int) error {
+	return errors.New("DSCP is not supported on this platform")
+}
@@ -0,0 +1,29 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package gqclient
+
+import (
+	"os"
+	"syscall"
+)
+
+// SetDSCP sets the DSCP bits of the packets sent on the socket fd, which can be
+// either IPv4 or IPv6. It should be called before connecting so that the SYN is
+// marked too
+func SetDSCP(fd int, dscp int) error {
+	// DSCP is the upper 6 bits of the ToS or traffic class byte
+	tos := dscp << 2
+	err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+	if err == nil {
+		// An IPv6 socket may also connect to an IPv4 mapped address. This fails
+		// harmlessly where IPv6 sockets can't
+		syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		return nil
+	}
+	err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+	if err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	return nil
+}
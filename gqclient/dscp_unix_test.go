@@ -0,0 +1,33 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package gqclient
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestSetDSCP(t *testing.T) {
+	for _, family := range []int{syscall.AF_INET, syscall.AF_INET6} {
+		fd, err := syscall.Socket(family, syscall.SOCK_STREAM, 0)
+		if err != nil {
+			// No IPv6
+			continue
+		}
+		err = SetDSCP(fd, 46)
+		level, opt := syscall.IPPROTO_IP, syscall.IP_TOS
+		if family == syscall.AF_INET6 {
+			level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+		}
+		tos, _ := syscall.GetsockoptInt(fd, level, opt)
+		syscall.Close(fd)
+		if err != nil || tos != 46<<2 {
+			t.Error(
+				"For", "family", family,
+				"expected", 46<<2,
+				"got", tos, err,
+			)
+		}
+	}
+}
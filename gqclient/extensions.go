@@ -0,0 +1,61 @@
+package gqclient
+
+// ExtensionTypes are the names of the ClientHello extensions that can be sent,
+// as in the IANA TLS ExtensionType registry. grease stands for all the GREASE ones
+var ExtensionTypes = map[string]uint16{
+	"server_name":                            0x0000,
+	"status_request":                         0x0005,
+	"supported_groups":                       0x000a,
+	"ec_point_formats":                       0x000b,
+	"signature_algorithms":                   0x000d,
+	"application_layer_protocol_negotiation": 0x0010,
+	"signed_certificate_timestamp":           0x0012,
+	"padding":                                0x0015,
+	"extended_master_secret":                 0x0017,
+	"compress_certificate":                   0x001b,
+	"record_size_limit":                      0x001c,
+	"delegated_credentials":                  0x0022,
+	"session_ticket":                         0x0023,
+	"pre_shared_key":                         0x0029,
+	"early_data":                             0x002a,
+	"supported_versions":                     0x002b,
+	"psk_key_exchange_modes":                 0x002d,
+	"key_share":                              0x0033,
+	"channel_id":                             0x7550,
+	"application_settings":                   0x4469,
+	"encrypted_client_hello":                 0xfe0d,
+	"renegotiation_info":                     0xff01,
+	"grease":                                 0x0a0a,
+}
+
+// CertCompressionAlgorithms are the names of the algorithms that can be advertised in
+// compress_certificate, see https://tools.ietf.org/html/rfc8879#section-3
+var CertCompressionAlgorithms = map[string]uint16{
+	"zlib":   1,
+	"brotli": 2,
+	"zstd":   3,
+}
+
+// MinimalExtensions are the extensions sent when ExtensionSet is minimal, which
+// is about what a simple TLS 1.2 client sends. session_ticket carries the
+// authentication so it's always there
+var MinimalExtensions = []string{"server_name", "supported_groups", "ec_point_formats", "signature_algorithms", "session_ticket"}
+
+// KeepsExtension reports whether the extension called name is sent under ExtensionSet
+func (sta *State) KeepsExtension(name string) bool {
+	var set []string
+	switch sta.ExtensionSet {
+	case "minimal":
+		set = MinimalExtensions
+	case "custom":
+		set = sta.Extensions
+	default:
+		return true
+	}
+	for _, n := range set {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
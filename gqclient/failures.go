@@ -0,0 +1,110 @@
+package gqclient
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// The fewest handshakes in the window for which a FailureWindow raises an alert,
+// so that a single failure after a quiet spell isn't taken for a server down
+const minAlertAttempts = 5
+
+// FailureWindow keeps the outcome of every handshake with each remote over a
+// sliding window, so that a remote that has started failing most handshakes
+// can be told apart from one failing now and then
+type FailureWindow struct {
+	Now          func() time.Time
+	window       time.Duration
+	alertPercent int
+	mu           sync.Mutex
+	remotes      map[string]*remoteOutcomes
+}
+
+type remoteOutcomes struct {
+	outcomes []outcome
+	alerting bool
+}
+
+type outcome struct {
+	at     time.Time
+	failed bool
+}
+
+// FailureStats are the handshakes with a remote over the window
+type FailureStats struct {
+	Remote   string
+	Attempts int
+	Failures int
+	// Whether the failure rate is at or over the alert threshold
+	Alerting bool
+}
+
+// Rate returns the fraction of the handshakes that failed
+func (s FailureStats) Rate() float64 {
+	if s.Attempts == 0 {
+		return 0
+	}
+	return float64(s.Failures) / float64(s.Attempts)
+}
+
+// NewFailureWindow makes a FailureWindow over window. A remote is alerting once
+// at least alertPercent of its handshakes in the window have failed. An
+// alertPercent of 0 means never
+func NewFailureWindow(window time.Duration, alertPercent int) *FailureWindow {
+	return &FailureWindow{
+		Now:          time.Now,
+		window:       window,
+		alertPercent: alertPercent,
+		remotes:      make(map[string]*remoteOutcomes),
+	}
+}
+
+// Add records a handshake with remote. It returns the stats of remote after it,
+// and whether the remote has just started or stopped alerting
+func (w *FailureWindow) Add(remote string, failed bool) (stats FailureStats, changed bool) {
+	now := w.Now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	r, ok := w.remotes[remote]
+	if !ok {
+		r = &remoteOutcomes{}
+		w.remotes[remote] = r
+	}
+	r.outcomes = append(r.outcomes, outcome{now, failed})
+	stats = w.stats(remote, r, now)
+	changed = stats.Alerting != r.alerting
+	r.alerting = stats.Alerting
+	return
+}
+
+// stats drops the outcomes of r that are out of the window and counts the rest
+func (w *FailureWindow) stats(remote string, r *remoteOutcomes, now time.Time) FailureStats {
+	i := 0
+	for i < len(r.outcomes) && now.Sub(r.outcomes[i].at) > w.window {
+		i++
+	}
+	r.outcomes = r.outcomes[i:]
+	ret := FailureStats{Remote: remote, Attempts: len(r.outcomes)}
+	for _, o := range r.outcomes {
+		if o.failed {
+			ret.Failures++
+		}
+	}
+	ret.Alerting = w.alertPercent != 0 && ret.Attempts >= minAlertAttempts &&
+		ret.Failures*100 >= ret.Attempts*w.alertPercent
+	return ret
+}
+
+// Snapshot returns the stats of every remote that has been handshaked with, by address
+func (w *FailureWindow) Snapshot() []FailureStats {
+	now := w.Now()
+	w.mu.Lock()
+	ret := make([]FailureStats, 0, len(w.remotes))
+	for remote, r := range w.remotes {
+		ret = append(ret, w.stats(remote, r, now))
+	}
+	w.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Remote < ret[j].Remote })
+	return ret
+}
@@ -0,0 +1,41 @@
+package gqclient
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFailureWindow(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	w := NewFailureWindow(time.Minute, 50)
+	w.Now = func() time.Time { return now }
+
+	var changed bool
+	var stats FailureStats
+	// Failures below the minimum number of handshakes don't alert
+	for i := 0; i < minAlertAttempts-1; i++ {
+		stats, changed = w.Add("a:443", true)
+		if changed || stats.Alerting {
+			t.Error("For", i+1, "failures", "expected", "no alert", "got", stats)
+		}
+	}
+	stats, changed = w.Add("a:443", false)
+	if !changed || !stats.Alerting || stats.Attempts != minAlertAttempts || stats.Failures != minAlertAttempts-1 {
+		t.Error("For", "enough failures", "expected", "alerting", "got", stats, changed)
+	}
+	w.Add("b:443", false)
+
+	// The failures go out of the window
+	now = now.Add(2 * time.Minute)
+	for i := 0; i < minAlertAttempts; i++ {
+		stats, changed = w.Add("a:443", false)
+	}
+	if stats.Alerting || stats.Attempts != minAlertAttempts || stats.Rate() != 0 {
+		t.Error("For", "old failures", "expected", "not alerting", "got", stats)
+	}
+
+	snap := w.Snapshot()
+	if len(snap) != 2 || snap[0].Remote != "a:443" || snap[1].Remote != "b:443" || snap[1].Attempts != 0 {
+		t.Error("For", "Snapshot", "expected", "a with its handshakes and b with none left", "got", snap)
+	}
+}
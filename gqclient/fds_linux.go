@@ -0,0 +1,19 @@
+package gqclient
+
+import "os"
+
+// OpenFDs returns the number of file descriptors this process has open, from
+// /proc/self/fd. ok is false if it can't be read
+func OpenFDs() (n int, ok bool) {
+	dir, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return 0, false
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return 0, false
+	}
+	// Less the one of dir itself
+	return len(names) - 1, true
+}
@@ -0,0 +1,22 @@
+package gqclient
+
+import (
+	"os"
+	"testing"
+)
+
+func TestOpenFDs(t *testing.T) {
+	before, ok := OpenFDs()
+	if !ok {
+		t.Fatal("For", "/proc/self/fd", "expected", "the count", "got", ok)
+	}
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, _ := OpenFDs()
+	f.Close()
+	if after != before+1 {
+		t.Error("For", "opening a file", "expected", before+1, "got", after)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package gqclient
+
+// OpenFDs is only supported on Linux, elsewhere ok is always false
+func OpenFDs() (n int, ok bool) {
+	return 0, false
+}
@@ -0,0 +1,44 @@
+package gqclient
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+type clientConfig struct {
+	ServerName     string
+	Key            string
+	TicketTimeHint int
+	Browser        string
+	FastOpen       bool
+}
+
+type serverConfig struct {
+	WebServerAddr string
+	Key           string
+	FastOpen      bool
+}
+
+// GenerateConfigs makes the content of a gqclient.json and a matching gqserver.json
+// with a new random Key. webServerAddr is the address of serverName
+func GenerateConfigs(serverName string, webServerAddr string) (client []byte, server []byte, err error) {
+	// URL encoding without padding so that the key doesn't need escaping in
+	// Android plugin options
+	key := base64.RawURLEncoding.EncodeToString(CryptoRandBytes(24))
+	client, err = json.MarshalIndent(clientConfig{
+		ServerName:     serverName,
+		Key:            key,
+		TicketTimeHint: 3600,
+		Browser:        "chrome",
+		FastOpen:       true,
+	}, "", "\t")
+	if err != nil {
+		return
+	}
+	server, err = json.MarshalIndent(serverConfig{
+		WebServerAddr: webServerAddr,
+		Key:           key,
+		FastOpen:      true,
+	}, "", "\t")
+	return
+}
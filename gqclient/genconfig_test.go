@@ -0,0 +1,48 @@
+package gqclient
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestGenerateConfigs(t *testing.T) {
+	client, server, err := GenerateConfigs("www.bing.com", "204.79.197.200:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "gqclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(client)
+	f.Close()
+	sta := &State{}
+	err = sta.ParseConfig(f.Name())
+	if err != nil {
+		t.Error(
+			"For", string(client),
+			"expected", "no err",
+			"got", err,
+		)
+	}
+
+	var serverSta struct {
+		WebServerAddr string
+		Key           string
+	}
+	err = json.Unmarshal(server, &serverSta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverSta.Key != sta.Key || len(sta.Key) != 32 || serverSta.WebServerAddr != "204.79.197.200:443" {
+		t.Error(
+			"For", string(server),
+			"expected", "Key "+sta.Key,
+			"got", serverSta.Key,
+		)
+	}
+}
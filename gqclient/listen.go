@@ -0,0 +1,29 @@
+package gqclient
+
+import (
+	"errors"
+	"net"
+	"strconv"
+)
+
+// ListenOptions are the socket options of a listener made by Listen
+type ListenOptions struct {
+	FastOpen  bool
+	ReusePort bool
+	// Length of the queue of connections waiting to be accepted. 0 means SOMAXCONN
+	Backlog int
+}
+
+// ListenInRange listens on the first port from first to last on host that is free.
+// It returns the error of the last port tried if none can be listened on
+func ListenInRange(host string, first int, last int, opts ListenOptions) (net.Listener, error) {
+	err := errors.New("Empty port range")
+	for port := first; port <= last; port++ {
+		var l net.Listener
+		l, err = Listen(JoinHostPort(host, strconv.Itoa(port)), opts)
+		if err == nil {
+			return l, nil
+		}
+	}
+	return nil, err
+}
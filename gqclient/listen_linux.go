@@ -0,0 +1,86 @@
+package gqclient
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// TCP_FASTOPEN in linux/tcp.h
+const tcpFastOpen = 23
+
+func sockaddr(addr *net.TCPAddr) (int, syscall.Sockaddr, error) {
+	if addr.IP == nil || addr.IP.To4() != nil {
+		sa := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa.Addr[:], addr.IP.To4())
+		return syscall.AF_INET, sa, nil
+	}
+	sa := &syscall.SockaddrInet6{Port: addr.Port}
+	copy(sa.Addr[:], addr.IP)
+	if addr.Zone != "" {
+		ifi, err := net.InterfaceByName(addr.Zone)
+		if err != nil {
+			return 0, nil, err
+		}
+		sa.ZoneId = uint32(ifi.Index)
+	}
+	return syscall.AF_INET6, sa, nil
+}
+
+// Listen listens for TCP connections on addr. Like the standard library, SO_REUSEADDR
+// is always set so that restarting doesn't fail because of sockets in TIME_WAIT.
+// SO_REUSEPORT allows another instance to listen on the same port at the same time
+func Listen(addr string, opts ListenOptions) (net.Listener, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	family, sa, err := sockaddr(tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_TCP)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	fail := func(call string, err error) (net.Listener, error) {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError(call, err)
+	}
+
+	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	if err != nil {
+		return fail("setsockopt", err)
+	}
+	if opts.ReusePort {
+		err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soReusePort, 1)
+		if err != nil {
+			return fail("setsockopt", err)
+		}
+	}
+	if opts.FastOpen {
+		// The value is the length of the queue of pending TFO connections
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, tcpFastOpen, 256)
+		if err != nil {
+			return fail("setsockopt", err)
+		}
+	}
+	err = syscall.Bind(fd, sa)
+	if err != nil {
+		return fail("bind", err)
+	}
+	backlog := opts.Backlog
+	if backlog == 0 {
+		backlog = syscall.SOMAXCONN
+	}
+	// The kernel silently caps this at net.core.somaxconn
+	err = syscall.Listen(fd, backlog)
+	if err != nil {
+		return fail("listen", err)
+	}
+
+	// FileListener makes its own copy of the fd
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
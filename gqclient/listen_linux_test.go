@@ -0,0 +1,51 @@
+package gqclient
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenReusePort(t *testing.T) {
+	l1, err := Listen("127.0.0.1:0", ListenOptions{ReusePort: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l1.Close()
+	addr := l1.Addr().String()
+
+	l2, err := Listen(addr, ListenOptions{ReusePort: true})
+	if err != nil {
+		t.Error(
+			"For", "second listener on "+addr,
+			"expected", "no err",
+			"got", err,
+		)
+	} else {
+		l2.Close()
+	}
+
+	go func() {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := l1.Accept()
+	if err != nil {
+		t.Error(
+			"For", "accepting on "+addr,
+			"expected", "no err",
+			"got", err,
+		)
+		return
+	}
+	conn.Close()
+}
+
+func TestListenIPv6(t *testing.T) {
+	l, err := Listen("[::1]:0", ListenOptions{})
+	if err != nil {
+		t.Skip("IPv6 not available:", err)
+	}
+	l.Close()
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package gqclient
+
+import (
+	"errors"
+	"net"
+
+	"github.com/cbeuw/GoQuiet/tfo"
+)
+
+// Listen listens for TCP connections on addr. ReusePort and Backlog are only supported on Linux
+func Listen(addr string, opts ListenOptions) (net.Listener, error) {
+	if opts.ReusePort {
+		return nil, errors.New("ReusePort is only supported on Linux")
+	}
+	if opts.Backlog != 0 {
+		return nil, errors.New("ListenBacklog is only supported on Linux")
+	}
+	return tfo.Listen(addr, opts.FastOpen)
+}
@@ -0,0 +1,33 @@
+package gqclient
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestListenInRange(t *testing.T) {
+	taken, err := Listen("127.0.0.1:0", ListenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	_, portStr, _ := net.SplitHostPort(taken.Addr().String())
+	first, _ := strconv.Atoi(portStr)
+
+	l, err := ListenInRange("127.0.0.1", first, first+10, ListenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, portStr, _ = net.SplitHostPort(l.Addr().String())
+	l.Close()
+	port, _ := strconv.Atoi(portStr)
+	if port <= first || port > first+10 {
+		t.Error("For", "the first port taken", "expected", "a port after it", "got", port)
+	}
+
+	_, err = ListenInRange("127.0.0.1", first, first, ListenOptions{})
+	if err == nil {
+		t.Error("For", "a range of one port that's taken", "expected", "an error", "got", err)
+	}
+}
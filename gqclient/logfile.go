@@ -0,0 +1,86 @@
+package gqclient
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is an io.Writer to a log file. Once the file grows past maxSize,
+// it's renamed to path.1 (path.1 to path.2 and so on) and a new file is started.
+// At most maxFiles old files are kept
+type RotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	m    sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenRotatingFile opens or creates the log file at path for appending.
+// maxSize of 0 means the file is never rotated
+func OpenRotatingFile(path string, maxSize int64, maxFiles int) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	err := rf.open()
+	if err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.file = f
+	rf.size = info.Size()
+	return nil
+}
+
+func (rf *RotatingFile) rotate() error {
+	rf.file.Close()
+	if rf.maxFiles == 0 {
+		os.Remove(rf.path)
+	} else {
+		os.Remove(fmt.Sprintf("%v.%v", rf.path, rf.maxFiles))
+		for i := rf.maxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%v.%v", rf.path, i), fmt.Sprintf("%v.%v", rf.path, i+1))
+		}
+		os.Rename(rf.path, rf.path+".1")
+	}
+	return rf.open()
+}
+
+// Write writes p to the log file, rotating it first if p doesn't fit
+func (rf *RotatingFile) Write(p []byte) (n int, err error) {
+	rf.m.Lock()
+	defer rf.m.Unlock()
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		err = rf.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err = rf.file.Write(p)
+	rf.size += int64(n)
+	return
+}
+
+// Close closes the current log file
+func (rf *RotatingFile) Close() error {
+	rf.m.Lock()
+	defer rf.m.Unlock()
+	return rf.file.Close()
+}
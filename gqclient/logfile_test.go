@@ -0,0 +1,49 @@
+package gqclient
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gqlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gqclient.log")
+
+	rf, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ln := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		rf.Write([]byte(ln))
+	}
+	rf.Close()
+
+	expect := map[string]string{
+		path:        "dddddddd\n",
+		path + ".1": "cccccccc\n",
+		path + ".2": "bbbbbbbb\n",
+	}
+	for p, exp := range expect {
+		content, _ := ioutil.ReadFile(p)
+		if string(content) != exp {
+			t.Error(
+				"For", filepath.Base(p),
+				"expected", exp,
+				"got", string(content),
+			)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error(
+			"For", filepath.Base(path)+".3",
+			"expected", "not exist",
+			"got", err,
+		)
+	}
+}
@@ -0,0 +1,138 @@
+package gqclient
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// The stages of the handshake that HandshakeFailed is called with
+var handshakeStages = []string{"dial", "clienthello", "serverread", "reply", "firstdata", "websocket"}
+
+// Metrics counts what happened to connections so that it can be scraped by
+// Prometheus. The zero value is ready to use
+type Metrics struct {
+	// The connections counted in active_connections, if not nil
+	Tracker *ConnTracker
+	// The handshakes counted in handshake_window_attempts, if not nil
+	Failures *FailureWindow
+
+	mu                sync.Mutex
+	handshakeFailures map[string]int64
+	// By label and then stage, for connections with a Label
+	labelledFailures map[string]map[string]int64
+}
+
+// HandshakeFailed counts a handshake that failed at stage
+func (m *Metrics) HandshakeFailed(stage string) {
+	m.HandshakeFailedFor("", stage)
+}
+
+// HandshakeFailedFor counts a handshake of a connection tagged with label that
+// failed at stage. It's in the totals as well as in those of label
+func (m *Metrics) HandshakeFailedFor(label, stage string) {
+	m.mu.Lock()
+	if m.handshakeFailures == nil {
+		m.handshakeFailures = make(map[string]int64)
+	}
+	m.handshakeFailures[stage]++
+	if label != "" {
+		if m.labelledFailures == nil {
+			m.labelledFailures = make(map[string]map[string]int64)
+		}
+		if m.labelledFailures[label] == nil {
+			m.labelledFailures[label] = make(map[string]int64)
+		}
+		m.labelledFailures[label][stage]++
+	}
+	m.mu.Unlock()
+}
+
+// HandshakeFailures returns the number of failed handshakes at each stage
+func (m *Metrics) HandshakeFailures() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make(map[string]int64)
+	for _, stage := range handshakeStages {
+		ret[stage] = m.handshakeFailures[stage]
+	}
+	return ret
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP handshake_failures_total Handshakes with the remote that failed, by the stage they failed at.")
+	fmt.Fprintln(w, "# TYPE handshake_failures_total counter")
+	for _, stage := range handshakeStages {
+		fmt.Fprintf(w, "handshake_failures_total{stage=%q} %d\n", stage, m.handshakeFailures[stage])
+	}
+	if len(m.labelledFailures) != 0 {
+		fmt.Fprintln(w, "# HELP labelled_handshake_failures_total Handshakes with the remote that failed, by the Label of the connection and the stage they failed at.")
+		fmt.Fprintln(w, "# TYPE labelled_handshake_failures_total counter")
+		for _, label := range sortedKeys(m.labelledFailures) {
+			for _, stage := range handshakeStages {
+				fmt.Fprintf(w, "labelled_handshake_failures_total{label=%q,stage=%q} %d\n", label, stage, m.labelledFailures[label][stage])
+			}
+		}
+	}
+	if m.Failures != nil {
+		stats := m.Failures.Snapshot()
+		fmt.Fprintln(w, "# HELP handshake_window_attempts Handshakes with each remote over the FailureWindow.")
+		fmt.Fprintln(w, "# TYPE handshake_window_attempts gauge")
+		for _, s := range stats {
+			fmt.Fprintf(w, "handshake_window_attempts{remote=%q} %d\n", s.Remote, s.Attempts)
+		}
+		fmt.Fprintln(w, "# HELP handshake_window_failure_ratio Fraction of the handshakes with each remote over the FailureWindow that failed.")
+		fmt.Fprintln(w, "# TYPE handshake_window_failure_ratio gauge")
+		for _, s := range stats {
+			fmt.Fprintf(w, "handshake_window_failure_ratio{remote=%q} %g\n", s.Remote, s.Rate())
+		}
+	}
+	if m.Tracker != nil {
+		fmt.Fprintln(w, "# HELP active_connections Connections relaying data.")
+		fmt.Fprintln(w, "# TYPE active_connections gauge")
+		fmt.Fprintf(w, "active_connections %d\n", m.Tracker.Len())
+		labelled := make(map[string]int)
+		for _, c := range m.Tracker.Snapshot() {
+			if c.Label != "" {
+				labelled[c.Label]++
+			}
+		}
+		if len(labelled) != 0 {
+			labels := make([]string, 0, len(labelled))
+			for label := range labelled {
+				labels = append(labels, label)
+			}
+			sort.Strings(labels)
+			fmt.Fprintln(w, "# HELP labelled_active_connections Connections relaying data, by their Label.")
+			fmt.Fprintln(w, "# TYPE labelled_active_connections gauge")
+			for _, label := range labels {
+				fmt.Fprintf(w, "labelled_active_connections{label=%q} %d\n", label, labelled[label])
+			}
+		}
+	}
+	// Against active_connections, these show connections that are gone but
+	// whose goroutines or sockets are still around
+	fmt.Fprintln(w, "# HELP go_goroutines Goroutines that currently exist.")
+	fmt.Fprintln(w, "# TYPE go_goroutines gauge")
+	fmt.Fprintf(w, "go_goroutines %d\n", runtime.NumGoroutine())
+	if fds, ok := OpenFDs(); ok {
+		fmt.Fprintln(w, "# HELP process_open_fds Open file descriptors.")
+		fmt.Fprintln(w, "# TYPE process_open_fds gauge")
+		fmt.Fprintf(w, "process_open_fds %d\n", fds)
+	}
+}
+
+func sortedKeys(m map[string]map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
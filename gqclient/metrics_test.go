@@ -0,0 +1,78 @@
+package gqclient
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	m := &Metrics{Failures: NewFailureWindow(time.Minute, 0)}
+	m.Failures.Add("1.2.3.4:443", true)
+	m.Failures.Add("1.2.3.4:443", false)
+	m.HandshakeFailed("dial")
+	m.HandshakeFailed("dial")
+	m.HandshakeFailed("reply")
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, exp := range []string{
+		`handshake_failures_total{stage="dial"} 2`,
+		`handshake_failures_total{stage="reply"} 1`,
+		`handshake_failures_total{stage="serverread"} 0`,
+		`handshake_window_attempts{remote="1.2.3.4:443"} 2`,
+		`handshake_window_failure_ratio{remote="1.2.3.4:443"} 0.5`,
+	} {
+		if !strings.Contains(body, exp+"\n") {
+			t.Error(
+				"For", "/metrics",
+				"expected", exp,
+				"got", body,
+			)
+		}
+	}
+}
+
+func TestLabelledMetrics(t *testing.T) {
+	m := &Metrics{Tracker: NewConnTracker()}
+	m.HandshakeFailed("dial")
+	m.HandshakeFailedFor("tenant-a", "dial")
+	m.HandshakeFailedFor("tenant-b", "serverread")
+	m.Tracker.Add("127.0.0.1:1000", "1.2.3.4:443")
+	m.Tracker.AddLabelled("127.0.0.1:1001", "1.2.3.4:443", "tenant-a")
+	m.Tracker.AddLabelled("127.0.0.1:1002", "1.2.3.4:443", "tenant-a")
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, exp := range []string{
+		`handshake_failures_total{stage="dial"} 2`,
+		`handshake_failures_total{stage="serverread"} 1`,
+		`labelled_handshake_failures_total{label="tenant-a",stage="dial"} 1`,
+		`labelled_handshake_failures_total{label="tenant-a",stage="serverread"} 0`,
+		`labelled_handshake_failures_total{label="tenant-b",stage="serverread"} 1`,
+		`active_connections 3`,
+		`labelled_active_connections{label="tenant-a"} 2`,
+	} {
+		if !strings.Contains(body, exp+"\n") {
+			t.Error("For", "/metrics", "expected", exp, "got", body)
+		}
+	}
+}
+
+func TestGoroutinesAndFDs(t *testing.T) {
+	rec := httptest.NewRecorder()
+	(&Metrics{}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	exp := []string{"go_goroutines "}
+	if _, ok := OpenFDs(); ok {
+		exp = append(exp, "process_open_fds ")
+	}
+	for _, e := range exp {
+		if !strings.Contains(body, "\n"+e) {
+			t.Error("For", "/metrics", "expected", e, "got", body)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package gqclient
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Number of sources above which buckets that have filled up again are dropped,
+// so that many short-lived sources don't use up memory
+const maxIdleBuckets = 1024
+
+// RateLimiter limits how often connections are accepted from each source, with
+// a token bucket per source IP
+type RateLimiter struct {
+	Now     func() time.Time
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter makes a RateLimiter that lets through rate connections a second
+// from each source on average, and up to burst at once
+func NewRateLimiter(rate, burst int) *RateLimiter {
+	return &RateLimiter{
+		Now:     time.Now,
+		rate:    float64(rate),
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow reports whether a connection from source, an address as given by
+// RemoteAddr, should be accepted. The port is left out, since every connection
+// from the same place comes from a different one
+func (l *RateLimiter) Allow(source string) bool {
+	host, _, err := net.SplitHostPort(source)
+	if err != nil {
+		host = source
+	}
+	now := l.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buckets) > maxIdleBuckets {
+		for h, b := range l.buckets {
+			if b.refill(now, l.rate, l.burst) == l.burst {
+				delete(l.buckets, h)
+			}
+		}
+	}
+	b, ok := l.buckets[host]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[host] = b
+	}
+	if b.refill(now, l.rate, l.burst) < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill adds the tokens earned since the last time and returns how many there are
+func (b *bucket) refill(now time.Time, rate, burst float64) float64 {
+	// A clock going backwards earns nothing rather than taking tokens away
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * rate
+	}
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	return b.tokens
+}
@@ -0,0 +1,47 @@
+package gqclient
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	l := NewRateLimiter(2, 3)
+	l.Now = func() time.Time { return now }
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		// Different ports of the same host share a bucket
+		if l.Allow("127.0.0.1:" + strconv.Itoa(40000+i)) {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Error("For", "10 connections at once", "expected", 3, "got", allowed)
+	}
+	if !l.Allow("192.168.1.2:40000") {
+		t.Error("For", "another host", "expected", true, "got", false)
+	}
+
+	now = now.Add(time.Second)
+	allowed = 0
+	for i := 0; i < 10; i++ {
+		if l.Allow("127.0.0.1:50000") {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Error("For", "10 connections a second later", "expected", 2, "got", allowed)
+	}
+
+	for i := 0; i <= maxIdleBuckets; i++ {
+		l.Allow("10.0." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256) + ":1")
+	}
+	now = now.Add(time.Minute)
+	l.Allow("127.0.0.1:50000")
+	if len(l.buckets) != 1 {
+		t.Error("For", "idle buckets", "expected", 1, "got", len(l.buckets))
+	}
+}
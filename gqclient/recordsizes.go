@@ -0,0 +1,48 @@
+package gqclient
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// The upper bounds of the buckets of a RecordSizes, the last one taking anything
+// bigger
+var recordSizeBounds = []int{64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384}
+
+// RecordSizes is a histogram of the sizes of the TLS records received on a
+// connection, in buckets of powers of two
+type RecordSizes struct {
+	mu     sync.Mutex
+	counts [10]int
+}
+
+// Add counts a record carrying size bytes
+func (h *RecordSizes) Add(size int) {
+	i := 0
+	for i < len(recordSizeBounds) && size > recordSizeBounds[i] {
+		i++
+	}
+	h.mu.Lock()
+	h.counts[i]++
+	h.mu.Unlock()
+}
+
+// String returns the buckets that have records, smallest first, like
+// "<=64:2 <=1024:5 >16384:1"
+func (h *RecordSizes) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var buckets []string
+	for i, n := range h.counts {
+		if n == 0 {
+			continue
+		}
+		if i < len(recordSizeBounds) {
+			buckets = append(buckets, fmt.Sprintf("<=%v:%v", recordSizeBounds[i], n))
+		} else {
+			buckets = append(buckets, fmt.Sprintf(">%v:%v", recordSizeBounds[i-1], n))
+		}
+	}
+	return strings.Join(buckets, " ")
+}
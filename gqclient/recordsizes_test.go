@@ -0,0 +1,19 @@
+package gqclient
+
+import (
+	"testing"
+)
+
+func TestRecordSizes(t *testing.T) {
+	h := &RecordSizes{}
+	if got := h.String(); got != "" {
+		t.Error("For", "no records", "expected", "", "got", got)
+	}
+	for _, size := range []int{0, 64, 65, 1000, 1024, 16384, 16385} {
+		h.Add(size)
+	}
+	exp := "<=64:2 <=128:1 <=1024:2 <=16384:1 >16384:1"
+	if got := h.String(); got != exp {
+		t.Error("For", "records", "expected", exp, "got", got)
+	}
+}
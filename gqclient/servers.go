@@ -0,0 +1,202 @@
+package gqclient
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+type serverStat struct {
+	addr    string
+	rtt     time.Duration
+	healthy bool
+	// Handshakes in a row that couldn't reach it
+	failures int
+}
+
+// Handshakes in a row that can't reach a server, by failing to connect or timing
+// out, before it's taken as down until a probe reaches it again
+const failoverAfter = 2
+
+// ServerPool keeps track of the latency to each remote server so that the
+// nearest working one can be used
+type ServerPool struct {
+	m       sync.RWMutex
+	servers []*serverStat
+	// The server the last handshake that worked was with
+	last string
+}
+
+// NewServerPool makes a ServerPool from a list of host:port. Until they are
+// probed, all servers are considered healthy and the first one is preferred
+func NewServerPool(addrs []string) *ServerPool {
+	sp := &ServerPool{}
+	for _, addr := range addrs {
+		sp.servers = append(sp.servers, &serverStat{addr: addr, healthy: true})
+	}
+	return sp
+}
+
+// Best returns the healthy server with the lowest latency, the one that last
+// worked out of those as near. If none is healthy, the one that last worked is
+// returned, or the first server
+func (sp *ServerPool) Best() string {
+	sp.m.RLock()
+	defer sp.m.RUnlock()
+	var best *serverStat
+	for _, s := range sp.servers {
+		if !s.healthy {
+			continue
+		}
+		if best == nil || s.rtt < best.rtt || s.rtt == best.rtt && s.addr == sp.last {
+			best = s
+		}
+	}
+	if best == nil {
+		if sp.last != "" {
+			return sp.last
+		}
+		return sp.servers[0].addr
+	}
+	return best.addr
+}
+
+// BestExcept returns the healthy server with the lowest latency other than addr.
+// If there is no other healthy one, addr is returned
+func (sp *ServerPool) BestExcept(addr string) string {
+	sp.m.RLock()
+	defer sp.m.RUnlock()
+	var best *serverStat
+	for _, s := range sp.servers {
+		if !s.healthy || s.addr == addr {
+			continue
+		}
+		if best == nil || s.rtt < best.rtt {
+			best = s
+		}
+	}
+	if best == nil {
+		return addr
+	}
+	return best.addr
+}
+
+// BestOfOtherFamily returns the healthy server with the lowest latency whose IP
+// is of the other family from that of addr, for happy eyeballs. Only servers given
+// as IPs are known to be of one family
+func (sp *ServerPool) BestOfOtherFamily(addr string) (string, bool) {
+	family := func(addr string) int {
+		host, _, err := net.SplitHostPort(addr)
+		ip := net.ParseIP(host)
+		switch {
+		case err != nil || ip == nil:
+			return 0
+		case ip.To4() != nil:
+			return 4
+		}
+		return 6
+	}
+	want := 10 - family(addr)
+	if want == 10 {
+		return "", false
+	}
+	sp.m.RLock()
+	defer sp.m.RUnlock()
+	var best *serverStat
+	for _, s := range sp.servers {
+		if !s.healthy || family(s.addr) != want {
+			continue
+		}
+		if best == nil || s.rtt < best.rtt {
+			best = s
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	return best.addr, true
+}
+
+// Has reports whether addr is one of the servers
+func (sp *ServerPool) Has(addr string) bool {
+	sp.m.RLock()
+	defer sp.m.RUnlock()
+	for _, s := range sp.servers {
+		if s.addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Worked records a handshake with addr that worked, which makes it the one
+// remembered in Best
+func (sp *ServerPool) Worked(addr string) {
+	sp.m.Lock()
+	defer sp.m.Unlock()
+	for _, s := range sp.servers {
+		if s.addr == addr {
+			s.failures = 0
+			s.healthy = true
+			sp.last = addr
+		}
+	}
+}
+
+// Failed records a handshake that couldn't reach addr. After failoverAfter in a
+// row it's taken as down, so that Best goes to another one
+func (sp *ServerPool) Failed(addr string) {
+	sp.m.Lock()
+	defer sp.m.Unlock()
+	for _, s := range sp.servers {
+		if s.addr != addr {
+			continue
+		}
+		s.failures++
+		if s.failures >= failoverAfter {
+			s.healthy = false
+		}
+	}
+}
+
+// report updates the latency estimate of a server using a moving average
+// like the smoothed RTT of TCP (RFC 6298)
+func (sp *ServerPool) report(addr string, rtt time.Duration, err error) {
+	sp.m.Lock()
+	defer sp.m.Unlock()
+	for _, s := range sp.servers {
+		if s.addr != addr {
+			continue
+		}
+		if err != nil {
+			s.healthy = false
+			continue
+		}
+		s.failures = 0
+		if !s.healthy || s.rtt == 0 {
+			s.healthy = true
+			s.rtt = rtt
+		} else {
+			s.rtt = s.rtt*7/8 + rtt/8
+		}
+	}
+}
+
+// Probe measures the time taken by ping for every server once. ping should make
+// a whole connection that carries data rather than only a TCP connection, as one
+// closed as soon as it's made is what a prober makes, a meaningless handshake
+// that may be significant to the GFW
+func (sp *ServerPool) Probe(ping func(addr string) error) {
+	sp.m.RLock()
+	addrs := make([]string, len(sp.servers))
+	for i, s := range sp.servers {
+		addrs[i] = s.addr
+	}
+	sp.m.RUnlock()
+
+	for _, addr := range addrs {
+		start := time.Now()
+		err := ping(addr)
+		sp.report(addr, time.Since(start), err)
+	}
+}
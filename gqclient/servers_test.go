@@ -0,0 +1,141 @@
+package gqclient
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestServerPoolBest(t *testing.T) {
+	sp := NewServerPool([]string{"a:443", "b:443", "c:443"})
+	if best := sp.Best(); best != "a:443" {
+		t.Error(
+			"For", "unprobed pool",
+			"expected", "a:443",
+			"got", best,
+		)
+	}
+
+	sp.report("a:443", 300*time.Millisecond, nil)
+	sp.report("b:443", 100*time.Millisecond, nil)
+	sp.report("c:443", 0, errors.New("unreachable"))
+	if best := sp.Best(); best != "b:443" {
+		t.Error(
+			"For", "b fastest, c down",
+			"expected", "b:443",
+			"got", best,
+		)
+	}
+
+	// One slow sample shouldn't outweigh the history
+	sp.report("b:443", 900*time.Millisecond, nil)
+	if best := sp.Best(); best != "b:443" {
+		t.Error(
+			"For", "one slow sample on b",
+			"expected", "b:443",
+			"got", best,
+		)
+	}
+
+	if other := sp.BestExcept("b:443"); other != "a:443" {
+		t.Error(
+			"For", "all but b, c down",
+			"expected", "a:443",
+			"got", other,
+		)
+	}
+	sp.report("a:443", 0, errors.New("unreachable"))
+	if other := sp.BestExcept("b:443"); other != "b:443" {
+		t.Error(
+			"For", "all but b, a and c down",
+			"expected", "b:443",
+			"got", other,
+		)
+	}
+}
+
+func TestServerPoolProbe(t *testing.T) {
+	sp := NewServerPool([]string{"a:443", "b:443"})
+	sp.Probe(func(addr string) error {
+		if addr == "a:443" {
+			return errors.New("unreachable")
+		}
+		return nil
+	})
+	if best := sp.Best(); best != "b:443" {
+		t.Error(
+			"For", "a unreachable",
+			"expected", "b:443",
+			"got", best,
+		)
+	}
+
+	sp.Probe(func(addr string) error {
+		return errors.New("unreachable")
+	})
+	if best := sp.Best(); best != "a:443" {
+		t.Error(
+			"For", "all unreachable",
+			"expected", "a:443",
+			"got", best,
+		)
+	}
+}
+
+func TestServerPoolFailover(t *testing.T) {
+	sp := NewServerPool([]string{"a:443", "b:443"})
+	sp.Worked("b:443")
+	if best := sp.Best(); best != "b:443" {
+		t.Error(
+			"For", "unprobed pool, b last worked",
+			"expected", "b:443",
+			"got", best,
+		)
+	}
+
+	for i := 0; i < failoverAfter; i++ {
+		sp.Failed("b:443")
+	}
+	if best := sp.Best(); best != "a:443" {
+		t.Error(
+			"For", "b failed", failoverAfter, "times",
+			"expected", "a:443",
+			"got", best,
+		)
+	}
+
+	// A probe that reaches it brings it back
+	sp.report("b:443", 100*time.Millisecond, nil)
+	sp.report("a:443", 100*time.Millisecond, nil)
+	sp.Failed("b:443")
+	if best := sp.Best(); best != "b:443" {
+		t.Error(
+			"For", "as near as a, b failed once since it was probed",
+			"expected", "b:443",
+			"got", best,
+		)
+	}
+}
+
+func TestServerPoolBestOfOtherFamily(t *testing.T) {
+	sp := NewServerPool([]string{"192.0.2.1:443", "example.com:443", "[2001:db8::1]:443", "[2001:db8::2]:8443"})
+	sp.report("[2001:db8::1]:443", 300*time.Millisecond, nil)
+	sp.report("[2001:db8::2]:8443", 100*time.Millisecond, nil)
+	sp.report("192.0.2.1:443", 0, errors.New("unreachable"))
+	for addr, exp := range map[string]string{
+		"192.0.2.1:443":      "[2001:db8::2]:8443",
+		"[2001:db8::1]:443":  "",
+		"example.com:443":    "",
+		"198.51.100.1:443":   "[2001:db8::2]:8443",
+		"[2001:db8::3]:8443": "",
+	} {
+		other, ok := sp.BestOfOtherFamily(addr)
+		if other != exp || ok != (exp != "") {
+			t.Error(
+				"For", addr,
+				"expected", exp,
+				"got", other, ok,
+			)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package gqclient
+
+// SignatureSchemes are the names of the values allowed in the signature_algorithms
+// extension, as in RFC 8446
+var SignatureSchemes = map[string]uint16{
+	"rsa_pkcs1_sha1":         0x0201,
+	"ecdsa_sha1":             0x0203,
+	"rsa_pkcs1_sha256":       0x0401,
+	"ecdsa_secp256r1_sha256": 0x0403,
+	"rsa_pkcs1_sha384":       0x0501,
+	"ecdsa_secp384r1_sha384": 0x0503,
+	"rsa_pkcs1_sha512":       0x0601,
+	"ecdsa_secp521r1_sha512": 0x0603,
+	"rsa_pss_rsae_sha256":    0x0804,
+	"rsa_pss_rsae_sha384":    0x0805,
+	"rsa_pss_rsae_sha512":    0x0806,
+	"ed25519":                0x0807,
+	"ed448":                  0x0808,
+	"rsa_pss_pss_sha256":     0x0809,
+	"rsa_pss_pss_sha384":     0x080a,
+	"rsa_pss_pss_sha512":     0x080b,
+}
+
+// DefaultDelegatedCredentials are the signature schemes Firefox advertises in the
+// delegated_credentials extension, which DelegatedCredentials of ["default"] stands for
+var DefaultDelegatedCredentials = []string{"ecdsa_secp256r1_sha256", "ecdsa_secp384r1_sha384", "ecdsa_secp521r1_sha512", "ecdsa_sha1"}
@@ -0,0 +1,7 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package gqclient
+
+// SO_REUSEPORT in asm-generic/socket.h. The syscall package doesn't have it
+const soReusePort = 0xf
@@ -0,0 +1,7 @@
+//go:build (linux && mips) || (linux && mipsle) || (linux && mips64) || (linux && mips64le)
+// +build linux,mips linux,mipsle linux,mips64 linux,mips64le
+
+package gqclient
+
+// SO_REUSEPORT in arch/mips/include/uapi/asm/socket.h
+const soReusePort = 0x200
@@ -2,9 +2,21 @@ package gqclient
 
 import (
 	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,20 +25,136 @@ type stateManager interface {
 	SetAESKey(string)
 }
 
-// State stores global variables
+// State stores global variables. It isn't modified once handshakes use it, so
+// its fields, Now included, are read without locking. A reload makes a new State.
+// Now is the wall clock the server checks tickets against, so it's only used
+// for timestamps, not to measure durations
 type State struct {
 	SS_LOCAL_HOST  string
 	SS_LOCAL_PORT  string
 	SS_REMOTE_HOST string
 	SS_REMOTE_PORT string
-	Now            func() time.Time
-	Opaque         int
+	Now            func() time.Time `json:"-"`
+	Opaque         int              `json:"-"`
 	Key            string
 	TicketTimeHint int
-	AESKey         []byte
+	AESKey         []byte `json:"-"`
 	ServerName     string
-	Browser        string
-	FastOpen       bool
+	// When ServerName is given as a list, the names in it, which connections take
+	// turns with. ServerName is the first of them
+	ServerNames             []string `json:",omitempty"`
+	Browser                 string
+	FastOpen                bool
+	MaxConnLifetime         int
+	LogFile                 string
+	LogMaxSizeMB            int
+	LogMaxFiles             int
+	RemoteServers           []string
+	ProbeInterval           int
+	ServerPool              *ServerPool `json:"-"`
+	LogLevel                string
+	SessionID               string
+	ReusePort               bool
+	MaxBytesPerConn         int
+	ListenBacklog           int
+	Route                   string
+	Compress                bool
+	MetricsAddr             string
+	DSCP                    int
+	LingerAfterClose        int
+	SignatureAlgorithms     []string
+	AuditFile               string
+	BufferAutoTune          bool
+	AdminSocket             string
+	Rand                    io.Reader `json:"-"`
+	SimulateResumption      int
+	ExtensionSet            string
+	Extensions              []string
+	NoDelay                 *bool
+	RetryWithNewFingerprint bool
+	BindInterface           string
+	CertCompression         []string
+	ConnRateLimit           int
+	ConnBurst               int
+	StrictRecordValidation  bool
+	HedgeConnections        bool
+	HedgeDelay              int
+	DetectInterception      bool
+	HappyEyeballs           bool
+	FailureWindow           int
+	FailureAlertPercent     int
+	MaxRecordSize           int
+	RecordSizeLimit         bool
+	RawExtensions           []string
+	ReplyDelayMaxMs         int
+	LogRecordSizes          bool
+	ThrottleLogs            bool
+	HelloTemplate           string
+	RecordSizing            string
+	AllowNon443             bool
+	DelegatedCredentials    []string
+	CheckForUpdates         bool
+	UpdateURL               string
+	ConnJitterMaxMs         int
+	WarmPoolSize            int
+	WarmPoolMaxIdle         int
+	BlackHoleTimeout        int
+	BlackHoleRecordSize     int
+	// Searches each connection for the largest record that doesn't stall
+	AutoMTU          bool
+	LocalPortRange   string
+	PprofAddr        string
+	RetryBudget      int
+	ClientHelloSplit int
+	UpBufferSize     int
+	DownBufferSize   int
+	StatusAddr       string
+	TraceFile        string
+	// Limits on putting the server's handshake messages back together
+	MaxHandshakeMessageSize    int
+	MaxHandshakeMessageRecords int
+	DNSRetries                 int
+	DNSTimeoutMs               int
+	// Tags the connections from SS in logs, metrics and the audit log
+	Label string
+	// Relays UDP from SS to the server, as SIP003u
+	UDPRelay bool
+	// Carries the connections from SS as streams over this many connections
+	MuxSessions int
+	// Seconds in each window of time a ClientHello is made for, which has to be
+	// the server's AuthWindow
+	AuthWindow int
+	// Seconds each attempt at a handshake with the server may take
+	HandshakeTimeout int
+	// Seconds a connection may go without data either way before it's closed
+	IdleTimeout int
+	// The most connections from SS at once, those over it are closed
+	MaxConnections int
+	// How the fake TLS gets to the server: tcp, or websocket to WebSocketURL
+	Transport string
+	// The ws:// or wss:// URL of the server's WebSocket, e.g. through a CDN
+	WebSocketURL string
+	// Read from the HelloTemplate file if Browser is template
+	Template *HelloTemplate `json:"-"`
+	// What was wrong with the config but has been worked around, for the caller
+	// to log
+	Warnings []string `json:"-"`
+	// Set for the smoke test, so that the server echoes the connection back
+	Ping   bool                                         `json:"-"`
+	Dialer func(network, addr string) (net.Conn, error) `json:"-"`
+	// Set for the connection of a UDP session, so that the server relays the
+	// datagrams in it to ss-server over UDP
+	Datagrams bool `json:"-"`
+	// Set for a connection carrying streams
+	Mux bool `json:"-"`
+	// Set for a connection from -socks, which starts with the address the server
+	// is to dial itself
+	Connect bool `json:"-"`
+	// Makes the 32 bytes of the ClientHello's random field that the server
+	// authenticates us by, in place of MakeRandomField's derivation. It's for
+	// trying out other auth schemes and has to be matched by AuthVerifyFunc on the
+	// server, or every connection fails auth and is sent to the web server
+	AuthPayloadFunc func(sta *State) []byte `json:"-"`
 }
 
 // semi-colon separated value. This is for Android plugin options
@@ -48,9 +176,18 @@ func ssvToJson(ssv string) (ret []byte) {
 		value := sp[1]
 		// JSON doesn't like quotation marks around int and boolean
 		// Yes this is extremely ugly but it's still better than writing a tokeniser
-		if key == "TicketTimeHint" || key == "FastOpen" {
+		if _, err := strconv.Atoi(value); key == "TicketTimeHint" && err != nil {
+			// A duration like 1h, which is a string in JSON
+			ret = append(ret, []byte("\""+key+"\":\""+value+"\",")...)
+			continue
+		}
+		switch key {
+		case "TicketTimeHint", "FastOpen", "MaxConnLifetime", "LogMaxSizeMB", "LogMaxFiles", "ProbeInterval", "ReusePort", "MaxBytesPerConn", "ListenBacklog", "Compress", "DSCP", "LingerAfterClose", "BufferAutoTune", "SimulateResumption", "NoDelay", "RetryWithNewFingerprint", "ConnRateLimit", "ConnBurst", "StrictRecordValidation", "HedgeConnections", "HedgeDelay", "DetectInterception", "HappyEyeballs", "FailureWindow", "FailureAlertPercent", "MaxRecordSize", "RecordSizeLimit", "ReplyDelayMaxMs", "LogRecordSizes", "ThrottleLogs", "AllowNon443", "CheckForUpdates", "ConnJitterMaxMs", "WarmPoolSize", "WarmPoolMaxIdle", "BlackHoleTimeout", "BlackHoleRecordSize", "RetryBudget", "ClientHelloSplit", "UpBufferSize", "DownBufferSize", "MaxHandshakeMessageSize", "MaxHandshakeMessageRecords", "DNSRetries", "DNSTimeoutMs", "AutoMTU", "UDPRelay", "MuxSessions", "AuthWindow", "HandshakeTimeout", "IdleTimeout", "MaxConnections":
 			ret = append(ret, []byte("\""+key+"\":"+value+",")...)
-		} else {
+		case "ServerName", "RemoteServers", "SignatureAlgorithms", "Extensions", "CertCompression", "RawExtensions", "DelegatedCredentials":
+			// comma separated list
+			ret = append(ret, []byte("\""+key+"\":[\""+strings.Replace(value, ",", "\",\"", -1)+"\"],")...)
+		default:
 			ret = append(ret, []byte("\""+key+"\":\""+value+"\",")...)
 		}
 	}
@@ -66,17 +203,709 @@ func (sta *State) ParseConfig(config string) (err error) {
 		content = ssvToJson(config)
 	} else {
 		content, err = ioutil.ReadFile(config)
+		if os.IsNotExist(err) {
+			// The path is relative to the working directory, which may not be the expected one
+			if abs, absErr := filepath.Abs(config); absErr == nil {
+				config = abs
+			}
+			return errors.New("Config file not found: " + config)
+		}
 		if err != nil {
 			return err
 		}
+		if IsEncryptedConfig(content) {
+			passphrase, err := ConfigPassphrase()
+			if err != nil {
+				return err
+			}
+			// Only ever kept in memory
+			content, err = DecryptConfig(content, passphrase)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	content, err = expandEnv(content)
+	if err != nil {
+		return err
+	}
+	content, err = ticketTimeHintSeconds(content)
+	if err != nil {
+		return err
+	}
+	content, err = serverNameList(content)
+	if err != nil {
+		return err
 	}
 	err = json.Unmarshal(content, &sta)
 	if err != nil {
+		return errors.New("Invalid JSON in config: " + err.Error())
+	}
+	if err = sta.validate(); err != nil {
 		return err
 	}
+	return sta.loadTemplate()
+}
+
+// loadTemplate reads the HelloTemplate file if Browser is template
+func (sta *State) loadTemplate() (err error) {
+	if sta.Browser != "template" {
+		return nil
+	}
+	sta.Template, err = LoadHelloTemplate(sta.HelloTemplate)
+	if err == nil && sta.RecordSizing == "browser" && len(sta.Template.FirstRecordSizes) == 0 {
+		return errors.New("RecordSizing browser needs FirstRecordSizes in the HelloTemplate")
+	}
+	return err
+}
+
+// ticketTimeHintSeconds replaces a TicketTimeHint given as a duration string,
+// like "1h", with the number of seconds in it. A number is left as seconds
+func ticketTimeHintSeconds(content []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(content, &fields) != nil {
+		// Reported when it's parsed into the State
+		return content, nil
+	}
+	raw, ok := fields["TicketTimeHint"]
+	if !ok || len(raw) == 0 || raw[0] != '"' {
+		return content, nil
+	}
+	var s string
+	json.Unmarshal(raw, &s)
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return nil, errors.New("Bad TicketTimeHint: " + err.Error())
+	}
+	if d%time.Second != 0 {
+		return nil, errors.New("TicketTimeHint must be a whole number of seconds: " + s)
+	}
+	fields["TicketTimeHint"] = json.RawMessage(strconv.Itoa(int(d / time.Second)))
+	return json.Marshal(fields)
+}
+
+// serverNameList moves a ServerName given as a list of names into ServerNames,
+// leaving the first as ServerName. A list of one is the same as just the name
+func serverNameList(content []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(content, &fields) != nil {
+		return content, nil
+	}
+	raw, ok := fields["ServerName"]
+	if !ok || len(raw) == 0 || raw[0] != '[' {
+		return content, nil
+	}
+	var names []string
+	if err := json.Unmarshal(raw, &names); err != nil {
+		return nil, errors.New("Bad ServerName: " + err.Error())
+	}
+	if len(names) == 0 {
+		return nil, errors.New("ServerName cannot be an empty list")
+	}
+	fields["ServerName"], _ = json.Marshal(names[0])
+	delete(fields, "ServerNames")
+	if len(names) > 1 {
+		fields["ServerNames"] = raw
+	}
+	return json.Marshal(fields)
+}
+
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${VAR} in the config with the value of the environment variable VAR.
+// The value is escaped so that it stays inside the JSON string it's placed in
+func expandEnv(content []byte) ([]byte, error) {
+	var err error
+	ret := envRef.ReplaceAllFunc(content, func(ref []byte) []byte {
+		name := string(envRef.FindSubmatch(ref)[1])
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			if err == nil {
+				err = errors.New("Undefined environment variable in config: " + name)
+			}
+			return ref
+		}
+		quoted, _ := json.Marshal(value)
+		return quoted[1 : len(quoted)-1]
+	})
+	return ret, err
+}
+
+// Browsers are the values allowed for Browser. chrome is the same as chrome-64
+var Browsers = []string{"chrome", "chrome-64", "chrome-120", "firefox", "safari"}
+
+// validate checks the values parsed from the config. Options that cannot be
+// used together or that depend on each other are also checked here so that
+// main doesn't need to know about them
+func (sta *State) validate() error {
+	switch {
+	case sta.Key == "":
+		return errors.New("Missing required field in config: Key")
+	case sta.TicketTimeHint == 0:
+		return errors.New("Missing required field in config: TicketTimeHint")
+	}
+	if sta.TicketTimeHint < 0 {
+		return errors.New("TicketTimeHint cannot be negative")
+	}
+	// Configs from before Browser was required, or with a browser a later version
+	// dropped, carry on as chrome
+	supported := sta.Browser == "template"
+	for _, b := range Browsers {
+		supported = supported || b == sta.Browser
+	}
+	switch {
+	case sta.Browser == "":
+		sta.Warnings = append(sta.Warnings, "Browser isn't set, using chrome")
+		sta.Browser = "chrome"
+	case !supported:
+		sta.Warnings = append(sta.Warnings, "Unsupported browser: "+sta.Browser+", using chrome. Available: "+strings.Join(Browsers, ", ")+", template")
+		sta.Browser = "chrome"
+	}
+	for _, name := range append([]string{sta.ServerName}, sta.ServerNames...) {
+		if name != "" && !validHostname(name) {
+			return errors.New("ServerName must be a host name: " + name)
+		}
+	}
+	if (sta.Browser == "template") != (sta.HelloTemplate != "") {
+		return errors.New("HelloTemplate must be set with Browser template and only then")
+	}
+	if sta.MaxConnLifetime < 0 {
+		return errors.New("MaxConnLifetime cannot be negative")
+	}
+	if sta.LingerAfterClose < 0 {
+		return errors.New("LingerAfterClose cannot be negative")
+	}
+	if sta.MaxBytesPerConn < 0 {
+		return errors.New("MaxBytesPerConn cannot be negative")
+	}
+	if sta.LogMaxSizeMB < 0 || sta.LogMaxFiles < 0 {
+		return errors.New("LogMaxSizeMB and LogMaxFiles cannot be negative")
+	}
+	if sta.ListenBacklog < 0 {
+		return errors.New("ListenBacklog cannot be negative")
+	}
+	if sta.DSCP < 0 || sta.DSCP > 63 {
+		return errors.New("DSCP must be between 0 and 63")
+	}
+	if sta.SimulateResumption < 0 || sta.SimulateResumption > 100 {
+		return errors.New("SimulateResumption must be between 0 and 100")
+	}
+	if sta.SimulateResumption != 0 && sta.Browser != "chrome-120" {
+		return errors.New("SimulateResumption is only supported with Browser chrome-120")
+	}
+	if sta.ConnRateLimit < 0 || sta.ConnBurst < 0 {
+		return errors.New("ConnRateLimit and ConnBurst cannot be negative")
+	}
+	if sta.ConnBurst != 0 && sta.ConnRateLimit == 0 {
+		return errors.New("ConnBurst can only be used with ConnRateLimit")
+	}
+	if sta.ReplyDelayMaxMs < 0 || sta.ReplyDelayMaxMs > maxReplyDelayMs {
+		return errors.New("ReplyDelayMaxMs must be between 0 and 1000")
+	}
+	if sta.ConnJitterMaxMs < 0 || sta.ConnJitterMaxMs > maxConnJitterMs {
+		return errors.New("ConnJitterMaxMs must be between 0 and 1000")
+	}
+	if sta.WarmPoolSize < 0 || sta.WarmPoolSize > maxWarmPoolSize {
+		return errors.New("WarmPoolSize must be between 0 and 16")
+	}
+	if sta.WarmPoolMaxIdle < 0 {
+		return errors.New("WarmPoolMaxIdle cannot be negative")
+	}
+	if sta.WarmPoolMaxIdle != 0 && sta.WarmPoolSize == 0 {
+		return errors.New("WarmPoolMaxIdle can only be used with WarmPoolSize")
+	}
+	if sta.RetryBudget < 0 {
+		return errors.New("RetryBudget cannot be negative")
+	}
+	if sta.HandshakeTimeout < 0 {
+		return errors.New("HandshakeTimeout cannot be negative")
+	}
+	if sta.IdleTimeout < 0 {
+		return errors.New("IdleTimeout cannot be negative")
+	}
+	if sta.MaxConnections < 0 {
+		return errors.New("MaxConnections cannot be negative")
+	}
+	if sta.ClientHelloSplit < 0 {
+		return errors.New("ClientHelloSplit cannot be negative")
+	}
+	if sta.ClientHelloSplit != 0 && sta.FastOpen {
+		// The ClientHello goes in the SYN in one piece
+		return errors.New("ClientHelloSplit cannot be used with FastOpen")
+	}
+	if sta.HedgeDelay < 0 {
+		return errors.New("HedgeDelay cannot be negative")
+	}
+	if sta.HedgeDelay != 0 && !sta.HedgeConnections {
+		return errors.New("HedgeDelay can only be used with HedgeConnections")
+	}
+	if sta.HappyEyeballs && sta.FastOpen {
+		// Both connections would carry the same ClientHello, and gq-server
+		// takes the one that arrives second for a replay
+		return errors.New("HappyEyeballs cannot be used with FastOpen")
+	}
+	if sta.FailureWindow < 0 {
+		return errors.New("FailureWindow cannot be negative")
+	}
+	if sta.FailureAlertPercent < 0 || sta.FailureAlertPercent > 100 {
+		return errors.New("FailureAlertPercent must be between 0 and 100")
+	}
+	if sta.UpBufferSize != 0 && (sta.UpBufferSize < 1024 || sta.UpBufferSize > 16384) {
+		// What's read into it is sent in one record
+		return errors.New("UpBufferSize must be between 1024 and 16384")
+	}
+	if sta.DownBufferSize != 0 && (sta.DownBufferSize < 1024 || sta.DownBufferSize > 65540) {
+		// It has to hold a whole record, which can't be longer than that
+		return errors.New("DownBufferSize must be between 1024 and 65540")
+	}
+	if sta.DNSRetries < 0 || sta.DNSRetries > 10 {
+		return errors.New("DNSRetries must be between 0 and 10")
+	}
+	if sta.DNSTimeoutMs != 0 && (sta.DNSTimeoutMs < 100 || sta.DNSTimeoutMs > 60000) {
+		return errors.New("DNSTimeoutMs must be between 100 and 60000")
+	}
+	if sta.MaxHandshakeMessageSize != 0 && (sta.MaxHandshakeMessageSize < 1024 || sta.MaxHandshakeMessageSize > 1<<24-1) {
+		// The most a handshake message's 3 byte length can say
+		return errors.New("MaxHandshakeMessageSize must be between 1024 and 16777215")
+	}
+	if sta.MaxHandshakeMessageRecords < 0 || sta.MaxHandshakeMessageRecords > 8 {
+		// No more records than that are read in the whole handshake
+		return errors.New("MaxHandshakeMessageRecords must be between 1 and 8, or 0 for the default")
+	}
+	if sta.MaxRecordSize != 0 && (sta.MaxRecordSize < 64 || sta.MaxRecordSize > 16384) {
+		// The range allowed in record_size_limit
+		return errors.New("MaxRecordSize must be between 64 and 16384")
+	}
+	if len(sta.Label) > 64 {
+		return errors.New("Label can't be longer than 64 characters")
+	}
+	for _, c := range sta.Label {
+		// It goes in log lines and Prometheus label values as it is
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return errors.New("Label can only have letters, digits, '-', '_' and '.'")
+		}
+	}
+	if sta.LocalPortRange != "" {
+		if _, _, err := sta.LocalPorts(); err != nil {
+			return err
+		}
+		// Every instance would get the first port
+		if sta.ReusePort {
+			return errors.New("LocalPortRange can't be used with ReusePort")
+		}
+	}
+	if sta.BlackHoleTimeout < 0 {
+		return errors.New("BlackHoleTimeout cannot be negative")
+	}
+	if sta.BlackHoleRecordSize != 0 && (sta.BlackHoleRecordSize < 64 || sta.BlackHoleRecordSize > 16384) {
+		return errors.New("BlackHoleRecordSize must be between 64 and 16384")
+	}
+	if sta.BlackHoleRecordSize != 0 && sta.BlackHoleTimeout == 0 {
+		return errors.New("BlackHoleRecordSize can only be used with BlackHoleTimeout")
+	}
+	if sta.AutoMTU && sta.BlackHoleTimeout == 0 {
+		// It's how long a record has to get through in
+		return errors.New("AutoMTU can only be used with BlackHoleTimeout")
+	}
+	if sta.AutoMTU && sta.BlackHoleRecordSize != 0 {
+		return errors.New("AutoMTU can't be used with BlackHoleRecordSize")
+	}
+	if sta.MuxSessions < 0 || sta.MuxSessions > maxMuxSessions {
+		return errors.New("MuxSessions must be between 0 and 8")
+	}
+	if sta.MuxSessions != 0 && (sta.WarmPoolSize != 0 || sta.BlackHoleTimeout != 0) {
+		// Streams are opened without a handshake of their own, and what stalls
+		// is the connection they share rather than any one of them
+		return errors.New("MuxSessions can't be used with WarmPoolSize or BlackHoleTimeout")
+	}
+	if sta.AuthWindow != 0 && (sta.AuthWindow < minAuthWindow || sta.AuthWindow > defaultAuthWindow) {
+		return errors.New("AuthWindow must be between 60 and 43200")
+	}
+	if sta.ProbeInterval < 0 {
+		return errors.New("ProbeInterval cannot be negative")
+	}
+	seen := make(map[string]bool)
+	for _, name := range sta.SignatureAlgorithms {
+		if _, ok := SignatureSchemes[name]; !ok {
+			return errors.New("Unknown signature algorithm: " + name)
+		}
+		if seen[name] {
+			return errors.New("Duplicate signature algorithm: " + name)
+		}
+		seen[name] = true
+	}
+	seen = make(map[string]bool)
+	for _, name := range sta.CertCompression {
+		if _, ok := CertCompressionAlgorithms[name]; !ok {
+			return errors.New("Unknown certificate compression algorithm: " + name)
+		}
+		if seen[name] {
+			return errors.New("Duplicate certificate compression algorithm: " + name)
+		}
+		seen[name] = true
+	}
+	if sta.UpdateURL != "" {
+		u, err := url.Parse(sta.UpdateURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return errors.New("UpdateURL must be an http or https URL")
+		}
+	}
+	seen = make(map[string]bool)
+	for _, name := range sta.DelegatedCredentials {
+		if name == "default" && len(sta.DelegatedCredentials) == 1 {
+			break
+		}
+		if _, ok := SignatureSchemes[name]; !ok {
+			return errors.New("Unknown signature algorithm in DelegatedCredentials: " + name)
+		}
+		if seen[name] {
+			return errors.New("Duplicate signature algorithm in DelegatedCredentials: " + name)
+		}
+		seen[name] = true
+	}
+	switch sta.ExtensionSet {
+	case "", "full", "minimal":
+		if len(sta.Extensions) != 0 {
+			return errors.New("Extensions can only be used with ExtensionSet custom")
+		}
+	case "custom":
+		if !sta.KeepsExtension("session_ticket") {
+			return errors.New("Extensions must include session_ticket")
+		}
+		// A ClientHello with these but not what they depend on is invalid TLS 1.3
+		if sta.KeepsExtension("pre_shared_key") && !sta.KeepsExtension("psk_key_exchange_modes") {
+			return errors.New("Extensions with pre_shared_key must include psk_key_exchange_modes")
+		}
+		if sta.KeepsExtension("early_data") && !sta.KeepsExtension("pre_shared_key") {
+			return errors.New("Extensions with early_data must include pre_shared_key")
+		}
+	default:
+		return errors.New("Unknown ExtensionSet: " + sta.ExtensionSet)
+	}
+	for _, name := range sta.Extensions {
+		if _, ok := ExtensionTypes[name]; !ok {
+			return errors.New("Unknown extension: " + name)
+		}
+	}
+	if err := validateRawExtensions(sta.RawExtensions); err != nil {
+		return err
+	}
+	switch sta.SessionID {
+	case "", "random", "empty", "resumption":
+	default:
+		return errors.New("Unknown SessionID: " + sta.SessionID)
+	}
+	if sta.BindInterface != "" && !bindInterfaceSupported {
+		return errors.New("BindInterface is only supported on Linux")
+	}
+	if sta.MetricsAddr != "" {
+		if _, _, err := net.SplitHostPort(sta.MetricsAddr); err != nil {
+			return errors.New("Bad MetricsAddr: " + err.Error())
+		}
+	}
+	if sta.PprofAddr != "" {
+		if _, _, err := net.SplitHostPort(sta.PprofAddr); err != nil {
+			return errors.New("Bad PprofAddr: " + err.Error())
+		}
+	}
+	if sta.StatusAddr != "" {
+		host, _, err := net.SplitHostPort(sta.StatusAddr)
+		if err != nil {
+			return errors.New("Bad StatusAddr: " + err.Error())
+		}
+		// It shows where connections come from and go
+		if ip := net.ParseIP(host); host != "" && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return errors.New("StatusAddr must be on loopback")
+		}
+	}
+	switch sta.Transport {
+	case "", "tcp":
+		if sta.WebSocketURL != "" {
+			return errors.New("WebSocketURL can only be used with Transport websocket")
+		}
+	case "websocket":
+		u, err := url.Parse(sta.WebSocketURL)
+		if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			return errors.New("Transport websocket needs a ws:// or wss:// WebSocketURL")
+		}
+	default:
+		return errors.New("Unknown Transport: " + sta.Transport)
+	}
+	switch sta.RecordSizing {
+	case "", "dynamic", "fixed", "browser":
+	default:
+		return errors.New("Unknown RecordSizing: " + sta.RecordSizing)
+	}
+	switch sta.LogLevel {
+	case "", "info", "debug":
+	default:
+		return errors.New("Unknown LogLevel: " + sta.LogLevel)
+	}
+	return nil
+}
+
+// The longest ReplyDelayMaxMs. A client takes milliseconds to process the
+// server's messages, so longer would stand out as much as no delay
+const maxReplyDelayMs = 1000
+
+// The largest MuxSessions. Fewer, longer connections to the server are what it's
+// for
+const maxMuxSessions = 8
+
+// The shortest AuthWindow. The clocks of clients are rarely closer to the server's
+// than this, and each window is one more hash for the server to check
+const minAuthWindow = 60
+
+// The largest WarmPoolSize. A browser doesn't keep more idle connections than this
+// open to one server
+const maxWarmPoolSize = 16
+
+// The longest ConnJitterMaxMs. Enough to spread out a burst of connections
+// without making each of them wait noticeably
+const maxConnJitterMs = 1000
+
+// How many bytes RawExtensions can add to a ClientHello, to leave room for the rest
+// of it in a record of at most 16384 bytes
+const maxRawExtensionsLen = 8192
+
+// validateRawExtensions checks that each of raw is a hex encoded extension record
+// with a type and a length matching its body. session_ticket, which carries the
+// authentication, and pre_shared_key, whose binders can't be made up, can't be set
+func validateRawExtensions(raw []string) error {
+	total := 0
+	seen := make(map[uint16]bool)
+	for _, h := range raw {
+		rec, err := hex.DecodeString(h)
+		if err != nil {
+			return errors.New("Bad hex in RawExtensions: " + h)
+		}
+		if len(rec) < 4 || BtoInt(rec[2:4]) != len(rec)-4 {
+			return errors.New("Malformed extension in RawExtensions: " + h)
+		}
+		typ := binary.BigEndian.Uint16(rec)
+		if typ == ExtensionTypes["session_ticket"] || typ == ExtensionTypes["pre_shared_key"] {
+			return errors.New("RawExtensions can't set session_ticket or pre_shared_key: " + h)
+		}
+		if seen[typ] {
+			return errors.New("Duplicate extension type in RawExtensions: " + h[:4])
+		}
+		seen[typ] = true
+		total += len(rec)
+	}
+	if total > maxRawExtensionsLen {
+		return errors.New("RawExtensions are too long to fit in the ClientHello")
+	}
 	return nil
 }
 
+// Redacted returns the config in sta as indented JSON, with the Key replaced so
+// that it can be logged
+func (sta *State) Redacted() []byte {
+	c := *sta
+	if c.Key != "" {
+		c.Key = "[redacted]"
+	}
+	ret, _ := json.MarshalIndent(&c, "", "\t")
+	return ret
+}
+
+// NonSecret returns the config in sta as JSON without Key, for RestoreNonSecret
+// in another process which reads Key from the config itself
+func (sta *State) NonSecret() []byte {
+	c := *sta
+	c.Key = ""
+	ret, _ := json.Marshal(&c)
+	return ret
+}
+
+// RestoreNonSecret sets the config in sta to the one in data, made by NonSecret.
+// Key is kept, and AESKey has to be set again
+func (sta *State) RestoreNonSecret(data []byte) error {
+	key := sta.Key
+	err := json.Unmarshal(data, sta)
+	sta.Key = key
+	if err != nil {
+		return errors.New("Invalid config to restore: " + err.Error())
+	}
+	if err = sta.validate(); err != nil {
+		return err
+	}
+	return sta.loadTemplate()
+}
+
+// RandBytes returns length random bytes from Rand, or cryptographically secure
+// ones if Rand is nil. Rand is only set by tests to make handshakes reproducible
+func (sta *State) RandBytes(length int) []byte {
+	if sta.Rand == nil {
+		return CryptoRandBytes(length)
+	}
+	ret := make([]byte, length)
+	io.ReadFull(sta.Rand, ret)
+	return ret
+}
+
+// validHostname reports whether name is a DNS host name, which is all the
+// server_name extension can carry
+func validHostname(name string) bool {
+	if len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// The turns connections take through ServerNames
+var serverNameTurn uint32
+
+// WithNextServerName returns the State to make a connection's handshake with:
+// sta itself, or a copy with the next of ServerNames as ServerName if there are
+// several
+func (sta *State) WithNextServerName() *State {
+	if len(sta.ServerNames) < 2 {
+		return sta
+	}
+	c := *sta
+	turn := atomic.AddUint32(&serverNameTurn, 1) - 1
+	c.ServerName = sta.ServerNames[int(turn%uint32(len(sta.ServerNames)))]
+	return &c
+}
+
+// JoinHostPort is net.JoinHostPort for a host that may already be in square
+// brackets, as an IPv6 address given with -s or -b may be
+func JoinHostPort(host, port string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// RemoteAddr returns the address of the server given by SS
+func (sta *State) RemoteAddr() string {
+	return JoinHostPort(sta.SS_REMOTE_HOST, sta.SS_REMOTE_PORT)
+}
+
+// LocalAddr returns the address SS is listened for on
+func (sta *State) LocalAddr() string {
+	return JoinHostPort(sta.SS_LOCAL_HOST, sta.SS_LOCAL_PORT)
+}
+
+// Non443Servers returns the servers, the one given by SS and RemoteServers, that
+// aren't on port 443
+func (sta *State) Non443Servers() []string {
+	var ret []string
+	for _, addr := range append([]string{sta.RemoteAddr()}, sta.RemoteServers...) {
+		if _, port, err := net.SplitHostPort(addr); err == nil && port != "443" {
+			ret = append(ret, addr)
+		}
+	}
+	return ret
+}
+
+// PprofListenAddr returns PprofAddr, on 127.0.0.1 if it has no host. Profiles show
+// what the relay is doing, so they're only served to other machines if asked for
+func (sta *State) PprofListenAddr() string {
+	return loopbackByDefault(sta.PprofAddr)
+}
+
+// StatusListenAddr returns StatusAddr, on 127.0.0.1 if it has no host
+func (sta *State) StatusListenAddr() string {
+	return loopbackByDefault(sta.StatusAddr)
+}
+
+// loopbackByDefault returns addr with 127.0.0.1 as its host if it has none
+func loopbackByDefault(addr string) string {
+	host, port, _ := net.SplitHostPort(addr)
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// LocalPorts returns the first and last ports of LocalPortRange, e.g. 20000-20100
+func (sta *State) LocalPorts() (first int, last int, err error) {
+	bounds := strings.Split(sta.LocalPortRange, "-")
+	if len(bounds) != 2 {
+		return 0, 0, errors.New("LocalPortRange must be like 20000-20100")
+	}
+	first, err = strconv.Atoi(bounds[0])
+	if err == nil {
+		last, err = strconv.Atoi(bounds[1])
+	}
+	if err != nil || first < 1 || last > 65535 || first > last {
+		return 0, 0, errors.New("Bad LocalPortRange: " + sta.LocalPortRange)
+	}
+	return first, last, nil
+}
+
+// Features returns the fingerprint used and the major features that are on, for a
+// summary of what gq-client does at startup. Options left at their defaults and
+// the ones that don't change the traffic, like logging, aren't listed
+func (sta *State) Features() []string {
+	ret := []string{"Browser " + sta.Browser}
+	if sta.Browser == "template" {
+		ret[0] += " from " + sta.HelloTemplate
+	}
+	on := func(set bool, name string) {
+		if set {
+			ret = append(ret, name)
+		}
+	}
+	value := func(v interface{}, name string) {
+		if v != 0 && v != "" {
+			ret = append(ret, fmt.Sprintf("%v %v", name, v))
+		}
+	}
+	value(len(sta.ServerNames), "ServerNames")
+	on(sta.FastOpen, "FastOpen")
+	value(sta.ClientHelloSplit, "ClientHelloSplit")
+	on(sta.Compress, "Compress")
+	on(sta.BufferAutoTune, "BufferAutoTune")
+	value(sta.Transport, "Transport")
+	value(sta.RecordSizing, "RecordSizing")
+	value(sta.MaxRecordSize, "MaxRecordSize")
+	on(sta.RecordSizeLimit, "RecordSizeLimit")
+	value(sta.ExtensionSet, "ExtensionSet")
+	value(sta.SimulateResumption, "SimulateResumption")
+	on(sta.RetryWithNewFingerprint, "RetryWithNewFingerprint")
+	value(len(sta.RemoteServers), "RemoteServers")
+	on(sta.HedgeConnections, "HedgeConnections")
+	on(sta.HappyEyeballs, "HappyEyeballs")
+	value(sta.WarmPoolSize, "WarmPoolSize")
+	value(sta.ConnJitterMaxMs, "ConnJitterMaxMs")
+	value(sta.ReplyDelayMaxMs, "ReplyDelayMaxMs")
+	value(sta.LingerAfterClose, "LingerAfterClose")
+	value(sta.ConnRateLimit, "ConnRateLimit")
+	on(sta.DetectInterception, "DetectInterception")
+	on(sta.StrictRecordValidation, "StrictRecordValidation")
+	value(sta.BlackHoleTimeout, "BlackHoleTimeout")
+	on(sta.AutoMTU, "AutoMTU")
+	on(sta.UDPRelay, "UDPRelay")
+	value(sta.MuxSessions, "MuxSessions")
+	value(sta.AuthWindow, "AuthWindow")
+	value(sta.HandshakeTimeout, "HandshakeTimeout")
+	value(sta.IdleTimeout, "IdleTimeout")
+	value(sta.MaxConnections, "MaxConnections")
+	value(sta.BindInterface, "BindInterface")
+	value(sta.DSCP, "DSCP")
+	return ret
+}
+
+// SetOpaque sets Opaque, which makes the session tickets of this process differ
+// from those of others with the same Key, from RandBytes. Tests set Rand first to
+// make it reproducible
+func (sta *State) SetOpaque() {
+	sta.Opaque = BtoInt(sta.RandBytes(32))
+}
+
 // SetAESKey calculates the SHA256 of the string key
 func (sta *State) SetAESKey() {
 	h := sha256.New()
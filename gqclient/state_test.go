@@ -2,6 +2,10 @@ package gqclient
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -15,6 +19,70 @@ func TestParseConfig(t *testing.T) {
 	}
 }
 
+func TestParseConfigErrors(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gqclient")
+	defer os.RemoveAll(dir)
+	invalid := filepath.Join(dir, "invalid.json")
+	ioutil.WriteFile(invalid, []byte(`{"Key": "example",}`), 0644)
+	noKey := filepath.Join(dir, "nokey.json")
+	ioutil.WriteFile(noKey, []byte(`{"Browser": "chrome", "TicketTimeHint": 1234}`), 0644)
+
+	cases := map[string]string{
+		filepath.Join(dir, "missing.json"): "Config file not found: " + filepath.Join(dir, "missing.json"),
+		invalid:                            "Invalid JSON in config",
+		noKey:                              "Missing required field in config: Key",
+	}
+	for path, exp := range cases {
+		sta := &State{}
+		err := sta.ParseConfig(path)
+		if err == nil || !strings.HasPrefix(err.Error(), exp) {
+			t.Error(
+				"For", path,
+				"expected", exp,
+				"got", err,
+			)
+		}
+	}
+}
+
+func TestHelloTemplateConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gqclient")
+	defer os.RemoveAll(dir)
+	good := filepath.Join(dir, "good.json")
+	ioutil.WriteFile(good, []byte(`{"Version": "0303", "RecordVersion": "0301", "SessionIDLength": 32,
+		"CipherSuites": ["grease", "1301", "c02f"],
+		"Extensions": [{"Type": "grease"}, {"Type": "server_name"}, {"Type": "session_ticket"}, {"Type": "eeee", "Data": "00"}]}`), 0644)
+	noTicket := filepath.Join(dir, "noticket.json")
+	ioutil.WriteFile(noTicket, []byte(`{"Version": "0303", "RecordVersion": "0301", "CipherSuites": ["1301"]}`), 0644)
+	badData := filepath.Join(dir, "baddata.json")
+	ioutil.WriteFile(badData, []byte(`{"Version": "0303", "RecordVersion": "0301", "CipherSuites": ["1301"],
+		"Extensions": [{"Type": "session_ticket"}, {"Type": "key_share", "Data": "xyz"}]}`), 0644)
+
+	cases := map[string]string{
+		good:                               "",
+		noTicket:                           "HelloTemplate must have session_ticket",
+		badData:                            "Bad hex in the data of key_share",
+		filepath.Join(dir, "missing.json"): "open",
+	}
+	for path, exp := range cases {
+		sta := &State{}
+		err := sta.ParseConfig("Browser=template;Key=example;TicketTimeHint=1234;HelloTemplate=" + path + ";")
+		if exp == "" && (err != nil || sta.Template == nil || len(sta.Template.Extensions) != 4) {
+			t.Error("For", path, "expected", "a HelloTemplate", "got", sta.Template, err)
+		}
+		if exp != "" && (err == nil || !strings.HasPrefix(err.Error(), exp)) {
+			t.Error("For", path, "expected", exp, "got", err)
+		}
+	}
+
+	// The template has no FirstRecordSizes
+	sta := &State{}
+	err := sta.ParseConfig("Browser=template;Key=example;TicketTimeHint=1234;RecordSizing=browser;HelloTemplate=" + good + ";")
+	if err == nil {
+		t.Error("For", "RecordSizing browser", "expected", "an error without FirstRecordSizes", "got", err)
+	}
+}
+
 func TestSsvToJson(t *testing.T) {
 	ssv := "Browser=chrome;Key=example;TicketTimeHint=1234;"
 	sta := &State{}
@@ -24,3 +92,380 @@ func TestSsvToJson(t *testing.T) {
 		fmt.Printf("TicketTimeHint: %+v", *sta)
 	}
 }
+
+func TestValidate(t *testing.T) {
+	cases := map[string]bool{
+		"Browser=chrome;Key=example;TicketTimeHint=1234;":                                                                                         true,
+		"Browser=firefox;Key=example;TicketTimeHint=1234;":                                                                                        true,
+		"Browser=chrome;TicketTimeHint=1234;":                                                                                                     false,
+		"Browser=chrome;Key=example;TicketTimeHint=0;":                                                                                            false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;SignatureAlgorithms=ed25519,rsa_pkcs1_sha256;":                                            true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;SignatureAlgorithms=ed25519,rsa_md5;":                                                     false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;SignatureAlgorithms=ed25519,ed25519;":                                                     false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;MaxRecordSize=4096;RecordSizeLimit=true;":                                                 true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;MaxRecordSize=32;":                                                                        false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;DNSRetries=3;DNSTimeoutMs=2000;":                                                          true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;DNSRetries=-1;":                                                                           false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;DNSTimeoutMs=10;":                                                                         false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;AutoMTU=true;BlackHoleTimeout=3;":                                                         true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;AutoMTU=true;":                                                                            false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;AutoMTU=true;BlackHoleTimeout=3;BlackHoleRecordSize=1000;":                                false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;Label=tenant-a.2;":                                                                        true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;Label=tenant a;":                                                                          false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;MuxSessions=2;":                                                                           true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;MuxSessions=9;":                                                                           false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;MuxSessions=2;WarmPoolSize=2;":                                                            false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;AuthWindow=600;":                                                                          true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;AuthWindow=30;":                                                                           false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;AuthWindow=86400;":                                                                        false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;HandshakeTimeout=10;IdleTimeout=300;MaxConnections=100;":                                  true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;IdleTimeout=-1;":                                                                          false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;MaxConnections=-1;":                                                                       false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;Transport=websocket;WebSocketURL=wss://cdn.example.com/gq;":                               true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;Transport=websocket;":                                                                     false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;Transport=websocket;WebSocketURL=https://cdn.example.com/gq;":                             false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;WebSocketURL=ws://cdn.example.com/gq;":                                                    false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;Transport=udp;":                                                                           false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;ServerName=www.example.com,cdn.example.org;":                                              true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;ServerName=www.example.com,www example.org;":                                              false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;ServerName=a234567890123456789012345678901234567890123456789012345678901234.com;":         false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;MaxHandshakeMessageSize=4096;MaxHandshakeMessageRecords=2;":                               true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;MaxHandshakeMessageSize=100;":                                                             false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;MaxHandshakeMessageRecords=9;":                                                            false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;MaxHandshakeMessageRecords=0;":                                                            true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;FailureWindow=60;FailureAlertPercent=80;":                                                 true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;FailureAlertPercent=101;":                                                                 false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;HappyEyeballs=true;":                                                                      true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;HappyEyeballs=true;FastOpen=true;":                                                        false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;ClientHelloSplit=100;":                                                                    true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;ClientHelloSplit=-1;":                                                                     false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;UpBufferSize=4096;DownBufferSize=32768;":                                                  true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;UpBufferSize=32768;":                                                                      false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;RecordSizing=browser;":                                                                    true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;DownBufferSize=512;":                                                                      false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;ClientHelloSplit=100;FastOpen=true;":                                                      false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;HedgeConnections=true;HedgeDelay=50;":                                                     true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;HedgeDelay=50;":                                                                           false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;ConnRateLimit=5;ConnBurst=20;":                                                            true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;ConnBurst=20;":                                                                            false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;ConnRateLimit=-1;":                                                                        false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;CheckForUpdates=true;UpdateURL=https://example.com/latest;":                               true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;CheckForUpdates=true;UpdateURL=ftp://example.com/latest;":                                 false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;CheckForUpdates=true;UpdateURL=example.com;":                                              false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;DelegatedCredentials=default;":                                                            true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;DelegatedCredentials=ed25519,ecdsa_sha1;":                                                 true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;DelegatedCredentials=default,ed25519;":                                                    false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;DelegatedCredentials=ed25519,ed25519;":                                                    false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;CertCompression=brotli,zlib;":                                                             true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;CertCompression=lzma;":                                                                    false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;CertCompression=zlib,zlib;":                                                               false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;RawExtensions=eeee000100,eeef0000;":                                                       true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;RawExtensions=eeee0001;":                                                                  false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;RawExtensions=eeee000100,eeee0000;":                                                       false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;RawExtensions=00230000;":                                                                  false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;RawExtensions=xyz0;":                                                                      false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;RecordSizing=dynamic;":                                                                    true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;RecordSizing=random;":                                                                     false,
+		"Browser=template;Key=example;TicketTimeHint=1234;":                                                                                       false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;HelloTemplate=hello.json;":                                                                false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;ConnJitterMaxMs=200;":                                                                     true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;ConnJitterMaxMs=-1;":                                                                      false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;ConnJitterMaxMs=2000;":                                                                    false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;WarmPoolSize=4;WarmPoolMaxIdle=20;":                                                       true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;WarmPoolSize=17;":                                                                         false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;WarmPoolSize=-1;":                                                                         false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;WarmPoolMaxIdle=20;":                                                                      false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;WarmPoolSize=2;WarmPoolMaxIdle=-1;":                                                       false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;BlackHoleTimeout=5;BlackHoleRecordSize=1000;":                                             true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;BlackHoleTimeout=-1;":                                                                     false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;BlackHoleTimeout=5;BlackHoleRecordSize=10;":                                               false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;BlackHoleRecordSize=1000;":                                                                false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;LocalPortRange=20000-20100;":                                                              true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;LocalPortRange=20000;":                                                                    false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;PprofAddr=:6060;":                                                                         true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;PprofAddr=6060;":                                                                          false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;StatusAddr=:8080;":                                                                        true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;StatusAddr=[::1]:8080;":                                                                   true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;StatusAddr=0.0.0.0:8080;":                                                                 false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;RetryBudget=10;":                                                                          true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;RetryBudget=-1;":                                                                          false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;LocalPortRange=20100-20000;":                                                              false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;LocalPortRange=0-100;":                                                                    false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;LocalPortRange=20000-20100;ReusePort=true;":                                               false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;ReplyDelayMaxMs=50;":                                                                      true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;ReplyDelayMaxMs=-1;":                                                                      false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;ReplyDelayMaxMs=5000;":                                                                    false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;ExtensionSet=minimal;":                                                                    true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;ExtensionSet=tiny;":                                                                       false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;ExtensionSet=custom;Extensions=session_ticket,server_name;":                               true,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;ExtensionSet=custom;Extensions=server_name;":                                              false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;ExtensionSet=custom;Extensions=session_ticket,heartbeat;":                                 false,
+		"Browser=chrome;Key=example;TicketTimeHint=1234;Extensions=session_ticket;":                                                               false,
+		"Browser=chrome-120;Key=example;TicketTimeHint=1234;ExtensionSet=custom;Extensions=session_ticket,pre_shared_key,psk_key_exchange_modes;": true,
+		"Browser=chrome-120;Key=example;TicketTimeHint=1234;ExtensionSet=custom;Extensions=session_ticket,pre_shared_key;":                        false,
+		"Browser=chrome-120;Key=example;TicketTimeHint=1234;ExtensionSet=custom;Extensions=session_ticket,early_data;":                            false,
+	}
+	for ssv, valid := range cases {
+		sta := &State{}
+		err := sta.ParseConfig(ssv)
+		if valid && err != nil {
+			t.Error(
+				"For", ssv,
+				"expected", "no err",
+				"got", err,
+			)
+		} else if !valid && err == nil {
+			t.Error(
+				"For", ssv,
+				"expected", "err",
+				"got", "no err",
+			)
+		}
+	}
+}
+
+func TestSsvRemoteServers(t *testing.T) {
+	ssv := "Browser=chrome;Key=example;TicketTimeHint=1234;RemoteServers=1.2.3.4:443,example.com:443;"
+	sta := &State{}
+	err := sta.ParseConfig(ssv)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(sta.RemoteServers) != 2 || sta.RemoteServers[0] != "1.2.3.4:443" || sta.RemoteServers[1] != "example.com:443" {
+		t.Error(
+			"For", ssv,
+			"expected", "[1.2.3.4:443 example.com:443]",
+			"got", sta.RemoteServers,
+		)
+	}
+}
+
+func TestPprofListenAddr(t *testing.T) {
+	cases := map[string]string{
+		":6060":         "127.0.0.1:6060",
+		"0.0.0.0:6060":  "0.0.0.0:6060",
+		"[::1]:6060":    "[::1]:6060",
+		"localhost:123": "localhost:123",
+	}
+	for addr, exp := range cases {
+		sta := &State{PprofAddr: addr}
+		if got := sta.PprofListenAddr(); got != exp {
+			t.Error("For", addr, "expected", exp, "got", got)
+		}
+		sta = &State{StatusAddr: addr}
+		if got := sta.StatusListenAddr(); got != exp {
+			t.Error("For", "StatusAddr", addr, "expected", exp, "got", got)
+		}
+	}
+}
+
+func TestNon443Servers(t *testing.T) {
+	sta := &State{
+		SS_REMOTE_HOST: "1.2.3.4",
+		SS_REMOTE_PORT: "8443",
+		RemoteServers:  []string{"example.com:443", "[::1]:80"},
+	}
+	got := fmt.Sprint(sta.Non443Servers())
+	if got != "[1.2.3.4:8443 [::1]:80]" {
+		t.Error("For", sta.SS_REMOTE_PORT, sta.RemoteServers, "expected", "[1.2.3.4:8443 [::1]:80]", "got", got)
+	}
+}
+
+func TestJoinHostPort(t *testing.T) {
+	cases := map[string]string{
+		"1.2.3.4":       "1.2.3.4:443",
+		"2001:db8::1":   "[2001:db8::1]:443",
+		"[2001:db8::1]": "[2001:db8::1]:443",
+		"example.com":   "example.com:443",
+	}
+	for host, exp := range cases {
+		sta := &State{SS_REMOTE_HOST: host, SS_REMOTE_PORT: "443", SS_LOCAL_HOST: host, SS_LOCAL_PORT: "443"}
+		if got := sta.RemoteAddr(); got != exp {
+			t.Error("For", host, "expected", exp, "got", got)
+		}
+		if got := sta.LocalAddr(); got != exp {
+			t.Error("For", host, "expected", exp, "got", got)
+		}
+	}
+}
+
+func TestBrowserFallback(t *testing.T) {
+	cases := map[string]string{
+		"Key=example;TicketTimeHint=1234;":                "Browser isn't set, using chrome",
+		"Browser=opera;Key=example;TicketTimeHint=1234;":  "Unsupported browser: opera, using chrome",
+		"Browser=safari;Key=example;TicketTimeHint=1234;": "",
+	}
+	for config, exp := range cases {
+		sta := &State{}
+		err := sta.ParseConfig(config)
+		warnings := strings.Join(sta.Warnings, "\n")
+		if err != nil || !strings.HasPrefix(warnings, exp) || (exp == "") != (warnings == "") {
+			t.Error("For", config, "expected", exp, "got", warnings, err)
+		}
+		if exp != "" && sta.Browser != "chrome" {
+			t.Error("For", config, "expected", "chrome", "got", sta.Browser)
+		}
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	sta := &State{}
+	sta.ParseConfig("Browser=firefox;Key=example;TicketTimeHint=1234;FastOpen=true;MaxRecordSize=1000;RecordSizing=dynamic;LogLevel=debug;")
+	got := strings.Join(sta.Features(), ", ")
+	exp := "Browser firefox, FastOpen, RecordSizing dynamic, MaxRecordSize 1000"
+	if got != exp {
+		t.Error("For", "FastOpen, RecordSizing and MaxRecordSize", "expected", exp, "got", got)
+	}
+	sta = &State{}
+	sta.ParseConfig("Browser=chrome;Key=example;TicketTimeHint=1234;")
+	got = strings.Join(sta.Features(), ", ")
+	if got != "Browser chrome" {
+		t.Error("For", "the defaults", "expected", "Browser chrome", "got", got)
+	}
+}
+
+func TestTicketTimeHintDuration(t *testing.T) {
+	cases := map[string]int{
+		"Browser=chrome;Key=example;TicketTimeHint=3600;":             3600,
+		"Browser=chrome;Key=example;TicketTimeHint=1h;":               3600,
+		"Browser=chrome;Key=example;TicketTimeHint=90m;":              5400,
+		`{"Browser":"chrome","Key":"example","TicketTimeHint":"30m"}`: 1800,
+		`{"Browser":"chrome","Key":"example","TicketTimeHint":1234}`:  1234,
+		"Browser=chrome;Key=example;TicketTimeHint=1.5s;":             -1,
+		"Browser=chrome;Key=example;TicketTimeHint=1x;":               -1,
+		"Browser=chrome;Key=example;TicketTimeHint=-1h;":              -1,
+	}
+	dir, _ := ioutil.TempDir("", "gqclient")
+	defer os.RemoveAll(dir)
+	for config, exp := range cases {
+		path := config
+		if strings.HasPrefix(config, "{") {
+			path = filepath.Join(dir, "config.json")
+			ioutil.WriteFile(path, []byte(config), 0644)
+		}
+		sta := &State{}
+		err := sta.ParseConfig(path)
+		if exp == -1 && err == nil || exp != -1 && (err != nil || sta.TicketTimeHint != exp) {
+			t.Error(
+				"For", config,
+				"expected", exp,
+				"got", sta.TicketTimeHint, err,
+			)
+		}
+	}
+}
+
+func TestServerNames(t *testing.T) {
+	// The ServerName and ServerNames parsed, or "error"
+	cases := map[string]string{
+		`{"Browser":"chrome","Key":"example","TicketTimeHint":1234,"ServerName":"www.example.com"}`:                      "www.example.com []",
+		`{"Browser":"chrome","Key":"example","TicketTimeHint":1234,"ServerName":["www.example.com"]}`:                    "www.example.com []",
+		`{"Browser":"chrome","Key":"example","TicketTimeHint":1234,"ServerName":["www.example.com","cdn.example.org"]}`:  "www.example.com [www.example.com cdn.example.org]",
+		`{"Browser":"chrome","Key":"example","TicketTimeHint":1234,"ServerName":[]}`:                                     "error",
+		`{"Browser":"chrome","Key":"example","TicketTimeHint":1234,"ServerName":["www.example.com","bad..example.org"]}`: "error",
+		"Browser=chrome;Key=example;TicketTimeHint=1234;ServerName=www.example.com;":                                     "www.example.com []",
+	}
+	dir, _ := ioutil.TempDir("", "gqclient")
+	defer os.RemoveAll(dir)
+	for config, exp := range cases {
+		path := config
+		if strings.HasPrefix(config, "{") {
+			path = filepath.Join(dir, "config.json")
+			ioutil.WriteFile(path, []byte(config), 0644)
+		}
+		sta := &State{}
+		err := sta.ParseConfig(path)
+		got := fmt.Sprint(sta.ServerName, " ", sta.ServerNames)
+		if err != nil {
+			got = "error"
+		}
+		if got != exp {
+			t.Error("For", config, "expected", exp, "got", got, err)
+		}
+	}
+
+	// Connections take turns with the names
+	sta := &State{ServerName: "a.example.com", ServerNames: []string{"a.example.com", "b.example.com", "c.example.com"}}
+	seen := map[string]int{}
+	for i := 0; i < 6; i++ {
+		seen[sta.WithNextServerName().ServerName]++
+	}
+	if len(seen) != 3 || seen["a.example.com"] != 2 || seen["b.example.com"] != 2 || seen["c.example.com"] != 2 {
+		t.Error("For", sta.ServerNames, "expected", "each twice", "got", seen)
+	}
+	if single := (&State{ServerName: "a.example.com"}); single.WithNextServerName() != single {
+		t.Error("For", "a single ServerName", "expected", "the State itself", "got", "a copy")
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("GQ_TEST_KEY", `ex"ample`)
+	defer os.Unsetenv("GQ_TEST_KEY")
+	ssv := "Browser=chrome;Key=${GQ_TEST_KEY};TicketTimeHint=1234;"
+	sta := &State{}
+	err := sta.ParseConfig(ssv)
+	if err != nil || sta.Key != `ex"ample` {
+		t.Error(
+			"For", ssv,
+			"expected", `ex"ample`,
+			"got", sta.Key, err,
+		)
+	}
+
+	ssv = "Browser=chrome;Key=${GQ_TEST_UNDEFINED};TicketTimeHint=1234;"
+	err = (&State{}).ParseConfig(ssv)
+	if err == nil {
+		t.Error(
+			"For", ssv,
+			"expected", "err",
+			"got", "no err",
+		)
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	sta := &State{}
+	sta.ParseConfig("Browser=chrome;Key=supersecretkey;TicketTimeHint=1234;ServerName=www.example.com;")
+	sta.SetAESKey()
+	redacted := string(sta.Redacted())
+	if strings.Contains(redacted, "supersecretkey") || !strings.Contains(redacted, "www.example.com") {
+		t.Error(
+			"For", "Key=supersecretkey",
+			"expected", "config without the key",
+			"got", redacted,
+		)
+	}
+	if sta.Key != "supersecretkey" {
+		t.Error(
+			"For", "Redacted",
+			"expected", "Key unchanged",
+			"got", sta.Key,
+		)
+	}
+}
+
+func TestNonSecret(t *testing.T) {
+	old := &State{}
+	old.ParseConfig("Browser=chrome-120;Key=supersecretkey;TicketTimeHint=1234;ServerName=www.example.com;")
+	data := old.NonSecret()
+	if strings.Contains(string(data), "supersecretkey") {
+		t.Error(
+			"For", "NonSecret",
+			"expected", "config without the key",
+			"got", string(data),
+		)
+	}
+
+	// The new process has a config that changed since
+	sta := &State{}
+	sta.ParseConfig("Browser=firefox;Key=supersecretkey;TicketTimeHint=1234;ServerName=www.example.org;")
+	err := sta.RestoreNonSecret(data)
+	if err != nil || sta.Key != "supersecretkey" || sta.Browser != "chrome-120" || sta.ServerName != "www.example.com" {
+		t.Error(
+			"For", "RestoreNonSecret",
+			"expected", "supersecretkey chrome-120 www.example.com",
+			"got", sta.Key, sta.Browser, sta.ServerName, err,
+		)
+	}
+}
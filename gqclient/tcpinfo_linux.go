@@ -0,0 +1,45 @@
+//go:build linux && !386
+// +build linux,!386
+
+package gqclient
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// tcpInfo gets the TCP_INFO of conn. ok is false if it isn't a TCP connection or
+// the kernel won't tell
+func tcpInfo(conn net.Conn) (info *syscall.TCPInfo, ok bool) {
+	sc, isSC := conn.(syscall.Conn)
+	if !isSC {
+		return nil, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, false
+	}
+	info = &syscall.TCPInfo{}
+	var errno syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		size := uint32(syscall.SizeofTCPInfo)
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(info)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil || errno != 0 {
+		return nil, false
+	}
+	return info, true
+}
+
+// SendStalled reports whether conn has data sent that the kernel keeps retransmitting
+// on timeout without it ever being acknowledged, which is what a large segment
+// dropped by a PMTUD black hole looks like. ok is false if this can't be determined
+func SendStalled(conn net.Conn) (stalled bool, ok bool) {
+	info, ok := tcpInfo(conn)
+	if !ok {
+		return false, false
+	}
+	return info.Unacked != 0 && info.Retransmits != 0, true
+}
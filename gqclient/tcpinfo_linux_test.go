@@ -0,0 +1,39 @@
+//go:build linux && !386
+// +build linux,!386
+
+package gqclient
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSendStalled(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c.Write(make([]byte, 5000))
+	io.ReadFull(s, make([]byte, 5000))
+
+	stalled, ok := SendStalled(c)
+	if !ok || stalled {
+		t.Error("For", "data read by the other end", "expected", "not stalled", "got", stalled, ok)
+	}
+	_, ok = SendStalled(&net.IPConn{})
+	if ok {
+		t.Error("For", "a connection without a socket", "expected", "not ok", "got", ok)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux || 386
+// +build !linux 386
+
+package gqclient
+
+import (
+	"net"
+)
+
+// SendStalled reports whether conn has data sent that the kernel keeps retransmitting
+// on timeout without it ever being acknowledged, which is what a large segment
+// dropped by a PMTUD black hole looks like. ok is false if this can't be determined
+func SendStalled(conn net.Conn) (stalled bool, ok bool) {
+	return false, false
+}
@@ -0,0 +1,102 @@
+package gqclient
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strconv"
+)
+
+// HelloTemplate is the ClientHello of a browser as captured, made by -import-hello,
+// for ClientHellos like it to be made from with Browser template. Values are hex,
+// and grease is any GREASE value, a fresh one of which is picked for each connection
+type HelloTemplate struct {
+	// legacy_version of the ClientHello and the version of the record carrying it
+	Version       string
+	RecordVersion string
+	// 32 for a random session id, 0 for none
+	SessionIDLength int
+	CipherSuites    []string
+	Extensions      []TemplateExtension
+	// The sizes of the first records the browser sends after the handshake, for
+	// RecordSizing browser. They aren't in the capture, so they're set by hand
+	FirstRecordSizes []int `json:",omitempty"`
+}
+
+// TemplateExtension is one extension of a HelloTemplate, in order. Data is sent as
+// is except for the extensions that differ in every connection: server_name,
+// session_ticket, key_share, encrypted_client_hello and padding, and the GREASE
+// values in supported_groups and supported_versions
+type TemplateExtension struct {
+	// The name of the extension in ExtensionTypes, or its type in hex
+	Type string
+	Data string `json:",omitempty"`
+}
+
+// TypeValue returns the extension type of e
+func (e TemplateExtension) TypeValue() (uint16, error) {
+	if typ, ok := ExtensionTypes[e.Type]; ok {
+		return typ, nil
+	}
+	typ, err := strconv.ParseUint(e.Type, 16, 16)
+	if err != nil || len(e.Type) != 4 {
+		return 0, errors.New("Unknown extension in HelloTemplate: " + e.Type)
+	}
+	return uint16(typ), nil
+}
+
+// LoadHelloTemplate reads and checks the HelloTemplate in the file at path
+func LoadHelloTemplate(path string) (*HelloTemplate, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &HelloTemplate{}
+	err = json.Unmarshal(content, t)
+	if err != nil {
+		return nil, errors.New("Invalid JSON in HelloTemplate: " + err.Error())
+	}
+	return t, t.Validate()
+}
+
+// Validate checks that the values in t are well-formed and that it has session_ticket
+func (t *HelloTemplate) Validate() error {
+	for _, v := range []string{t.Version, t.RecordVersion} {
+		if b, err := hex.DecodeString(v); err != nil || len(b) != 2 {
+			return errors.New("Bad version in HelloTemplate: " + v)
+		}
+	}
+	if t.SessionIDLength != 0 && t.SessionIDLength != 32 {
+		return errors.New("SessionIDLength in HelloTemplate must be 0 or 32")
+	}
+	if len(t.CipherSuites) == 0 {
+		return errors.New("HelloTemplate has no CipherSuites")
+	}
+	for _, c := range t.CipherSuites {
+		if b, err := hex.DecodeString(c); c != "grease" && (err != nil || len(b) != 2) {
+			return errors.New("Bad cipher suite in HelloTemplate: " + c)
+		}
+	}
+	for _, size := range t.FirstRecordSizes {
+		if size < 1 || size > 16384 {
+			return errors.New("FirstRecordSizes in HelloTemplate must be between 1 and 16384")
+		}
+	}
+	hasTicket := false
+	for _, e := range t.Extensions {
+		typ, err := e.TypeValue()
+		if err != nil {
+			return err
+		}
+		if _, err = hex.DecodeString(e.Data); err != nil {
+			return errors.New("Bad hex in the data of " + e.Type + " in HelloTemplate")
+		}
+		hasTicket = hasTicket || typ == ExtensionTypes["session_ticket"]
+	}
+	// The authentication goes in session_ticket
+	if !hasTicket {
+		return errors.New("HelloTemplate must have session_ticket")
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+//go:build linux && !386
+// +build linux,!386
+
+package gqclient
+
+import (
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// TCPI_OPT_SYN_DATA in linux/tcp.h
+const tcpiOptSynData = 0x20
+
+// TFOSupported reports whether the kernel has TCP fast open enabled for outgoing
+// (client) and incoming (server) connections. ok is false if this can't be determined
+func TFOSupported() (client bool, server bool, ok bool) {
+	content, err := ioutil.ReadFile("/proc/sys/net/ipv4/tcp_fastopen")
+	if err != nil {
+		return false, false, false
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return false, false, false
+	}
+	return v&1 != 0, v&2 != 0, true
+}
+
+// SynDataAcked reports whether the data sent with the SYN of conn was acknowledged,
+// i.e. TCP fast open has actually taken effect. ok is false if this can't be determined
+func SynDataAcked(conn net.Conn) (acked bool, ok bool) {
+	info, ok := tcpInfo(conn)
+	if !ok {
+		return false, false
+	}
+	return info.Options&tcpiOptSynData != 0, true
+}
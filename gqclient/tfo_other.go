@@ -0,0 +1,20 @@
+//go:build !linux || 386
+// +build !linux 386
+
+package gqclient
+
+import (
+	"net"
+)
+
+// TFOSupported reports whether the kernel has TCP fast open enabled for outgoing
+// (client) and incoming (server) connections. ok is false if this can't be determined
+func TFOSupported() (client bool, server bool, ok bool) {
+	return false, false, false
+}
+
+// SynDataAcked reports whether the data sent with the SYN of conn was acknowledged,
+// i.e. TCP fast open has actually taken effect. ok is false if this can't be determined
+func SynDataAcked(conn net.Conn) (acked bool, ok bool) {
+	return false, false
+}
@@ -2,10 +2,13 @@ package gqclient
 
 import (
 	"crypto/rand"
+	"fmt"
 	"io"
 	"math/big"
 	prand "math/rand"
 	"net"
+	"os"
+	"syscall"
 	"time"
 )
 
@@ -33,32 +36,84 @@ func CryptoRandBytes(length int) (ret []byte) {
 	return
 }
 
+// CheckEntropy checks that cryptographically secure random bytes can be read.
+// On some systems this blocks until enough entropy is gathered after boot
+func CheckEntropy() error {
+	buf := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, buf)
+	return err
+}
+
 // PsudoRandBytes returns a byte slice filled with psudorandom bytes generated by the seed
 func PsudoRandBytes(length int, seed int64) (ret []byte) {
-	prand.Seed(seed)
+	// A source of its own rather than seeding the global one, which concurrent
+	// handshakes would reseed under each other and get each other's bytes
+	r := prand.New(prand.NewSource(seed))
 	for len(ret) < length {
-		randByte := byte(prand.Intn(256))
+		randByte := byte(r.Intn(256))
 		ret = append(ret, randByte)
 	}
 	return
 }
 
+// IsClosedByPeer reports whether err is from the other end closing or resetting the connection
+func IsClosedByPeer(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+			return sysErr.Err == syscall.ECONNRESET
+		}
+	}
+	return false
+}
+
+// IsResetOrRefused reports whether err is from the connection being reset, or
+// refused while connecting
+func IsResetOrRefused(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	return err == syscall.ECONNRESET || err == syscall.ECONNREFUSED
+}
+
 // ReadTillDrain reads TLS data according to its record layer
 func ReadTillDrain(conn net.Conn, buffer []byte) (n int, err error) {
+	return ReadTillDrainBefore(conn, buffer, time.Time{})
+}
+
+// ReadTillDrainBefore is ReadTillDrain for a read that has to be done by deadline,
+// unless it's zero. The rest of a record isn't waited for past it, and once the
+// record is in the read deadline of conn is put back to deadline rather than
+// cleared, so that a handshake can't outlast it a record at a time
+func ReadTillDrainBefore(conn net.Conn, buffer []byte, deadline time.Time) (n int, err error) {
 	// TCP is a stream. Multiple TLS messages can arrive at the same time,
 	// a single message can also be segmented due to MTU of the IP layer.
-	// This function guareentees a single TLS message to be read and everything
-	// else is left in the buffer.
+	// This function guarantees a single whole TLS record to be read: the
+	// header says how much to read, so the rest of a split record is waited
+	// for and records that came together are left in the connection for the
+	// next call. PeelRecordLayer relies on this
 	i, err := io.ReadFull(conn, buffer[:5])
 	if err != nil {
 		return
 	}
 
 	dataLength := BtoInt(buffer[3:5])
+	if 5+dataLength > len(buffer) {
+		return 5, fmt.Errorf("Record of %v bytes is too long for the buffer", dataLength)
+	}
 	left := dataLength
 	readPtr := 5
 
-	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	rest := time.Now().Add(3 * time.Second)
+	if !deadline.IsZero() && deadline.Before(rest) {
+		rest = deadline
+	}
+	conn.SetReadDeadline(rest)
 	for left != 0 {
 		// If left > buffer size (i.e. our message got segmented), the entire MTU is read
 		// if left = buffer size, the entire buffer is all there left to read
@@ -71,9 +126,36 @@ func ReadTillDrain(conn net.Conn, buffer []byte) (n int, err error) {
 		left -= i
 		readPtr += i
 	}
-	conn.SetReadDeadline(time.Time{})
+	conn.SetReadDeadline(deadline)
 
 	n = 5 + dataLength
 	buffer = buffer[:n]
 	return
 }
+
+// CloseWrite shuts down the writing side of conn if it's a TCP connection or like
+// one, so that the other end reads EOF but can still send. It returns false if conn
+// can't be half-closed, in which case it should be closed fully
+func CloseWrite(conn net.Conn) bool {
+	cw, ok := conn.(interface {
+		CloseWrite() error
+	})
+	return ok && cw.CloseWrite() == nil
+}
+
+// WriteAll writes all of data to conn. net.Conn.Write should return an error if
+// it writes less than len(data), but we don't rely on that because a silently
+// dropped tail of a record would desync the stream
+func WriteAll(conn net.Conn, data []byte) error {
+	for len(data) > 0 {
+		n, err := conn.Write(data)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		data = data[n:]
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package gqclient
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// shortConn writes at most 3 bytes at a time without an error
+type shortConn struct {
+	net.Conn
+	written []byte
+}
+
+func (c *shortConn) Write(b []byte) (int, error) {
+	if len(b) > 3 {
+		b = b[:3]
+	}
+	c.written = append(c.written, b...)
+	return len(b), nil
+}
+
+func TestWriteAll(t *testing.T) {
+	data := []byte{0x17, 0x03, 0x03, 0x00, 0x05, 'h', 'e', 'l', 'l', 'o'}
+	conn := &shortConn{}
+	err := WriteAll(conn, data)
+	if err != nil || !bytes.Equal(conn.written, data) {
+		t.Error(
+			"For", "short writes",
+			"expected", data,
+			"got", conn.written, err,
+		)
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if !CloseWrite(c) {
+		t.Error("For", "TCP", "expected", true, "got", false)
+	}
+	// The other end reads EOF and can still send
+	_, err = s.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Error("For", "reading after CloseWrite", "expected", io.EOF, "got", err)
+	}
+	s.Write([]byte("reply"))
+	got := make([]byte, 5)
+	_, err = io.ReadFull(c, got)
+	if err != nil || string(got) != "reply" {
+		t.Error("For", "writing back after CloseWrite", "expected", "reply", "got", string(got), err)
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if CloseWrite(a) {
+		t.Error("For", "net.Pipe", "expected", false, "got", true)
+	}
+}
+
+func TestReadTillDrainTooLong(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go c2.Write([]byte{0x17, 0x03, 0x03, 0x01, 0x00})
+	_, err := ReadTillDrain(c1, make([]byte, 100))
+	if err == nil {
+		t.Error("For", "a record longer than the buffer", "expected", "an error", "got", nil)
+	}
+}
+
+func TestReadTillDrainChunked(t *testing.T) {
+	first := []byte{0x17, 0x03, 0x03, 0x00, 0x05, 'h', 'e', 'l', 'l', 'o'}
+	second := []byte{0x17, 0x03, 0x03, 0x00, 0x03, 'b', 'y', 'e'}
+	stream := append(append([]byte{}, first...), second...)
+	// Where the stream is cut into the writes that arrive
+	cases := map[string][]int{
+		"both records in one write":            {len(stream)},
+		"a write for each record":              {len(first), len(second)},
+		"split in the header":                  {3, len(stream) - 3},
+		"split in the payload":                 {7, len(stream) - 7},
+		"the second header with the first end": {8, 5, len(stream) - 13},
+		"a byte at a time":                     nil,
+	}
+	for name, cuts := range cases {
+		if cuts == nil {
+			for range stream {
+				cuts = append(cuts, 1)
+			}
+		}
+		c1, c2 := net.Pipe()
+		go func(cuts []int) {
+			rest := stream
+			for _, n := range cuts {
+				c2.Write(rest[:n])
+				rest = rest[n:]
+			}
+		}(cuts)
+		buf := make([]byte, 100)
+		for _, exp := range [][]byte{first, second} {
+			n, err := ReadTillDrain(c1, buf)
+			if err != nil || !bytes.Equal(buf[:n], exp) {
+				t.Error("For", name, "expected", exp, "got", buf[:n], err)
+			}
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestReadTillDrainBefore(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	record := []byte{0x17, 0x03, 0x03, 0x00, 0x05, 'h', 'e', 'l', 'l', 'o'}
+	go c2.Write(record)
+	deadline := time.Now().Add(200 * time.Millisecond)
+	buf := make([]byte, 100)
+	n, err := ReadTillDrainBefore(c1, buf, deadline)
+	if err != nil || !bytes.Equal(buf[:n], record) {
+		t.Error("For", "a record before the deadline", "expected", record, "got", buf[:n], err)
+	}
+	// Nothing else comes, and the deadline must still hold for the next read
+	go c2.Write(record[:7])
+	_, err = ReadTillDrainBefore(c1, buf, deadline)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() || time.Now().After(deadline.Add(time.Second)) {
+		t.Error("For", "half a record", "expected", "a timeout at the deadline", "got", err, time.Since(deadline))
+	}
+}
+
+func TestPsudoRandBytesConcurrent(t *testing.T) {
+	exp := make([][]byte, 50)
+	for i := range exp {
+		exp[i] = PsudoRandBytes(192, int64(i))
+	}
+	var wg sync.WaitGroup
+	for i := range exp {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for c := 0; c < 20; c++ {
+				if got := PsudoRandBytes(192, int64(i)); !bytes.Equal(got, exp[i]) {
+					t.Error("For", "seed", i, "expected", exp[i], "got", got)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
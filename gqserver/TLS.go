@@ -3,7 +3,6 @@ package gqserver
 import (
 	"encoding/binary"
 	"errors"
-	"time"
 )
 
 // ClientHello contains every field in a ClientHello message
@@ -20,9 +19,19 @@ type ClientHello struct {
 	compressionMethods    []byte
 	extensionsLen         int
 	extensions            map[[2]byte][]byte
+	// The types of the extensions in the order they were sent, for JA3
+	extensionOrder []uint16
+	// The user VerifyClientHello found it was made by, nil for the Key
+	user *User
 }
 
-func parseExtensions(input []byte) (ret map[[2]byte][]byte, err error) {
+// User returns the user of Users the ClientHello was made by, or nil if it was
+// made with the Key or hasn't been through VerifyClientHello
+func (ch *ClientHello) User() *User {
+	return ch.user
+}
+
+func parseExtensions(input []byte) (ret map[[2]byte][]byte, order []uint16, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = errors.New("Malformed Extensions")
@@ -40,22 +49,38 @@ func parseExtensions(input []byte) (ret map[[2]byte][]byte, err error) {
 		data := input[pointer : pointer+length]
 		pointer += length
 		ret[typ] = data
+		order = append(order, binary.BigEndian.Uint16(typ[:]))
 	}
-	return ret, err
+	return ret, order, err
 }
 
+// RecordHeaderLen is the length of the record layer, which PutRecordHeader needs
+// in front of the data
+const RecordHeaderLen = 5
+
 // AddRecordLayer adds record layer to data
 func AddRecordLayer(input []byte, typ []byte, ver []byte) []byte {
-	length := make([]byte, 2)
-	binary.BigEndian.PutUint16(length, uint16(len(input)))
-	ret := append(typ, ver...)
-	ret = append(ret, length...)
-	ret = append(ret, input...)
+	ret := make([]byte, RecordHeaderLen+len(input))
+	copy(ret[RecordHeaderLen:], input)
+	PutRecordHeader(ret, typ, ver)
 	return ret
 }
 
-// PeelRecordLayer peels off the record layer
+// PutRecordHeader writes the record layer into the first RecordHeaderLen bytes of
+// record, for the data after them. Unlike AddRecordLayer the data isn't copied
+func PutRecordHeader(record []byte, typ []byte, ver []byte) {
+	copy(record[0:1], typ)
+	copy(record[1:3], ver)
+	binary.BigEndian.PutUint16(record[3:5], uint16(len(record)-RecordHeaderLen))
+}
+
+// PeelRecordLayer peels off the record layer. The type, version and length are not
+// checked, so records with any version, e.g. rewritten by a middlebox, are accepted.
+// Data shorter than a record header gives nil
 func PeelRecordLayer(data []byte) []byte {
+	if len(data) < 5 {
+		return nil
+	}
 	ret := data[5:]
 	return ret
 }
@@ -106,7 +131,7 @@ func ParseClientHello(data []byte) (ret *ClientHello, err error) {
 	// Extensions
 	extensionsLen := BtoInt(data[pointer : pointer+2])
 	pointer += 2
-	extensions, err := parseExtensions(data[pointer:])
+	extensions, extensionOrder, err := parseExtensions(data[pointer:])
 	ret = &ClientHello{
 		handshakeType,
 		length,
@@ -120,22 +145,56 @@ func ParseClientHello(data []byte) (ret *ClientHello, err error) {
 		compressionMethods,
 		extensionsLen,
 		extensions,
+		extensionOrder,
+		nil,
 	}
 	return
 }
 
+// RecordSizeLimit returns the most plaintext the client accepts in a record, from
+// its record_size_limit extension, or 0 if it didn't send one. The limit counts
+// the content type byte in TLS 1.3 but not in TLS 1.2, so one is taken off to be
+// within it either way, see https://tools.ietf.org/html/rfc8449#section-4
+func (ch *ClientHello) RecordSizeLimit() int {
+	ext := ch.extensions[[2]byte{0x00, 0x1c}]
+	if len(ext) != 2 {
+		return 0
+	}
+	limit := BtoInt(ext) - 1
+	if limit < 63 {
+		// Smaller than allowed, so it's not a real limit
+		return 0
+	}
+	return limit
+}
+
+// ServerName returns the host name in the server_name extension, or an empty
+// string if there isn't one
+func (ch *ClientHello) ServerName() string {
+	// server name list length 2, name type 1, name length 2
+	ext := ch.extensions[[2]byte{0x00, 0x00}]
+	if len(ext) < 5 || ext[2] != 0x00 {
+		return ""
+	}
+	length := BtoInt(ext[3:5])
+	if len(ext) < 5+length {
+		return ""
+	}
+	return string(ext[5 : 5+length])
+}
+
 func composeServerHello(ch *ClientHello) []byte {
 	var serverHello [10][]byte
-	serverHello[0] = []byte{0x02}                              // handshake type
-	serverHello[1] = []byte{0x00, 0x00, 0x4d}                  // length 77
-	serverHello[2] = []byte{0x03, 0x03}                        // server version
-	serverHello[3] = PsudoRandBytes(32, time.Now().UnixNano()) // random
-	serverHello[4] = []byte{0x20}                              // session id length 32
-	serverHello[5] = ch.sessionId                              // session id
-	serverHello[6] = []byte{0xc0, 0x30}                        // cipher suite TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
-	serverHello[7] = []byte{0x00}                              // compression method null
-	serverHello[8] = []byte{0x00, 0x05}                        // extensions length 5
-	serverHello[9] = []byte{0xff, 0x01, 0x00, 0x01, 0x00}      // extensions renegotiation_info
+	serverHello[0] = []byte{0x02}                                   // handshake type
+	serverHello[1] = []byte{0x00, 0x00, byte(45 + ch.sessionIdLen)} // length 77 with a 32 byte session id
+	serverHello[2] = []byte{0x03, 0x03}                             // server version
+	serverHello[3] = CryptoRandBytes(32)                            // random, which the client's Finished is bound to
+	serverHello[4] = []byte{byte(ch.sessionIdLen)}                  // session id length
+	serverHello[5] = ch.sessionId                                   // session id, echoed like resuming a session
+	serverHello[6] = []byte{0xc0, 0x30}                             // cipher suite TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+	serverHello[7] = []byte{0x00}                                   // compression method null
+	serverHello[8] = []byte{0x00, 0x05}                             // extensions length 5
+	serverHello[9] = []byte{0xff, 0x01, 0x00, 0x01, 0x00}           // extensions renegotiation_info
 	ret := []byte{}
 	for i := 0; i < 10; i++ {
 		ret = append(ret, serverHello[i]...)
@@ -150,8 +209,7 @@ func ComposeReply(ch *ClientHello) []byte {
 	TLS12 := []byte{0x03, 0x03}
 	shBytes := AddRecordLayer(composeServerHello(ch), []byte{0x16}, TLS12)
 	ccsBytes := AddRecordLayer([]byte{0x01}, []byte{0x14}, TLS12)
-	finished := make([]byte, 64)
-	finished = PsudoRandBytes(40, time.Now().UnixNano())
+	finished := CryptoRandBytes(40)
 	fBytes := AddRecordLayer(finished, []byte{0x16}, TLS12)
 	ret := append(shBytes, ccsBytes...)
 	ret = append(ret, fBytes...)
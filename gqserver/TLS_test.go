@@ -69,5 +69,61 @@ func TestComposeReply(t *testing.T) {
 				"got", fmt.Sprintf("%x", result[44:76]),
 			)
 		}
+		// The client's Finished is bound to the random, so no two can be the same
+		again := ComposeReply(ch)
+		if bytes.Equal(result[11:43], again[11:43]) {
+			t.Error(
+				"For", c.Name(),
+				"expected", "a different random in each reply",
+				"got", fmt.Sprintf("%x", result[11:43]), "twice",
+			)
+		}
+	}
+}
+
+func TestRecordSizeLimit(t *testing.T) {
+	cases := map[string]int{
+		"":     0,
+		"4001": 16384,
+		"1000": 4095,
+		"0010": 0,
+		"10":   0,
+	}
+	for ext, exp := range cases {
+		ch := &ClientHello{extensions: map[[2]byte][]byte{}}
+		if ext != "" {
+			ch.extensions[[2]byte{0x00, 0x1c}], _ = hex.DecodeString(ext)
+		}
+		if got := ch.RecordSizeLimit(); got != exp {
+			t.Error(
+				"For", ext,
+				"expected", exp,
+				"got", got,
+			)
+		}
+	}
+}
+
+func TestPeelRecordLayer(t *testing.T) {
+	for _, ver := range [][]byte{{0x03, 0x01}, {0x03, 0x03}, {0x03, 0x04}} {
+		record := append([]byte{0x17}, ver...)
+		record = append(record, 0x00, 0x05)
+		record = append(record, "hello"...)
+		got := PeelRecordLayer(record)
+		if !bytes.Equal(got, []byte("hello")) {
+			t.Error(
+				"For", "version", ver,
+				"expected", "hello",
+				"got", got,
+			)
+		}
+	}
+}
+
+func TestPutRecordHeader(t *testing.T) {
+	record := append(make([]byte, RecordHeaderLen), "hello"...)
+	PutRecordHeader(record, []byte{0x17}, []byte{0x03, 0x03})
+	if !bytes.Equal(record, AddRecordLayer([]byte("hello"), []byte{0x17}, []byte{0x03, 0x03})) {
+		t.Error("For", "hello", "expected", "the same record as AddRecordLayer", "got", record)
 	}
 }
@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 )
 
 func decrypt(iv []byte, key []byte, ciphertext []byte) []byte {
@@ -19,26 +22,198 @@ func decrypt(iv []byte, key []byte, ciphertext []byte) []byte {
 	return ret
 }
 
+// The length in seconds of the windows of time the random field is made for. The
+// client and the server have to be in the same one, give or take ClockSkewTolerance.
+// AuthWindow replaces it, and has to be the same as the clients'
+const defaultAuthWindow = 12 * 60 * 60
+
+// The shortest AuthWindow
+const minAuthWindow = 60
+
+func (sta *State) authWindow() int {
+	if sta.AuthWindow != 0 {
+		return sta.AuthWindow
+	}
+	return defaultAuthWindow
+}
+
+// The reasons VerifyClientHello turns down a ClientHello
+var (
+	ErrBadAuth = errors.New("ClientHello failed auth")
+	ErrReplay  = errors.New("ClientHello is a replay")
+	ErrExpired = errors.New("ClientHello is from a user that has expired")
+)
+
 // IsSS checks if a ClientHello belongs to shadowsocks
 func IsSS(input *ClientHello, sta *State) bool {
+	return VerifyClientHello(input, sta) == nil
+}
+
+// VerifyClientHello is IsSS that says why a ClientHello doesn't belong to
+// shadowsocks, with ErrBadAuth, ErrExpired or ErrReplay. The Key and then each
+// of Users are tried, and the user it was made with is kept for User and the
+// checks after it, which are made with the user's key
+func VerifyClientHello(input *ClientHello, sta *State) error {
+	if sta.AuthVerifyFunc != nil {
+		if !sta.AuthVerifyFunc(input.random, sta) {
+			return ErrBadAuth
+		}
+	} else {
+		now := sta.Now()
+		matched := sta.Key != "" && madeWith(input.random, sta.Key, sta.AESKey, int(now.Unix()), sta)
+		if !matched {
+			for _, u := range sta.Users {
+				if madeWith(input.random, u.Key, u.aesKey, int(now.Unix()), sta) {
+					if u.Expired(now) {
+						return ErrExpired
+					}
+					input.user = u
+					matched = true
+					break
+				}
+			}
+		}
+		if !matched {
+			return ErrBadAuth
+		}
+	}
+
+	// Only the randoms of genuine ClientHellos are remembered, so that a flood
+	// of made up ones can't fill UsedRandom
 	var random [32]byte
 	copy(random[:], input.random)
+	if !sta.UseRandom(random) {
+		log.Println("Replay! Duplicate random")
+		return ErrReplay
+	}
+	return nil
+}
+
+// madeWith checks if random was made with key, whose SHA256 is aesKey, at now
+func madeWith(random []byte, key string, aesKey []byte, now int, sta *State) bool {
+	plaintext := decrypt(random[0:16], aesKey, random[16:])
+	// The windows the client may be in if its clock is off by up to
+	// ClockSkewTolerance, which are at most three
+	window := sta.authWindow()
+	for t := (now - sta.ClockSkewTolerance) / window; t <= (now+sta.ClockSkewTolerance)/window; t++ {
+		h := sha256.New()
+		h.Write([]byte(fmt.Sprintf("%v", t) + key))
+		if bytes.Equal(plaintext, h.Sum(nil)[0:16]) {
+			return true
+		}
+	}
+	return false
+}
 
-	sta.M.Lock()
-	used := sta.UsedRandom[random]
-	sta.M.Unlock()
+// keyOf returns the AESKey of the user ch was made by, or of the Key
+func (sta *State) keyOf(ch *ClientHello) []byte {
+	if ch.user != nil {
+		return ch.user.aesKey
+	}
+	return sta.AESKey
+}
 
-	if used != 0 {
-		log.Println("Replay! Duplicate random")
+// IsBound checks if the client's Finished message is bound to the random field
+// of our ServerHello, which proves that the client has seen this specific handshake.
+// reply is what ComposeReply returned and finished has its record layer peeled
+func IsBound(ch *ClientHello, reply []byte, finished []byte, sta *State) bool {
+	// record layer 5 bytes, handshake type 1, length 3, server version 2, random 32
+	if len(reply) < 43 || len(finished) < sha256.Size {
 		return false
 	}
+	mac := hmac.New(sha256.New, sta.keyOf(ch))
+	mac.Write(reply[11:43])
+	return hmac.Equal(mac.Sum(nil), finished[:sha256.Size])
+}
+
+// IsPing checks whether the client asked with its Finished message for the
+// connection to be echoed back, as in a smoke test, rather than relayed to
+// ss-server. This must only be called after IsBound
+func IsPing(ch *ClientHello, reply []byte, finished []byte, sta *State) bool {
+	if len(reply) < 43 || len(finished) < sha256.Size+8 {
+		return false
+	}
+	mac := hmac.New(sha256.New, sta.keyOf(ch))
+	mac.Write([]byte("ping"))
+	mac.Write(reply[11:43])
+	return hmac.Equal(mac.Sum(nil)[:8], finished[sha256.Size:sha256.Size+8])
+}
+
+// IsConnect checks whether the client asked with its Finished message for us to
+// dial the address the connection starts with, as gq-client -socks does, rather
+// than relay it to ss-server. This must only be called after IsBound
+func IsConnect(ch *ClientHello, reply []byte, finished []byte, sta *State) bool {
+	if len(reply) < 43 || len(finished) < sha256.Size+8 {
+		return false
+	}
+	mac := hmac.New(sha256.New, sta.keyOf(ch))
+	mac.Write([]byte("connect"))
+	mac.Write(reply[11:43])
+	return hmac.Equal(mac.Sum(nil)[:8], finished[sha256.Size:sha256.Size+8])
+}
+
+// RouteOf finds the address of the ss-server this connection should be relayed to.
+// A route chosen by the client with Route in its Finished message comes first, then
+// a route named after the SNI in the ClientHello. If neither matches one of Routes,
+// the default SS_LOCAL_HOST:SS_LOCAL_PORT is used. This must only be called after
+// IsBound so that the route is only revealed to a client that knows the key
+func RouteOf(ch *ClientHello, reply []byte, finished []byte, sta *State) string {
+	if len(sta.Routes) != 0 && len(reply) >= 43 && len(finished) >= sha256.Size+8 {
+		for name, addr := range sta.Routes {
+			mac := hmac.New(sha256.New, sta.keyOf(ch))
+			mac.Write([]byte("route"))
+			mac.Write(reply[11:43])
+			mac.Write([]byte(name))
+			if hmac.Equal(mac.Sum(nil)[:8], finished[sha256.Size:sha256.Size+8]) {
+				return addr
+			}
+		}
+		if addr, ok := sta.Routes[ch.ServerName()]; ok {
+			return addr
+		}
+	}
+	return net.JoinHostPort(sta.SS_LOCAL_HOST, sta.SS_LOCAL_PORT)
+}
 
-	sta.PutUsedRandom(random)
+// DatagramRouteOf checks whether the client asked with its Finished message for
+// the connection to carry a UDP session, and if it did, finds the address of the
+// ss-server its datagrams are relayed to like RouteOf does. ss-server takes UDP on
+// the same port as TCP. This must only be called after IsBound
+func DatagramRouteOf(ch *ClientHello, reply []byte, finished []byte, sta *State) (addr string, ok bool) {
+	return taggedRouteOf("udp", ch, reply, finished, sta)
+}
+
+// MuxRouteOf checks whether the client asked with its Finished message for the
+// connection to carry streams, and if it did, finds the address of the ss-server
+// each of them is relayed to like RouteOf does. This must only be called after
+// IsBound
+func MuxRouteOf(ch *ClientHello, reply []byte, finished []byte, sta *State) (addr string, ok bool) {
+	return taggedRouteOf("mux", ch, reply, finished, sta)
+}
 
-	h := sha256.New()
-	t := int(sta.Now().Unix()) / (12 * 60 * 60)
-	h.Write([]byte(fmt.Sprintf("%v", t) + sta.Key))
-	goal := h.Sum(nil)[0:16]
-	plaintext := decrypt(input.random[0:16], sta.AESKey, input.random[16:])
-	return bytes.Equal(plaintext, goal)
+// taggedRouteOf is RouteOf for a tag that says both what the connection is for
+// and its route, or no route to go by the SNI
+func taggedRouteOf(purpose string, ch *ClientHello, reply []byte, finished []byte, sta *State) (addr string, ok bool) {
+	if len(reply) < 43 || len(finished) < sha256.Size+8 {
+		return "", false
+	}
+	isFor := func(route string) bool {
+		mac := hmac.New(sha256.New, sta.keyOf(ch))
+		mac.Write([]byte(purpose))
+		mac.Write(reply[11:43])
+		mac.Write([]byte(route))
+		return hmac.Equal(mac.Sum(nil)[:8], finished[sha256.Size:sha256.Size+8])
+	}
+	for name, addr := range sta.Routes {
+		if isFor(name) {
+			return addr, true
+		}
+	}
+	if !isFor("") {
+		return "", false
+	}
+	if addr, ok := sta.Routes[ch.ServerName()]; ok {
+		return addr, true
+	}
+	return net.JoinHostPort(sta.SS_LOCAL_HOST, sta.SS_LOCAL_PORT), true
 }
@@ -1,6 +1,8 @@
 package gqserver
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
 	"strconv"
@@ -9,6 +11,9 @@ import (
 	"time"
 )
 
+// The files in tests/auth are ClientHellos named RESULT_key_time, followed by the
+// Browser that made them for those from gq-client. They're kept as they are so
+// that clients of the version that made them are still let in
 func TestIsSS(t *testing.T) {
 	dir := "tests/auth/"
 	files, _ := ioutil.ReadDir(dir)
@@ -49,3 +54,333 @@ func TestIsSS(t *testing.T) {
 
 	}
 }
+
+func TestClockSkewTolerance(t *testing.T) {
+	// Made by a client at the start of a window
+	content, _ := ioutil.ReadFile("tests/auth/TRUE_testkey_1791936000_chrome")
+	ch, _ := ParseClientHello(content)
+	cases := []struct {
+		offset    int
+		tolerance int
+		exp       bool
+	}{
+		{0, 0, true},
+		{-10, 0, false},
+		{-10, 60, true},
+		{-100, 60, false},
+		{defaultAuthWindow + 30, 0, false},
+		{defaultAuthWindow + 30, 60, true},
+		{defaultAuthWindow + 100, 60, false},
+	}
+	for _, c := range cases {
+		sta := &State{
+			Key:                "testkey",
+			Now:                func() time.Time { return time.Unix(int64(1791936000+c.offset), 0) },
+			UsedRandom:         map[[32]byte]int{},
+			ClockSkewTolerance: c.tolerance,
+		}
+		sta.SetAESKey()
+		if IsSS(ch, sta) != c.exp {
+			t.Error(
+				"For", "our clock", c.offset, "seconds off with ClockSkewTolerance", c.tolerance,
+				"expected", c.exp,
+				"got", !c.exp,
+			)
+		}
+	}
+}
+
+func TestAuthVerifyFunc(t *testing.T) {
+	content, _ := ioutil.ReadFile("tests/TLS/OK_0000_000b00000869702e34322e706c")
+	ch, _ := ParseClientHello(content)
+	for _, accept := range []bool{true, false} {
+		sta := &State{
+			Key:        "testkey",
+			Now:        time.Now,
+			UsedRandom: map[[32]byte]int{},
+			AuthVerifyFunc: func(random []byte, sta *State) bool {
+				return accept
+			},
+		}
+		sta.SetAESKey()
+		exp := ErrBadAuth
+		if accept {
+			exp = nil
+		}
+		if err := VerifyClientHello(ch, sta); err != exp {
+			t.Error("For", "AuthVerifyFunc returning", accept, "expected", exp, "got", err)
+		}
+		if err := VerifyClientHello(ch, sta); accept && err != ErrReplay {
+			t.Error("For", "a replayed random", "expected", ErrReplay, "got", err)
+		}
+	}
+}
+
+func TestUsers(t *testing.T) {
+	content, _ := ioutil.ReadFile("tests/auth/TRUE_testkey_1791936000_chrome")
+	now := time.Unix(1791936000, 0)
+	cases := []struct {
+		key    string
+		expiry time.Time
+		exp    error
+	}{
+		{"otherkey", time.Time{}, nil},
+		{"otherkey", now.Add(time.Hour), nil},
+		{"otherkey", now.Add(-time.Hour), ErrExpired},
+		{"", time.Time{}, nil},
+	}
+	for _, c := range cases {
+		sta := &State{
+			Key:        c.key,
+			Now:        func() time.Time { return now },
+			UsedRandom: map[[32]byte]int{},
+			Users: []*User{
+				{ID: "bob", Key: "bobkey"},
+				{ID: "alice", Key: "testkey", Expiry: c.expiry},
+			},
+		}
+		sta.SetAESKey()
+		ch, _ := ParseClientHello(content)
+		if err := VerifyClientHello(ch, sta); err != c.exp {
+			t.Error("For", "Key", c.key, "and expiry", c.expiry, "expected", c.exp, "got", err)
+			continue
+		}
+		if c.exp == nil && ch.User().Name() != "alice" {
+			t.Error("For", "the user of a ClientHello", "expected", "alice", "got", ch.User().Name())
+		}
+	}
+
+	// The checks after auth use the user's key
+	sta := &State{
+		Key:        "otherkey",
+		Now:        func() time.Time { return now },
+		UsedRandom: map[[32]byte]int{},
+		Users:      []*User{{ID: "alice", Key: "testkey"}},
+	}
+	sta.SetAESKey()
+	ch, _ := ParseClientHello(content)
+	VerifyClientHello(ch, sta)
+	reply := ComposeReply(ch)
+	mac := hmac.New(sha256.New, sta.Users[0].aesKey)
+	mac.Write(reply[11:43])
+	if !IsBound(ch, reply, mac.Sum(nil), sta) {
+		t.Error("For", "a Finished made with the user's key", "expected", true, "got", false)
+	}
+}
+
+func TestIsBound(t *testing.T) {
+	sta := &State{Key: "testkey"}
+	sta.SetAESKey()
+	content, _ := ioutil.ReadFile("tests/TLS/OK_0000_000b00000869702e34322e706c")
+	ch, _ := ParseClientHello(content)
+	reply := ComposeReply(ch)
+
+	mac := hmac.New(sha256.New, sta.AESKey)
+	mac.Write(reply[11:43])
+	finished := append(mac.Sum(nil), make([]byte, 8)...)
+	if !IsBound(ch, reply, finished, sta) {
+		t.Error(
+			"For", "bound Finished",
+			"expecting", "true",
+			"got", false,
+		)
+	}
+
+	otherReply := ComposeReply(ch)
+	otherReply[11] ^= 0xff
+	if IsBound(ch, otherReply, finished, sta) {
+		t.Error(
+			"For", "Finished replayed into another handshake",
+			"expecting", "false",
+			"got", true,
+		)
+	}
+
+	if IsBound(ch, reply, finished[:16], sta) {
+		t.Error(
+			"For", "short Finished",
+			"expecting", "false",
+			"got", true,
+		)
+	}
+}
+
+func TestRouteOf(t *testing.T) {
+	sta := &State{
+		Key:           "testkey",
+		SS_LOCAL_HOST: "127.0.0.1",
+		SS_LOCAL_PORT: "8388",
+		Routes: map[string]string{
+			"alice":       "127.0.0.1:8389",
+			"ip.42.pl":    "127.0.0.1:8390",
+			"www.foo.com": "127.0.0.1:8391",
+		},
+	}
+	sta.SetAESKey()
+	// The SNI of this ClientHello is ip.42.pl
+	content, _ := ioutil.ReadFile("tests/TLS/OK_0000_000b00000869702e34322e706c")
+	ch, _ := ParseClientHello(content)
+	reply := ComposeReply(ch)
+
+	finishedFor := func(route string) []byte {
+		mac := hmac.New(sha256.New, sta.AESKey)
+		mac.Write(reply[11:43])
+		finished := mac.Sum(nil)
+		mac = hmac.New(sha256.New, sta.AESKey)
+		mac.Write([]byte("route"))
+		mac.Write(reply[11:43])
+		mac.Write([]byte(route))
+		return append(finished, mac.Sum(nil)[:8]...)
+	}
+	cases := map[string]string{
+		"alice":       "127.0.0.1:8389",
+		"www.foo.com": "127.0.0.1:8391",
+		// Not in Routes, so the SNI decides
+		"bob": "127.0.0.1:8390",
+	}
+	for route, exp := range cases {
+		got := RouteOf(ch, reply, finishedFor(route), sta)
+		if got != exp {
+			t.Error(
+				"For", route,
+				"expecting", exp,
+				"got", got,
+			)
+		}
+	}
+
+	sta.Routes = nil
+	got := RouteOf(ch, reply, finishedFor("alice"), sta)
+	if got != "127.0.0.1:8388" {
+		t.Error(
+			"For", "no Routes",
+			"expecting", "127.0.0.1:8388",
+			"got", got,
+		)
+	}
+}
+
+func TestIsPing(t *testing.T) {
+	sta := &State{Key: "testkey"}
+	sta.SetAESKey()
+	content, _ := ioutil.ReadFile("tests/TLS/OK_0000_000b00000869702e34322e706c")
+	ch, _ := ParseClientHello(content)
+	reply := ComposeReply(ch)
+
+	mac := hmac.New(sha256.New, sta.AESKey)
+	mac.Write(reply[11:43])
+	finished := mac.Sum(nil)
+	mac = hmac.New(sha256.New, sta.AESKey)
+	mac.Write([]byte("ping"))
+	mac.Write(reply[11:43])
+	ping := append(finished, mac.Sum(nil)[:8]...)
+	if !IsPing(ch, reply, ping, sta) {
+		t.Error("For", "ping tag", "expecting", true, "got", false)
+	}
+	random := append(finished[:sha256.Size:sha256.Size], make([]byte, 8)...)
+	if IsPing(ch, reply, random, sta) {
+		t.Error("For", "random tag", "expecting", false, "got", true)
+	}
+}
+
+func TestIsConnect(t *testing.T) {
+	sta := &State{Key: "testkey"}
+	sta.SetAESKey()
+	content, _ := ioutil.ReadFile("tests/TLS/OK_0000_000b00000869702e34322e706c")
+	ch, _ := ParseClientHello(content)
+	reply := ComposeReply(ch)
+
+	mac := hmac.New(sha256.New, sta.AESKey)
+	mac.Write(reply[11:43])
+	finished := mac.Sum(nil)
+	mac = hmac.New(sha256.New, sta.AESKey)
+	mac.Write([]byte("connect"))
+	mac.Write(reply[11:43])
+	connect := append(finished, mac.Sum(nil)[:8]...)
+	if !IsConnect(ch, reply, connect, sta) {
+		t.Error("For", "connect tag", "expecting", true, "got", false)
+	}
+	if IsPing(ch, reply, connect, sta) {
+		t.Error("For", "connect tag", "expecting", "not a ping", "got", "a ping")
+	}
+}
+
+func TestDatagramRouteOf(t *testing.T) {
+	sta := &State{
+		Key:           "testkey",
+		SS_LOCAL_HOST: "127.0.0.1",
+		SS_LOCAL_PORT: "8388",
+		Routes: map[string]string{
+			"alice":    "127.0.0.1:8389",
+			"ip.42.pl": "127.0.0.1:8390",
+		},
+	}
+	sta.SetAESKey()
+	// The SNI of this ClientHello is ip.42.pl
+	content, _ := ioutil.ReadFile("tests/TLS/OK_0000_000b00000869702e34322e706c")
+	ch, _ := ParseClientHello(content)
+	reply := ComposeReply(ch)
+
+	finishedWith := func(purpose string, route string) []byte {
+		mac := hmac.New(sha256.New, sta.AESKey)
+		mac.Write(reply[11:43])
+		finished := mac.Sum(nil)
+		mac = hmac.New(sha256.New, sta.AESKey)
+		mac.Write([]byte(purpose))
+		mac.Write(reply[11:43])
+		mac.Write([]byte(route))
+		return append(finished, mac.Sum(nil)[:8]...)
+	}
+	cases := []struct {
+		finished []byte
+		exp      string
+	}{
+		{finishedWith("udp", "alice"), "127.0.0.1:8389"},
+		// No Route, so the SNI decides
+		{finishedWith("udp", ""), "127.0.0.1:8390"},
+		// A TCP connection
+		{finishedWith("route", "alice"), ""},
+		// Streams, which are for MuxRouteOf
+		{finishedWith("mux", "alice"), ""},
+	}
+	for _, c := range cases {
+		got, ok := DatagramRouteOf(ch, reply, c.finished, sta)
+		if got != c.exp || ok != (c.exp != "") {
+			t.Error("For", c.finished[sha256.Size:], "expecting", c.exp, "got", got, ok)
+		}
+	}
+
+	sta.Routes = nil
+	got, ok := DatagramRouteOf(ch, reply, finishedWith("udp", ""), sta)
+	if got != "127.0.0.1:8388" || !ok {
+		t.Error("For", "no Routes", "expecting", "127.0.0.1:8388", "got", got, ok)
+	}
+}
+
+func TestMuxRouteOf(t *testing.T) {
+	sta := &State{
+		Key:           "testkey",
+		SS_LOCAL_HOST: "127.0.0.1",
+		SS_LOCAL_PORT: "8388",
+		Routes:        map[string]string{"alice": "127.0.0.1:8389"},
+	}
+	sta.SetAESKey()
+	content, _ := ioutil.ReadFile("tests/TLS/OK_0000_000b00000869702e34322e706c")
+	ch, _ := ParseClientHello(content)
+	reply := ComposeReply(ch)
+
+	mac := hmac.New(sha256.New, sta.AESKey)
+	mac.Write(reply[11:43])
+	finished := mac.Sum(nil)
+	mac = hmac.New(sha256.New, sta.AESKey)
+	mac.Write([]byte("mux"))
+	mac.Write(reply[11:43])
+	mac.Write([]byte("alice"))
+	finished = append(finished, mac.Sum(nil)[:8]...)
+	if got, ok := MuxRouteOf(ch, reply, finished, sta); got != "127.0.0.1:8389" || !ok {
+		t.Error("For", "mux tag for alice", "expecting", "127.0.0.1:8389", "got", got, ok)
+	}
+	if got, ok := DatagramRouteOf(ch, reply, finished, sta); ok {
+		t.Error("For", "mux tag", "expecting", "not UDP", "got", got)
+	}
+}
@@ -0,0 +1,115 @@
+package gqserver
+
+import (
+	"errors"
+	"net"
+	"strconv"
+)
+
+// ErrShortAddr is returned by ParseAddr for an address that hasn't all arrived yet
+var ErrShortAddr = errors.New("Address cut short")
+
+// ErrInternalAddr is returned by ResolveConnect for an address on the server or
+// its network
+var ErrInternalAddr = errors.New("Address is on the server or its network")
+
+// Carrier-grade NAT, which IsPrivate leaves out, but is as internal to a cloud
+var sharedAddrSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// ParseAddr parses the address a connection from gq-client -socks starts with, in
+// the form of a SOCKS5 address: a byte of its type, then 4 bytes of IPv4, 16 of
+// IPv6, or a byte of length and a domain, then 2 bytes of port. It returns the
+// address as host:port and how many bytes of b it took
+func ParseAddr(b []byte) (addr string, n int, err error) {
+	if len(b) < 1 {
+		return "", 0, ErrShortAddr
+	}
+	var host string
+	switch b[0] {
+	case 0x01, 0x04:
+		n = 1 + net.IPv4len
+		if b[0] == 0x04 {
+			n = 1 + net.IPv6len
+		}
+		if len(b) < n+2 {
+			return "", 0, ErrShortAddr
+		}
+		host = net.IP(b[1:n]).String()
+	case 0x03:
+		if len(b) < 2 {
+			return "", 0, ErrShortAddr
+		}
+		n = 2 + int(b[1])
+		if len(b) < n+2 {
+			return "", 0, ErrShortAddr
+		}
+		host = string(b[2:n])
+	default:
+		return "", 0, errors.New("Unknown address type")
+	}
+	port := BtoInt(b[n : n+2])
+	return net.JoinHostPort(host, strconv.Itoa(port)), n + 2, nil
+}
+
+// ResolveConnect resolves addr, from ParseAddr, and returns it with the IP to
+// connect to, so that what's checked is what's dialed. The addresses of the
+// server's interfaces, its public ones included, and loopback, private,
+// link-local and multicast addresses are refused with ErrInternalAddr, as they'd
+// let a client reach ss-server, MetricsAddr, the metadata of a cloud and the rest
+// of the server's network from inside it, unless they're in AllowConnectTo
+func (sta *State) ResolveConnect(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		ips, err = net.LookupIP(host)
+		if err != nil {
+			return "", err
+		}
+	}
+	for _, ip := range ips {
+		if sta.connectAllowed(ip) {
+			return net.JoinHostPort(ip.String(), port), nil
+		}
+	}
+	return "", ErrInternalAddr
+}
+
+func (sta *State) connectAllowed(ip net.IP) bool {
+	for _, network := range sta.allowConnectTo {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return !ip.IsLoopback() && !ip.IsUnspecified() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsMulticast() && !sharedAddrSpace.Contains(ip) && !onServer(ip)
+}
+
+// interfaceAddrs lists the addresses of the server's interfaces. Tests replace it
+var interfaceAddrs = net.InterfaceAddrs
+
+// onServer reports whether ip is an address of one of the server's interfaces,
+// where anything listening on all addresses can be reached past a firewall in
+// front of the server
+func onServer(ip net.IP) bool {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		// Refused rather than let through to what may be the server
+		return true
+	}
+	for _, a := range addrs {
+		switch a := a.(type) {
+		case *net.IPNet:
+			if a.IP.Equal(ip) {
+				return true
+			}
+		case *net.IPAddr:
+			if a.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package gqserver
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseAddr(t *testing.T) {
+	cases := []struct {
+		b    []byte
+		addr string
+		n    int
+		err  error
+	}{
+		{[]byte{0x01, 127, 0, 0, 1, 0x1f, 0x90, 'x'}, "127.0.0.1:8080", 7, nil},
+		{append(append([]byte{0x04}, make([]byte, 15)...), 1, 0x01, 0xbb), "[::1]:443", 19, nil},
+		{append([]byte{0x03, 11}, "example.com\x00\x50"...), "example.com:80", 15, nil},
+		{[]byte{0x03, 11, 'e'}, "", 0, ErrShortAddr},
+		{[]byte{0x01, 127, 0, 0, 1, 0x1f}, "", 0, ErrShortAddr},
+		{[]byte{}, "", 0, ErrShortAddr},
+	}
+	for _, c := range cases {
+		addr, n, err := ParseAddr(c.b)
+		if addr != c.addr || n != c.n || err != c.err {
+			t.Error("For", c.b, "expected", c.addr, c.n, c.err, "got", addr, n, err)
+		}
+	}
+	if _, _, err := ParseAddr([]byte{0x02, 0, 0}); err == nil {
+		t.Error("For", "an unknown address type", "expected", "an error", "got", nil)
+	}
+}
+
+func TestResolveConnect(t *testing.T) {
+	defer func(old func() ([]net.Addr, error)) { interfaceAddrs = old }(interfaceAddrs)
+	// A server with a public address of its own, and one let through
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.IPv4(203, 0, 113, 7), Mask: net.CIDRMask(24, 32)},
+			&net.IPNet{IP: net.ParseIP("2001:db8::7"), Mask: net.CIDRMask(64, 128)},
+			&net.IPAddr{IP: net.IPv4(198, 51, 100, 9)},
+			&net.IPNet{IP: net.IPv4(10, 1, 0, 5), Mask: net.CIDRMask(16, 32)},
+		}, nil
+	}
+	sta := &State{Key: "testkey", WebServerAddr: "204.79.197.200:443", AllowConnectTo: []string{"10.1.0.0/16"}}
+	if err := sta.validate(); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]error{
+		"203.0.113.7:8388":      ErrInternalAddr,
+		"[2001:db8::7]:8388":    ErrInternalAddr,
+		"198.51.100.9:9100":     ErrInternalAddr,
+		"10.1.0.5:8388":         nil,
+		"203.0.113.1:443":       nil,
+		"[2001:db8::1]:443":     nil,
+		"10.1.2.3:22":           nil,
+		"127.0.0.1:8388":        ErrInternalAddr,
+		"[::1]:8388":            ErrInternalAddr,
+		"[::ffff:127.0.0.1]:80": ErrInternalAddr,
+		"0.0.0.0:8388":          ErrInternalAddr,
+		"169.254.169.254:80":    ErrInternalAddr,
+		"10.2.0.1:80":           ErrInternalAddr,
+		"192.168.1.1:80":        ErrInternalAddr,
+		"100.64.0.1:80":         ErrInternalAddr,
+		"[fd00::1]:80":          ErrInternalAddr,
+		"[fe80::1]:80":          ErrInternalAddr,
+	}
+	for addr, exp := range cases {
+		if _, err := sta.ResolveConnect(addr); err != exp {
+			t.Error("For", addr, "expected", exp, "got", err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package gqserver
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDatagramRecords(t *testing.T) {
+	var datagrams [][]byte
+	var stream []byte
+	for _, size := range []int{0, 5, 20000, MaxDatagramSize} {
+		datagram := PsudoRandBytes(size, int64(size))
+		datagrams = append(datagrams, datagram)
+		stream = append(stream, DatagramRecords(datagram)...)
+	}
+
+	var r DatagramReader
+	var got [][]byte
+	for len(stream) > 0 {
+		length := 5 + BtoInt(stream[3:5])
+		if stream[0] != 0x17 || length-5 > maxDatagramRecord {
+			t.Fatal("For", "a record", "expected", "application data of at most 16384 bytes", "got", stream[:5])
+		}
+		// A byte at a time, as if the records were cut anywhere
+		for _, b := range PeelRecordLayer(stream[:length]) {
+			r.Feed([]byte{b})
+			if datagram, ok := r.Next(); ok {
+				got = append(got, datagram)
+			}
+		}
+		stream = stream[length:]
+	}
+	if len(got) != len(datagrams) {
+		t.Fatal("For", "4 datagrams", "expected", len(datagrams), "got", len(got))
+	}
+	for i := range datagrams {
+		if !bytes.Equal(got[i], datagrams[i]) {
+			t.Error("For", "datagram", i, "expected", len(datagrams[i]), "bytes", "got", len(got[i]))
+		}
+	}
+	if _, ok := r.Next(); ok {
+		t.Error("For", "a drained reader", "expected", "no datagram", "got", "one")
+	}
+}
@@ -0,0 +1,141 @@
+package gqserver
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// see https://tools.ietf.org/html/draft-davidben-tls-grease-01
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// u16s reads the uint16 in data, leaving out GREASE values
+func u16s(data []byte) []uint16 {
+	var ret []uint16
+	for i := 0; i+1 < len(data); i += 2 {
+		if v := binary.BigEndian.Uint16(data[i:]); !isGREASE(v) {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// u16sWithLen reads a list of uint16 in ext that starts with a length field of
+// lenSize bytes. A malformed list gives nothing
+func u16sWithLen(ext []byte, lenSize int) []uint16 {
+	if len(ext) < lenSize || len(ext) < lenSize+BtoInt(ext[:lenSize]) {
+		return nil
+	}
+	return u16s(ext[lenSize : lenSize+BtoInt(ext[:lenSize])])
+}
+
+func (ch *ClientHello) extension(typ uint16) []byte {
+	return ch.extensions[[2]byte{byte(typ >> 8), byte(typ)}]
+}
+
+func joinDecimal(list []uint16) string {
+	s := make([]string, len(list))
+	for i, v := range list {
+		s[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(s, "-")
+}
+
+func joinHex(list []uint16) string {
+	s := make([]string, len(list))
+	for i, v := range list {
+		s[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(s, ",")
+}
+
+// JA3 returns the JA3 string of ch. GREASE values are left out
+func (ch *ClientHello) JA3() string {
+	var pointFormats []uint16
+	if ext := ch.extension(0x000b); len(ext) != 0 && len(ext) >= 1+int(ext[0]) {
+		for _, f := range ext[1 : 1+int(ext[0])] {
+			pointFormats = append(pointFormats, uint16(f))
+		}
+	}
+	return strings.Join([]string{
+		strconv.Itoa(BtoInt(ch.clientVersion)),
+		joinDecimal(u16s(ch.cipherSuites)),
+		joinDecimal(ch.extensionTypes()),
+		joinDecimal(u16sWithLen(ch.extension(0x000a), 2)),
+		joinDecimal(pointFormats),
+	}, ",")
+}
+
+// extensionTypes returns the types of the extensions of ch in order, without GREASE
+func (ch *ClientHello) extensionTypes() []uint16 {
+	var ret []uint16
+	for _, typ := range ch.extensionOrder {
+		if !isGREASE(typ) {
+			ret = append(ret, typ)
+		}
+	}
+	return ret
+}
+
+// JA4 returns the JA4 fingerprint of ch, see https://github.com/FoxIO-LLC/ja4
+func (ch *ClientHello) JA4() string {
+	version := uint16(BtoInt(ch.clientVersion))
+	if ext := ch.extension(0x002b); len(ext) != 0 {
+		for _, v := range u16sWithLen(ext, 1) {
+			if v > version {
+				version = v
+			}
+		}
+	}
+	ver := map[uint16]string{0x0304: "13", 0x0303: "12", 0x0302: "11", 0x0301: "10"}[version]
+	if ver == "" {
+		ver = "00"
+	}
+	sni := "i"
+	if _, ok := ch.extensions[[2]byte{0x00, 0x00}]; ok {
+		sni = "d"
+	}
+	alpn := "00"
+	// protocol name list length 2, name length 1
+	if ext := ch.extension(0x0010); len(ext) > 3 && len(ext) >= 3+int(ext[2]) && ext[2] != 0 {
+		first := ext[3 : 3+int(ext[2])]
+		alpn = string(first[:1]) + string(first[len(first)-1:])
+	}
+	ciphers := u16s(ch.cipherSuites)
+	exts := ch.extensionTypes()
+	count := func(n int) string {
+		if n > 99 {
+			n = 99
+		}
+		return fmt.Sprintf("%02d", n)
+	}
+	a := "t" + ver + sni + count(len(ciphers)) + count(len(exts)) + alpn
+
+	sort.Slice(ciphers, func(i, j int) bool { return ciphers[i] < ciphers[j] })
+	var sorted []uint16
+	for _, e := range exts {
+		// SNI and ALPN are already in a
+		if e != 0x0000 && e != 0x0010 {
+			sorted = append(sorted, e)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	c := joinHex(sorted)
+	if sigAlgos := u16sWithLen(ch.extension(0x000d), 2); len(sigAlgos) != 0 {
+		c += "_" + joinHex(sigAlgos)
+	}
+	hash := func(s string) string {
+		if s == "" {
+			return "000000000000"
+		}
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])[:12]
+	}
+	return a + "_" + hash(joinHex(ciphers)) + "_" + hash(c)
+}
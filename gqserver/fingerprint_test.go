@@ -0,0 +1,38 @@
+package gqserver
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestFingerprints(t *testing.T) {
+	content, _ := ioutil.ReadFile("tests/TLS/OK_0000_000b00000869702e34322e706c")
+	ch, err := ParseClientHello(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ja3 := "771,49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53-10,65281-0-23-35-13-5-18-16-30032-11-10-21,29-23-24,0"
+	if got := ch.JA3(); got != ja3 {
+		t.Error("For", "JA3", "expected", ja3, "got", got)
+	}
+	ja4 := "t12d1312h2_8b80da21ef18_1c0c7ba38891"
+	if got := ch.JA4(); got != ja4 {
+		t.Error("For", "JA4", "expected", ja4, "got", got)
+	}
+
+	grease := &ClientHello{
+		clientVersion:  []byte{0x03, 0x03},
+		cipherSuites:   []byte{0x0a, 0x0a, 0x13, 0x01},
+		extensionOrder: []uint16{0x1a1a, 0x002b, 0x000a},
+		extensions: map[[2]byte][]byte{
+			{0x00, 0x2b}: {0x04, 0x2a, 0x2a, 0x03, 0x04},
+			{0x00, 0x0a}: {0x00, 0x04, 0x3a, 0x3a, 0x00, 0x1d},
+		},
+	}
+	if got := grease.JA3(); got != "771,4865,43-10,29," {
+		t.Error("For", "GREASE values", "expected", "771,4865,43-10,29,", "got", got)
+	}
+	if got := grease.JA4()[:10]; got != "t13i010200" {
+		t.Error("For", "GREASE values in JA4", "expected", "t13i010200", "got", got)
+	}
+}
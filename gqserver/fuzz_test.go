@@ -0,0 +1,33 @@
+package gqserver
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func FuzzReadTillDrain(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(AddRecordLayer([]byte("data"), []byte{0x17}, []byte{0x03, 0x03}))
+	f.Add([]byte{0x17, 0x03, 0x03, 0xff, 0xff})
+	f.Add([]byte{0x17, 0x03, 0x03, 0x00, 0x05, 0x01})
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		go func() {
+			c2.Write(stream)
+			c2.Close()
+		}()
+		buf := make([]byte, 20480)
+		for {
+			n, err := ReadTillDrain(c1, buf)
+			if err != nil {
+				return
+			}
+			record := buf[:n]
+			if n != 5+BtoInt(record[3:5]) || !bytes.Equal(PeelRecordLayer(record), record[5:]) {
+				t.Fatal("For", stream, "expected", "one whole record", "got", record)
+			}
+		}
+	})
+}
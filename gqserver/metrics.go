@@ -0,0 +1,161 @@
+package gqserver
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The stages of the handshake that HandshakeFailed is called with, after the
+// ClientHello has passed auth
+var handshakeStages = []string{"reply", "finished", "unbound"}
+
+// The reasons that Rejected is called with for connections that aren't from
+// gq-client, which are sent to WebServerAddr
+var rejectReasons = []string{"silent", "notclienthello", "notwebsocket", "auth", "expired", "replay"}
+
+// The upper bounds in seconds of the buckets of connection_duration_seconds
+var durationBuckets = []float64{1, 10, 60, 300, 1800, 3600}
+
+// Metrics counts what happened to connections so that it can be scraped by
+// Prometheus. The zero value is ready to use
+type Metrics struct {
+	// Bytes relayed from clients to ss-server and back. Accessed atomically, and
+	// first in the struct so that they're 64-bit aligned on 32-bit platforms
+	up   int64
+	down int64
+	// Returns the connections being dealt with, for active_connections, if not nil
+	Active func() int
+
+	mu                sync.Mutex
+	handshakeFailures map[string]int64
+	rejections        map[string]int64
+	// Bytes up and down by the ID of the user they were relayed for
+	userBytes map[string]*[2]int64
+	// The connections that lasted up to each of durationBuckets, and longer
+	durations     [7]int64
+	durationSum   time.Duration
+	durationCount int64
+}
+
+// AddUp counts n bytes from a client relayed to ss-server for user, the ID of
+// one of Users or an empty string for the Key
+func (m *Metrics) AddUp(user string, n int) {
+	atomic.AddInt64(&m.up, int64(n))
+	m.addUser(user, 0, n)
+}
+
+// AddDown counts n bytes from ss-server relayed to a client for user
+func (m *Metrics) AddDown(user string, n int) {
+	atomic.AddInt64(&m.down, int64(n))
+	m.addUser(user, 1, n)
+}
+
+func (m *Metrics) addUser(user string, direction int, n int) {
+	if user == "" {
+		return
+	}
+	m.mu.Lock()
+	if m.userBytes == nil {
+		m.userBytes = make(map[string]*[2]int64)
+	}
+	bytes, ok := m.userBytes[user]
+	if !ok {
+		bytes = new([2]int64)
+		m.userBytes[user] = bytes
+	}
+	bytes[direction] += int64(n)
+	m.mu.Unlock()
+}
+
+// HandshakeFailed counts a handshake that failed at stage
+func (m *Metrics) HandshakeFailed(stage string) {
+	m.mu.Lock()
+	if m.handshakeFailures == nil {
+		m.handshakeFailures = make(map[string]int64)
+	}
+	m.handshakeFailures[stage]++
+	m.mu.Unlock()
+}
+
+// Rejected counts a connection sent to WebServerAddr for reason
+func (m *Metrics) Rejected(reason string) {
+	m.mu.Lock()
+	if m.rejections == nil {
+		m.rejections = make(map[string]int64)
+	}
+	m.rejections[reason]++
+	m.mu.Unlock()
+}
+
+// ConnClosed counts a connection that was open for d
+func (m *Metrics) ConnClosed(d time.Duration) {
+	bucket := len(durationBuckets)
+	for i, le := range durationBuckets {
+		if d.Seconds() <= le {
+			bucket = i
+			break
+		}
+	}
+	m.mu.Lock()
+	m.durations[bucket]++
+	m.durationSum += d
+	m.durationCount++
+	m.mu.Unlock()
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if m.Active != nil {
+		fmt.Fprintln(w, "# HELP active_connections Connections from clients being dealt with.")
+		fmt.Fprintln(w, "# TYPE active_connections gauge")
+		fmt.Fprintf(w, "active_connections %d\n", m.Active())
+	}
+	fmt.Fprintln(w, "# HELP relayed_bytes_total Bytes relayed between clients and ss-server, by direction.")
+	fmt.Fprintln(w, "# TYPE relayed_bytes_total counter")
+	fmt.Fprintf(w, "relayed_bytes_total{direction=\"up\"} %d\n", atomic.LoadInt64(&m.up))
+	fmt.Fprintf(w, "relayed_bytes_total{direction=\"down\"} %d\n", atomic.LoadInt64(&m.down))
+	if len(m.userBytes) != 0 {
+		users := make([]string, 0, len(m.userBytes))
+		for user := range m.userBytes {
+			users = append(users, user)
+		}
+		sort.Strings(users)
+		fmt.Fprintln(w, "# HELP user_relayed_bytes_total Bytes relayed between clients and ss-server, by user and direction.")
+		fmt.Fprintln(w, "# TYPE user_relayed_bytes_total counter")
+		for _, user := range users {
+			fmt.Fprintf(w, "user_relayed_bytes_total{user=%q,direction=\"up\"} %d\n", user, m.userBytes[user][0])
+			fmt.Fprintf(w, "user_relayed_bytes_total{user=%q,direction=\"down\"} %d\n", user, m.userBytes[user][1])
+		}
+	}
+	fmt.Fprintln(w, "# HELP handshake_failures_total Handshakes with clients that passed auth and then failed, by the stage they failed at.")
+	fmt.Fprintln(w, "# TYPE handshake_failures_total counter")
+	for _, stage := range handshakeStages {
+		fmt.Fprintf(w, "handshake_failures_total{stage=%q} %d\n", stage, m.handshakeFailures[stage])
+	}
+	fmt.Fprintln(w, "# HELP rejected_connections_total Connections sent to WebServerAddr, by the reason they were.")
+	fmt.Fprintln(w, "# TYPE rejected_connections_total counter")
+	for _, reason := range rejectReasons {
+		fmt.Fprintf(w, "rejected_connections_total{reason=%q} %d\n", reason, m.rejections[reason])
+	}
+	fmt.Fprintln(w, "# HELP connection_duration_seconds How long connections from clients were open.")
+	fmt.Fprintln(w, "# TYPE connection_duration_seconds histogram")
+	var cumulative int64
+	for i, le := range durationBuckets {
+		cumulative += m.durations[i]
+		fmt.Fprintf(w, "connection_duration_seconds_bucket{le=\"%g\"} %d\n", le, cumulative)
+	}
+	fmt.Fprintf(w, "connection_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.durationCount)
+	fmt.Fprintf(w, "connection_duration_seconds_sum %g\n", m.durationSum.Seconds())
+	fmt.Fprintf(w, "connection_duration_seconds_count %d\n", m.durationCount)
+	fmt.Fprintln(w, "# HELP go_goroutines Goroutines that currently exist.")
+	fmt.Fprintln(w, "# TYPE go_goroutines gauge")
+	fmt.Fprintf(w, "go_goroutines %d\n", runtime.NumGoroutine())
+}
@@ -0,0 +1,48 @@
+package gqserver
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	m := &Metrics{Active: func() int { return 3 }}
+	m.AddUp("", 100)
+	m.AddUp("alice", 20)
+	m.AddDown("", 5000)
+	m.HandshakeFailed("finished")
+	m.Rejected("replay")
+	m.Rejected("auth")
+	m.Rejected("auth")
+	m.ConnClosed(500 * time.Millisecond)
+	m.ConnClosed(30 * time.Second)
+	m.ConnClosed(2 * time.Hour)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, exp := range []string{
+		`active_connections 3`,
+		`relayed_bytes_total{direction="up"} 120`,
+		`relayed_bytes_total{direction="down"} 5000`,
+		`user_relayed_bytes_total{user="alice",direction="up"} 20`,
+		`user_relayed_bytes_total{user="alice",direction="down"} 0`,
+		`handshake_failures_total{stage="finished"} 1`,
+		`handshake_failures_total{stage="reply"} 0`,
+		`rejected_connections_total{reason="auth"} 2`,
+		`rejected_connections_total{reason="replay"} 1`,
+		`rejected_connections_total{reason="silent"} 0`,
+		`connection_duration_seconds_bucket{le="1"} 1`,
+		`connection_duration_seconds_bucket{le="60"} 2`,
+		`connection_duration_seconds_bucket{le="3600"} 2`,
+		`connection_duration_seconds_bucket{le="+Inf"} 3`,
+		`connection_duration_seconds_sum 7230.5`,
+		`connection_duration_seconds_count 3`,
+	} {
+		if !strings.Contains(body, exp+"\n") {
+			t.Error("For", "/metrics", "expected", exp, "got", body)
+		}
+	}
+}
@@ -3,7 +3,12 @@ package gqserver
 import (
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 )
@@ -26,37 +31,278 @@ type State struct {
 	SS_REMOTE_HOST string
 	SS_REMOTE_PORT string
 	FastOpen       bool
-	M              sync.RWMutex
-	UsedRandom     map[[32]byte]int
+	Routes         map[string]string
+	Compress       bool
+	MaxUsedRandoms int
+	// Seconds by which a client's clock may be off from ours
+	ClockSkewTolerance int
+	// Seconds in each window of time a ClientHello is made for, and so the longest
+	// one can be replayed for
+	AuthWindow int
+	// Bytes read from ss-server at most for each record to the client
+	DownBufferSize int
+	// Seconds a client may take to answer our ServerHello
+	HandshakeTimeout int
+	// Seconds a connection may go without data either way before it's closed
+	IdleTimeout int
+	// The most connections from clients at once, those over it are closed
+	MaxConnections int
+	// Log the JA3 and JA4 of each client that passes auth
+	LogFingerprints bool
+	// The address /metrics is served on for Prometheus, empty for none. It has to
+	// be on loopback, as anyone who can fetch it can tell what we are
+	MetricsAddr string
+	// Let MetricsAddr be on an address other machines can reach
+	AllowRemoteMetrics bool
+	// Keys of their own that clients can be let in with besides Key
+	Users []*User
+	// Dial the addresses asked for by gq-client -socks, which makes us an open
+	// proxy to anyone with a key
+	AllowConnect bool
+	// Networks as CIDRs that AllowConnect may reach even though they're on the
+	// server or its network, which are refused otherwise
+	AllowConnectTo []string
+	allowConnectTo []*net.IPNet
+	// How clients get to us: tcp, or websocket at WebSocketPath
+	Transport     string
+	WebSocketPath string
+	// The certificate and its key in PEM files for wss://, without them it's ws://
+	// for a CDN or a reverse proxy to take TLS
+	WebSocketCert string
+	WebSocketKey  string
+	M             sync.RWMutex
+	UsedRandom    map[[32]byte]int
+	// The randoms in UsedRandom from the oldest, so that they can be expired
+	// or evicted without going through the whole map
+	usedOrder []usedRandom
+	// Checks the random field of a ClientHello in place of IsSS's own check, for
+	// the AuthPayloadFunc of gq-client. Both have to be set to match, or every
+	// client fails auth. Replays are still caught by UsedRandom
+	AuthVerifyFunc func(random []byte, sta *State) bool
 }
 
+type usedRandom struct {
+	random [32]byte
+	time   int
+}
+
+// The default MaxUsedRandoms, which takes about 150MB
+const defaultMaxUsedRandoms = 1 << 20
+
 // ParseConfig parses the config file into a State variable
 func (sta *State) ParseConfig(configPath string) error {
 	content, err := ioutil.ReadFile(configPath)
 	if err != nil {
 		return err
 	}
+	content, err = expandEnv(content)
+	if err != nil {
+		return err
+	}
 	err = json.Unmarshal(content, &sta)
 	if err != nil {
 		return err
 	}
+	return sta.validate()
+}
+
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${VAR} in the config with the value of the environment variable VAR.
+// The value is escaped so that it stays inside the JSON string it's placed in
+func expandEnv(content []byte) ([]byte, error) {
+	var err error
+	ret := envRef.ReplaceAllFunc(content, func(ref []byte) []byte {
+		name := string(envRef.FindSubmatch(ref)[1])
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			if err == nil {
+				err = errors.New("Undefined environment variable in config: " + name)
+			}
+			return ref
+		}
+		quoted, _ := json.Marshal(value)
+		return quoted[1 : len(quoted)-1]
+	})
+	return ret, err
+}
+
+// validate checks the values parsed from the config. Options that cannot be
+// used together or that depend on each other are also checked here so that
+// main doesn't need to know about them
+func (sta *State) validate() error {
+	if sta.Key == "" && len(sta.Users) == 0 {
+		return errors.New("Key cannot be empty without Users")
+	}
+	ids := make(map[string]bool)
+	keys := map[string]bool{sta.Key: true}
+	for _, u := range sta.Users {
+		if u == nil || u.ID == "" {
+			return errors.New("Every user must have an ID")
+		}
+		if ids[u.ID] {
+			return errors.New("Duplicate user ID " + u.ID)
+		}
+		ids[u.ID] = true
+		if u.Key == "" || keys[u.Key] {
+			// Which user a client is couldn't be told otherwise
+			return errors.New("User " + u.ID + " must have a Key of its own")
+		}
+		keys[u.Key] = true
+		if u.RateLimit < 0 {
+			return errors.New("RateLimit of user " + u.ID + " cannot be negative")
+		}
+	}
+	if sta.WebServerAddr == "" {
+		return errors.New("WebServerAddr cannot be empty")
+	}
+	if sta.MaxUsedRandoms < 0 {
+		return errors.New("MaxUsedRandoms cannot be negative")
+	}
+	if sta.AuthWindow != 0 && (sta.AuthWindow < minAuthWindow || sta.AuthWindow > defaultAuthWindow) {
+		return errors.New("AuthWindow must be between 60 and 43200")
+	}
+	if sta.ClockSkewTolerance < 0 || sta.ClockSkewTolerance > sta.authWindow() {
+		return errors.New("ClockSkewTolerance must be between 0 and AuthWindow")
+	}
+	if sta.DownBufferSize != 0 && (sta.DownBufferSize < 1024 || sta.DownBufferSize > 16384) {
+		// Each read goes into one record, which can't carry more
+		return errors.New("DownBufferSize must be between 1024 and 16384")
+	}
+	if sta.HandshakeTimeout < 0 {
+		return errors.New("HandshakeTimeout cannot be negative")
+	}
+	if sta.IdleTimeout < 0 {
+		return errors.New("IdleTimeout cannot be negative")
+	}
+	if sta.MaxConnections < 0 {
+		return errors.New("MaxConnections cannot be negative")
+	}
+	if sta.MetricsAddr != "" {
+		host, _, err := net.SplitHostPort(sta.MetricsAddr)
+		if err != nil {
+			return errors.New("Bad MetricsAddr: " + err.Error())
+		}
+		if ip := net.ParseIP(host); host != "" && host != "localhost" && (ip == nil || !ip.IsLoopback()) && !sta.AllowRemoteMetrics {
+			return errors.New("MetricsAddr must be on loopback unless AllowRemoteMetrics is set")
+		}
+	}
+	switch sta.Transport {
+	case "", "tcp":
+		if sta.WebSocketPath != "" || sta.WebSocketCert != "" || sta.WebSocketKey != "" {
+			return errors.New("WebSocketPath, WebSocketCert and WebSocketKey can only be used with Transport websocket")
+		}
+	case "websocket":
+		if sta.WebSocketPath != "" && !strings.HasPrefix(sta.WebSocketPath, "/") {
+			return errors.New("WebSocketPath must start with /")
+		}
+		if (sta.WebSocketCert == "") != (sta.WebSocketKey == "") {
+			return errors.New("WebSocketCert and WebSocketKey must be used together")
+		}
+	default:
+		return errors.New("Unknown Transport: " + sta.Transport)
+	}
+	sta.allowConnectTo = nil
+	for _, cidr := range sta.AllowConnectTo {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return errors.New("Bad network in AllowConnectTo: " + err.Error())
+		}
+		sta.allowConnectTo = append(sta.allowConnectTo, network)
+	}
+	for name, addr := range sta.Routes {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return errors.New("Bad address for route " + name + ": " + err.Error())
+		}
+	}
 	return nil
 }
 
-// SetAESKey calculates the SHA256 of the string key
+// MetricsListenAddr returns MetricsAddr, on 127.0.0.1 if it has no host
+func (sta *State) MetricsListenAddr() string {
+	host, port, _ := net.SplitHostPort(sta.MetricsAddr)
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// SetAESKey calculates the SHA256 of the string key, and of the keys of Users
 func (sta *State) SetAESKey() {
 	h := sha256.New()
 	h.Write([]byte(sta.Key))
 	sta.AESKey = h.Sum(nil)
+	for _, u := range sta.Users {
+		u.setAESKey()
+	}
 }
 
-// PutUsedRandom adds a random field into map UsedRandom
+// PutUsedRandom adds a random field into map UsedRandom. If there are more than
+// MaxUsedRandoms, the oldest ones are evicted
 func (sta *State) PutUsedRandom(random [32]byte) {
 	sta.M.Lock()
-	sta.UsedRandom[random] = int(sta.Now().Unix())
+	sta.putUsedRandom(random)
+	sta.M.Unlock()
+}
+
+func (sta *State) putUsedRandom(random [32]byte) {
+	now := int(sta.Now().Unix())
+	sta.UsedRandom[random] = now
+	sta.usedOrder = append(sta.usedOrder, usedRandom{random, now})
+	max := sta.MaxUsedRandoms
+	if max == 0 {
+		max = defaultMaxUsedRandoms
+	}
+	for len(sta.UsedRandom) > max && len(sta.usedOrder) != 0 {
+		sta.popUsedRandom()
+	}
+}
+
+// popUsedRandom removes the oldest random
+func (sta *State) popUsedRandom() {
+	oldest := sta.usedOrder[0]
+	sta.usedOrder = sta.usedOrder[1:]
+	// It may have been deleted, or put again since
+	if t, ok := sta.UsedRandom[oldest.random]; ok && t == oldest.time {
+		delete(sta.UsedRandom, oldest.random)
+	}
+}
+
+// UseRandom marks random as used and reports whether it wasn't already
+func (sta *State) UseRandom(random [32]byte) bool {
+	sta.M.Lock()
+	defer sta.M.Unlock()
+	if _, used := sta.UsedRandom[random]; used {
+		return false
+	}
+	sta.putUsedRandom(random)
+	return true
+}
+
+// CleanUsedRandom removes the randoms older than any valid ClientHello
+func (sta *State) CleanUsedRandom() {
+	now := int(sta.Now().Unix())
+	sta.M.Lock()
+	// Randoms are kept for as long as a ClientHello made with them stays valid,
+	// which is a window and twice ClockSkewTolerance
+	ttl := sta.authWindow() + 2*sta.ClockSkewTolerance
+	for len(sta.usedOrder) != 0 && now-sta.usedOrder[0].time > ttl {
+		sta.popUsedRandom()
+	}
+	if len(sta.usedOrder) == 0 {
+		// Let go of the array behind it
+		sta.usedOrder = nil
+	}
 	sta.M.Unlock()
 }
 
+// UsedRandomCount returns the number of randoms in UsedRandom
+func (sta *State) UsedRandomCount() int {
+	sta.M.RLock()
+	defer sta.M.RUnlock()
+	return len(sta.UsedRandom)
+}
+
 // DelUsedRandom deletes a random field from the map
 func (sta *State) DelUsedRandom(random [32]byte) {
 	sta.M.Lock()
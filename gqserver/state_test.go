@@ -1,8 +1,10 @@
 package gqserver
 
 import (
+	"encoding/binary"
 	"fmt"
 	"testing"
+	"time"
 )
 
 func TestParseConfig(t *testing.T) {
@@ -15,3 +17,113 @@ func TestParseConfig(t *testing.T) {
 		fmt.Println("WebServerAddr: " + sta.WebServerAddr)
 	}
 }
+
+func TestMetricsAddr(t *testing.T) {
+	for _, c := range []struct {
+		addr   string
+		remote bool
+		ok     bool
+	}{
+		{"127.0.0.1:9090", false, true},
+		{"[::1]:9090", false, true},
+		{"localhost:9090", false, true},
+		{":9090", false, true},
+		{"0.0.0.0:9090", false, false},
+		{"203.0.113.1:9090", false, false},
+		{"203.0.113.1:9090", true, true},
+		{"9090", false, false},
+	} {
+		sta := &State{Key: "testkey", WebServerAddr: "204.79.197.200:443", MetricsAddr: c.addr, AllowRemoteMetrics: c.remote}
+		if err := sta.validate(); (err == nil) != c.ok {
+			t.Error(
+				"For", c.addr, "with AllowRemoteMetrics", c.remote,
+				"expected", c.ok,
+				"got", err,
+			)
+		}
+	}
+	sta := &State{MetricsAddr: ":9090"}
+	if addr := sta.MetricsListenAddr(); addr != "127.0.0.1:9090" {
+		t.Error(
+			"For", ":9090",
+			"expected", "127.0.0.1:9090",
+			"got", addr,
+		)
+	}
+}
+
+func TestUsedRandomFlood(t *testing.T) {
+	now := 1519319215
+	sta := &State{
+		Key:            "testkey",
+		Now:            func() time.Time { return time.Unix(int64(now), 0) },
+		UsedRandom:     map[[32]byte]int{},
+		MaxUsedRandoms: 100,
+	}
+	sta.SetAESKey()
+
+	// ClientHellos from someone without the key aren't remembered at all
+	for i := 0; i < 10000; i++ {
+		ch := &ClientHello{random: PsudoRandBytes(32, int64(i))}
+		IsSS(ch, sta)
+	}
+	if sta.UsedRandomCount() != 0 {
+		t.Error(
+			"For", "10000 made up ClientHellos",
+			"expected", 0,
+			"got", sta.UsedRandomCount(),
+		)
+	}
+
+	var randoms [][32]byte
+	for i := 0; i < 10000; i++ {
+		var random [32]byte
+		binary.BigEndian.PutUint32(random[:], uint32(i))
+		randoms = append(randoms, random)
+		sta.PutUsedRandom(random)
+	}
+	if sta.UsedRandomCount() != 100 || sta.UseRandom(randoms[9999]) || !sta.UseRandom(randoms[0]) {
+		t.Error(
+			"For", "10000 randoms with MaxUsedRandoms 100",
+			"expected", "the newest 100 kept",
+			"got", sta.UsedRandomCount(),
+		)
+	}
+
+	// Kept for longer while a ClientHello made with them may still be let in
+	sta.ClockSkewTolerance = 60
+	now += defaultAuthWindow + 1
+	sta.CleanUsedRandom()
+	if sta.UsedRandomCount() != 100 {
+		t.Error(
+			"For", "randoms 12 hours old with ClockSkewTolerance 60",
+			"expected", 100,
+			"got", sta.UsedRandomCount(),
+		)
+	}
+	now += 120
+	sta.CleanUsedRandom()
+	if sta.UsedRandomCount() != 0 {
+		t.Error(
+			"For", "randoms older than 12 hours",
+			"expected", 0,
+			"got", sta.UsedRandomCount(),
+		)
+	}
+
+	// A shorter AuthWindow forgets them sooner
+	sta.ClockSkewTolerance = 0
+	sta.AuthWindow = 600
+	for _, random := range randoms[:100] {
+		sta.PutUsedRandom(random)
+	}
+	now += 601
+	sta.CleanUsedRandom()
+	if sta.UsedRandomCount() != 0 {
+		t.Error(
+			"For", "randoms older than an AuthWindow of 600",
+			"expected", 0,
+			"got", sta.UsedRandomCount(),
+		)
+	}
+}
@@ -0,0 +1,74 @@
+package gqserver
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// User is one of the keys in Users that clients can be let in with, so that each
+// can be given their own and revoked on its own
+type User struct {
+	// Tags the connections of the user, in logs and metrics
+	ID  string
+	Key string
+	// Bytes a second the connections of the user can relay, both ways together,
+	// 0 for no limit
+	RateLimit int
+	// When the user stops being let in, zero for never
+	Expiry time.Time
+	aesKey []byte
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (u *User) setAESKey() {
+	h := sha256.New()
+	h.Write([]byte(u.Key))
+	u.aesKey = h.Sum(nil)
+}
+
+// Name returns the ID of u, or an empty string for the Key of the State, which
+// isn't a user
+func (u *User) Name() string {
+	if u == nil {
+		return ""
+	}
+	return u.ID
+}
+
+// Expired reports whether u has expired by now. nil, for the Key of the State,
+// never does
+func (u *User) Expired(now time.Time) bool {
+	return u != nil && !u.Expiry.IsZero() && now.After(u.Expiry)
+}
+
+// Wait waits until n more bytes can be relayed for u under its RateLimit. Up to
+// RateLimit bytes can go at once after a pause, and more than that is let through
+// and waited for afterwards, so that a read never has to be split up
+func (u *User) Wait(n int) {
+	if u == nil || u.RateLimit == 0 {
+		return
+	}
+	rate := float64(u.RateLimit)
+	now := time.Now()
+	u.mu.Lock()
+	if u.last.IsZero() {
+		u.tokens = rate
+	} else if elapsed := now.Sub(u.last); elapsed > 0 {
+		u.tokens += elapsed.Seconds() * rate
+	}
+	if u.tokens > rate {
+		u.tokens = rate
+	}
+	u.last = now
+	u.tokens -= float64(n)
+	var wait time.Duration
+	if u.tokens < 0 {
+		wait = time.Duration(-u.tokens / rate * float64(time.Second))
+	}
+	u.mu.Unlock()
+	time.Sleep(wait)
+}
@@ -0,0 +1,39 @@
+package gqserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUserExpired(t *testing.T) {
+	now := time.Unix(1519319215, 0)
+	var none *User
+	for u, exp := range map[*User]bool{
+		none:                                 false,
+		&User{}:                              false,
+		&User{Expiry: now.Add(-time.Second)}: true,
+		&User{Expiry: now.Add(time.Second)}:  false,
+	} {
+		if u.Expired(now) != exp {
+			t.Error("For", u, "expected", exp, "got", !exp)
+		}
+	}
+}
+
+func TestUserWait(t *testing.T) {
+	u := &User{ID: "alice", RateLimit: 10000}
+	start := time.Now()
+	// The first second's worth goes at once
+	u.Wait(10000)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Error("For", "a burst of RateLimit", "expected", "no wait", "got", elapsed)
+	}
+	u.Wait(2000)
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Error("For", "more than RateLimit", "expected", "a wait of 200ms", "got", elapsed)
+	}
+
+	var none *User
+	none.Wait(1 << 30)
+	(&User{}).Wait(1 << 30)
+}
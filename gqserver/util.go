@@ -1,7 +1,10 @@
 package gqserver
 
 import (
+	"crypto/rand"
+	"fmt"
 	"io"
+	"math/big"
 	prand "math/rand"
 	"net"
 	"time"
@@ -20,11 +23,24 @@ func BtoInt(b []byte) int {
 	return int(sum)
 }
 
+// CryptoRandBytes generates a byte slice filled with cryptographically secure random bytes
+func CryptoRandBytes(length int) (ret []byte) {
+	byteMax := big.NewInt(int64(256))
+	for len(ret) < length {
+		randInt, _ := rand.Int(rand.Reader, byteMax)
+		randByte := byte(randInt.Int64())
+		ret = append(ret, randByte)
+	}
+	return
+}
+
 // PsudoRandBytes returns a byte slice filled with psudorandom bytes generated by the seed
 func PsudoRandBytes(length int, seed int64) (ret []byte) {
-	prand.Seed(seed)
+	// A source of its own rather than seeding the global one, which concurrent
+	// handshakes would reseed under each other and get each other's bytes
+	r := prand.New(prand.NewSource(seed))
 	for len(ret) < length {
-		randByte := byte(prand.Intn(256))
+		randByte := byte(r.Intn(256))
 		ret = append(ret, randByte)
 	}
 	return
@@ -42,6 +58,9 @@ func ReadTillDrain(conn net.Conn, buffer []byte) (n int, err error) {
 	}
 
 	dataLength := BtoInt(buffer[3:5])
+	if 5+dataLength > len(buffer) {
+		return 5, fmt.Errorf("Record of %v bytes is too long for the buffer", dataLength)
+	}
 	left := dataLength
 	readPtr := 5
 
@@ -64,3 +83,56 @@ func ReadTillDrain(conn net.Conn, buffer []byte) (n int, err error) {
 	buffer = buffer[:n]
 	return
 }
+
+// ReadFirstRecord reads the first of what a client sends into buffer: a whole
+// handshake record, however many segments it arrives in, and nothing after it, so
+// that records which came with it are left in conn for ReadTillDrain. Anything that
+// doesn't start like a handshake record is returned as soon as it's read, for the
+// web server to answer without waiting for more. n is what has been read into
+// buffer, even when err isn't nil
+func ReadFirstRecord(conn net.Conn, buffer []byte) (n int, err error) {
+	n, err = io.ReadAtLeast(conn, buffer[:5], 1)
+	if err != nil || buffer[0] != 0x16 {
+		return
+	}
+	i, err := io.ReadFull(conn, buffer[n:5])
+	n += i
+	if err != nil {
+		return
+	}
+	dataLength := BtoInt(buffer[3:5])
+	if 5+dataLength > len(buffer) {
+		// Not a ClientHello we could take, which ParseClientHello will tell
+		return
+	}
+	i, err = io.ReadFull(conn, buffer[5:5+dataLength])
+	n += i
+	return
+}
+
+// CloseWrite shuts down the writing side of conn if it's a TCP connection or like
+// one, so that the other end reads EOF but can still send. It returns false if conn
+// can't be half-closed, in which case it should be closed fully
+func CloseWrite(conn net.Conn) bool {
+	cw, ok := conn.(interface {
+		CloseWrite() error
+	})
+	return ok && cw.CloseWrite() == nil
+}
+
+// WriteAll writes all of data to conn. net.Conn.Write should return an error if
+// it writes less than len(data), but we don't rely on that because a silently
+// dropped tail of a record would desync the stream
+func WriteAll(conn net.Conn, data []byte) error {
+	for len(data) > 0 {
+		n, err := conn.Write(data)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		data = data[n:]
+	}
+	return nil
+}
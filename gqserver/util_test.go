@@ -0,0 +1,101 @@
+package gqserver
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// shortConn writes at most 3 bytes at a time without an error
+type shortConn struct {
+	net.Conn
+	written []byte
+}
+
+func (c *shortConn) Write(b []byte) (int, error) {
+	if len(b) > 3 {
+		b = b[:3]
+	}
+	c.written = append(c.written, b...)
+	return len(b), nil
+}
+
+func TestWriteAll(t *testing.T) {
+	data := []byte{0x17, 0x03, 0x03, 0x00, 0x05, 'h', 'e', 'l', 'l', 'o'}
+	conn := &shortConn{}
+	err := WriteAll(conn, data)
+	if err != nil || !bytes.Equal(conn.written, data) {
+		t.Error(
+			"For", "short writes",
+			"expected", data,
+			"got", conn.written, err,
+		)
+	}
+}
+
+func TestReadTillDrainTooLong(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go c2.Write([]byte{0x17, 0x03, 0x03, 0x01, 0x00})
+	_, err := ReadTillDrain(c1, make([]byte, 100))
+	if err == nil {
+		t.Error("For", "a record longer than the buffer", "expected", "an error", "got", nil)
+	}
+}
+
+func TestReadFirstRecord(t *testing.T) {
+	record := []byte{0x16, 0x03, 0x01, 0x00, 0x05, 'h', 'e', 'l', 'l', 'o'}
+	next := []byte{0x14, 0x03, 0x03, 0x00, 0x01, 0x01}
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go func() {
+		// A byte at a time, as if each were a segment of its own
+		for _, b := range append(append([]byte{}, record...), next...) {
+			c2.Write([]byte{b})
+		}
+	}()
+	buf := make([]byte, 100)
+	n, err := ReadFirstRecord(c1, buf)
+	if err != nil || !bytes.Equal(buf[:n], record) {
+		t.Error("For", "a record in segments", "expected", record, "got", buf[:n], err)
+	}
+	n, err = ReadTillDrain(c1, buf)
+	if err != nil || !bytes.Equal(buf[:n], next) {
+		t.Error("For", "the record after it", "expected", next, "got", buf[:n], err)
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if !CloseWrite(c) {
+		t.Error("For", "TCP", "expected", true, "got", false)
+	}
+	_, err = s.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Error("For", "reading after CloseWrite", "expected", io.EOF, "got", err)
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if CloseWrite(a) {
+		t.Error("For", "net.Pipe", "expected", false, "got", true)
+	}
+}
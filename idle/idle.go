@@ -0,0 +1,66 @@
+// Package idle closes what's gone without traffic for too long. Both gq-client
+// and gq-server use it for IdleTimeout
+package idle
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Timer calls a function once Active hasn't been called for a while. A nil
+// Timer does nothing, so that connections without one don't have to check
+type Timer struct {
+	// When Active was last called, in nanoseconds. Accessed atomically, and first
+	// in the struct so that it's 64-bit aligned on 32-bit platforms
+	last    int64
+	timeout time.Duration
+	mu      sync.Mutex
+	timer   *time.Timer
+	stopped bool
+}
+
+// NewTimer calls idle once Active hasn't been called for timeout, counting
+// from now
+func NewTimer(timeout time.Duration, idle func()) *Timer {
+	t := &Timer{timeout: timeout}
+	t.Active()
+	t.mu.Lock()
+	t.timer = time.AfterFunc(timeout, func() { t.check(idle) })
+	t.mu.Unlock()
+	return t
+}
+
+// check calls idle if the timeout has passed since Active was last called, or
+// waits for the rest of it if not
+func (t *Timer) check(idle func()) {
+	since := time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&t.last))
+	if since >= t.timeout {
+		idle()
+		return
+	}
+	t.mu.Lock()
+	if !t.stopped {
+		t.timer.Reset(t.timeout - since)
+	}
+	t.mu.Unlock()
+}
+
+// Active pushes back the time the function is called
+func (t *Timer) Active() {
+	if t == nil {
+		return
+	}
+	atomic.StoreInt64(&t.last, time.Now().UnixNano())
+}
+
+// Stop stops the function from being called, if it hasn't been already
+func (t *Timer) Stop() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.stopped = true
+	t.timer.Stop()
+	t.mu.Unlock()
+}
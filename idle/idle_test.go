@@ -0,0 +1,36 @@
+package idle
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTimer(t *testing.T) {
+	var fired int32
+	timer := NewTimer(100*time.Millisecond, func() { atomic.StoreInt32(&fired, 1) })
+	// Kept from firing while it's active
+	for c := 0; c < 5; c++ {
+		time.Sleep(50 * time.Millisecond)
+		timer.Active()
+	}
+	if atomic.LoadInt32(&fired) != 0 {
+		t.Error("For", "an active timer", "expected", "not to fire", "got", "fired")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if atomic.LoadInt32(&fired) != 1 {
+		t.Error("For", "an idle timer", "expected", "to fire", "got", "not fired")
+	}
+
+	atomic.StoreInt32(&fired, 0)
+	timer = NewTimer(50*time.Millisecond, func() { atomic.StoreInt32(&fired, 1) })
+	timer.Stop()
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadInt32(&fired) != 0 {
+		t.Error("For", "a stopped timer", "expected", "not to fire", "got", "fired")
+	}
+
+	var none *Timer
+	none.Active()
+	none.Stop()
+}
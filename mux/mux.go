@@ -0,0 +1,264 @@
+// Package mux carries many streams over one connection, so that gq-client can
+// send the connections from SS through a few long-lived connections to gq-server
+// rather than making a handshake for each. Both ends use it, so that the frames
+// they send each other always match.
+//
+// Each frame is an application data record whose payload is the stream id in 4
+// bytes, the frame type in 1, then the data. Streams are opened by the client.
+// A stream can be sent initialWindow bytes before anything has been read from it,
+// and the reader hands out more as it reads, so one stream that isn't being read
+// doesn't hold up the others
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// Frame types
+const (
+	frameOpen = iota
+	frameData
+	// 4 bytes of how much more can be sent on the stream
+	frameWindow
+	// The sender has no more to send, like a half-close
+	frameClose
+	// The stream is over both ways
+	frameReset
+)
+
+const frameHeaderLen = 5
+
+// The most data in a frame, so that it fits in a record of the most a TLS record
+// can carry
+const maxFrameData = 16384 - frameHeaderLen
+
+// The bytes a stream can be sent before any of them have been read
+const initialWindow = 256 * 1024
+
+// The streams opened by the client that the server hasn't got to Accept yet.
+// Any more are reset
+const acceptBacklog = 64
+
+// ErrSessionClosed is returned for a session that has been closed, and for its
+// streams
+var ErrSessionClosed = errors.New("Mux session closed")
+
+var errReset = errors.New("Stream reset by peer")
+
+// Session is one connection that streams are carried over
+type Session struct {
+	conn    net.Conn
+	client  bool
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error
+
+	accepts chan *Stream
+	done    chan struct{}
+}
+
+// NewClient starts a session on conn, a connection to the server that has been
+// through the handshake, for streams to be opened on
+func NewClient(conn net.Conn) *Session {
+	return newSession(conn, true)
+}
+
+// NewServer starts a session on conn, a connection from a client that has been
+// through the handshake, for streams to be accepted from
+func NewServer(conn net.Conn) *Session {
+	return newSession(conn, false)
+}
+
+func newSession(conn net.Conn, client bool) *Session {
+	s := &Session{
+		conn:    conn,
+		client:  client,
+		streams: make(map[uint32]*Stream),
+		accepts: make(chan *Stream, acceptBacklog),
+		done:    make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+// Open opens a stream to the server
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	s.nextID++
+	st := newStream(s, s.nextID)
+	s.streams[st.id] = st
+	s.mu.Unlock()
+	if err := s.writeFrame(st.id, frameOpen, nil); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the client to open a stream
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accepts:
+		return st, nil
+	case <-s.done:
+		return nil, s.Err()
+	}
+}
+
+// NumStreams returns how many streams are open
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// Done is closed once the session is over, after which Err says why
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the session is over, or nil if it isn't
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close ends the session and every stream on it
+func (s *Session) Close() error {
+	s.fail(ErrSessionClosed)
+	return nil
+}
+
+// fail ends the session because of err
+func (s *Session) fail(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*Stream)
+	close(s.done)
+	s.mu.Unlock()
+	s.conn.Close()
+	for _, st := range streams {
+		st.fail(err)
+	}
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) writeFrame(id uint32, typ byte, data []byte) error {
+	record := make([]byte, 5+frameHeaderLen+len(data))
+	record[0], record[1], record[2] = 0x17, 0x03, 0x03
+	binary.BigEndian.PutUint16(record[3:5], uint16(frameHeaderLen+len(data)))
+	binary.BigEndian.PutUint32(record[5:9], id)
+	record[9] = typ
+	copy(record[10:], data)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.Err(); err != nil {
+		return err
+	}
+	for len(record) > 0 {
+		n, err := s.conn.Write(record)
+		if err == nil && n == 0 {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			s.fail(err)
+			return err
+		}
+		record = record[n:]
+	}
+	return nil
+}
+
+// readLoop hands the frames from the connection to their streams until it fails
+func (s *Session) readLoop() {
+	header := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			if err == io.EOF {
+				// Not to be mistaken for the end of a stream
+				err = io.ErrUnexpectedEOF
+			}
+			s.fail(err)
+			return
+		}
+		length := int(binary.BigEndian.Uint16(header[3:5]))
+		if header[0] != 0x17 || length < frameHeaderLen || length > frameHeaderLen+maxFrameData {
+			s.fail(errors.New("Bad mux frame"))
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			s.fail(err)
+			return
+		}
+		if err := s.handle(binary.BigEndian.Uint32(payload), payload[4], payload[frameHeaderLen:]); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handle(id uint32, typ byte, data []byte) error {
+	s.mu.Lock()
+	st := s.streams[id]
+	if typ == frameOpen {
+		if s.client || st != nil {
+			s.mu.Unlock()
+			return errors.New("Unexpected mux stream open")
+		}
+		st = newStream(s, id)
+		s.streams[id] = st
+		s.mu.Unlock()
+		select {
+		case s.accepts <- st:
+		default:
+			go st.Close()
+		}
+		return nil
+	}
+	s.mu.Unlock()
+	if st == nil {
+		// A stream closed on this end that the frames were sent on before the
+		// other end heard of it
+		return nil
+	}
+	switch typ {
+	case frameData:
+		st.receive(data)
+	case frameWindow:
+		if len(data) != 4 {
+			return errors.New("Bad mux window frame")
+		}
+		st.grant(int(binary.BigEndian.Uint32(data)))
+	case frameClose:
+		st.remoteClosed()
+	case frameReset:
+		s.remove(id)
+		st.fail(errReset)
+	default:
+		return errors.New("Unknown mux frame type")
+	}
+	return nil
+}
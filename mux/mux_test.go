@@ -0,0 +1,173 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func makeSessions() (client *Session, server *Session) {
+	c, s := net.Pipe()
+	return NewClient(c), NewServer(s)
+}
+
+func TestStreams(t *testing.T) {
+	client, server := makeSessions()
+	defer client.Close()
+	// The server echoes each stream back and closes it after EOF
+	go func() {
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.CloseWrite()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := make([]byte, 100000+i)
+			rand.Read(data)
+			st, err := client.Open()
+			if err != nil {
+				t.Error("For", "Open", "expected", nil, "got", err)
+				return
+			}
+			go func() {
+				st.Write(data)
+				st.CloseWrite()
+			}()
+			got, err := ioutil.ReadAll(st)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Error("For", "stream", i, "expected", len(data), "bytes echoed", "got", len(got), err)
+			}
+			st.Close()
+		}(i)
+	}
+	wg.Wait()
+	time.Sleep(50 * time.Millisecond)
+	if n := client.NumStreams(); n != 0 {
+		t.Error("For", "closed streams", "expected", 0, "got", n)
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	client, server := makeSessions()
+	defer client.Close()
+	data := make([]byte, 4*initialWindow)
+	rand.Read(data)
+	st, _ := client.Open()
+	wrote := make(chan int, 1)
+	go func() {
+		n, _ := st.Write(data)
+		wrote <- n
+	}()
+	remote, _ := server.Accept()
+
+	// Another stream still gets through while the first is stuck
+	other, _ := client.Open()
+	other.Write([]byte("hello"))
+	otherRemote, _ := server.Accept()
+	buf := make([]byte, 5)
+	otherRemote.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(otherRemote, buf); err != nil || string(buf) != "hello" {
+		t.Error("For", "a second stream", "expected", "hello", "got", string(buf), err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	remote.mu.Lock()
+	buffered := len(remote.buf)
+	remote.mu.Unlock()
+	if buffered > initialWindow {
+		t.Error("For", "a stream that isn't read", "expected", "at most", initialWindow, "got", buffered)
+	}
+	select {
+	case n := <-wrote:
+		t.Fatal("For", "a stream that isn't read", "expected", "Write to wait", "got", n)
+	default:
+	}
+
+	got := make([]byte, len(data))
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(remote, got); err != nil || !bytes.Equal(got, data) {
+		t.Error("For", "reading it all", "expected", len(data), "got", err)
+	}
+	if n := <-wrote; n != len(data) {
+		t.Error("For", "Write", "expected", len(data), "got", n)
+	}
+}
+
+func TestClose(t *testing.T) {
+	client, server := makeSessions()
+	defer client.Close()
+
+	// After CloseWrite the other end reads EOF and can still answer
+	st, _ := client.Open()
+	st.Write([]byte("request"))
+	st.CloseWrite()
+	remote, _ := server.Accept()
+	got, err := ioutil.ReadAll(remote)
+	if err != nil || string(got) != "request" {
+		t.Error("For", "CloseWrite", "expected", "request then EOF", "got", string(got), err)
+	}
+	remote.Write([]byte("response"))
+	remote.Close()
+	got, err = ioutil.ReadAll(st)
+	if err != nil || string(got) != "response" {
+		t.Error("For", "an answer after CloseWrite", "expected", "response then EOF", "got", string(got), err)
+	}
+	st.Close()
+
+	// Close before the other end is done resets it
+	st, _ = client.Open()
+	remote, _ = server.Accept()
+	st.Close()
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = remote.Read(make([]byte, 1)); err != errReset {
+		t.Error("For", "Close", "expected", errReset, "got", err)
+	}
+	if _, err = st.Write([]byte("x")); err != errClosed {
+		t.Error("For", "Write after Close", "expected", errClosed, "got", err)
+	}
+
+	// The connection going fails every stream
+	st, _ = client.Open()
+	server.Close()
+	st.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = st.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Error("For", "a closed connection", "expected", "an error", "got", err)
+	}
+	if _, err = client.Open(); err == nil {
+		t.Error("For", "Open on a failed session", "expected", "an error", "got", nil)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	client, server := makeSessions()
+	defer client.Close()
+	st, _ := client.Open()
+	remote, _ := server.Accept()
+	st.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := st.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Error("For", "a read deadline", "expected", "a timeout", "got", err)
+	}
+	// And it can be read again once the deadline is lifted
+	st.SetReadDeadline(time.Time{})
+	remote.Write([]byte("x"))
+	if _, err = st.Read(make([]byte, 1)); err != nil {
+		t.Error("For", "a read without a deadline", "expected", nil, "got", err)
+	}
+}
@@ -0,0 +1,275 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var errClosed = errors.New("Stream closed")
+
+// timeoutError is returned once a deadline has passed, like a net.Conn's
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Stream is one of the connections carried by a Session. It's a net.Conn that can
+// be half-closed with CloseWrite
+type Stream struct {
+	s  *Session
+	id uint32
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// Received and not read yet
+	buf []byte
+	// Read since the other end was last given more window
+	unacked int
+	// How much more the other end can send
+	recvWindow int
+	// How much more can be sent
+	sendWindow int
+	// The other end has no more to send
+	readEOF bool
+	// We have no more to send
+	wroteEOF bool
+	closed   bool
+	err      error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+var _ net.Conn = &Stream{}
+
+func newStream(s *Session, id uint32) *Stream {
+	st := &Stream{
+		s:          s,
+		id:         id,
+		recvWindow: initialWindow,
+		sendWindow: initialWindow,
+	}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+// past reports whether deadline has been set and has passed
+func past(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+func (st *Stream) Read(b []byte) (int, error) {
+	st.mu.Lock()
+	for len(st.buf) == 0 {
+		var err error
+		switch {
+		case st.closed:
+			err = errClosed
+		case st.err != nil:
+			err = st.err
+		case st.readEOF:
+			err = io.EOF
+		case past(st.readDeadline):
+			err = timeoutError{}
+		}
+		if err != nil {
+			st.mu.Unlock()
+			return 0, err
+		}
+		st.cond.Wait()
+	}
+	n := copy(b, st.buf)
+	st.buf = st.buf[n:]
+	st.unacked += n
+	grant := 0
+	if st.unacked >= initialWindow/2 && !st.readEOF {
+		grant, st.unacked = st.unacked, 0
+		st.recvWindow += grant
+	}
+	st.mu.Unlock()
+	// Not while holding mu, as the write can wait for the other end to read
+	if grant != 0 {
+		window := make([]byte, 4)
+		binary.BigEndian.PutUint32(window, uint32(grant))
+		st.s.writeFrame(st.id, frameWindow, window)
+	}
+	return n, nil
+}
+
+func (st *Stream) Write(b []byte) (written int, err error) {
+	for len(b) > 0 {
+		st.mu.Lock()
+		for {
+			switch {
+			case st.closed:
+				err = errClosed
+			case st.err != nil:
+				err = st.err
+			case st.wroteEOF:
+				err = io.ErrClosedPipe
+			case past(st.writeDeadline):
+				err = timeoutError{}
+			}
+			if err != nil || st.sendWindow != 0 {
+				break
+			}
+			st.cond.Wait()
+		}
+		if err != nil {
+			st.mu.Unlock()
+			return written, err
+		}
+		n := len(b)
+		if n > maxFrameData {
+			n = maxFrameData
+		}
+		if n > st.sendWindow {
+			n = st.sendWindow
+		}
+		st.sendWindow -= n
+		st.mu.Unlock()
+		if err = st.s.writeFrame(st.id, frameData, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite tells the other end there's no more to send, after which it reads
+// EOF but can still send
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.closed || st.err != nil || st.wroteEOF {
+		err := st.err
+		st.mu.Unlock()
+		return err
+	}
+	st.wroteEOF = true
+	both := st.readEOF
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	if both {
+		st.s.remove(st.id)
+	}
+	return st.s.writeFrame(st.id, frameClose, nil)
+}
+
+// Close closes the stream. If the other end may still send, the stream is reset
+// so that it stops, otherwise the other end reads EOF
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	typ := -1
+	if st.err == nil && !st.readEOF {
+		typ = frameReset
+	} else if st.err == nil && !st.wroteEOF {
+		typ = frameClose
+	}
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	st.s.remove(st.id)
+	if typ != -1 {
+		return st.s.writeFrame(st.id, byte(typ), nil)
+	}
+	return nil
+}
+
+func (st *Stream) receive(data []byte) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if len(data) > st.recvWindow {
+		// The other end has sent more than it was allowed
+		st.err = errors.New("Mux stream window exceeded")
+		st.cond.Broadcast()
+		go st.s.writeFrame(st.id, frameReset, nil)
+		go st.s.remove(st.id)
+		return
+	}
+	st.recvWindow -= len(data)
+	if !st.closed {
+		st.buf = append(st.buf, data...)
+	}
+	st.cond.Broadcast()
+}
+
+func (st *Stream) grant(n int) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *Stream) remoteClosed() {
+	st.mu.Lock()
+	st.readEOF = true
+	both := st.wroteEOF
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	if both {
+		st.s.remove(st.id)
+	}
+}
+
+func (st *Stream) fail(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.s.conn.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.s.conn.RemoteAddr()
+}
+
+// setDeadline sets *deadline to t, with *timer waking up whatever is waiting on
+// the stream once it passes
+func (st *Stream) setDeadline(deadline *time.Time, timer **time.Timer, t time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	*deadline = t
+	if *timer != nil {
+		(*timer).Stop()
+	}
+	if !t.IsZero() {
+		*timer = time.AfterFunc(time.Until(t), func() {
+			st.mu.Lock()
+			st.cond.Broadcast()
+			st.mu.Unlock()
+		})
+	}
+	st.cond.Broadcast()
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.setDeadline(&st.readDeadline, &st.readTimer, t)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.setDeadline(&st.writeDeadline, &st.writeTimer, t)
+	return nil
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
@@ -0,0 +1,18 @@
+package tfo
+
+import (
+	"errors"
+	"syscall"
+)
+
+// TCP_FASTOPEN in netinet/tcp.h
+const tcpFastOpen = 0x105
+
+// Sending data with the SYN needs connectx, which net doesn't use
+func setFastOpenConnect(fd uintptr) error {
+	return errors.New("TCP fast open for outgoing connections is not supported on this platform")
+}
+
+func setFastOpenListen(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpen, 1)
+}
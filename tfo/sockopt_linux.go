@@ -0,0 +1,23 @@
+package tfo
+
+import "syscall"
+
+// In linux/tcp.h
+const (
+	tcpFastOpen        = 23
+	tcpFastOpenConnect = 30
+)
+
+// The length of the queue of connections whose SYN had data and that haven't
+// finished their handshake
+const fastOpenQueueLen = 256
+
+// setFastOpenConnect makes connect return straight away, with the SYN being sent
+// with the first write. It needs Linux 4.11
+func setFastOpenConnect(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+}
+
+func setFastOpenListen(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpen, fastOpenQueueLen)
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package tfo
+
+import "errors"
+
+func setFastOpenConnect(fd uintptr) error {
+	return errors.New("TCP fast open is not supported on this platform")
+}
+
+func setFastOpenListen(fd uintptr) error {
+	return errors.New("TCP fast open is not supported on this platform")
+}
@@ -0,0 +1,69 @@
+// Package tfo dials and listens for TCP connections with TCP fast open, so that the
+// first data sent on a connection can go with its SYN. It sets the socket options
+// for it in the Control hooks of net.Dialer and net.ListenConfig, on the platforms
+// that have them. Elsewhere, or if the kernel turns the options down, connections
+// are made and accepted as they would be without fast open
+package tfo
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+var fdCallback func(fd int)
+
+// SetFdCallback makes cb be called with the file descriptor of every socket Dial
+// makes, before it connects. It must not be called while connections are being made
+func SetFdCallback(cb func(fd int)) {
+	fdCallback = cb
+}
+
+// Dial connects to the TCP address addr and sends data. If fastOpen is true, data
+// is sent with the SYN where the platform allows it
+func Dial(addr string, fastOpen bool, data []byte) (net.Conn, error) {
+	cb := fdCallback
+	// There's nothing to put in the SYN without data
+	fastOpen = fastOpen && len(data) != 0
+	d := net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				if fastOpen {
+					// The data is sent after the handshake instead if it fails
+					setFastOpenConnect(fd)
+				}
+				if cb != nil {
+					cb(int(fd))
+				}
+			})
+		},
+	}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 0 {
+		// With fast open the SYN is only sent now, so this is where the
+		// connection is refused if it is
+		if _, err = conn.Write(data); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Listen listens for TCP connections on addr, accepting data with their SYNs if
+// fastOpen is true and the platform allows it
+func Listen(addr string, fastOpen bool) (net.Listener, error) {
+	var lc net.ListenConfig
+	if fastOpen {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				// The listener works without it if it fails
+				setFastOpenListen(fd)
+			})
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
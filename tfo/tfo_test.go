@@ -0,0 +1,61 @@
+package tfo
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestDial(t *testing.T) {
+	for _, fastOpen := range []bool{false, true} {
+		l, err := Listen("127.0.0.1:0", fastOpen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(chan string, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				got <- err.Error()
+				return
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			buf := make([]byte, 5)
+			if _, err = io.ReadFull(conn, buf); err != nil {
+				got <- err.Error()
+				return
+			}
+			got <- string(buf)
+		}()
+
+		var fds int
+		SetFdCallback(func(fd int) { fds++ })
+		conn, err := Dial(l.Addr().String(), fastOpen, []byte("hello"))
+		SetFdCallback(nil)
+		if err != nil {
+			t.Fatal("For", "Dial with fastOpen", fastOpen, "expected", nil, "got", err)
+		}
+		if s := <-got; s != "hello" {
+			t.Error("For", "fastOpen", fastOpen, "expected", "hello", "got", s)
+		}
+		if fds != 1 {
+			t.Error("For", "fd callback with fastOpen", fastOpen, "expected", 1, "got", fds)
+		}
+		conn.Close()
+		l.Close()
+	}
+}
+
+func TestDialRefused(t *testing.T) {
+	l, _ := Listen("127.0.0.1:0", false)
+	addr := l.Addr().String()
+	l.Close()
+	// With fast open the SYN only goes with the data, which is where it fails
+	for _, fastOpen := range []bool{false, true} {
+		if conn, err := Dial(addr, fastOpen, []byte("hello")); err == nil {
+			conn.Close()
+			t.Error("For", "a closed port with fastOpen", fastOpen, "expected", "an error", "got", nil)
+		}
+	}
+}
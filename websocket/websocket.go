@@ -0,0 +1,287 @@
+// Package websocket carries a stream of bytes in the binary messages of a
+// WebSocket, so that gq-client and gq-server can reach each other through a CDN
+// or a reverse proxy that only passes HTTP. Both ends use it, and what goes
+// through is the same fake TLS as over TCP.
+//
+// Each Write is sent as a binary message of one frame, and Read returns the data
+// of the messages as a stream. Only as much of RFC 6455 as that needs is done: no
+// extensions or subprotocols, and Close closes the connection without a closing
+// handshake, which every WebSocket has to put up with anyway
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Opcodes
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// Appended to Sec-WebSocket-Key to make Sec-WebSocket-Accept
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ErrNotWebSocket is returned by Server for a request that isn't to open a
+// WebSocket at its path, which is left unanswered
+var ErrNotWebSocket = errors.New("Not a WebSocket request")
+
+// Conn is a WebSocket over a net.Conn
+type Conn struct {
+	net.Conn
+	// Reads go through it, as it may have read past the opening handshake
+	r       *bufio.Reader
+	client  bool
+	writeMu sync.Mutex
+
+	// What's left of the data of the frame being read, and its mask
+	remaining int64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerHas reports whether the comma separated header has token in it
+func headerHas(h http.Header, name string, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// recorder keeps what's read through it until it's stopped, so that a request
+// that isn't for a WebSocket can be passed on as it came
+type recorder struct {
+	r    io.Reader
+	read []byte
+	stop bool
+}
+
+func (rec *recorder) Read(b []byte) (int, error) {
+	n, err := rec.r.Read(b)
+	if !rec.stop {
+		rec.read = append(rec.read, b[:n]...)
+	}
+	return n, err
+}
+
+// Client opens a WebSocket at path on conn, with host in the Host header
+func Client(conn net.Conn, host string, path string) (*Conn, error) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, errors.New("WebSocket refused with " + resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, errors.New("Bad Sec-WebSocket-Accept")
+	}
+	return &Conn{Conn: conn, r: r, client: true}, nil
+}
+
+// Server takes the request on conn to open a WebSocket at path and answers it.
+// Any other request is left for the caller to answer, with ErrNotWebSocket, and
+// when opening it fails, what was read from conn is returned in read so that it
+// can be passed on, to a web server say
+func Server(conn net.Conn, path string) (ws *Conn, read []byte, err error) {
+	rec := &recorder{r: conn}
+	r := bufio.NewReader(rec)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, rec.read, err
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != http.MethodGet || req.URL.Path != path || key == "" ||
+		!headerHas(req.Header, "Upgrade", "websocket") || !headerHas(req.Header, "Connection", "upgrade") ||
+		req.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, rec.read, ErrNotWebSocket
+	}
+	rec.stop = true
+	rec.read = nil
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err = io.WriteString(conn, resp); err != nil {
+		return nil, nil, err
+	}
+	return &Conn{Conn: conn, r: r}, nil, nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.r.Read(b)
+	c.unmask(b[:n])
+	c.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (c *Conn) unmask(b []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos%4]
+		c.maskPos++
+	}
+}
+
+// nextFrame reads the header of the next frame, and the whole of it if it's a
+// control frame, which is dealt with. io.EOF is returned once the other end has
+// closed the WebSocket
+func (c *Conn) nextFrame() error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0f
+	c.masked = header[1]&0x80 != 0
+	if c.masked == c.client {
+		// Only frames from the client are masked
+		return errors.New("Bad WebSocket frame mask")
+	}
+	length := int64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.r, ext); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.r, ext); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(ext) & (1<<63 - 1))
+	}
+	if c.masked {
+		if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+			return err
+		}
+	}
+	c.maskPos = 0
+
+	switch opcode {
+	case opContinuation, opText, opBinary:
+		c.remaining = length
+		return nil
+	case opClose, opPing, opPong:
+		if length > 125 {
+			return errors.New("WebSocket control frame too long")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		switch opcode {
+		case opClose:
+			c.writeFrame(opClose, payload)
+			return io.EOF
+		case opPing:
+			return c.writeFrame(opPong, payload)
+		}
+		return nil
+	}
+	return errors.New("Unknown WebSocket opcode")
+}
+
+// Write sends b as a binary message
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(opBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *Conn) writeFrame(opcode byte, data []byte) error {
+	frame := make([]byte, 0, 14+len(data))
+	frame = append(frame, 0x80|opcode)
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(data) < 126:
+		frame = append(frame, maskBit|byte(len(data)))
+	case len(data) <= 0xffff:
+		frame = append(frame, maskBit|126, byte(len(data)>>8), byte(len(data)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = frame[:len(frame)+8]
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(len(data)))
+	}
+	if c.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		frame = append(frame, mask[:]...)
+		for i, d := range data {
+			frame = append(frame, d^mask[i%4])
+		}
+	} else {
+		frame = append(frame, data...)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	for len(frame) > 0 {
+		n, err := c.Conn.Write(frame)
+		if err == nil && n == 0 {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			return err
+		}
+		frame = frame[n:]
+	}
+	return nil
+}
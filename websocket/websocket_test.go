@@ -0,0 +1,102 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func makeConns(t *testing.T) (client *Conn, server *Conn) {
+	c, s := net.Pipe()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	s.SetDeadline(time.Now().Add(5 * time.Second))
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		server, _, err = Server(s, "/gq")
+		done <- err
+	}()
+	client, err := Client(c, "cdn.example.com", "/gq")
+	if err != nil {
+		t.Fatal("For", "Client", "expected", nil, "got", err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal("For", "Server", "expected", nil, "got", err)
+	}
+	return client, server
+}
+
+func TestConn(t *testing.T) {
+	client, server := makeConns(t)
+	defer client.Close()
+	// Lengths that take each of the three sizes of length
+	for _, size := range []int{1, 125, 126, 65535, 70000} {
+		data := make([]byte, size)
+		rand.Read(data)
+		for _, dir := range []struct {
+			name string
+			from *Conn
+			to   *Conn
+		}{{"client to server", client, server}, {"server to client", server, client}} {
+			go dir.from.Write(data)
+			got := make([]byte, size)
+			if _, err := io.ReadFull(dir.to, got); err != nil || !bytes.Equal(got, data) {
+				t.Error("For", dir.name, size, "bytes", "expected", "them all", "got", err)
+			}
+		}
+	}
+
+	// A ping is answered and doesn't show up in the data
+	go func() {
+		client.writeFrame(opPing, []byte("hi"))
+		client.Write([]byte("after"))
+	}()
+	got := make([]byte, 5)
+	go func() {
+		io.ReadFull(server, got)
+		server.Write([]byte("x"))
+	}()
+	// The pong is read first, then the data the server sends once it's read ours
+	x := make([]byte, 1)
+	if _, err := client.Read(x); err != nil || x[0] != 'x' {
+		t.Error("For", "data after a pong", "expected", "x", "got", string(x), err)
+	}
+	if string(got) != "after" {
+		t.Error("For", "data after a ping", "expected", "after", "got", string(got))
+	}
+
+	// A close ends the data
+	go client.writeFrame(opClose, nil)
+	// For the close frame the server answers with
+	go io.Copy(ioutil.Discard, client)
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("For", "a close frame", "expected", io.EOF, "got", err)
+	}
+}
+
+func TestNotWebSocket(t *testing.T) {
+	c, s := net.Pipe()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	done := make(chan error, 1)
+	var read []byte
+	go func() {
+		var err error
+		_, read, err = Server(s, "/gq")
+		s.Close()
+		done <- err
+	}()
+	req := "GET /gq HTTP/1.1\r\nHost: cdn.example.com\r\n\r\n"
+	go io.WriteString(c, req)
+	// It's for the caller to answer, with what was read
+	resp, _ := ioutil.ReadAll(c)
+	if err := <-done; err != ErrNotWebSocket {
+		t.Error("For", "a plain GET", "expected", ErrNotWebSocket, "got", err)
+	}
+	if string(read) != req || len(resp) != 0 {
+		t.Error("For", "a plain GET", "expected", req, "and no answer", "got", string(read), string(resp))
+	}
+}